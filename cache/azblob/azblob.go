@@ -0,0 +1,603 @@
+// Package azblob provides a CacheProxy which stores blobs in an Azure
+// Blob Storage container, using the Blob service REST API.
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// The Blob service REST API version used for all requests.
+	apiVersion = "2019-12-12"
+
+	// Blobs larger than this are uploaded in blocks of blockSize bytes,
+	// smaller blobs with a single request.
+	maxSinglePutSize = 32 * 1024 * 1024
+	blockSize        = 16 * 1024 * 1024
+
+	// The maximum number of concurrent HEAD requests made by ContainsMany.
+	maxConcurrentContains = 32
+
+	// Managed identity tokens are refreshed this long before they expire.
+	tokenRefreshMargin = 5 * time.Minute
+
+	// The number of blobs requested per List Blobs call.
+	maxListResults = 5000
+)
+
+// The Azure Instance Metadata Service endpoint which provides managed
+// identity tokens. Overridden in tests.
+var imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_azblob_cache_hits",
+		Help: "The total number of Azure Blob Storage backend cache hits",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_azblob_cache_misses",
+		Help: "The total number of Azure Blob Storage backend cache misses",
+	})
+)
+
+var errNotFound = errors.New("NOT FOUND")
+
+type azBlobCache struct {
+	client       *http.Client
+	account      string
+	containerURL *url.URL
+	prefix       string
+	auth         authorizer
+	accessLogger cache.Logger
+	errorLogger  cache.Logger
+}
+
+// authorizer adds credentials to a request.
+type authorizer interface {
+	authorize(ctx context.Context, req *http.Request) error
+}
+
+// New returns a CacheProxy which stores blobs in the container described
+// by `cfg`. Uploads are performed synchronously, use the uploader package
+// to perform them in the background.
+func New(cfg *config.AzBlobStorageConfig, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	errorLogger.Printf("Using Azure Blob Storage backend, container %s", cfg.ContainerName)
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.StorageAccount)
+	}
+
+	containerURL, err := url.Parse(strings.TrimRight(endpoint, "/") + "/" +
+		url.PathEscape(cfg.ContainerName))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &azBlobCache{
+		client:       &http.Client{},
+		account:      cfg.StorageAccount,
+		containerURL: containerURL,
+		prefix:       cfg.Prefix,
+		accessLogger: accessLogger,
+		errorLogger:  errorLogger,
+	}
+
+	switch cfg.AuthMethod {
+	case config.AzBlobAuthSharedKey:
+		key, err := base64.StdEncoding.DecodeString(cfg.SharedKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid azblob_proxy.shared_key: %v", err)
+		}
+		c.auth = &sharedKeyAuthorizer{account: cfg.StorageAccount, key: key}
+	case config.AzBlobAuthSAS:
+		query, err := url.ParseQuery(strings.TrimPrefix(cfg.SASToken, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid azblob_proxy.sas_token: %v", err)
+		}
+		c.auth = &sasAuthorizer{query: query}
+	case config.AzBlobAuthManagedIdentity:
+		c.auth = &managedIdentityAuthorizer{
+			client:   c.client,
+			clientID: cfg.ManagedIdentityClientID,
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported azblob_proxy.auth_method: %q", cfg.AuthMethod)
+	}
+
+	return c, nil
+}
+
+// Return the name of the blob for an item, with the same layout as the
+// S3 backend.
+func (c *azBlobCache) blobName(kind cache.EntryKind, hash string) string {
+	if c.prefix == "" {
+		return fmt.Sprintf("%s/%s", kind, hash)
+	}
+	return fmt.Sprintf("%s/%s/%s", c.prefix, kind, hash)
+}
+
+func (c *azBlobCache) blobURL(kind cache.EntryKind, hash string, query url.Values) *url.URL {
+	u := *c.containerURL
+
+	segments := strings.Split(c.blobName(kind, hash), "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	escapedName := strings.Join(segments, "/")
+
+	u.Path = c.containerURL.Path + "/" + c.blobName(kind, hash)
+	u.RawPath = c.containerURL.EscapedPath() + "/" + escapedName
+	u.RawQuery = query.Encode()
+
+	return &u
+}
+
+// Send a request for a blob, with the required headers and credentials.
+func (c *azBlobCache) do(ctx context.Context, method string, u *url.URL,
+	header http.Header, body io.Reader, size int64) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			// Make sure that a Content-Length header is sent.
+			req.Body = http.NoBody
+		}
+	}
+
+	err = c.auth.authorize(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.client.Do(req)
+}
+
+func (c *azBlobCache) logResponse(method string, kind cache.EntryKind, hash string, status string) {
+	c.accessLogger.Printf("AZBLOB %s %s %s", method, c.blobName(kind, hash), status)
+}
+
+// Return an error for an unexpected response, and close its body.
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	code := resp.Header.Get("x-ms-error-code")
+	if code == "" {
+		code = resp.Status
+	}
+
+	return &cache.Error{
+		Code: resp.StatusCode,
+		Text: fmt.Sprintf("Azure Blob Storage error: %s", code),
+	}
+}
+
+func (c *azBlobCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	var err error
+	if size <= maxSinglePutSize {
+		err = c.putBlob(ctx, kind, hash, size, rdr)
+	} else {
+		err = c.putBlocks(ctx, kind, hash, size, rdr)
+	}
+
+	status := "OK"
+	if err != nil {
+		status = err.Error()
+	}
+	c.logResponse("UPLOAD", kind, hash, status)
+
+	return err
+}
+
+func (c *azBlobCache) putBlob(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.do(ctx, http.MethodPut, c.blobURL(kind, hash, nil), header,
+		ioutil.NopCloser(rdr), size)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Upload a large blob in blocks, and then commit the block list.
+func (c *azBlobCache) putBlocks(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	var blockIDs []string
+	buf := make([]byte, blockSize)
+
+	for offset := int64(0); offset < size; {
+		n, err := io.ReadFull(rdr, buf)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("expected %d bytes, found %d", size, offset)
+		}
+
+		// All the block IDs of a blob must have the same length.
+		blockID := base64.StdEncoding.EncodeToString(
+			[]byte(fmt.Sprintf("%08d", len(blockIDs))))
+		blockIDs = append(blockIDs, blockID)
+
+		query := url.Values{}
+		query.Set("comp", "block")
+		query.Set("blockid", blockID)
+		resp, err := c.do(ctx, http.MethodPut, c.blobURL(kind, hash, query),
+			http.Header{}, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusCreated {
+			return responseError(resp)
+		}
+		resp.Body.Close()
+
+		offset += int64(n)
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blockIDs {
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+
+	query := url.Values{}
+	query.Set("comp", "blocklist")
+	header := http.Header{}
+	header.Set("x-ms-blob-content-type", "application/octet-stream")
+	resp, err := c.do(ctx, http.MethodPut, c.blobURL(kind, hash, query), header,
+		bytes.NewReader(blockList.Bytes()), int64(blockList.Len()))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (c *azBlobCache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.blobURL(kind, hash, nil), http.Header{}, nil, 0)
+	if err != nil {
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", kind, hash, err.Error())
+		return nil, -1, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", kind, hash, errNotFound.Error())
+		return nil, -1, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		cacheMisses.Inc()
+		err = responseError(resp)
+		c.logResponse("DOWNLOAD", kind, hash, err.Error())
+		return nil, -1, err
+	}
+
+	cacheHits.Inc()
+	c.logResponse("DOWNLOAD", kind, hash, "OK")
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (c *azBlobCache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	resp, err := c.do(ctx, http.MethodHead, c.blobURL(kind, hash, nil), http.Header{}, nil, 0)
+	if err != nil {
+		c.logResponse("CONTAINS", kind, hash, err.Error())
+		return false, -1, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		c.logResponse("CONTAINS", kind, hash, errNotFound.Error())
+		return false, -1, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = responseError(resp)
+		c.logResponse("CONTAINS", kind, hash, err.Error())
+		return false, -1, err
+	}
+
+	c.logResponse("CONTAINS", kind, hash, "OK")
+
+	return true, resp.ContentLength, nil
+}
+
+// Delete removes a blob, if it exists.
+func (c *azBlobCache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.blobURL(kind, hash, nil), http.Header{}, nil, 0)
+	if err != nil {
+		c.logResponse("DELETE", kind, hash, err.Error())
+		return err
+	}
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		err = responseError(resp)
+		c.logResponse("DELETE", kind, hash, err.Error())
+		return err
+	}
+	resp.Body.Close()
+
+	c.logResponse("DELETE", kind, hash, "OK")
+
+	return nil
+}
+
+func (c *azBlobCache) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, c, kind, hashes, maxConcurrentContains)
+}
+
+type listBlobsResult struct {
+	Blobs []struct {
+		Name          string `xml:"Name"`
+		ContentLength int64  `xml:"Properties>Content-Length"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List pages through the blobs of the given kind with the List Blobs
+// API, which returns them in ascending order of name.
+func (c *azBlobCache) List(ctx context.Context, kind cache.EntryKind, after string,
+	fn func(hash string, size int64) error) error {
+
+	prefix := c.blobName(kind, "")
+	marker := ""
+	for {
+		u := *c.containerURL
+		query := url.Values{}
+		query.Set("restype", "container")
+		query.Set("comp", "list")
+		query.Set("prefix", prefix)
+		query.Set("maxresults", strconv.Itoa(maxListResults))
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		u.RawQuery = query.Encode()
+
+		resp, err := c.do(ctx, http.MethodGet, &u, http.Header{}, nil, 0)
+		if err != nil {
+			c.logResponse("LIST", kind, "", err.Error())
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = responseError(resp)
+			c.logResponse("LIST", kind, "", err.Error())
+			return err
+		}
+
+		var result listBlobsResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		c.logResponse("LIST", kind, "", "OK")
+
+		for _, blob := range result.Blobs {
+			// Markers are opaque, so skip the items before `after` here.
+			hash := strings.TrimPrefix(blob.Name, prefix)
+			if hash <= after {
+				continue
+			}
+			err = fn(hash, blob.ContentLength)
+			if err != nil {
+				return err
+			}
+		}
+
+		if result.NextMarker == "" {
+			return nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// sharedKeyAuthorizer signs requests with the storage account key.
+type sharedKeyAuthorizer struct {
+	account string
+	key     []byte
+}
+
+func (a *sharedKeyAuthorizer) authorize(ctx context.Context, req *http.Request) error {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign(a.account, req)))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", "SharedKey "+a.account+":"+signature)
+	return nil
+}
+
+// Return the string which is signed for Shared Key authorization, see
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func stringToSign(account string, req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	h := req.Header
+	fields := []string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		contentLength,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead.
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	}
+
+	var msHeaders []string
+	for name := range h {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(h.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for name, values := range query {
+		sort.Strings(values)
+		params = append(params, strings.ToLower(name)+":"+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+
+	var sb strings.Builder
+	for _, f := range fields {
+		sb.WriteString(f + "\n")
+	}
+	for _, mh := range msHeaders {
+		sb.WriteString(mh + "\n")
+	}
+	sb.WriteString(resource)
+
+	return sb.String()
+}
+
+// sasAuthorizer adds a shared access signature to each request.
+type sasAuthorizer struct {
+	query url.Values
+}
+
+func (a *sasAuthorizer) authorize(ctx context.Context, req *http.Request) error {
+	query := req.URL.Query()
+	for k, v := range a.query {
+		query[k] = v
+	}
+	req.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// managedIdentityAuthorizer adds OAuth tokens for the Azure managed
+// identity of the host, from the Instance Metadata Service.
+type managedIdentityAuthorizer struct {
+	client   *http.Client
+	clientID string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (a *managedIdentityAuthorizer) authorize(ctx context.Context, req *http.Request) error {
+	token, err := a.getToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *managedIdentityAuthorizer) getToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Add(tokenRefreshMargin).Before(a.expires) {
+		return a.token, nil
+	}
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", "https://storage.azure.com/")
+	if a.clientID != "" {
+		query.Set("client_id", a.clientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		imdsTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get a managed identity token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to get a managed identity token: %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse the managed identity token: %v", err)
+	}
+
+	expiresOn, err := strconv.ParseInt(tokenResp.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse the managed identity token expiry: %v", err)
+	}
+
+	a.token = tokenResp.AccessToken
+	a.expires = time.Unix(expiresOn, 0)
+
+	return a.token, nil
+}
@@ -0,0 +1,422 @@
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+const (
+	testAccount   = "devstoreaccount1"
+	testContainer = "bazel"
+)
+
+var testKey = base64.StdEncoding.EncodeToString([]byte("not a real key"))
+
+// fakeBlobService is an httptest stand-in for the Blob service, which
+// stores blobs in memory.
+type fakeBlobService struct {
+	// Checks the credentials of each request.
+	checkAuth func(r *http.Request) bool
+
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string][]byte
+	puts   int // The number of Put Blob requests.
+}
+
+func newFakeBlobService(checkAuth func(r *http.Request) bool) (*fakeBlobService, *httptest.Server) {
+	s := &fakeBlobService{
+		checkAuth: checkAuth,
+		blobs:     make(map[string][]byte),
+		blocks:    make(map[string][]byte),
+	}
+	return s, httptest.NewServer(s)
+}
+
+func (s *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		http.Error(w, "missing headers", http.StatusBadRequest)
+		return
+	}
+	if !s.checkAuth(r) {
+		w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	name := r.URL.Path
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		data, _ := ioutil.ReadAll(r.Body)
+		s.blocks[name+"#"+query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		err := xml.NewDecoder(r.Body).Decode(&list)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var blob []byte
+		for _, id := range list.Latest {
+			blob = append(blob, s.blocks[name+"#"+id]...)
+		}
+		s.blobs[name] = blob
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			http.Error(w, "missing blob type", http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		s.blobs[name] = data
+		s.puts++
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodGet && query.Get("comp") == "list":
+		// Return one blob per page, to exercise the markers.
+		var names []string
+		for blobName := range s.blobs {
+			blobPrefix := name + "/" + query.Get("prefix")
+			if strings.HasPrefix(blobName, blobPrefix) && blobName > name+"/"+query.Get("marker") {
+				names = append(names, strings.TrimPrefix(blobName, name+"/"))
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "<EnumerationResults><Blobs>")
+		if len(names) > 0 {
+			fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Content-Length>%d</Content-Length></Properties></Blob>",
+				names[0], len(s.blobs[name+"/"+names[0]]))
+		}
+		fmt.Fprintf(w, "</Blobs>")
+		if len(names) > 1 {
+			fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", names[0])
+		}
+		fmt.Fprintf(w, "</EnumerationResults>")
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case r.Method == http.MethodDelete:
+		if _, ok := s.blobs[name]; !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+	}
+}
+
+func checkSharedKey(r *http.Request) bool {
+	key, _ := base64.StdEncoding.DecodeString(testKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign(testAccount, r)))
+	expected := "SharedKey " + testAccount + ":" +
+		base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return r.Header.Get("Authorization") == expected
+}
+
+func newTestCache(t *testing.T, endpoint string, cfg config.AzBlobStorageConfig) cache.CacheProxy {
+	cfg.StorageAccount = testAccount
+	cfg.ContainerName = testContainer
+	cfg.Endpoint = endpoint + "/" + testAccount
+
+	logger := testutils.NewSilentLogger()
+	c, err := New(&cfg, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSharedKeyRoundTrip(t *testing.T) {
+	s, srv := newFakeBlobService(checkSharedKey)
+	defer srv.Close()
+
+	c := newTestCache(t, srv.URL, config.AzBlobStorageConfig{
+		Prefix:     "cache",
+		AuthMethod: config.AzBlobAuthSharedKey,
+		SharedKey:  testKey,
+	})
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	rc, _, err := c.Get(ctx, cache.CAS, hash)
+	if rc != nil || err != nil {
+		t.Fatalf("Expected a miss, got %v %v", rc, err)
+	}
+
+	err = c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same layout as the S3 backend.
+	name := fmt.Sprintf("/%s/%s/cache/cas/%s", testAccount, testContainer, hash)
+	s.mu.Lock()
+	_, ok := s.blobs[name]
+	s.mu.Unlock()
+	if !ok {
+		t.Fatalf("Expected a blob named %s", name)
+	}
+
+	rc, size, err := c.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("Expected to find the blob")
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if size != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Fatal("Got the wrong data")
+	}
+
+	found, size, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || size != int64(len(data)) {
+		t.Fatalf("Expected to find %d bytes, got %v %d", len(data), found, size)
+	}
+
+	found, _, err = c.Contains(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("Expected the AC entry to be missing")
+	}
+
+	// Deleting a missing blob is not an error.
+	for i := 0; i < 2; i++ {
+		err = c.(cache.Deleter).Delete(ctx, cache.CAS, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, _, err = c.Contains(ctx, cache.CAS, hash)
+	if err != nil || found {
+		t.Fatalf("Expected the blob to be deleted, got %v %v", found, err)
+	}
+}
+
+func TestWrongSharedKey(t *testing.T) {
+	_, srv := newFakeBlobService(checkSharedKey)
+	defer srv.Close()
+
+	c := newTestCache(t, srv.URL, config.AzBlobStorageConfig{
+		AuthMethod: config.AzBlobAuthSharedKey,
+		SharedKey:  base64.StdEncoding.EncodeToString([]byte("wrong key")),
+	})
+
+	_, hash := testutils.RandomDataAndHash(16)
+	_, _, err := c.Get(context.Background(), cache.CAS, hash)
+	cerr, ok := err.(*cache.Error)
+	if !ok || cerr.Code != http.StatusForbidden {
+		t.Fatalf("Expected a 403 error, got %v", err)
+	}
+}
+
+func TestBlockUpload(t *testing.T) {
+	s, srv := newFakeBlobService(checkSharedKey)
+	defer srv.Close()
+
+	c := newTestCache(t, srv.URL, config.AzBlobStorageConfig{
+		AuthMethod: config.AzBlobAuthSharedKey,
+		SharedKey:  testKey,
+	})
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(maxSinglePutSize + blockSize/2)
+	err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	puts := s.puts
+	numBlocks := len(s.blocks)
+	s.mu.Unlock()
+	if puts != 0 || numBlocks != 3 {
+		t.Fatalf("Expected 3 blocks and no single put, got %d blocks and %d puts",
+			numBlocks, puts)
+	}
+
+	rc, _, err := c.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatal("Got the wrong data")
+	}
+}
+
+func TestSAS(t *testing.T) {
+	_, srv := newFakeBlobService(func(r *http.Request) bool {
+		return r.URL.Query().Get("sig") == "c2lnbmF0dXJl" &&
+			r.Header.Get("Authorization") == ""
+	})
+	defer srv.Close()
+
+	c := newTestCache(t, srv.URL, config.AzBlobStorageConfig{
+		AuthMethod: config.AzBlobAuthSAS,
+		SASToken:   "?sv=2019-12-12&sp=rw&sig=c2lnbmF0dXJl",
+	})
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+	err := c.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err := c.Contains(ctx, cache.AC, hash)
+	if err != nil || !found {
+		t.Fatalf("Expected to find the blob, got %v %v", found, err)
+	}
+}
+
+func TestManagedIdentity(t *testing.T) {
+	var tokenRequests int
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" ||
+			r.URL.Query().Get("client_id") != "my-identity" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		tokenRequests++
+		fmt.Fprintf(w, `{"access_token": "the-token", "expires_on": "%d"}`,
+			time.Now().Add(time.Hour).Unix())
+	}))
+	defer imds.Close()
+
+	origURL := imdsTokenURL
+	imdsTokenURL = imds.URL
+	defer func() { imdsTokenURL = origURL }()
+
+	_, srv := newFakeBlobService(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer the-token"
+	})
+	defer srv.Close()
+
+	c := newTestCache(t, srv.URL, config.AzBlobStorageConfig{
+		AuthMethod:              config.AzBlobAuthManagedIdentity,
+		ManagedIdentityClientID: "my-identity",
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, hash := testutils.RandomDataAndHash(16)
+		_, _, err := c.Contains(ctx, cache.CAS, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tokenRequests != 1 {
+		t.Fatalf("Expected the token to be reused, got %d token requests", tokenRequests)
+	}
+}
+
+func TestStringToSign(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPut,
+		"https://myaccount.blob.core.windows.net/mycontainer/ac/abc?comp=block&blockid=MDA%3D",
+		strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("x-ms-version", "2019-12-12")
+	req.Header.Set("x-ms-date", "Fri, 26 Jun 2015 23:39:12 GMT")
+
+	expected := "PUT\n\n\n5\n\napplication/octet-stream\n\n\n\n\n\n\n" +
+		"x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\n" +
+		"x-ms-version:2019-12-12\n" +
+		"/myaccount/mycontainer/ac/abc\nblockid:MDA=\ncomp:block"
+
+	got := stringToSign("myaccount", req)
+	if got != expected {
+		t.Fatalf("Expected:\n%q\ngot:\n%q", expected, got)
+	}
+}
+
+func TestList(t *testing.T) {
+	_, srv := newFakeBlobService(checkSharedKey)
+	defer srv.Close()
+
+	c := newTestCache(t, srv.URL, config.AzBlobStorageConfig{
+		Prefix:     "cache",
+		AuthMethod: config.AzBlobAuthSharedKey,
+		SharedKey:  testKey,
+	})
+
+	ctx := context.Background()
+	var hashes []string
+	for i := 0; i < 4; i++ {
+		data, hash := testutils.RandomDataAndHash(int64(i + 1))
+		err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	var listed []string
+	err := c.(cache.Lister).List(ctx, cache.CAS, hashes[0],
+		func(hash string, size int64) error {
+			listed = append(listed, hash)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(listed, hashes[1:]) {
+		t.Fatalf("Expected %v, got %v", hashes[1:], listed)
+	}
+}
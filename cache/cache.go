@@ -1,7 +1,14 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"sync"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 )
 
 // EntryKind describes the kind of cache entry
@@ -45,21 +52,183 @@ func (e *Error) Error() string {
 	return e.Text
 }
 
+// IsBackendFailure returns true if `err` indicates that a backend is
+// unavailable or unhealthy, rather than that it rejected the request:
+// any non-nil error other than an Error with a 4xx code, except for 408
+// (Request Timeout) and 429 (Too Many Requests).
+func IsBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cerr, ok := err.(*Error)
+	if !ok {
+		return true
+	}
+
+	switch cerr.Code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return cerr.Code < 400 || cerr.Code >= 500
+}
+
+// ErrBypassed is returned by CacheProxy Get, Contains and ContainsMany
+// calls which skipped an unavailable backend, eg because its circuit
+// breaker is open. The item might exist in the backend, so callers
+// should treat this as a cache miss which is not remembered.
+// ContainsMany still returns a slice with the items which were found.
+var ErrBypassed = errors.New("The proxy backend is temporarily bypassed")
+
 // Cache backends implement this interface, and are optionally used
 // by DiskCache. CacheProxy implementations are expected to be safe
 // for concurrent use.
+//
+// Implementations should abort requests to the backend when `ctx` is
+// cancelled or its deadline expires, and return the context's error.
 type CacheProxy interface {
-	// Put should make a reasonable effort to proxy this data to the backend.
-	// This is allowed to fail silently (eg when under heavy load).
-	Put(kind EntryKind, hash string, size int64, rdr io.Reader)
+	// Put uploads `size` bytes from `rdr` to the backend, and returns
+	// an error if this failed. Implementations that upload asynchronously
+	// (see the uploader package) return before the upload has finished,
+	// and take ownership of `rdr` if it is an io.Closer. Such uploads are
+	// not tied to `ctx`.
+	Put(ctx context.Context, kind EntryKind, hash string, size int64, rdr io.Reader) error
 
 	// Get should return the cache item identified by `hash`, or an error
 	// if something went wrong. If the item was not found, the io.ReadCloser
-	// will be nil.
-	Get(kind EntryKind, hash string) (io.ReadCloser, int64, error)
+	// will be nil. `ctx` also applies to reading from the io.ReadCloser.
+	Get(ctx context.Context, kind EntryKind, hash string) (io.ReadCloser, int64, error)
 
 	// Contains returns whether or not the cache item exists on the
 	// remote end, and the size if it exists (and -1 if the size is
-	// unknown).
-	Contains(kind EntryKind, hash string) (bool, int64)
+	// unknown). An error is returned if this could not be determined.
+	Contains(ctx context.Context, kind EntryKind, hash string) (bool, int64, error)
+
+	// ContainsMany is a batch version of Contains, which returns whether
+	// each of `hashes` exists on the remote end, in the same order. If an
+	// error is returned, the results for the hashes which could be checked
+	// are still valid, and the others are reported as missing. Backends
+	// without native batching can implement this with ContainsParallel.
+	ContainsMany(ctx context.Context, kind EntryKind, hashes []string) ([]bool, error)
+}
+
+// Deleter is implemented by CacheProxy backends which can remove items,
+// which is used to discard corrupt items. Deleting a missing item is
+// not an error.
+type Deleter interface {
+	Delete(ctx context.Context, kind EntryKind, hash string) error
+}
+
+// Lister is implemented by CacheProxy backends which can enumerate their
+// items, which is used to copy them to another backend.
+type Lister interface {
+	// List calls `fn` with the hash and size of each item of the given
+	// kind whose hash sorts after `after` (which may be empty), in
+	// ascending order of hash. If `fn` returns an error, listing stops
+	// and List returns that error.
+	List(ctx context.Context, kind EntryKind, after string,
+		fn func(hash string, size int64) error) error
+}
+
+// InvalidItemError is returned when reading an item from a proxy backend
+// that turns out to be corrupt, eg a CAS blob whose contents don't match
+// its hash. The item should be treated as missing.
+type InvalidItemError struct {
+	Kind   EntryKind
+	Hash   string
+	Reason string
+}
+
+func (e *InvalidItemError) Error() string {
+	return fmt.Sprintf("Invalid item %s/%s: %s", e.Kind, e.Hash, e.Reason)
+}
+
+type digestSizesKey struct{}
+
+// WithDigestSizes returns a copy of `ctx` which also records the sizes
+// of the blobs in `sizes`, keyed by hash. Clients of the gRPC API send
+// blob sizes with each request, but the Cache and CacheProxy methods
+// only take hashes. Backends which need the sizes to address blobs can
+// look them up with DigestSize.
+func WithDigestSizes(ctx context.Context, sizes map[string]int64) context.Context {
+	if parent, ok := ctx.Value(digestSizesKey{}).(map[string]int64); ok {
+		merged := make(map[string]int64, len(parent)+len(sizes))
+		for hash, size := range parent {
+			merged[hash] = size
+		}
+		for hash, size := range sizes {
+			merged[hash] = size
+		}
+		sizes = merged
+	}
+
+	return context.WithValue(ctx, digestSizesKey{}, sizes)
+}
+
+// WithDigestSize returns a copy of `ctx` which also records the size of
+// the blob identified by `d`, see WithDigestSizes.
+func WithDigestSize(ctx context.Context, d *pb.Digest) context.Context {
+	return WithDigestSizes(ctx, map[string]int64{d.Hash: d.SizeBytes})
+}
+
+// DigestSize returns the size recorded for `hash` in `ctx` by
+// WithDigestSizes, or -1 if the size is unknown.
+func DigestSize(ctx context.Context, hash string) int64 {
+	sizes, _ := ctx.Value(digestSizesKey{}).(map[string]int64)
+	if size, ok := sizes[hash]; ok {
+		return size
+	}
+	return -1
+}
+
+// ContainsParallel checks each of `hashes` with p.Contains, with at most
+// `maxConcurrency` calls in flight, and returns the results in the form
+// expected from CacheProxy.ContainsMany. The first error encountered is
+// returned, after all the calls have finished.
+func ContainsParallel(ctx context.Context, p CacheProxy, kind EntryKind,
+	hashes []string, maxConcurrency int) ([]bool, error) {
+
+	found := make([]bool, len(hashes))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, maxConcurrency)
+
+	for i := range hashes {
+		if ctx.Err() != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			mu.Unlock()
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ok, _, err := p.Contains(ctx, kind, hashes[i])
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			// Each goroutine writes to a different index.
+			found[i] = ok
+		}(i)
+	}
+
+	wg.Wait()
+
+	return found, firstErr
 }
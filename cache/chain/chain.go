@@ -0,0 +1,727 @@
+// Package chain provides a CacheProxy which combines an ordered list of
+// other CacheProxy backends, for example a nearby bucket with a fallback
+// to a central cache.
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/buchgr/bazel-remote/cache"
+)
+
+// ReadMode selects how the readable backends are queried.
+type ReadMode int
+
+const (
+	// FirstHit queries the readable backends one at a time, in order,
+	// until one of them has the item.
+	FirstHit ReadMode = iota
+
+	// Race queries all the readable backends concurrently, and uses the
+	// first one to find the item. The other requests are cancelled.
+	Race
+)
+
+// Backend is an element of the chain.
+type Backend struct {
+	// Used to identify the backend in logs and errors.
+	Name string
+
+	Proxy cache.CacheProxy
+
+	// Whether the backend is used for Get and Contains requests.
+	Read bool
+
+	// Whether the backend is used for Put requests.
+	Write bool
+}
+
+var errAllFailed = errors.New("all backends failed")
+var errIncompleteRead = errors.New("the item was not read completely")
+var errBackfillTooSlow = errors.New("the backfill fell too far behind the download")
+
+// The maximum amount of data which is buffered in memory for each
+// backfill upload. Uploads which fall further behind the download are
+// abandoned, so that a slow backend doesn't slow down the client.
+var maxBackfillBuffer = 16 * 1024 * 1024
+
+type chainProxy struct {
+	readers     []Backend
+	writers     []Backend
+	readMode    ReadMode
+	backfill    bool
+	errorLogger cache.Logger
+}
+
+// New returns a CacheProxy which uploads items to each of the writable
+// backends, and looks items up in the readable backends using the given
+// ReadMode. Put fails if any of the writable backends fails.
+//
+// Read errors are logged and treated as cache misses, unless all of the
+// readable backends fail, in which case the first error is returned.
+// Misses are returned with cache.ErrBypassed if any of the readable
+// backends was bypassed, since it might have the item.
+//
+// If `backfill` is true, items found by Get are also uploaded to the
+// earlier backends in the list which are readable and writable and
+// reported a cache miss, while the item is being read by the caller. In
+// Race mode, only the backends which reported a miss before the item
+// was found are backfilled. Backfill uploads never slow down the caller,
+// they are abandoned if they fall too far behind.
+func New(backends []Backend, readMode ReadMode, backfill bool,
+	errorLogger cache.Logger) cache.CacheProxy {
+
+	c := &chainProxy{
+		readMode:    readMode,
+		backfill:    backfill,
+		errorLogger: errorLogger,
+	}
+
+	for _, b := range backends {
+		if b.Read {
+			c.readers = append(c.readers, b)
+		}
+		if b.Write {
+			c.writers = append(c.writers, b)
+		}
+	}
+
+	return c
+}
+
+func (c *chainProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	switch len(c.writers) {
+	case 0:
+		return nil
+	case 1:
+		err := c.writers[0].Proxy.Put(ctx, kind, hash, size, rdr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.writers[0].Name, err)
+		}
+		return nil
+	}
+
+	errs := putAll(ctx, c.writers, kind, hash, size, rdr)
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %v", c.writers[i].Name, err))
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, ", "))
+	}
+
+	return nil
+}
+
+// Upload the data from `rdr` to all of `backends` concurrently, and
+// return their errors.
+func putAll(ctx context.Context, backends []Backend, kind cache.EntryKind,
+	hash string, size int64, rdr io.Reader) []error {
+
+	errs := make([]error, len(backends))
+	w, wg := startPuts(ctx, backends, kind, hash, size, func(i int, err error) {
+		errs[i] = err
+	})
+
+	_, err := io.Copy(w, rdr)
+	if err == errAllFailed {
+		err = nil
+	}
+	w.close(err)
+	wg.Wait()
+
+	return errs
+}
+
+// Start uploading to each of `backends` in the background, from the
+// returned writer, and call `done` with the result of each upload.
+func startPuts(ctx context.Context, backends []Backend, kind cache.EntryKind,
+	hash string, size int64, done func(int, error)) (*fanoutWriter, *sync.WaitGroup) {
+
+	w := &fanoutWriter{}
+	wg := &sync.WaitGroup{}
+
+	for i, b := range backends {
+		pr, pw := io.Pipe()
+		w.writers = append(w.writers, pw)
+
+		wg.Add(1)
+		go func(i int, b Backend, pr *io.PipeReader) {
+			defer wg.Done()
+
+			err := b.Proxy.Put(ctx, kind, hash, size, pr)
+
+			// Unblock the writer, in case the backend returned
+			// without reading everything.
+			pr.Close()
+
+			done(i, err)
+		}(i, b, pr)
+	}
+
+	return w, wg
+}
+
+// fanoutWriter is like io.MultiWriter, but it stops writing to writers
+// which fail instead of failing itself, until all the writers fail.
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	active := 0
+	for i, w := range f.writers {
+		if w == nil {
+			continue
+		}
+
+		_, err := w.Write(p)
+		if err != nil {
+			f.writers[i] = nil
+			continue
+		}
+		active++
+	}
+
+	if active == 0 {
+		return 0, errAllFailed
+	}
+
+	return len(p), nil
+}
+
+// Signal the end of the data to the remaining writers, or an error if
+// `err` is non-nil.
+func (f *fanoutWriter) close(err error) {
+	for _, w := range f.writers {
+		if w != nil {
+			w.CloseWithError(err)
+		}
+	}
+}
+
+func (c *chainProxy) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	if c.readMode == Race {
+		return c.getRace(ctx, kind, hash)
+	}
+
+	var missed []Backend
+	var firstErr error
+	numErrs := 0
+	bypassed := false
+
+	for _, b := range c.readers {
+		rc, size, err := b.Proxy.Get(ctx, kind, hash)
+		if err == cache.ErrBypassed {
+			bypassed = true
+		} else if err != nil {
+			c.errorLogger.Printf("Failed to get %s/%s from %s: %v",
+				kind, hash, b.Name, err)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			numErrs++
+			continue
+		}
+
+		if rc == nil {
+			if b.Write {
+				missed = append(missed, b)
+			}
+			continue
+		}
+
+		return c.backfillReader(kind, hash, rc, size, missed), size, nil
+	}
+
+	if numErrs > 0 && numErrs == len(c.readers) {
+		return nil, -1, firstErr
+	}
+	if bypassed {
+		return nil, -1, cache.ErrBypassed
+	}
+
+	return nil, -1, nil
+}
+
+type getResult struct {
+	idx  int
+	rc   io.ReadCloser
+	size int64
+	err  error
+}
+
+func (c *chainProxy) getRace(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	if len(c.readers) == 0 {
+		return nil, -1, nil
+	}
+
+	results := make(chan getResult, len(c.readers))
+	cancels := make([]context.CancelFunc, len(c.readers))
+
+	for i, b := range c.readers {
+		var bctx context.Context
+		bctx, cancels[i] = context.WithCancel(ctx)
+
+		go func(i int, b Backend) {
+			rc, size, err := b.Proxy.Get(bctx, kind, hash)
+			results <- getResult{idx: i, rc: rc, size: size, err: err}
+		}(i, b)
+	}
+
+	var missed []Backend
+	var firstErr error
+	numErrs := 0
+	bypassed := false
+
+	for n := 0; n < len(c.readers); n++ {
+		r := <-results
+		b := c.readers[r.idx]
+
+		if r.err == cache.ErrBypassed {
+			bypassed = true
+		} else if r.err != nil {
+			c.errorLogger.Printf("Failed to get %s/%s from %s: %v",
+				kind, hash, b.Name, r.err)
+		}
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			numErrs++
+			cancels[r.idx]()
+			continue
+		}
+
+		if r.rc == nil {
+			if b.Write {
+				missed = append(missed, b)
+			}
+			cancels[r.idx]()
+			continue
+		}
+
+		// We have a winner, cancel the other requests and close
+		// any readers they return.
+		for i, cancel := range cancels {
+			if i != r.idx {
+				cancel()
+			}
+		}
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				loser := <-results
+				if loser.rc != nil {
+					loser.rc.Close()
+				}
+			}
+		}(len(c.readers) - n - 1)
+
+		rc := c.backfillReader(kind, hash, r.rc, r.size, missed)
+		return &cancelReadCloser{ReadCloser: rc, cancel: cancels[r.idx]},
+			r.size, nil
+	}
+
+	if numErrs == len(c.readers) {
+		return nil, -1, firstErr
+	}
+	if bypassed {
+		return nil, -1, cache.ErrBypassed
+	}
+
+	return nil, -1, nil
+}
+
+// cancelReadCloser releases the context of a Get request when the
+// reader is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
+
+// If backfilling is enabled, return a reader which also uploads the data
+// read from `rc` to `targets`. Otherwise return `rc`.
+func (c *chainProxy) backfillReader(kind cache.EntryKind, hash string,
+	rc io.ReadCloser, size int64, targets []Backend) io.ReadCloser {
+
+	if !c.backfill || len(targets) == 0 {
+		return rc
+	}
+
+	// The uploads are not tied to the request context, they finish or
+	// fail along with the download.
+	r := &backfillReadCloser{ReadCloser: rc}
+	for _, b := range targets {
+		buf := newBackfillBuffer(maxBackfillBuffer)
+		r.bufs = append(r.bufs, buf)
+
+		go func(b Backend, buf *backfillBuffer) {
+			err := b.Proxy.Put(context.Background(), kind, hash, size, buf)
+
+			// Stop buffering data, in case the backend returned
+			// without reading everything.
+			buf.close(errIncompleteRead)
+
+			if err != nil {
+				c.errorLogger.Printf("Failed to backfill %s/%s into %s: %v",
+					kind, hash, b.Name, err)
+			}
+		}(b, buf)
+	}
+
+	return r
+}
+
+// backfillReadCloser copies the data read from the wrapped reader to
+// a backfillBuffer for each backfill upload.
+type backfillReadCloser struct {
+	io.ReadCloser
+	bufs []*backfillBuffer
+	done bool
+}
+
+func (r *backfillReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+
+	if !r.done {
+		for _, buf := range r.bufs {
+			if n > 0 {
+				buf.write(p[:n])
+			}
+			if err == io.EOF {
+				buf.close(nil)
+			} else if err != nil {
+				buf.close(err)
+			}
+		}
+		if err != nil {
+			r.done = true
+		}
+	}
+
+	return n, err
+}
+
+func (r *backfillReadCloser) Close() error {
+	if !r.done {
+		for _, buf := range r.bufs {
+			buf.close(errIncompleteRead)
+		}
+		r.done = true
+	}
+	return r.ReadCloser.Close()
+}
+
+// backfillBuffer passes data from a download to a backfill upload
+// without ever blocking the download. If more than `max` bytes are
+// waiting to be read, the upload fails with errBackfillTooSlow.
+type backfillBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	queued int
+	max    int
+	closed bool
+	err    error // Returned by Read once closed, io.EOF if nil.
+}
+
+func newBackfillBuffer(max int) *backfillBuffer {
+	b := &backfillBuffer{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *backfillBuffer) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	if b.queued+len(p) > b.max {
+		b.closeLocked(errBackfillTooSlow)
+		return
+	}
+
+	b.chunks = append(b.chunks, append([]byte(nil), p...))
+	b.queued += len(p)
+	b.cond.Signal()
+}
+
+// Signal the end of the data, or an error if `err` is non-nil, in which
+// case the remaining buffered data is dropped. Calls after the first
+// have no effect.
+func (b *backfillBuffer) close(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closeLocked(err)
+	}
+}
+
+func (b *backfillBuffer) closeLocked(err error) {
+	b.closed = true
+	b.err = err
+	if err != nil {
+		b.chunks = nil
+		b.queued = 0
+	}
+	b.cond.Signal()
+}
+
+func (b *backfillBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.chunks) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+
+	if len(b.chunks) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.chunks[0])
+	if n == len(b.chunks[0]) {
+		b.chunks[0] = nil
+		b.chunks = b.chunks[1:]
+	} else {
+		b.chunks[0] = b.chunks[0][n:]
+	}
+	b.queued -= n
+
+	return n, nil
+}
+
+func (c *chainProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	if c.readMode == Race {
+		return c.containsRace(ctx, kind, hash)
+	}
+
+	var firstErr error
+	numErrs := 0
+	bypassed := false
+
+	for _, b := range c.readers {
+		found, size, err := b.Proxy.Contains(ctx, kind, hash)
+		if err == cache.ErrBypassed {
+			bypassed = true
+		} else if err != nil {
+			c.errorLogger.Printf("Failed to check %s for %s/%s: %v",
+				b.Name, kind, hash, err)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			numErrs++
+			continue
+		}
+
+		if found {
+			return true, size, nil
+		}
+	}
+
+	if numErrs > 0 && numErrs == len(c.readers) {
+		return false, -1, firstErr
+	}
+	if bypassed {
+		return false, -1, cache.ErrBypassed
+	}
+
+	return false, -1, nil
+}
+
+type containsResult struct {
+	found bool
+	size  int64
+	err   error
+}
+
+func (c *chainProxy) containsRace(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	if len(c.readers) == 0 {
+		return false, -1, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan containsResult, len(c.readers))
+	for _, b := range c.readers {
+		go func(b Backend) {
+			found, size, err := b.Proxy.Contains(ctx, kind, hash)
+			if err != nil && err != cache.ErrBypassed {
+				c.errorLogger.Printf("Failed to check %s for %s/%s: %v",
+					b.Name, kind, hash, err)
+			}
+			results <- containsResult{found: found, size: size, err: err}
+		}(b)
+	}
+
+	var firstErr error
+	numErrs := 0
+	bypassed := false
+
+	for range c.readers {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			numErrs++
+			bypassed = bypassed || r.err == cache.ErrBypassed
+			continue
+		}
+
+		if r.found {
+			return true, r.size, nil
+		}
+	}
+
+	if numErrs == len(c.readers) {
+		return false, -1, firstErr
+	}
+	if bypassed {
+		return false, -1, cache.ErrBypassed
+	}
+
+	return false, -1, nil
+}
+
+func (c *chainProxy) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	found := make([]bool, len(hashes))
+	if len(c.readers) == 0 {
+		return found, nil
+	}
+
+	if c.readMode == Race {
+		return c.containsManyRace(ctx, kind, hashes)
+	}
+
+	// Only ask each backend about the items which the earlier backends
+	// didn't have.
+	remaining := make([]int, len(hashes))
+	for i := range hashes {
+		remaining[i] = i
+	}
+
+	var firstErr error
+	numErrs := 0
+	bypassed := false
+
+	for _, b := range c.readers {
+		if len(remaining) == 0 {
+			break
+		}
+
+		subset := make([]string, len(remaining))
+		for i, idx := range remaining {
+			subset[i] = hashes[idx]
+		}
+
+		subsetFound, err := b.Proxy.ContainsMany(ctx, kind, subset)
+		if err == cache.ErrBypassed {
+			bypassed = true
+		} else if err != nil {
+			c.errorLogger.Printf("Failed to check %s for %d blobs: %v",
+				b.Name, len(subset), err)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			numErrs++
+		}
+
+		stillMissing := remaining[:0]
+		for i, idx := range remaining {
+			if i < len(subsetFound) && subsetFound[i] {
+				found[idx] = true
+			} else {
+				stillMissing = append(stillMissing, idx)
+			}
+		}
+		remaining = stillMissing
+	}
+
+	if numErrs == len(c.readers) {
+		return found, firstErr
+	}
+	if bypassed && len(remaining) > 0 {
+		return found, cache.ErrBypassed
+	}
+
+	return found, nil
+}
+
+func (c *chainProxy) containsManyRace(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	type result struct {
+		found []bool
+		err   error
+	}
+
+	results := make(chan result, len(c.readers))
+	for _, b := range c.readers {
+		go func(b Backend) {
+			found, err := b.Proxy.ContainsMany(ctx, kind, hashes)
+			if err != nil && err != cache.ErrBypassed {
+				c.errorLogger.Printf("Failed to check %s for %d blobs: %v",
+					b.Name, len(hashes), err)
+			}
+			results <- result{found: found, err: err}
+		}(b)
+	}
+
+	found := make([]bool, len(hashes))
+	var firstErr error
+	numErrs := 0
+	bypassed := false
+
+	for range c.readers {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			numErrs++
+			bypassed = bypassed || r.err == cache.ErrBypassed
+		}
+		for i := 0; i < len(r.found) && i < len(found); i++ {
+			found[i] = found[i] || r.found[i]
+		}
+	}
+
+	if numErrs == len(c.readers) {
+		return found, firstErr
+	}
+	if bypassed {
+		for _, f := range found {
+			if !f {
+				return found, cache.ErrBypassed
+			}
+		}
+	}
+
+	return found, nil
+}
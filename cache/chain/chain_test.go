@@ -0,0 +1,348 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+type memBackend struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	err   error         // If non-nil, returned by all requests.
+	delay time.Duration // Added to Get and Contains requests.
+
+	// If non-nil, Put requests wait until it is closed.
+	putBlock chan struct{}
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{blobs: make(map[string][]byte)}
+}
+
+func (b *memBackend) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.putBlock != nil {
+		<-b.putBlock
+	}
+
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return errors.New("size mismatch")
+	}
+
+	b.mu.Lock()
+	b.blobs[hash] = data
+	b.mu.Unlock()
+
+	return nil
+}
+
+func (b *memBackend) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	select {
+	case <-time.After(b.delay):
+	case <-ctx.Done():
+		return nil, -1, ctx.Err()
+	}
+
+	if b.err != nil {
+		return nil, -1, b.err
+	}
+
+	data, ok := b.get(hash)
+	if !ok {
+		return nil, -1, nil
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (b *memBackend) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	if b.err != nil {
+		return false, -1, b.err
+	}
+
+	data, ok := b.get(hash)
+	return ok, int64(len(data)), nil
+}
+
+func (b *memBackend) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, b, kind, hashes, 2)
+}
+
+func (b *memBackend) get(hash string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.blobs[hash]
+	return data, ok
+}
+
+func getData(t *testing.T, p cache.CacheProxy, hash string) []byte {
+	t.Helper()
+
+	rc, _, err := p.Get(context.Background(), cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	return data
+}
+
+func TestPutRoles(t *testing.T) {
+	readOnly := newMemBackend()
+	rw := newMemBackend()
+	writeOnly := newMemBackend()
+
+	p := New([]Backend{
+		{Name: "ro", Proxy: readOnly, Read: true},
+		{Name: "rw", Proxy: rw, Read: true, Write: true},
+		{Name: "wo", Proxy: writeOnly, Write: true},
+	}, FirstHit, false, testutils.NewSilentLogger())
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	err := p.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := readOnly.get(hash); ok {
+		t.Error("Expected the read-only backend to be skipped")
+	}
+	for _, b := range []*memBackend{rw, writeOnly} {
+		stored, _ := b.get(hash)
+		if !bytes.Equal(stored, data) {
+			t.Error("Expected the writable backends to store the item")
+		}
+	}
+
+	// Failures in one backend should not prevent uploads to the others.
+	rw.err = errors.New("broken")
+	data, hash = testutils.RandomDataAndHash(1024)
+	err = p.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("Expected an error when one of the backends fails")
+	}
+	if stored, _ := writeOnly.get(hash); !bytes.Equal(stored, data) {
+		t.Error("Expected the working backend to store the item")
+	}
+}
+
+func TestFirstHitWithBackfill(t *testing.T) {
+	near := newMemBackend()
+	central := newMemBackend()
+
+	p := New([]Backend{
+		{Name: "near", Proxy: near, Read: true, Write: true},
+		{Name: "central", Proxy: central, Read: true, Write: true},
+	}, FirstHit, true, testutils.NewSilentLogger())
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	central.blobs[hash] = data
+
+	if !bytes.Equal(getData(t, p, hash), data) {
+		t.Fatal("Expected to find the item in the second backend")
+	}
+
+	// The backfill finishes in the background.
+	for i := 0; i < 100; i++ {
+		if _, ok := near.get(hash); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stored, _ := near.get(hash); !bytes.Equal(stored, data) {
+		t.Fatal("Expected the item to be backfilled into the first backend")
+	}
+
+	// Errors are treated as misses, unless all backends fail.
+	near.err = errors.New("broken")
+	if !bytes.Equal(getData(t, p, hash), data) {
+		t.Fatal("Expected to fall back to the second backend")
+	}
+	central.err = errors.New("broken")
+	_, _, err := p.Get(context.Background(), cache.CAS, hash)
+	if err == nil {
+		t.Fatal("Expected an error when all backends fail")
+	}
+}
+
+func TestSlowBackfill(t *testing.T) {
+	defer func(max int) { maxBackfillBuffer = max }(maxBackfillBuffer)
+	maxBackfillBuffer = 2048
+
+	near := newMemBackend()
+	near.putBlock = make(chan struct{})
+	central := newMemBackend()
+
+	p := New([]Backend{
+		{Name: "near", Proxy: near, Read: true, Write: true},
+		{Name: "central", Proxy: central, Read: true, Write: true},
+	}, FirstHit, true, testutils.NewSilentLogger())
+
+	small, smallHash := testutils.RandomDataAndHash(1024)
+	central.blobs[smallHash] = small
+	large, largeHash := testutils.RandomDataAndHash(4096)
+	central.blobs[largeHash] = large
+
+	// The downloads complete while the backfill uploads are blocked.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !bytes.Equal(getData(t, p, smallHash), small) {
+			t.Error("Expected to find the small item in the second backend")
+		}
+		if !bytes.Equal(getData(t, p, largeHash), large) {
+			t.Error("Expected to find the large item in the second backend")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The download was blocked by the backfill upload")
+	}
+	close(near.putBlock)
+
+	// The buffered item is backfilled, and the item which didn't fit
+	// in the buffer is not.
+	for i := 0; i < 100; i++ {
+		if _, ok := near.get(smallHash); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stored, _ := near.get(smallHash); !bytes.Equal(stored, small) {
+		t.Fatal("Expected the small item to be backfilled into the first backend")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := near.get(largeHash); ok {
+		t.Fatal("Expected the large item not to be backfilled")
+	}
+}
+
+func TestRace(t *testing.T) {
+	slow := newMemBackend()
+	slow.delay = time.Hour
+	fast := newMemBackend()
+
+	p := New([]Backend{
+		{Name: "slow", Proxy: slow, Read: true},
+		{Name: "fast", Proxy: fast, Read: true},
+	}, Race, false, testutils.NewSilentLogger())
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	slow.blobs[hash] = data
+	fast.blobs[hash] = data
+
+	done := make(chan []byte)
+	go func() {
+		done <- getData(t, p, hash)
+	}()
+
+	select {
+	case got := <-done:
+		if !bytes.Equal(got, data) {
+			t.Fatal("Unexpected data")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the fast backend to win the race")
+	}
+
+	_, missingHash := testutils.RandomDataAndHash(1024)
+	found, err := p.ContainsMany(context.Background(), cache.CAS,
+		[]string{hash, missingHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found[0] || found[1] {
+		t.Fatalf("Unexpected ContainsMany result: %v", found)
+	}
+}
+
+func TestContainsManyFirstHit(t *testing.T) {
+	first := newMemBackend()
+	second := newMemBackend()
+
+	p := New([]Backend{
+		{Name: "first", Proxy: first, Read: true},
+		{Name: "second", Proxy: second, Read: true},
+	}, FirstHit, false, testutils.NewSilentLogger())
+
+	_, hash1 := testutils.RandomDataAndHash(10)
+	_, hash2 := testutils.RandomDataAndHash(10)
+	_, hash3 := testutils.RandomDataAndHash(10)
+	first.blobs[hash1] = []byte{}
+	second.blobs[hash2] = []byte{}
+
+	found, err := p.ContainsMany(context.Background(), cache.CAS,
+		[]string{hash1, hash2, hash3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found[0] || !found[1] || found[2] {
+		t.Fatalf("Unexpected ContainsMany result: %v", found)
+	}
+}
+
+func TestBypassedBackend(t *testing.T) {
+	for _, mode := range []ReadMode{FirstHit, Race} {
+		bypassed := newMemBackend()
+		bypassed.err = cache.ErrBypassed
+		available := newMemBackend()
+
+		p := New([]Backend{
+			{Name: "bypassed", Proxy: bypassed, Read: true},
+			{Name: "available", Proxy: available, Read: true},
+		}, mode, false, testutils.NewSilentLogger())
+
+		data, hash := testutils.RandomDataAndHash(10)
+		_, missingHash := testutils.RandomDataAndHash(10)
+		available.blobs[hash] = data
+
+		ctx := context.Background()
+
+		// Hits are not affected.
+		if !bytes.Equal(getData(t, p, hash), data) {
+			t.Fatalf("%v: Expected to find %s", mode, hash)
+		}
+		found, err := p.ContainsMany(ctx, cache.CAS, []string{hash})
+		if err != nil || !found[0] {
+			t.Fatalf("%v: Expected to find %s, got %v %v", mode, hash, found, err)
+		}
+
+		// Misses might be hits in the bypassed backend.
+		rc, _, err := p.Get(ctx, cache.CAS, missingHash)
+		if rc != nil || err != cache.ErrBypassed {
+			t.Fatalf("%v: Expected a bypassed miss, got %v %v", mode, rc, err)
+		}
+		ok, _, err := p.Contains(ctx, cache.CAS, missingHash)
+		if ok || err != cache.ErrBypassed {
+			t.Fatalf("%v: Expected a bypassed miss, got %v %v", mode, ok, err)
+		}
+		found, err = p.ContainsMany(ctx, cache.CAS, []string{hash, missingHash})
+		if err != cache.ErrBypassed || !found[0] || found[1] {
+			t.Fatalf("%v: Expected a bypassed miss, got %v %v", mode, found, err)
+		}
+	}
+}
@@ -0,0 +1,707 @@
+// Package cluster provides a disk.Cache which spreads cache items over a
+// group of bazel-remote nodes. Each key is assigned to one or more owner
+// nodes on a consistent-hash ring, and requests for keys owned by other
+// nodes are forwarded to them over the HTTP API.
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/disk"
+	cachehttp "github.com/buchgr/bazel-remote/cache/http"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+const (
+	// Requests forwarded between nodes carry this header, so that the
+	// receiving node doesn't forward them again. The value is either
+	// forwardRoute or forwardReplica.
+	forwardedHeader = "X-Bazel-Remote-Forwarded"
+
+	// Carries the cluster secret, which authenticates forwardedHeader.
+	secretHeader = "X-Bazel-Remote-Cluster-Secret"
+
+	// The receiving node is an owner of the key, and should store
+	// uploads locally and replicate them to the other owners.
+	forwardRoute = "route"
+
+	// The receiving node should only store uploads locally.
+	forwardReplica = "replica"
+
+	// How long to stop sending requests to a peer after it failed.
+	peerRetryDelay = 30 * time.Second
+
+	// How often to try delivering hinted uploads, and to check the
+	// membership file for changes.
+	handoffInterval        = 10 * time.Second
+	membershipPollInterval = 10 * time.Second
+)
+
+// The maximum time to spend handing off a single hinted upload.
+var hintDeliveryTimeout = time.Minute
+
+var (
+	forwardedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_cluster_forwarded_requests",
+		Help: "The total number of requests forwarded to other cluster nodes",
+	})
+	peerErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_cluster_peer_errors",
+		Help: "The total number of failed requests to other cluster nodes",
+	})
+	pendingHints = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bazel_remote_cluster_pending_hints",
+		Help: "The number of uploads stored locally for cluster nodes which were unavailable",
+	})
+)
+
+type ctxKey int
+
+const forwardedKey ctxKey = 0
+
+// WrapHandler returns an HTTP handler which marks requests forwarded by
+// other cluster nodes, so that the Cluster serves them from the local
+// cache instead of forwarding them again. It should wrap the handler of
+// the cache HTTP API.
+//
+// Only requests with the cluster secret are treated as forwarded, so
+// that clients can't bypass the ownership and replication of items.
+func (c *Cluster) WrapHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode := r.Header.Get(forwardedHeader)
+		secret := r.Header.Get(secretHeader)
+		r.Header.Del(forwardedHeader)
+		r.Header.Del(secretHeader)
+
+		if mode != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(c.secret)) == 1 {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedKey, mode))
+		}
+		handler(w, r)
+	}
+}
+
+func forwardMode(ctx context.Context) string {
+	mode, _ := ctx.Value(forwardedKey).(string)
+	return mode
+}
+
+// headerTransport adds the forwarding and secret headers to each request.
+type headerTransport struct {
+	base   http.RoundTripper
+	mode   string
+	secret string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cachehttp.RedirectedToOtherHost(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(forwardedHeader, t.mode)
+	req.Header.Set(secretHeader, t.secret)
+	return t.base.RoundTrip(req)
+}
+
+type peer struct {
+	url     string
+	route   cache.CacheProxy
+	replica cache.CacheProxy
+
+	// Guarded by Cluster.mu.
+	downUntil time.Time
+}
+
+type hintKey struct {
+	node string
+	kind cache.EntryKind
+	hash string
+}
+
+// Cluster is a disk.Cache which stores the items owned by this node in
+// a local disk.Cache, and forwards requests for other items to their
+// owners.
+//
+// Uploads to a node which is unavailable are stored locally as "hints",
+// and handed off to the node once it is reachable again. Hints are only
+// kept in memory.
+type Cluster struct {
+	local        disk.Cache
+	self         string
+	replicas     int
+	staticNodes  []string
+	secret       string
+	client       *http.Client // The base client for requests to peers.
+	accessLogger cache.Logger
+	errorLogger  cache.Logger
+
+	mu    sync.Mutex
+	ring  *ring
+	peers map[string]*peer
+	hints map[hintKey]struct{}
+}
+
+// New returns a Cluster which uses `local` for the items owned by this
+// node, identified by the base URL `self` of its HTTP API. The other
+// members are listed in `nodes` and/or `membershipFile`, which contains
+// one base URL per line and is re-read when it changes. Each item is
+// stored on `replicationFactor` nodes.
+//
+// Base URLs of nodes which require authentication can include basic
+// auth credentials. Other client settings for requests to the nodes,
+// eg TLS, are taken from `clientConfig`. All nodes must use the same
+// `secret`, which authenticates requests forwarded between them.
+func New(local disk.Cache, self string, nodes []string, membershipFile string,
+	replicationFactor int, secret string, clientConfig *config.HTTPBackendConfig,
+	accessLogger cache.Logger, errorLogger cache.Logger) (*Cluster, error) {
+
+	if replicationFactor < 1 {
+		replicationFactor = 1
+	}
+
+	client, err := cachehttp.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		local:        local,
+		self:         normalizeURL(self),
+		replicas:     replicationFactor,
+		staticNodes:  nodes,
+		secret:       secret,
+		client:       client,
+		accessLogger: accessLogger,
+		errorLogger:  errorLogger,
+		peers:        make(map[string]*peer),
+		hints:        make(map[hintKey]struct{}),
+	}
+
+	var fileNodes []string
+	if membershipFile != "" {
+		data, err := ioutil.ReadFile(membershipFile)
+		if err != nil {
+			return nil, err
+		}
+		fileNodes = parseMembership(data)
+
+		go c.watchMembership(membershipFile, data)
+	}
+
+	err = c.setMembers(fileNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for range time.Tick(handoffInterval) {
+			c.deliverHints()
+		}
+	}()
+
+	return c, nil
+}
+
+func normalizeURL(u string) string {
+	return strings.TrimRight(strings.TrimSpace(u), "/")
+}
+
+// Parse a membership file with one node URL per line. Empty lines and
+// lines starting with '#' are ignored.
+func parseMembership(data []byte) []string {
+	var nodes []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		nodes = append(nodes, line)
+	}
+
+	return nodes
+}
+
+func (c *Cluster) watchMembership(path string, last []byte) {
+	for range time.Tick(membershipPollInterval) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			c.errorLogger.Printf("Failed to read cluster membership file: %v", err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		err = c.setMembers(parseMembership(data))
+		if err != nil {
+			c.errorLogger.Printf("Failed to update cluster membership: %v", err)
+		}
+	}
+}
+
+// Rebuild the ring from the static nodes, `fileNodes` and this node.
+func (c *Cluster) setMembers(fileNodes []string) error {
+	members := []string{c.self}
+	for _, n := range append(append([]string{}, c.staticNodes...), fileNodes...) {
+		n = normalizeURL(n)
+		if !containsNode(members, n) {
+			members = append(members, n)
+		}
+	}
+	sort.Strings(members)
+
+	peers := make(map[string]*peer, len(members))
+	for _, m := range members {
+		if m == c.self {
+			continue
+		}
+
+		c.mu.Lock()
+		p, ok := c.peers[m]
+		c.mu.Unlock()
+		if !ok {
+			var err error
+			p, err = c.newPeer(m)
+			if err != nil {
+				return err
+			}
+		}
+		peers[m] = p
+	}
+
+	r := newRing(members)
+
+	c.mu.Lock()
+	c.ring = r
+	c.peers = peers
+	c.mu.Unlock()
+
+	c.errorLogger.Printf("Cluster members: %s", strings.Join(members, ", "))
+
+	return nil
+}
+
+func (c *Cluster) newPeer(nodeURL string) (*peer, error) {
+	baseURL, err := url.Parse(nodeURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cluster node URL %q: %v", nodeURL, err)
+	}
+
+	newClient := func(mode string) cache.CacheProxy {
+		client := *c.client
+		client.Transport = &headerTransport{
+			base:   c.client.Transport,
+			mode:   mode,
+			secret: c.secret,
+		}
+		return cachehttp.New(baseURL, &client, c.accessLogger, c.errorLogger)
+	}
+
+	return &peer{
+		url:     nodeURL,
+		route:   newClient(forwardRoute),
+		replica: newClient(forwardReplica),
+	}, nil
+}
+
+// Return the owners of `hash`, whether this node is one of them, and
+// the peers among them which are not known to be down.
+func (c *Cluster) owners(hash string) (owners []string, isOwner bool, live []*peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owners = c.ring.owners(hash, c.replicas)
+	now := time.Now()
+	for _, o := range owners {
+		if o == c.self {
+			isOwner = true
+			continue
+		}
+		if p := c.peers[o]; p != nil && now.After(p.downUntil) {
+			live = append(live, p)
+		}
+	}
+
+	return owners, isOwner, live
+}
+
+func (c *Cluster) peer(node string) *peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peers[node]
+}
+
+func (c *Cluster) isDown(p *peer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(p.downUntil)
+}
+
+// Record a failed request to `p`. Errors caused by the caller's context
+// are not the peer's fault, and neither are requests which the peer
+// rejected, eg uploads of invalid items (see cache.IsBackendFailure).
+func (c *Cluster) peerFailed(ctx context.Context, p *peer, err error) {
+	if !cache.IsBackendFailure(err) {
+		return
+	}
+
+	peerErrors.Inc()
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.errorLogger.Printf("Cluster node %s failed: %v", p.url, err)
+
+	c.mu.Lock()
+	p.downUntil = time.Now().Add(peerRetryDelay)
+	c.mu.Unlock()
+}
+
+func (c *Cluster) peerSucceeded(p *peer) {
+	c.mu.Lock()
+	p.downUntil = time.Time{}
+	c.mu.Unlock()
+}
+
+// The HTTP API serves RAW items under the "ac" path.
+func peerKind(kind cache.EntryKind) cache.EntryKind {
+	if kind == cache.RAW {
+		return cache.AC
+	}
+	return kind
+}
+
+// Get returns the item from this node if it is an owner, and otherwise
+// from the first available owner. If no owner has the item, a locally
+// stored hint is returned if there is one.
+func (c *Cluster) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	if forwardMode(ctx) != "" {
+		return c.local.Get(ctx, kind, hash)
+	}
+
+	_, isOwner, live := c.owners(hash)
+	if isOwner {
+		rc, size, err := c.local.Get(ctx, kind, hash)
+		if rc != nil || err != nil {
+			return rc, size, err
+		}
+	}
+
+	for _, p := range live {
+		forwardedRequests.Inc()
+		rc, size, err := p.route.Get(ctx, peerKind(kind), hash)
+		if err != nil {
+			c.peerFailed(ctx, p, err)
+			continue
+		}
+		c.peerSucceeded(p)
+		if rc != nil {
+			return rc, size, nil
+		}
+	}
+
+	if !isOwner {
+		return c.local.Get(ctx, kind, hash)
+	}
+
+	return nil, -1, nil
+}
+
+// Contains checks the owners of the item, like Get.
+func (c *Cluster) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64) {
+	if forwardMode(ctx) != "" {
+		return c.local.Contains(ctx, kind, hash)
+	}
+
+	_, isOwner, live := c.owners(hash)
+	if isOwner {
+		found, size := c.local.Contains(ctx, kind, hash)
+		if found {
+			return found, size
+		}
+	}
+
+	for _, p := range live {
+		forwardedRequests.Inc()
+		found, size, err := p.route.Contains(ctx, peerKind(kind), hash)
+		if err != nil {
+			c.peerFailed(ctx, p, err)
+			continue
+		}
+		c.peerSucceeded(p)
+		if found {
+			return true, size
+		}
+	}
+
+	if !isOwner {
+		return c.local.Contains(ctx, kind, hash)
+	}
+
+	return false, -1
+}
+
+// FindMissingCasBlobs checks the blobs owned by this node locally, and
+// sends one batch request to the first available owner of each of the
+// other blobs.
+func (c *Cluster) FindMissingCasBlobs(ctx context.Context, hashes []string) []string {
+	if forwardMode(ctx) != "" {
+		return c.local.FindMissingCasBlobs(ctx, hashes)
+	}
+
+	var local []string
+	remote := make(map[*peer][]string)
+	for _, hash := range hashes {
+		_, isOwner, live := c.owners(hash)
+		if isOwner || len(live) == 0 {
+			local = append(local, hash)
+		} else {
+			remote[live[0]] = append(remote[live[0]], hash)
+		}
+	}
+
+	missing := c.local.FindMissingCasBlobs(ctx, local)
+
+	for p, peerHashes := range remote {
+		forwardedRequests.Inc()
+		found, err := p.route.ContainsMany(ctx, cache.CAS, peerHashes)
+		if err != nil {
+			c.peerFailed(ctx, p, err)
+		} else {
+			c.peerSucceeded(p)
+		}
+		for i, hash := range peerHashes {
+			if i >= len(found) || !found[i] {
+				missing = append(missing, hash)
+			}
+		}
+	}
+
+	return missing
+}
+
+// Put stores the item on its owners. If this node is an owner, the item
+// is stored locally and then replicated to the other owners. Otherwise
+// it is streamed to the first available owner, which replicates it. If
+// no owner is available, the item is stored locally as a hint.
+func (c *Cluster) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) error {
+	mode := forwardMode(ctx)
+	if mode == forwardReplica {
+		return c.local.Put(ctx, kind, hash, size, r)
+	}
+
+	owners, isOwner, live := c.owners(hash)
+
+	if isOwner || mode == forwardRoute {
+		err := c.local.Put(ctx, kind, hash, size, r)
+		if err != nil {
+			return err
+		}
+
+		c.replicate(ctx, kind, hash, size, owners)
+		return nil
+	}
+
+	if len(live) > 0 {
+		p := live[0]
+		forwardedRequests.Inc()
+		err := p.route.Put(ctx, peerKind(kind), hash, size, r)
+		if err != nil {
+			c.peerFailed(ctx, p, err)
+			if !cache.IsBackendFailure(err) {
+				// The owner rejected the upload, the client
+				// gets the same error.
+				return err
+			}
+			// The request body has been consumed, so we can't
+			// fall back to another node.
+			return &cache.Error{
+				Code: http.StatusServiceUnavailable,
+				Text: fmt.Sprintf("Failed to forward %s/%s to %s: %v",
+					kind, hash, p.url, err),
+			}
+		}
+		c.peerSucceeded(p)
+		return nil
+	}
+
+	err := c.local.Put(ctx, kind, hash, size, r)
+	if err != nil {
+		return err
+	}
+	c.addHint(owners[0], kind, hash)
+
+	return nil
+}
+
+// Upload a locally stored item to the other nodes in `owners`, and
+// store hints for the nodes which are unavailable.
+func (c *Cluster) replicate(ctx context.Context, kind cache.EntryKind, hash string, size int64, owners []string) {
+	var wg sync.WaitGroup
+
+	for _, o := range owners {
+		if o == c.self {
+			continue
+		}
+
+		p := c.peer(o)
+		if p == nil {
+			continue
+		}
+		if c.isDown(p) {
+			c.addHint(o, kind, hash)
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+
+			err := c.sendLocal(ctx, p.replica, kind, hash)
+			if err != nil {
+				c.peerFailed(ctx, p, err)
+				c.addHint(p.url, kind, hash)
+				return
+			}
+			c.peerSucceeded(p)
+		}(p)
+	}
+
+	wg.Wait()
+}
+
+// Upload the local copy of an item with `proxy`. Returns errLocalMissing
+// if there is no local copy.
+func (c *Cluster) sendLocal(ctx context.Context, proxy cache.CacheProxy, kind cache.EntryKind, hash string) error {
+	rc, size, err := c.local.Get(ctx, kind, hash)
+	if err != nil {
+		return err
+	}
+	if rc == nil {
+		return errLocalMissing
+	}
+	defer rc.Close()
+
+	forwardedRequests.Inc()
+	return proxy.Put(ctx, peerKind(kind), hash, size, rc)
+}
+
+var errLocalMissing = fmt.Errorf("the local copy was evicted")
+
+func (c *Cluster) addHint(node string, kind cache.EntryKind, hash string) {
+	c.mu.Lock()
+	c.hints[hintKey{node: node, kind: kind, hash: hash}] = struct{}{}
+	pendingHints.Set(float64(len(c.hints)))
+	c.mu.Unlock()
+}
+
+func (c *Cluster) removeHint(h hintKey) {
+	c.mu.Lock()
+	delete(c.hints, h)
+	pendingHints.Set(float64(len(c.hints)))
+	c.mu.Unlock()
+}
+
+// Try to deliver the locally stored hints to their nodes.
+func (c *Cluster) deliverHints() {
+	c.mu.Lock()
+	hints := make([]hintKey, 0, len(c.hints))
+	for h := range c.hints {
+		hints = append(hints, h)
+	}
+	c.mu.Unlock()
+
+	for _, h := range hints {
+		p := c.peer(h.node)
+		if p == nil {
+			// The node left the cluster.
+			c.removeHint(h)
+			continue
+		}
+
+		c.mu.Lock()
+		down := time.Now().Before(p.downUntil)
+		c.mu.Unlock()
+		if down {
+			// Try again in a later round.
+			continue
+		}
+
+		// Don't let a hung peer block the delivery of other hints.
+		ctx, cancel := context.WithTimeout(context.Background(), hintDeliveryTimeout)
+		err := c.sendLocal(ctx, p.route, h.kind, h.hash)
+		cancel()
+		if err == errLocalMissing {
+			c.errorLogger.Printf("Dropping hint for %s/%s to %s: %v",
+				h.kind, h.hash, h.node, err)
+			c.removeHint(h)
+			continue
+		}
+		if err != nil {
+			// A timeout counts as a failure of the peer.
+			c.peerFailed(context.Background(), p, err)
+			continue
+		}
+
+		c.peerSucceeded(p)
+		c.removeHint(h)
+	}
+}
+
+// validationView looks up the dependencies of an ActionResult across the
+// cluster, even when the ActionResult itself was requested by another
+// node.
+type validationView struct {
+	c *Cluster
+
+	// If true, the ActionResult itself is read from the local cache.
+	localAC bool
+}
+
+func (v *validationView) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	if kind != cache.CAS && v.localAC {
+		return v.c.local.Get(ctx, kind, hash)
+	}
+	return v.c.Get(context.WithValue(ctx, forwardedKey, ""), kind, hash)
+}
+
+func (v *validationView) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64) {
+	return v.c.Contains(context.WithValue(ctx, forwardedKey, ""), kind, hash)
+}
+
+// GetValidatedActionResult returns the ActionResult if it and all the
+// blobs it refers to are available in the cluster.
+func (c *Cluster) GetValidatedActionResult(ctx context.Context, hash string) (*pb.ActionResult, []byte, error) {
+	view := &validationView{c: c, localAC: forwardMode(ctx) != ""}
+	return disk.LoadValidatedActionResult(ctx, view, hash)
+}
+
+// MaxSize returns the maximum size of the local cache.
+func (c *Cluster) MaxSize() int64 {
+	return c.local.MaxSize()
+}
+
+// Stats returns the size and number of items of the local cache.
+func (c *Cluster) Stats() (currentSize int64, numItems int) {
+	return c.local.Stats()
+}
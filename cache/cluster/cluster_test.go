@@ -0,0 +1,411 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/disk"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/buchgr/bazel-remote/server"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+type testNode struct {
+	url     string
+	local   *disk.DiskCache
+	cluster *Cluster
+	srv     *httptest.Server
+	down    int32 // If non-zero, all HTTP requests fail with 503.
+	hang    int32 // If non-zero, all HTTP requests hang until cancelled.
+}
+
+func (n *testNode) setDown(down bool) {
+	var v int32
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&n.down, v)
+}
+
+const testSecret = "EXAMPLE_SECRET"
+
+// Start `num` in-process cluster nodes which store each item on
+// `replicationFactor` of them. The returned function stops the nodes.
+func newTestCluster(t *testing.T, num int, replicationFactor int) ([]*testNode, func()) {
+	logger := testutils.NewSilentLogger()
+
+	nodes := make([]*testNode, num)
+	urls := make([]string, num)
+	for i := range nodes {
+		n := &testNode{}
+		n.srv = httptest.NewUnstartedServer(nil)
+		n.url = "http://" + n.srv.Listener.Addr().String()
+		urls[i] = n.url
+		nodes[i] = n
+	}
+
+	var dirs []string
+	cleanup := func() {
+		for _, n := range nodes {
+			n.srv.Close()
+		}
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+
+	for _, n := range nodes {
+		dir := testutils.TempDir(t)
+		dirs = append(dirs, dir)
+
+		var err error
+		n.local, err = disk.New(logger, dir, 100*1024*1024, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n.cluster, err = New(n.local, n.url, urls, "", replicationFactor,
+			testSecret, &config.HTTPBackendConfig{}, logger, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := server.NewHTTPCache(n.cluster, logger, logger, true, false, "")
+		handler := n.cluster.WrapHandler(h.CacheHandler)
+		node := n
+		n.srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&node.down) != 0 {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			if atomic.LoadInt32(&node.hang) != 0 {
+				<-r.Context().Done()
+				return
+			}
+			handler(w, r)
+		})
+		n.srv.Start()
+	}
+
+	return nodes, cleanup
+}
+
+// Return a random blob whose owners satisfy `match`.
+func blobOwnedBy(t *testing.T, c *Cluster, match func(owners []string) bool) ([]byte, string) {
+	for i := 0; i < 10000; i++ {
+		data, hash := testutils.RandomDataAndHash(256)
+		owners, _, _ := c.owners(hash)
+		if match(owners) {
+			return data, hash
+		}
+	}
+
+	t.Fatal("Failed to find a matching blob")
+	return nil, ""
+}
+
+func holders(nodes []*testNode, hash string) []string {
+	var found []string
+	for _, n := range nodes {
+		ok, _ := n.local.Contains(context.Background(), cache.CAS, hash)
+		if ok {
+			found = append(found, n.url)
+		}
+	}
+	return found
+}
+
+func TestClusterPutReplicates(t *testing.T) {
+	nodes, cleanup := newTestCluster(t, 3, 2)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, writer := range nodes {
+		data, hash := testutils.RandomDataAndHash(1024)
+
+		err := writer.cluster.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		owners, _, _ := writer.cluster.owners(hash)
+		found := holders(nodes, hash)
+		if len(found) != 2 {
+			t.Fatalf("Expected the blob on 2 nodes, found it on %v", found)
+		}
+		for _, o := range owners {
+			if !containsNode(found, o) {
+				t.Fatalf("Expected the blob on owner %s, found it on %v", o, found)
+			}
+		}
+
+		for _, reader := range nodes {
+			rc, size, err := reader.cluster.Get(ctx, cache.CAS, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rc == nil {
+				t.Fatalf("Expected %s to find the blob", reader.url)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != int64(len(data)) || !bytes.Equal(got, data) {
+				t.Fatalf("%s returned the wrong data", reader.url)
+			}
+
+			ok, _ := reader.cluster.Contains(ctx, cache.CAS, hash)
+			if !ok {
+				t.Fatalf("Expected %s to contain the blob", reader.url)
+			}
+		}
+	}
+}
+
+func TestClusterFindMissingCasBlobs(t *testing.T) {
+	nodes, cleanup := newTestCluster(t, 3, 1)
+	defer cleanup()
+	ctx := context.Background()
+
+	var present []string
+	for i := 0; i < 10; i++ {
+		data, hash := testutils.RandomDataAndHash(64)
+		err := nodes[i%3].cluster.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		present = append(present, hash)
+	}
+
+	var absent []string
+	for i := 0; i < 10; i++ {
+		_, hash := testutils.RandomDataAndHash(64)
+		absent = append(absent, hash)
+	}
+
+	for _, n := range nodes {
+		missing := n.cluster.FindMissingCasBlobs(ctx, append(append([]string{}, present...), absent...))
+		if len(missing) != len(absent) {
+			t.Fatalf("Expected %d missing blobs, found %d", len(absent), len(missing))
+		}
+		for _, hash := range missing {
+			if !containsNode(absent, hash) {
+				t.Fatalf("Unexpected missing blob %s", hash)
+			}
+		}
+	}
+}
+
+func TestClusterHintedHandoff(t *testing.T) {
+	nodes, cleanup := newTestCluster(t, 2, 1)
+	defer cleanup()
+	ctx := context.Background()
+
+	a, b := nodes[0], nodes[1]
+	data, hash := blobOwnedBy(t, a.cluster, func(owners []string) bool {
+		return owners[0] == b.url
+	})
+
+	b.setDown(true)
+
+	err := a.cluster.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("Expected an error when forwarding to an unavailable owner")
+	}
+
+	// The owner is now known to be down, so the next upload is stored
+	// locally as a hint.
+	err = a.cluster.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := holders(nodes, hash)
+	if len(found) != 1 || found[0] != a.url {
+		t.Fatalf("Expected the blob only on %s, found it on %v", a.url, found)
+	}
+
+	// The hint is served while the owner is down.
+	ok, _ := a.cluster.Contains(ctx, cache.CAS, hash)
+	if !ok {
+		t.Fatal("Expected the hinted blob to be found")
+	}
+
+	// Simulate the end of the retry delay.
+	b.setDown(false)
+	p := a.cluster.peer(b.url)
+	a.cluster.mu.Lock()
+	p.downUntil = time.Time{}
+	a.cluster.mu.Unlock()
+	a.cluster.deliverHints()
+
+	found = holders(nodes, hash)
+	if !containsNode(found, b.url) {
+		t.Fatalf("Expected the hint to be delivered to %s, found it on %v", b.url, found)
+	}
+
+	a.cluster.mu.Lock()
+	numHints := len(a.cluster.hints)
+	a.cluster.mu.Unlock()
+	if numHints != 0 {
+		t.Fatalf("Expected no remaining hints, found %d", numHints)
+	}
+}
+
+func TestClusterHintDeliveryTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		hintDeliveryTimeout = timeout
+	}(hintDeliveryTimeout)
+	hintDeliveryTimeout = 100 * time.Millisecond
+
+	nodes, cleanup := newTestCluster(t, 2, 1)
+	defer cleanup()
+
+	a, b := nodes[0], nodes[1]
+	for i := 0; i < 3; i++ {
+		data, hash := blobOwnedBy(t, a.cluster, func(owners []string) bool {
+			return owners[0] == b.url
+		})
+		err := a.local.Put(context.Background(), cache.CAS, hash,
+			int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.cluster.addHint(b.url, cache.CAS, hash)
+	}
+
+	atomic.StoreInt32(&b.hang, 1)
+	defer atomic.StoreInt32(&b.hang, 0)
+
+	done := make(chan struct{})
+	go func() {
+		a.cluster.deliverHints()
+		close(done)
+	}()
+
+	// The first attempt times out and marks the peer as down, so the
+	// remaining hints are left for a later round.
+	select {
+	case <-done:
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("Expected hint delivery to give up on the hung peer")
+	}
+
+	p := a.cluster.peer(b.url)
+	a.cluster.mu.Lock()
+	numHints := len(a.cluster.hints)
+	down := time.Now().Before(p.downUntil)
+	a.cluster.mu.Unlock()
+	if numHints != 3 || !down {
+		t.Fatalf("Expected 3 remaining hints and the peer marked as down, got %d, %v",
+			numHints, down)
+	}
+}
+
+func TestClusterIgnoresUnauthenticatedForwarding(t *testing.T) {
+	nodes, cleanup := newTestCluster(t, 3, 2)
+	defer cleanup()
+
+	a, b := nodes[0], nodes[1]
+	data, hash := blobOwnedBy(t, a.cluster, func(owners []string) bool {
+		return owners[0] == b.url
+	})
+	owners, _, _ := a.cluster.owners(hash)
+
+	put := func(secret string) {
+		req, err := http.NewRequest(http.MethodPut, b.url+"/cas/"+hash,
+			bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(forwardedHeader, forwardReplica)
+		if secret != "" {
+			req.Header.Set(secretHeader, secret)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status: %s", rsp.Status)
+		}
+	}
+
+	// Without the secret, the upload is replicated as usual.
+	put("wrong")
+	found := holders(nodes, hash)
+	if len(found) != 2 || !containsNode(found, owners[0]) || !containsNode(found, owners[1]) {
+		t.Fatalf("Expected the blob on %v, found it on %v", owners, found)
+	}
+
+	// With the secret, a replica upload is only stored locally.
+	data, hash = blobOwnedBy(t, a.cluster, func(owners []string) bool {
+		return owners[0] == b.url
+	})
+	put(testSecret)
+	found = holders(nodes, hash)
+	if len(found) != 1 || found[0] != b.url {
+		t.Fatalf("Expected the blob only on %s, found it on %v", b.url, found)
+	}
+}
+
+func TestClusterPutRejectedByOwner(t *testing.T) {
+	nodes, cleanup := newTestCluster(t, 2, 1)
+	defer cleanup()
+
+	a, b := nodes[0], nodes[1]
+	_, hash := blobOwnedBy(t, a.cluster, func(owners []string) bool {
+		return owners[0] == b.url
+	})
+
+	// The owner validates ActionResults, and rejects this one.
+	data := []byte("not an ActionResult")
+	err := a.cluster.Put(context.Background(), cache.AC, hash,
+		int64(len(data)), bytes.NewReader(data))
+	cerr, ok := err.(*cache.Error)
+	if !ok || cerr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a cache.Error with code %d, got %v",
+			http.StatusBadRequest, err)
+	}
+
+	// The owner is still used for other requests.
+	if a.cluster.isDown(a.cluster.peer(b.url)) {
+		t.Fatal("Expected the owner not to be marked as down")
+	}
+	data, hash = blobOwnedBy(t, a.cluster, func(owners []string) bool {
+		return owners[0] == b.url
+	})
+	err = a.cluster.Put(context.Background(), cache.CAS, hash,
+		int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := holders(nodes, hash)
+	if len(found) != 1 || found[0] != b.url {
+		t.Fatalf("Expected the blob on %s, found it on %v", b.url, found)
+	}
+}
+
+func TestParseMembership(t *testing.T) {
+	data := []byte(`
+# A comment.
+http://a:8080
+
+  http://b:8080/
+`)
+
+	nodes := parseMembership(data)
+	if len(nodes) != 2 || nodes[0] != "http://a:8080" || nodes[1] != "http://b:8080/" {
+		t.Fatalf("Unexpected nodes: %v", nodes)
+	}
+}
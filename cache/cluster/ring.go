@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strconv"
+)
+
+// The number of points each node gets on the ring. More points give a
+// more even distribution of keys.
+const virtualNodes = 100
+
+// ring is an immutable consistent-hash ring.
+type ring struct {
+	points []uint64
+	nodes  []string // The node owning each point.
+	size   int      // The number of distinct nodes.
+}
+
+func hashPoint(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newRing(nodes []string) *ring {
+	type point struct {
+		pos  uint64
+		node string
+	}
+
+	points := make([]point, 0, len(nodes)*virtualNodes)
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{
+				pos:  hashPoint(node + "#" + strconv.Itoa(i)),
+				node: node,
+			})
+		}
+	}
+
+	sort.Slice(points, func(a int, b int) bool {
+		return points[a].pos < points[b].pos
+	})
+
+	r := &ring{
+		points: make([]uint64, len(points)),
+		nodes:  make([]string, len(points)),
+		size:   len(nodes),
+	}
+	for i, p := range points {
+		r.points[i] = p.pos
+		r.nodes[i] = p.node
+	}
+
+	return r
+}
+
+// Return the position of a cache key on the ring. Keys are sha256 hashes
+// already, so their leading bytes are used directly.
+func keyPoint(hash string) uint64 {
+	if len(hash) >= 16 {
+		b, err := hex.DecodeString(hash[:16])
+		if err == nil {
+			return binary.BigEndian.Uint64(b)
+		}
+	}
+
+	return hashPoint(hash)
+}
+
+// owners returns up to `n` distinct nodes responsible for `hash`, in
+// order of preference.
+func (r *ring) owners(hash string, n int) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+	if n > r.size {
+		n = r.size
+	}
+
+	key := keyPoint(hash)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= key
+	})
+
+	owners := make([]string, 0, n)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		node := r.nodes[(start+i)%len(r.points)]
+		if !containsNode(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+
+	return owners
+}
+
+func containsNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
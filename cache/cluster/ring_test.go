@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"testing"
+
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+func TestRingOwners(t *testing.T) {
+	nodes := []string{"http://a", "http://b", "http://c"}
+	r := newRing(nodes)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		_, hash := testutils.RandomDataAndHash(16)
+
+		owners := r.owners(hash, 2)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("Expected 2 distinct owners, found %v", owners)
+		}
+		if r.owners(hash, 2)[0] != owners[0] {
+			t.Fatal("Expected the owners to be stable")
+		}
+		counts[owners[0]]++
+
+		all := r.owners(hash, 10)
+		if len(all) != len(nodes) {
+			t.Fatalf("Expected %d owners, found %v", len(nodes), all)
+		}
+	}
+
+	// Each node should be the primary owner of a reasonable share of
+	// the keys.
+	for _, n := range nodes {
+		if counts[n] < 600 {
+			t.Errorf("Node %s only owns %d of 3000 keys", n, counts[n])
+		}
+	}
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	before := newRing([]string{"http://a", "http://b", "http://c"})
+	after := newRing([]string{"http://a", "http://b", "http://c", "http://d"})
+
+	for i := 0; i < 1000; i++ {
+		_, hash := testutils.RandomDataAndHash(16)
+
+		// Keys either stay put, or move to the new node.
+		o1 := before.owners(hash, 1)[0]
+		o2 := after.owners(hash, 1)[0]
+		if o1 != o2 && o2 != "http://d" {
+			t.Fatalf("Key %s moved from %s to %s", hash, o1, o2)
+		}
+	}
+}
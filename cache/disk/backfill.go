@@ -0,0 +1,310 @@
+package disk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	backfillUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_disk_cache_backfill_uploads",
+		Help: "The total number of local items uploaded to the proxy backend by the backfill",
+	})
+	backfillUploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_disk_cache_backfill_upload_bytes",
+		Help: "The total number of bytes uploaded to the proxy backend by the backfill",
+	})
+)
+
+// The number of items processed between checkpoints.
+const backfillCheckpointInterval = 1000
+
+// backfillState is stored in the backfill state file.
+type backfillState struct {
+	// All items with keys up to and including LastKey have been
+	// uploaded to the proxy backend, or were already present there.
+	LastKey string `json:"last_key"`
+	// True once every item that existed when the backfill started has
+	// been processed successfully.
+	Done bool `json:"done"`
+}
+
+// WithBackfill makes New upload the items which were already stored
+// locally to the proxy backend in the background, if the proxy backend
+// does not contain them. The progress is recorded in `stateFile`, so
+// the backfill resumes where it left off after a restart, and is not
+// repeated once it has finished. Uploads are paced to an average of
+// `bytesPerSecond`, or not limited if this is 0. This has no effect
+// without a proxy, or with NewMemory.
+func WithBackfill(stateFile string, bytesPerSecond int64) Option {
+	return func(c *DiskCache) {
+		c.backfillStateFile = stateFile
+		c.backfillBytesPerSecond = bytesPerSecond
+	}
+}
+
+func (c *DiskCache) startBackfill() {
+	if c.proxy == nil || c.backfillStateFile == "" {
+		return
+	}
+
+	go func() {
+		err := c.backfill(context.Background())
+		if err != nil {
+			c.logger.Printf("Backfill to the proxy backend failed: %v", err)
+		}
+	}()
+}
+
+// backfill uploads the items in the index which are missing from the
+// proxy backend, in key order starting after the last checkpoint.
+// Items which fail to upload are logged and skipped, but the
+// checkpoint is not advanced past them, so they are retried after
+// a restart.
+func (c *DiskCache) backfill(ctx context.Context) error {
+	state, err := loadBackfillState(c.backfillStateFile)
+	if err != nil {
+		return err
+	}
+	if state.Done {
+		return nil
+	}
+
+	c.mu.Lock()
+	lruKeys := c.lru.Keys()
+	c.mu.Unlock()
+
+	keys := make([]string, 0, len(lruKeys))
+	for _, k := range lruKeys {
+		key := k.(string)
+		if key > state.LastKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	c.logger.Printf("Backfilling up to %d items to the proxy backend, starting after %q",
+		len(keys), state.LastKey)
+
+	limiter := newRateLimiter(c.backfillBytesPerSecond)
+	var uploaded, failed int
+
+	for i, key := range keys {
+		n, err := c.backfillItem(ctx, key, limiter)
+		if err != nil {
+			c.logger.Printf("Backfill of %s failed: %v", key, err)
+			failed++
+		} else if n >= 0 {
+			uploaded++
+		}
+
+		if failed == 0 {
+			state.LastKey = key
+			if (i+1)%backfillCheckpointInterval == 0 {
+				err = saveBackfillState(c.backfillStateFile, state)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	c.logger.Printf("Backfill processed %d items: %d uploaded, %d failed",
+		len(keys), uploaded, failed)
+
+	if failed > 0 {
+		c.logger.Printf("Backfill will retry from %q after a restart",
+			state.LastKey)
+	} else {
+		state.Done = true
+	}
+
+	return saveBackfillState(c.backfillStateFile, state)
+}
+
+// Upload a single item to the proxy backend if it is missing there.
+// Return the number of bytes uploaded, or -1 if nothing was uploaded.
+func (c *DiskCache) backfillItem(ctx context.Context, key string, limiter *rateLimiter) (int64, error) {
+	kind, hash, ok := parseCacheKey(key)
+	if !ok {
+		return -1, nil // Not a cache item.
+	}
+
+	// The item might have been evicted since the backfill started,
+	// or be in the process of being replaced.
+	c.mu.Lock()
+	val, found := c.lru.Get(key)
+	var item lruItem
+	if found {
+		item = *val.(*lruItem)
+	}
+	c.mu.Unlock()
+	if !item.committed {
+		return -1, nil
+	}
+
+	// Some proxy backends need the size to find CAS blobs.
+	if kind == cache.CAS {
+		ctx = cache.WithDigestSizes(ctx, map[string]int64{hash: item.size})
+	}
+
+	exists, _, err := c.proxy.Contains(ctx, kind, hash)
+	if err != nil {
+		return -1, err
+	}
+	if exists {
+		return -1, nil
+	}
+
+	rc, size, err := c.store.open(key)
+	if os.IsNotExist(err) {
+		return -1, nil // Evicted.
+	}
+	if err != nil {
+		return -1, err
+	}
+	defer rc.Close()
+
+	err = limiter.wait(ctx, size)
+	if err != nil {
+		return -1, err
+	}
+
+	err = c.proxy.Put(ctx, kind, hash, size, rc)
+	if err != nil {
+		return -1, err
+	}
+	c.negative.remove(key)
+
+	backfillUploads.Inc()
+	backfillUploadBytes.Add(float64(size))
+
+	return size, nil
+}
+
+// parseCacheKey is the inverse of cacheKey.
+func parseCacheKey(key string) (cache.EntryKind, string, bool) {
+	hash := filepath.Base(key)
+	if len(hash) != sha256HashStrSize {
+		return cache.AC, "", false
+	}
+
+	prefix := strings.SplitN(key, string(filepath.Separator), 2)[0]
+	for _, kind := range []cache.EntryKind{cache.AC, cache.CAS, cache.RAW} {
+		if prefix == kind.String() && key == cacheKey(kind, hash) {
+			return kind, hash, true
+		}
+	}
+
+	return cache.AC, "", false
+}
+
+func loadBackfillState(path string) (backfillState, error) {
+	var state backfillState
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("Failed to parse the backfill state file %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// Write the state file atomically, so a crash never leaves it corrupt.
+func saveBackfillState(path string, state backfillState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// rateLimiter paces uploads to a number of bytes per second, with
+// bursts of up to one second's worth of bytes after idle periods. A nil
+// *rateLimiter does not limit anything.
+type rateLimiter struct {
+	bytesPerSecond float64
+	credit         float64 // In bytes, negative while paying off a debt.
+	last           time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		credit:         float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// wait blocks until `size` more bytes can be sent without exceeding
+// the rate. An item is sent as soon as there is any credit left, even
+// if it is larger, and the following items wait for the difference.
+func (l *rateLimiter) wait(ctx context.Context, size int64) error {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now()
+	l.credit += now.Sub(l.last).Seconds() * l.bytesPerSecond
+	if l.credit > l.bytesPerSecond {
+		l.credit = l.bytesPerSecond
+	}
+	l.last = now
+
+	if l.credit <= 0 {
+		delay := time.Duration(-l.credit / l.bytesPerSecond * float64(time.Second))
+
+		t := time.NewTimer(delay)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		l.credit = 0
+		l.last = time.Now()
+	}
+
+	l.credit -= float64(size)
+	return nil
+}
@@ -0,0 +1,220 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	cachehttp "github.com/buchgr/bazel-remote/cache/http"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+// sizedProxy requires the sizes of CAS blobs, like grpc_proxy.
+type sizedProxy struct {
+	cache.CacheProxy
+}
+
+func (p sizedProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	if kind == cache.CAS && cache.DigestSize(ctx, hash) < 0 {
+		return false, -1, errors.New("unknown blob size")
+	}
+	return p.CacheProxy.Contains(ctx, kind, hash)
+}
+
+func TestBackfill(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+
+	// Populate the cache before the proxy is configured.
+	testCache, err := New(testutils.NewSilentLogger(), cacheDir, 10*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	blobs := make(map[string][]byte)
+	for i := 0; i < 4; i++ {
+		blob, hash := testutils.RandomDataAndHash(100)
+		err = testCache.Put(ctx, cache.CAS, hash, int64(len(blob)),
+			bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+		blobs[hash] = blob
+	}
+	sort.Strings(hashes)
+
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := sizedProxy{cachehttp.New(url, &http.Client{},
+		testutils.NewSilentLogger(), testutils.NewSilentLogger())}
+
+	// One item is already present in the proxy.
+	backend.cas[hashes[1]] = blobs[hashes[1]]
+
+	// Pretend an earlier backfill was interrupted after the first item.
+	stateFile := filepath.Join(testutils.TempDir(t), "backfill.json")
+	defer os.RemoveAll(filepath.Dir(stateFile))
+	err = saveBackfillState(stateFile, backfillState{
+		LastKey: cacheKey(cache.CAS, hashes[0]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the backfill synchronously instead of with the option.
+	testCache, err = New(testutils.NewSilentLogger(), cacheDir, 10*1024,
+		proxy, WithWriteThrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache.backfillStateFile = stateFile
+	err = testCache.backfill(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := backend.cas[hashes[0]]; found {
+		t.Error("Expected the item before the checkpoint to be skipped")
+	}
+	for _, hash := range hashes[1:] {
+		if !bytes.Equal(backend.cas[hash], blobs[hash]) {
+			t.Errorf("Expected %s to be uploaded", hash)
+		}
+	}
+
+	// 3 Contains requests, and 2 uploads (which also check whether
+	// the item exists first).
+	if backend.numRequests() != 7 {
+		t.Fatalf("Expected 7 proxy requests, got %d", backend.numRequests())
+	}
+
+	state, err := loadBackfillState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Done || state.LastKey != cacheKey(cache.CAS, hashes[3]) {
+		t.Fatalf("Unexpected backfill state: %+v", state)
+	}
+
+	// A finished backfill is not repeated.
+	err = testCache.backfill(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.numRequests() != 7 {
+		t.Fatalf("Expected 7 proxy requests, got %d", backend.numRequests())
+	}
+}
+
+func TestBackfillFailure(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := cachehttp.New(url, &http.Client{}, testutils.NewSilentLogger(),
+		testutils.NewSilentLogger())
+
+	testCache, err := New(testutils.NewSilentLogger(), cacheDir, 10*1024,
+		proxy, WithWriteThrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, hash := testutils.RandomDataAndHash(100)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(blob)),
+		bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateFile := filepath.Join(testutils.TempDir(t), "backfill.json")
+	defer os.RemoveAll(filepath.Dir(stateFile))
+
+	backend.srv.Close()
+	testCache.backfillStateFile = stateFile
+	err = testCache.backfill(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed item is retried by the next backfill.
+	state, err := loadBackfillState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Done || state.LastKey != "" {
+		t.Fatalf("Unexpected backfill state: %+v", state)
+	}
+}
+
+func TestParseCacheKey(t *testing.T) {
+	_, hash := testutils.RandomDataAndHash(10)
+
+	for _, kind := range []cache.EntryKind{cache.AC, cache.CAS, cache.RAW} {
+		k, h, ok := parseCacheKey(cacheKey(kind, hash))
+		if !ok || k != kind || h != hash {
+			t.Errorf("Failed to parse the %s key: %v %s %v", kind, k, h, ok)
+		}
+	}
+
+	for _, key := range []string{"", "backfill.json", "cas/" + hash,
+		filepath.Join("other", hash[:2], hash)} {
+		_, _, ok := parseCacheKey(key)
+		if ok {
+			t.Errorf("Expected %q not to be parsed as a cache key", key)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	var nilLimiter *rateLimiter
+	err := nilLimiter.wait(ctx, 1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := newRateLimiter(1000)
+
+	// Up to a second's worth of bytes is sent immediately, even after
+	// an idle period.
+	l.last = l.last.Add(-time.Hour)
+	start := time.Now()
+	l.wait(ctx, 1000)
+	l.wait(ctx, 100)
+	// The burst is used up, so this has to wait for the previous 100
+	// bytes at 1000 bytes/second.
+	l.wait(ctx, 100)
+
+	elapsed := time.Since(start)
+	if elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("Expected the limiter to wait about 100ms, waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = l.wait(ctx, 100)
+	if err != context.Canceled {
+		t.Fatalf("Expected the wait to be cancelled, got %v", err)
+	}
+}
@@ -1,9 +1,11 @@
 package disk
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -11,8 +13,10 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/uploader"
 	"github.com/djherbis/atime"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -30,6 +34,22 @@ var (
 		Name: "bazel_remote_disk_cache_misses",
 		Help: "The total number of disk backend cache misses",
 	})
+	passthroughPuts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_disk_cache_passthrough_puts",
+		Help: "The total number of uploads streamed directly to the proxy backend",
+	})
+	passthroughPutBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_disk_cache_passthrough_put_bytes",
+		Help: "The total number of bytes streamed directly to the proxy backend",
+	})
+	passthroughGets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_disk_cache_passthrough_gets",
+		Help: "The total number of downloads streamed directly from the proxy backend",
+	})
+	passthroughGetBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_disk_cache_passthrough_get_bytes",
+		Help: "The total number of bytes streamed directly from the proxy backend",
+	})
 )
 
 // lruItem is the type of the values stored in SizedLRU to keep track of items.
@@ -43,16 +63,99 @@ func (i *lruItem) Size() int64 {
 	return i.size
 }
 
+// Cache is the interface used by the HTTP and gRPC servers to access
+// the cache. It is implemented by DiskCache.
+type Cache interface {
+	Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error)
+	Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64)
+	FindMissingCasBlobs(ctx context.Context, hashes []string) []string
+	Put(ctx context.Context, kind cache.EntryKind, hash string, expectedSize int64, r io.Reader) error
+	GetValidatedActionResult(ctx context.Context, hash string) (*pb.ActionResult, []byte, error)
+	MaxSize() int64
+	Stats() (currentSize int64, numItems int)
+}
+
 // DiskCache is filesystem-based cache, with an optional backend proxy.
+// The same LRU index can also be used with an in-memory store, see
+// NewMemory.
 type DiskCache struct {
 	logger cache.Logger
-	dir    string
+	dir    string // Empty if the cache is not backed by a directory.
+	store  blobStore
 	proxy  cache.CacheProxy
 
+	// Used to upload items to the proxy in the background, unless
+	// writeThrough is true.
+	uploader cache.CacheProxy
+
+	// If true, Put only returns once the proxy has accepted the upload.
+	writeThrough bool
+
+	// Items larger than this are not stored locally, but streamed
+	// directly to and from the proxy. Disabled if 0.
+	passthroughThreshold int64
+
+	// Recent proxy misses, or nil if these are not cached.
+	negative *negativeCache
+
+	// If set, local items are uploaded to the proxy in the background
+	// if it does not contain them, see WithBackfill.
+	backfillStateFile      string
+	backfillBytesPerSecond int64
+
 	mu  *sync.Mutex
 	lru SizedLRU
 }
 
+// Option is used to configure optional DiskCache behaviour.
+type Option func(*DiskCache)
+
+// WithWriteThrough makes Put wait for the proxy backend to store each
+// item, and fail if the proxy returns an error. In this case the item
+// is not kept in the local cache either. By default Put returns as soon
+// as the item has been stored locally, and proxy errors are only logged.
+func WithWriteThrough(enabled bool) Option {
+	return func(c *DiskCache) {
+		c.writeThrough = enabled
+	}
+}
+
+// WithPassthroughThreshold makes the cache bypass local storage for
+// items larger than `size` bytes. Such items are uploaded to and
+// streamed from the proxy backend directly, and are counted by the
+// separate pass-through metrics. This has no effect without a proxy.
+func WithPassthroughThreshold(size int64) Option {
+	return func(c *DiskCache) {
+		c.passthroughThreshold = size
+	}
+}
+
+// WithUploader makes the cache queue background uploads to the proxy
+// backend with `u`, instead of the default in-memory queue. This has no
+// effect without a proxy, or in write-through mode.
+func WithUploader(u cache.CacheProxy) Option {
+	return func(c *DiskCache) {
+		c.uploader = u
+	}
+}
+
+// WithNegativeCache makes the cache remember proxy misses for `ttl`,
+// and report the item as missing without asking the proxy backend
+// again in that time. At most `maxEntries` misses are remembered (a
+// default limit is used if this is 0). Items stored with Put are never
+// reported missing due to earlier misses, but items uploaded to the
+// proxy backend by other clients may be reported missing for up to
+// `ttl`. This has no effect without a proxy, or if `ttl` is 0.
+func WithNegativeCache(ttl time.Duration, maxEntries int) Option {
+	return func(c *DiskCache) {
+		if ttl > 0 {
+			c.negative = newNegativeCache(ttl, maxEntries)
+		} else {
+			c.negative = nil
+		}
+	}
+}
+
 type nameAndInfo struct {
 	name string // relative path
 	info os.FileInfo
@@ -63,7 +166,7 @@ const sha256HashStrSize = sha256.Size * 2 // Two hex characters per byte.
 // New returns a new instance of a filesystem-based cache rooted at `dir`,
 // with a maximum size of `maxSizeBytes` bytes and an optional backend `proxy`.
 // DiskCache is safe for concurrent use.
-func New(logger cache.Logger, dir string, maxSizeBytes int64, proxy cache.CacheProxy) (*DiskCache, error) {
+func New(logger cache.Logger, dir string, maxSizeBytes int64, proxy cache.CacheProxy, opts ...Option) (*DiskCache, error) {
 	// Create the directory structure.
 	hexLetters := []byte("0123456789abcdef")
 	for _, c1 := range hexLetters {
@@ -84,16 +187,37 @@ func New(logger cache.Logger, dir string, maxSizeBytes int64, proxy cache.CacheP
 		}
 	}
 
-	// The eviction callback deletes the file from disk.
+	c := newDiskCache(logger, filepath.Clean(dir), &fileStore{dir: dir},
+		maxSizeBytes, proxy, opts)
+
+	err := c.migrateDirectories()
+	if err != nil {
+		return nil, fmt.Errorf("Attempting to migrate the old directory structure to the new structure failed "+
+			"with error: %v", err)
+	}
+	err = c.loadExistingFiles()
+	if err != nil {
+		return nil, fmt.Errorf("Loading of existing cache entries failed due to error: %v", err)
+	}
+
+	c.startBackfill()
+
+	return c, nil
+}
+
+func newDiskCache(logger cache.Logger, dir string, store blobStore,
+	maxSizeBytes int64, proxy cache.CacheProxy, opts []Option) *DiskCache {
+
+	// The eviction callback deletes the blob from the store.
 	// This function is only called while the lock is held
 	// by the current goroutine.
 	onEvict := func(key Key, value SizedItem) {
 
-		f := filepath.Join(dir, key.(string))
+		f := key.(string)
 
 		if value.(*lruItem).committed {
 			// Common case. Just remove the cache file and we're done.
-			err := os.Remove(f)
+			err := store.remove(f)
 			if err != nil {
 				logger.Printf("ERROR: failed to remove evicted cache file: %s", f)
 			}
@@ -116,16 +240,15 @@ func New(logger cache.Logger, dir string, maxSizeBytes int64, proxy cache.CacheP
 		// still uploading when they reach the least-recently used
 		// end of the index).
 
-		tf := f + ".tmp"
 		var fErr, tfErr error
 		removedCount := 0
 
-		tfErr = os.Remove(tf)
+		tfErr = store.removeTemp(f)
 		if tfErr == nil {
 			removedCount++
 		}
 
-		fErr = os.Remove(f)
+		fErr = store.remove(f)
 		if fErr == nil {
 			removedCount++
 		}
@@ -133,8 +256,8 @@ func New(logger cache.Logger, dir string, maxSizeBytes int64, proxy cache.CacheP
 		// We expect to have removed at least one file at this point.
 		if removedCount == 0 {
 			if !os.IsNotExist(tfErr) {
-				logger.Printf("ERROR: failed to remove evicted item: %s / %v",
-					tf, tfErr)
+				logger.Printf("ERROR: failed to remove evicted item: %s.tmp / %v",
+					f, tfErr)
 			}
 
 			if !os.IsNotExist(fErr) {
@@ -146,23 +269,24 @@ func New(logger cache.Logger, dir string, maxSizeBytes int64, proxy cache.CacheP
 
 	c := &DiskCache{
 		logger: logger,
-		dir:    filepath.Clean(dir),
+		dir:    dir,
+		store:  store,
 		proxy:  proxy,
 		mu:     &sync.Mutex{},
 		lru:    NewSizedLRU(maxSizeBytes, onEvict),
 	}
 
-	err := c.migrateDirectories()
-	if err != nil {
-		return nil, fmt.Errorf("Attempting to migrate the old directory structure to the new structure failed "+
-			"with error: %v", err)
+	for _, opt := range opts {
+		opt(c)
 	}
-	err = c.loadExistingFiles()
-	if err != nil {
-		return nil, fmt.Errorf("Loading of existing cache entries failed due to error: %v", err)
+
+	if c.proxy == nil || c.writeThrough {
+		c.uploader = nil
+	} else if c.uploader == nil {
+		c.uploader = uploader.New(c.proxy, logger)
 	}
 
-	return c, nil
+	return c
 }
 
 func (c *DiskCache) migrateDirectories() error {
@@ -248,8 +372,9 @@ func (c *DiskCache) loadExistingFiles() error {
 
 // Put stores a stream of `expectedSize` bytes from `r` into the cache.
 // If `hash` is not the empty string, and the contents don't match it,
-// a non-nil error is returned.
-func (c *DiskCache) Put(kind cache.EntryKind, hash string, expectedSize int64, r io.Reader) error {
+// a non-nil error is returned. `ctx` applies to synchronous uploads to
+// the proxy backend, background uploads are not cancelled with it.
+func (c *DiskCache) Put(ctx context.Context, kind cache.EntryKind, hash string, expectedSize int64, r io.Reader) error {
 
 	// The hash format is checked properly in the http/grpc code.
 	// Just perform a simple/fast check here, to catch bad tests.
@@ -260,6 +385,15 @@ func (c *DiskCache) Put(kind cache.EntryKind, hash string, expectedSize int64, r
 
 	key := cacheKey(kind, hash)
 
+	// Forget earlier proxy misses both before and after the upload,
+	// so lookups which overlap with it aren't remembered as misses.
+	c.negative.remove(key)
+	defer c.negative.remove(key)
+
+	if c.isPassthrough(expectedSize) {
+		return c.putPassthrough(ctx, kind, hash, expectedSize, r)
+	}
+
 	c.mu.Lock()
 
 	// If there's an ongoing upload (i.e. cache key is present in uncommitted state),
@@ -292,7 +426,6 @@ func (c *DiskCache) Put(kind cache.EntryKind, hash string, expectedSize int64, r
 	// (if the upload went well), or delete it. Capturing the flag variable is not very nice,
 	// but this stuff is really easy to get wrong without defer().
 	shouldCommit := false
-	filePath := cacheFilePath(kind, c.dir, hash)
 	defer func() {
 		c.mu.Lock()
 		if shouldCommit {
@@ -302,29 +435,24 @@ func (c *DiskCache) Put(kind cache.EntryKind, hash string, expectedSize int64, r
 		}
 		c.mu.Unlock()
 
-		if shouldCommit && c.proxy != nil {
+		if shouldCommit && c.uploader != nil {
 			// TODO: buffer in memory, avoid a filesystem round-trip?
-			fr, err := os.Open(filePath)
+			fr, _, err := c.store.open(key)
 			if err == nil {
-				c.proxy.Put(kind, hash, expectedSize, fr)
+				err = c.uploader.Put(context.Background(), kind, hash, expectedSize, fr)
+			}
+			if err != nil {
+				c.logger.Printf("Failed to proxy %s: %v", key, err)
 			}
 		}
 	}()
 
 	// Download to a temporary file
-	tmpFilePath := filePath + ".tmp"
-	f, err := os.Create(tmpFilePath)
+	f, err := c.store.create(key)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if !shouldCommit {
-			// Only delete the temp file if moving it didn't succeed.
-			os.Remove(tmpFilePath)
-		}
-		// Just in case we didn't already close it.  No need to check errors.
-		f.Close()
-	}()
+	defer f.abort()
 
 	var bytesCopied int64 = 0
 	if kind == cache.CAS {
@@ -343,28 +471,139 @@ func (c *DiskCache) Put(kind cache.EntryKind, hash string, expectedSize int64, r
 		}
 	}
 
-	if err = f.Sync(); err != nil {
+	if bytesCopied != expectedSize {
+		return fmt.Errorf(
+			"sizes don't match. Expected %d, found %d", expectedSize, bytesCopied)
+	}
+
+	// Rename to the final path
+	err = f.commit()
+	if err != nil {
 		return err
 	}
 
-	if err = f.Close(); err != nil {
+	if c.proxy != nil && c.writeThrough {
+		err = c.putProxy(ctx, kind, hash, key, expectedSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only commit if renaming (and uploading, in write-through
+	// mode) succeeded. This flag is used by the defer() block above.
+	shouldCommit = true
+
+	return nil
+}
+
+// Synchronously upload a blob which has been stored locally but not
+// committed in the index yet to the proxy backend. Return a cache.Error
+// with code http.StatusServiceUnavailable if the proxy failed.
+func (c *DiskCache) putProxy(ctx context.Context, kind cache.EntryKind, hash string, key string, size int64) error {
+	fr, _, err := c.store.open(key)
+	if err != nil {
 		return err
 	}
+	defer fr.Close()
 
-	if bytesCopied != expectedSize {
-		return fmt.Errorf(
-			"sizes don't match. Expected %d, found %d", expectedSize, bytesCopied)
+	err = c.proxy.Put(ctx, kind, hash, size, fr)
+	if err != nil {
+		return proxyPutError(key, err)
 	}
 
-	// Rename to the final path
-	err = os.Rename(tmpFilePath, filePath)
-	if err == nil {
-		// Only commit if renaming succeeded.
-		// This flag is used by the defer() block above.
-		shouldCommit = true
+	return nil
+}
+
+func proxyPutError(key string, err error) error {
+	return &cache.Error{
+		Code: http.StatusServiceUnavailable,
+		Text: fmt.Sprintf("Failed to upload %s to the proxy backend: %v",
+			key, err),
 	}
+}
 
-	return err
+// Return true if items of the given size should bypass the local cache.
+func (c *DiskCache) isPassthrough(size int64) bool {
+	return c.proxy != nil && c.passthroughThreshold > 0 &&
+		size > c.passthroughThreshold
+}
+
+// Stream an item directly to the proxy backend, without storing it
+// locally. CAS items are verified while streaming, and the upload is
+// aborted if the contents don't match `hash`.
+func (c *DiskCache) putPassthrough(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) error {
+	vr := &verifyingReader{
+		r:    r,
+		size: size,
+	}
+	if kind == cache.CAS {
+		vr.hasher = sha256.New()
+		vr.hash = hash
+	}
+
+	err := c.proxy.Put(ctx, kind, hash, size, vr)
+	if vr.err != nil {
+		// The client sent bad data, this was most likely
+		// also the cause of the proxy error.
+		return vr.err
+	}
+	if err != nil {
+		return proxyPutError(cacheKey(kind, hash), err)
+	}
+
+	passthroughPuts.Inc()
+	passthroughPutBytes.Add(float64(size))
+
+	return nil
+}
+
+// verifyingReader passes through reads from r, and returns an error
+// once `size` bytes have been read, if the data read so far doesn't
+// match `hash` (if non-empty), or if r has more or less than `size`
+// bytes.
+type verifyingReader struct {
+	r      io.Reader
+	hasher hash.Hash
+	hash   string
+	size   int64
+
+	read int64
+	err  error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.r.Read(p)
+	if v.hasher != nil {
+		v.hasher.Write(p[:n])
+	}
+	v.read += int64(n)
+
+	// On failure, hold back the last chunk of data, so the receiver
+	// sees an incomplete upload even if it ignores the error.
+
+	if v.read > v.size || (err == io.EOF && v.read != v.size) {
+		v.err = fmt.Errorf("sizes don't match. Expected %d, found %d",
+			v.size, v.read)
+		return 0, v.err
+	}
+
+	// Some clients stop reading as soon as they have the expected
+	// number of bytes, so check the hash here instead of at EOF.
+	if v.read == v.size && v.hasher != nil {
+		actualHash := hex.EncodeToString(v.hasher.Sum(nil))
+		v.hasher = nil
+		if actualHash != v.hash {
+			v.err = fmt.Errorf("hashsums don't match. Expected %s, found %s",
+				v.hash, actualHash)
+			return 0, v.err
+		}
+	}
+
+	return n, err
 }
 
 // Return two bools, `available` is true if the item is in the local
@@ -404,8 +643,10 @@ func (c *DiskCache) availableOrTryProxy(key string) (available bool, tryProxy bo
 // Get returns an io.ReadCloser with the content of the cache item stored under `hash`
 // and the number of bytes that can be read from it. If the item is not found, the
 // io.ReadCloser will be nil. If some error occurred when processing the request, then
-// it is returned.
-func (c *DiskCache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+// it is returned. `ctx` applies to requests to the proxy backend.
+// Items which are stored locally are returned as an io.ReadSeeker, so
+// callers can skip parts of them without reading the data.
+func (c *DiskCache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
 
 	// The hash format is checked properly in the http/grpc code.
 	// Just perform a simple/fast check here, to catch bad tests.
@@ -420,16 +661,12 @@ func (c *DiskCache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64
 	available, tryProxy := c.availableOrTryProxy(key)
 
 	if available {
-		blobPath := cacheFilePath(kind, c.dir, hash)
-		var fileInfo os.FileInfo
-		fileInfo, err = os.Stat(blobPath)
+		var f io.ReadCloser
+		var size int64
+		f, size, err = c.store.open(key)
 		if err == nil {
-			var f *os.File
-			f, err = os.Open(blobPath)
-			if err == nil {
-				cacheHits.Inc()
-				return f, fileInfo.Size(), nil
-			}
+			cacheHits.Inc()
+			return f, size, nil
 		}
 
 		cacheMisses.Inc()
@@ -442,12 +679,9 @@ func (c *DiskCache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64
 		return nil, -1, nil
 	}
 
-	filePath := cacheFilePath(kind, c.dir, hash)
-	tmpFilePath := filePath + ".tmp"
 	shouldCommit := false
-	tmpFileCreated := false
 	foundSize := int64(-1)
-	var f *os.File
+	var f blobWriter
 
 	// We're allowed to try downloading this blob from the proxy.
 	// Before returning, we have to either commit the item and set
@@ -470,53 +704,68 @@ func (c *DiskCache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64
 
 		c.mu.Unlock()
 
-		if !shouldCommit && tmpFileCreated {
-			os.Remove(tmpFilePath) // No need to check the error.
+		if f != nil {
+			f.abort()
 		}
-
-		f.Close() // No need to check the error.
 	}()
 
-	r, foundSize, err := c.proxy.Get(kind, hash)
-	if r != nil {
-		defer r.Close()
+	if c.negative.contains(key) {
+		// The proxy didn't have this item recently.
+		return nil, -1, nil
+	}
+
+	lookup := c.negative.begin()
+	r, foundSize, err := c.proxy.Get(ctx, kind, hash)
+	if err == cache.ErrBypassed {
+		// The proxy might have the item, so don't remember the miss.
+		return nil, -1, nil
+	}
+	if err == nil && r == nil {
+		c.negative.add(lookup, key)
 	}
 	if err != nil || r == nil {
+		if r != nil {
+			r.Close()
+		}
 		return nil, -1, err
 	}
 
-	f, err = os.Create(tmpFilePath)
-	if err != nil {
-		return nil, -1, err
+	if c.isPassthrough(foundSize) {
+		// Stream the item to the caller without storing it. The
+		// placeholder is removed by the defer() block above.
+		passthroughGets.Inc()
+		passthroughGetBytes.Add(float64(foundSize))
+		return r, foundSize, nil
 	}
-	tmpFileCreated = true
+	defer r.Close()
 
-	written, err := io.Copy(f, r)
+	f, err = c.store.create(key)
 	if err != nil {
 		return nil, -1, err
 	}
 
-	if written != foundSize {
-		return nil, -1, err
+	written, err := io.Copy(f, r)
+	if _, ok := err.(*cache.InvalidItemError); ok {
+		// The proxy's copy is corrupt, report a cache miss.
+		return nil, -1, nil
 	}
-
-	if err = f.Sync(); err != nil {
+	if err != nil {
 		return nil, -1, err
 	}
 
-	if err = f.Close(); err != nil {
+	if written != foundSize {
 		return nil, -1, err
 	}
 
 	// Rename to the final path
-	err = os.Rename(tmpFilePath, filePath)
+	err = f.commit()
 	if err == nil {
 		// Only commit if renaming succeeded.
 		// This flag is used by the defer() block above.
 		shouldCommit = true
 
-		var f2 *os.File
-		f2, err = os.Open(filePath)
+		var f2 io.ReadCloser
+		f2, _, err = c.store.open(key)
 		if err == nil {
 			return f2, foundSize, nil
 		}
@@ -529,8 +778,9 @@ func (c *DiskCache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64
 // the size if known (or -1 if unknown).
 //
 // If there is a local cache miss, the proxy backend (if there is
-// one) will be checked.
-func (c *DiskCache) Contains(kind cache.EntryKind, hash string) (bool, int64) {
+// one) will be checked. Proxy errors are logged, and reported as
+// cache misses.
+func (c *DiskCache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64) {
 
 	// The hash format is checked properly in the http/grpc code.
 	// Just perform a simple/fast check here, to catch bad tests.
@@ -555,13 +805,94 @@ func (c *DiskCache) Contains(kind cache.EntryKind, hash string) (bool, int64) {
 		return true, size
 	}
 
-	if c.proxy != nil {
-		return c.proxy.Contains(kind, hash)
+	key := cacheKey(kind, hash)
+	if c.proxy != nil && !c.negative.contains(key) {
+		lookup := c.negative.begin()
+		found, size, err := c.proxy.Contains(ctx, kind, hash)
+		if err == cache.ErrBypassed {
+			return false, int64(-1)
+		}
+		if err != nil {
+			c.logger.Printf("Failed to check the proxy for %s: %v",
+				key, err)
+			return false, int64(-1)
+		}
+		if !found {
+			c.negative.add(lookup, key)
+		}
+		return found, size
 	}
 
 	return false, int64(-1)
 }
 
+// FindMissingCasBlobs returns the subset of `hashes` which are not
+// available in the CAS. Blobs which are not in the local cache are
+// checked with a single batch request to the proxy backend, if there is
+// one. Proxy errors are logged, and the affected blobs are reported as
+// missing.
+func (c *DiskCache) FindMissingCasBlobs(ctx context.Context, hashes []string) []string {
+	var missing []string
+
+	c.mu.Lock()
+	for _, hash := range hashes {
+		val, found := c.lru.Get(cacheKey(cache.CAS, hash))
+		// Uncommitted (i.e. uploading items) should be reported as missing.
+		if !found || !val.(*lruItem).committed {
+			missing = append(missing, hash)
+		}
+	}
+	c.mu.Unlock()
+
+	if c.proxy == nil || len(missing) == 0 {
+		return missing
+	}
+
+	// Only ask the proxy about blobs which weren't recently missing.
+	var unknown []string
+	for _, hash := range missing {
+		if !c.negative.contains(cacheKey(cache.CAS, hash)) {
+			unknown = append(unknown, hash)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return missing
+	}
+
+	lookup := c.negative.begin()
+	found, err := c.proxy.ContainsMany(ctx, cache.CAS, unknown)
+	if err != nil && err != cache.ErrBypassed {
+		c.logger.Printf("Failed to check the proxy for %d blobs: %v",
+			len(unknown), err)
+	}
+
+	inProxy := make(map[string]bool, len(unknown))
+	var newlyMissing []string
+	for i, hash := range unknown {
+		if found[i] {
+			inProxy[hash] = true
+		} else {
+			newlyMissing = append(newlyMissing, cacheKey(cache.CAS, hash))
+		}
+	}
+
+	// Proxy errors and bypassed lookups are reported as misses, but not
+	// remembered.
+	if err == nil {
+		c.negative.add(lookup, newlyMissing...)
+	}
+
+	stillMissing := missing[:0]
+	for _, hash := range missing {
+		if !inProxy[hash] {
+			stillMissing = append(stillMissing, hash)
+		}
+	}
+
+	return stillMissing
+}
+
 // MaxSize returns the maximum cache size in bytes.
 func (c *DiskCache) MaxSize() int64 {
 	// The underlying value is never modified, no need to lock.
@@ -581,25 +912,40 @@ func cacheKey(kind cache.EntryKind, hash string) string {
 	return filepath.Join(kind.String(), hash[:2], hash)
 }
 
-func cacheFilePath(kind cache.EntryKind, cacheDir string, hash string) string {
-	return filepath.Join(cacheDir, cacheKey(kind, hash))
-}
-
 // If `hash` refers to a valid ActionResult with all the dependencies
 // available in the CAS, return it and its serialized value.
 // If not, return nil values.
 // If something unexpected went wrong, return an error.
-func (c *DiskCache) GetValidatedActionResult(hash string) (*pb.ActionResult, []byte, error) {
-	rdr, sizeBytes, err := c.Get(cache.AC, hash)
+func (c *DiskCache) GetValidatedActionResult(ctx context.Context, hash string) (*pb.ActionResult, []byte, error) {
+	return LoadValidatedActionResult(ctx, c, hash)
+}
+
+// BlobSource is the subset of the Cache interface which is used by
+// LoadValidatedActionResult.
+type BlobSource interface {
+	Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error)
+	Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64)
+}
+
+// LoadValidatedActionResult implements Cache.GetValidatedActionResult
+// on top of the Get and Contains methods of `c`.
+func LoadValidatedActionResult(ctx context.Context, c BlobSource, hash string) (*pb.ActionResult, []byte, error) {
+	rdr, sizeBytes, err := c.Get(ctx, cache.AC, hash)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if rdr == nil || sizeBytes <= 0 {
+	if rdr == nil {
+		return nil, nil, nil // aka "not found"
+	}
+
+	if sizeBytes <= 0 {
+		rdr.Close()
 		return nil, nil, nil // aka "not found"
 	}
 
 	acdata, err := ioutil.ReadAll(rdr)
+	rdr.Close()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -612,7 +958,7 @@ func (c *DiskCache) GetValidatedActionResult(hash string) (*pb.ActionResult, []b
 
 	for _, f := range result.OutputFiles {
 		if len(f.Contents) == 0 && f.Digest.SizeBytes > 0 {
-			found, _ := c.Contains(cache.CAS, f.Digest.Hash)
+			found, _ := c.Contains(cache.WithDigestSize(ctx, f.Digest), cache.CAS, f.Digest.Hash)
 			if !found {
 				return nil, nil, nil // aka "not found"
 			}
@@ -620,7 +966,7 @@ func (c *DiskCache) GetValidatedActionResult(hash string) (*pb.ActionResult, []b
 	}
 
 	for _, d := range result.OutputDirectories {
-		r, size, err := c.Get(cache.CAS, d.TreeDigest.Hash)
+		r, size, err := c.Get(cache.WithDigestSize(ctx, d.TreeDigest), cache.CAS, d.TreeDigest.Hash)
 		if r == nil {
 			return nil, nil, err // aka "not found", or an err if non-nil
 		}
@@ -651,7 +997,7 @@ func (c *DiskCache) GetValidatedActionResult(hash string) (*pb.ActionResult, []b
 			if f.Digest == nil {
 				continue
 			}
-			found, _ := c.Contains(cache.CAS, f.Digest.Hash)
+			found, _ := c.Contains(cache.WithDigestSize(ctx, f.Digest), cache.CAS, f.Digest.Hash)
 			if !found {
 				return nil, nil, nil // aka "not found"
 			}
@@ -662,7 +1008,7 @@ func (c *DiskCache) GetValidatedActionResult(hash string) (*pb.ActionResult, []b
 				if f.Digest == nil {
 					continue
 				}
-				found, _ := c.Contains(cache.CAS, f.Digest.Hash)
+				found, _ := c.Contains(cache.WithDigestSize(ctx, f.Digest), cache.CAS, f.Digest.Hash)
 				if !found {
 					return nil, nil, nil // aka "not found"
 				}
@@ -671,14 +1017,14 @@ func (c *DiskCache) GetValidatedActionResult(hash string) (*pb.ActionResult, []b
 	}
 
 	if result.StdoutDigest != nil && result.StdoutDigest.SizeBytes > 0 {
-		found, _ := c.Contains(cache.CAS, result.StdoutDigest.Hash)
+		found, _ := c.Contains(cache.WithDigestSize(ctx, result.StdoutDigest), cache.CAS, result.StdoutDigest.Hash)
 		if !found {
 			return nil, nil, nil // aka "not found"
 		}
 	}
 
 	if result.StderrDigest != nil && result.StderrDigest.SizeBytes > 0 {
-		found, _ := c.Contains(cache.CAS, result.StderrDigest.Hash)
+		found, _ := c.Contains(cache.WithDigestSize(ctx, result.StderrDigest), cache.CAS, result.StderrDigest.Hash)
 		if !found {
 			return nil, nil, nil // aka "not found"
 		}
@@ -2,8 +2,10 @@ package disk
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,6 +22,9 @@ import (
 
 	"github.com/buchgr/bazel-remote/cache"
 	cachehttp "github.com/buchgr/bazel-remote/cache/http"
+	"github.com/buchgr/bazel-remote/cache/resilience"
+	"github.com/buchgr/bazel-remote/cache/verify"
+	"github.com/buchgr/bazel-remote/config"
 	testutils "github.com/buchgr/bazel-remote/utils"
 )
 
@@ -31,6 +36,14 @@ func tempDir(t *testing.T) string {
 	return dir
 }
 
+func newTestCache(t *testing.T, dir string, maxSize int64, proxy cache.CacheProxy) *DiskCache {
+	c, err := New(testutils.NewSilentLogger(), dir, maxSize, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
 func checkItems(cache *DiskCache, expSize int64, expNum int) error {
 	if cache.lru.Len() != expNum {
 		return fmt.Errorf("expected %d files in the cache, found %d", expNum, cache.lru.Len())
@@ -74,7 +87,7 @@ const CONTENTS_HASH = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e730433629
 func TestCacheBasics(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
-	testCache := New(cacheDir, 100, nil)
+	testCache := newTestCache(t, cacheDir, 100, nil)
 
 	err := checkItems(testCache, 0, 0)
 	if err != nil {
@@ -82,7 +95,7 @@ func TestCacheBasics(t *testing.T) {
 	}
 
 	// Non-existing item
-	rdr, sizeBytes, err := testCache.Get(cache.CAS, CONTENTS_HASH)
+	rdr, sizeBytes, err := testCache.Get(context.Background(), cache.CAS, CONTENTS_HASH)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,7 +104,7 @@ func TestCacheBasics(t *testing.T) {
 	}
 
 	// Add an item
-	err = testCache.Put(cache.CAS, CONTENTS_HASH, int64(len(CONTENTS)), strings.NewReader(CONTENTS))
+	err = testCache.Put(context.Background(), cache.CAS, CONTENTS_HASH, int64(len(CONTENTS)), strings.NewReader(CONTENTS))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,7 +117,7 @@ func TestCacheBasics(t *testing.T) {
 	}
 
 	// Get the item back
-	rdr, sizeBytes, err = testCache.Get(cache.CAS, CONTENTS_HASH)
+	rdr, sizeBytes, err = testCache.Get(context.Background(), cache.CAS, CONTENTS_HASH)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -118,7 +131,7 @@ func TestCacheBasics(t *testing.T) {
 func TestCacheEviction(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
-	testCache := New(cacheDir, 10, nil)
+	testCache := newTestCache(t, cacheDir, 10, nil)
 
 	expectedSizesNumItems := []struct {
 		expSize int64
@@ -144,7 +157,7 @@ func TestCacheEviction(t *testing.T) {
 				sha256.Size*2, len(key), key)
 		}
 
-		err := testCache.Put(cache.AC, key, int64(i), strReader)
+		err := testCache.Put(context.Background(), cache.AC, key, int64(i), strReader)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -159,9 +172,9 @@ func TestCacheEviction(t *testing.T) {
 func TestCachePutWrongSize(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
-	testCache := New(cacheDir, 100, nil)
+	testCache := newTestCache(t, cacheDir, 100, nil)
 
-	err := testCache.Put(cache.AC, "aa-aa", int64(10), strings.NewReader("hello"))
+	err := testCache.Put(context.Background(), cache.AC, "aa-aa", int64(10), strings.NewReader("hello"))
 	if err == nil {
 		t.Fatal("Expected error due to size being different")
 	}
@@ -195,12 +208,12 @@ func putGetCompareBytes(kind cache.EntryKind, hash string, data []byte, testCach
 
 	r := bytes.NewReader(data)
 
-	err := testCache.Put(kind, hash, int64(len(data)), r)
+	err := testCache.Put(context.Background(), kind, hash, int64(len(data)), r)
 	if err != nil {
 		return err
 	}
 
-	rdr, sizeBytes, err := testCache.Get(kind, hash)
+	rdr, sizeBytes, err := testCache.Get(context.Background(), kind, hash)
 	if err != nil {
 		return err
 	}
@@ -217,7 +230,7 @@ func hashStr(content string) string {
 func TestOverwrite(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
-	testCache := New(cacheDir, 10, nil)
+	testCache := newTestCache(t, cacheDir, 10, nil)
 
 	var err error
 	err = putGetCompare(cache.CAS, hashStr("hello"), "hello", testCache)
@@ -274,7 +287,7 @@ func TestCacheExistingFiles(t *testing.T) {
 	}
 
 	const expectedSize = 4 * int64(len(CONTENTS))
-	testCache := New(cacheDir, expectedSize, nil)
+	testCache := newTestCache(t, cacheDir, expectedSize, nil)
 
 	err := checkItems(testCache, expectedSize, 4)
 	if err != nil {
@@ -282,7 +295,7 @@ func TestCacheExistingFiles(t *testing.T) {
 	}
 
 	// Adding a new file should evict items[0] (the oldest)
-	err = testCache.Put(cache.CAS, CONTENTS_HASH, int64(len(CONTENTS)), strings.NewReader(CONTENTS))
+	err = testCache.Put(context.Background(), cache.CAS, CONTENTS_HASH, int64(len(CONTENTS)), strings.NewReader(CONTENTS))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -291,7 +304,7 @@ func TestCacheExistingFiles(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	found, _ := testCache.Contains(cache.CAS, "f53b46209596d170f7659a414c9ff9f6b545cf77ffd6e1cbe9bcc57e1afacfbd")
+	found, _ := testCache.Contains(context.Background(), cache.CAS, "f53b46209596d170f7659a414c9ff9f6b545cf77ffd6e1cbe9bcc57e1afacfbd")
 	if found {
 		t.Fatalf("%s should have been evicted", items[0])
 	}
@@ -302,11 +315,11 @@ func TestCacheExistingFiles(t *testing.T) {
 func TestCacheBlobTooLarge(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
-	testCache := New(cacheDir, 100, nil)
+	testCache := newTestCache(t, cacheDir, 100, nil)
 
 	for k := range []cache.EntryKind{cache.AC, cache.RAW} {
 		kind := cache.EntryKind(k)
-		err := testCache.Put(kind, hashStr("foo"), 10000, strings.NewReader(CONTENTS))
+		err := testCache.Put(context.Background(), kind, hashStr("foo"), 10000, strings.NewReader(CONTENTS))
 		if err == nil {
 			t.Fatal("Expected an error")
 		}
@@ -325,16 +338,16 @@ func TestCacheBlobTooLarge(t *testing.T) {
 func TestCacheCorruptedCASBlob(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
-	testCache := New(cacheDir, 1000, nil)
+	testCache := newTestCache(t, cacheDir, 1000, nil)
 
-	err := testCache.Put(cache.CAS, hashStr("foo"), int64(len(CONTENTS)),
+	err := testCache.Put(context.Background(), cache.CAS, hashStr("foo"), int64(len(CONTENTS)),
 		strings.NewReader(CONTENTS))
 	if err == nil {
 		t.Fatal("expected hash mismatch error")
 	}
 
 	// We expect the upload to succeed without validation:
-	err = testCache.Put(cache.RAW, hashStr("foo"), int64(len(CONTENTS)),
+	err = testCache.Put(context.Background(), cache.RAW, hashStr("foo"), int64(len(CONTENTS)),
 		strings.NewReader(CONTENTS))
 	if err != nil {
 		t.Fatal(err)
@@ -357,24 +370,24 @@ func TestMigrateFromOldDirectoryStructure(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	testCache := New(cacheDir, 2560, nil)
+	testCache := newTestCache(t, cacheDir, 2560, nil)
 	_, numItems := testCache.Stats()
 	if numItems != 3 {
 		t.Fatalf("Expected test cache size 3 but was %d", numItems)
 	}
 
 	var found bool
-	found, _ = testCache.Contains(cache.AC, acHash)
+	found, _ = testCache.Contains(context.Background(), cache.AC, acHash)
 	if !found {
 		t.Fatalf("Expected cache to contain AC entry '%s'", acHash)
 	}
 
-	found, _ = testCache.Contains(cache.CAS, casHash1)
+	found, _ = testCache.Contains(context.Background(), cache.CAS, casHash1)
 	if !found {
 		t.Fatalf("Expected cache to contain CAS entry '%s'", casHash1)
 	}
 
-	found, _ = testCache.Contains(cache.CAS, casHash2)
+	found, _ = testCache.Contains(context.Background(), cache.CAS, casHash2)
 	if !found {
 		t.Fatalf("Expected cache to contain CAS entry '%s'", casHash2)
 	}
@@ -401,7 +414,7 @@ func TestLoadExistingEntries(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	testCache := New(cacheDir, blobSize*numBlobs, nil)
+	testCache := newTestCache(t, cacheDir, blobSize*numBlobs, nil)
 	_, numItems := testCache.Stats()
 	if int64(numItems) != numBlobs {
 		t.Fatalf("Expected test cache size %d but was %d",
@@ -410,17 +423,17 @@ func TestLoadExistingEntries(t *testing.T) {
 
 	var found bool
 
-	found, _ = testCache.Contains(cache.AC, acHash)
+	found, _ = testCache.Contains(context.Background(), cache.AC, acHash)
 	if !found {
 		t.Fatalf("Expected cache to contain AC entry '%s'", acHash)
 	}
 
-	found, _ = testCache.Contains(cache.CAS, casHash)
+	found, _ = testCache.Contains(context.Background(), cache.CAS, casHash)
 	if !found {
 		t.Fatalf("Expected cache to contain CAS entry '%s'", casHash)
 	}
 
-	found, _ = testCache.Contains(cache.RAW, rawHash)
+	found, _ = testCache.Contains(context.Background(), cache.RAW, rawHash)
 	if !found {
 		t.Fatalf("Expected cache to contain RAW entry '%s'", rawHash)
 	}
@@ -433,7 +446,7 @@ func TestDistinctKeyspaces(t *testing.T) {
 	blobSize := 1024
 	cacheSize := int64(blobSize * 3)
 
-	testCache := New(cacheDir, cacheSize, nil)
+	testCache := newTestCache(t, cacheDir, cacheSize, nil)
 
 	blob, casHash := testutils.RandomDataAndHash(1024)
 
@@ -469,9 +482,10 @@ func TestDistinctKeyspaces(t *testing.T) {
 type testServer struct {
 	srv *httptest.Server
 
-	mu  sync.Mutex
-	ac  map[string][]byte
-	cas map[string][]byte
+	mu       sync.Mutex
+	ac       map[string][]byte
+	cas      map[string][]byte
+	requests int
 }
 
 func (s *testServer) handler(w http.ResponseWriter, r *http.Request) {
@@ -489,6 +503,8 @@ func (s *testServer) handler(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.requests++
+
 	switch method := r.Method; method {
 	case http.MethodGet:
 		data, ok := kindMap[hash]
@@ -502,6 +518,7 @@ func (s *testServer) handler(w http.ResponseWriter, r *http.Request) {
 		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, "failed to read body", http.StatusInternalServerError)
+			return
 		}
 		kindMap[hash] = data
 
@@ -520,6 +537,12 @@ func (s *testServer) numItems() int {
 	return len(s.ac) + len(s.cas)
 }
 
+func (s *testServer) numRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
 func newTestServer(t *testing.T) *testServer {
 	ts := testServer{
 		ac:  make(map[string][]byte),
@@ -548,13 +571,13 @@ func TestHttpProxyBackend(t *testing.T) {
 
 	cacheSize := int64(1024 * 10)
 
-	testCache := New(cacheDir, cacheSize, proxy)
+	testCache := newTestCache(t, cacheDir, cacheSize, proxy)
 
 	blobSize := int64(1024)
 	blob, casHash := testutils.RandomDataAndHash(blobSize)
 
 	// Non-existing item
-	r, _, err := testCache.Get(cache.CAS, casHash)
+	r, _, err := testCache.Get(context.Background(), cache.CAS, casHash)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -566,7 +589,7 @@ func TestHttpProxyBackend(t *testing.T) {
 		t.Fatal("Expected empty backend")
 	}
 
-	err = testCache.Put(cache.CAS, casHash, int64(len(blob)),
+	err = testCache.Put(context.Background(), cache.CAS, casHash, int64(len(blob)),
 		bytes.NewReader(blob))
 	if err != nil {
 		t.Fatal(err)
@@ -583,17 +606,17 @@ func TestHttpProxyBackend(t *testing.T) {
 	// Create a new (empty) testCache, without a proxy backend.
 	cacheDir = testutils.TempDir(t)
 	defer os.RemoveAll(cacheDir)
-	testCache = New(cacheDir, cacheSize, nil)
+	testCache = newTestCache(t, cacheDir, cacheSize, nil)
 
 	// Confirm that it does not contain the item we added to the
 	// first testCache and the proxy backend.
 
-	found, _ := testCache.Contains(cache.CAS, casHash)
+	found, _ := testCache.Contains(context.Background(), cache.CAS, casHash)
 	if found {
 		t.Fatalf("Expected the cache not to contain %s", casHash)
 	}
 
-	r, _, err = testCache.Get(cache.CAS, casHash)
+	r, _, err = testCache.Get(context.Background(), cache.CAS, casHash)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -604,13 +627,13 @@ func TestHttpProxyBackend(t *testing.T) {
 	// Add the proxy backend and check that we can Get the item.
 	testCache.proxy = proxy
 
-	found, _ = testCache.Contains(cache.CAS, casHash)
+	found, _ = testCache.Contains(context.Background(), cache.CAS, casHash)
 	if !found {
 		t.Fatalf("Expected the cache to contain %s (via the proxy)",
 			casHash)
 	}
 
-	r, fetchedSize, err := testCache.Get(cache.CAS, casHash)
+	r, fetchedSize, err := testCache.Get(context.Background(), cache.CAS, casHash)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -636,6 +659,375 @@ func TestHttpProxyBackend(t *testing.T) {
 	}
 }
 
+type failingProxy struct{}
+
+func (p failingProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	return errors.New("backend unavailable")
+}
+
+func (p failingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	return nil, -1, nil
+}
+
+func (p failingProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	return false, -1, nil
+}
+
+func (p failingProxy) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return make([]bool, len(hashes)), nil
+}
+
+func TestWriteThrough(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	blob, casHash := testutils.RandomDataAndHash(1024)
+
+	// A failing proxy should fail the Put, and not leave the item
+	// in the local cache.
+	testCache, err := New(testutils.NewSilentLogger(), cacheDir, 10*1024,
+		failingProxy{}, WithWriteThrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testCache.Put(context.Background(), cache.CAS, casHash, int64(len(blob)), bytes.NewReader(blob))
+	if cerr, ok := err.(*cache.Error); !ok || cerr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a %d error, got: %v", http.StatusServiceUnavailable, err)
+	}
+
+	err = checkItems(testCache, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without write-through, proxy errors are ignored.
+	testCache = newTestCache(t, cacheDir, 10*1024, failingProxy{})
+	err = testCache.Put(context.Background(), cache.CAS, casHash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkItems(testCache, int64(len(blob)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A working proxy should have the item as soon as Put returns.
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := cachehttp.New(url, &http.Client{}, testutils.NewSilentLogger(),
+		testutils.NewSilentLogger())
+
+	cacheDir = testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCache, err = New(testutils.NewSilentLogger(), cacheDir, 10*1024,
+		proxy, WithWriteThrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testCache.Put(context.Background(), cache.CAS, casHash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if backend.numItems() != 1 {
+		t.Fatal("Expected the item to be uploaded before Put returned")
+	}
+	err = checkItems(testCache, int64(len(blob)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := cachehttp.New(url, &http.Client{}, testutils.NewSilentLogger(),
+		testutils.NewSilentLogger())
+
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	// The large blob would not fit in the local cache.
+	smallBlob, smallHash := testutils.RandomDataAndHash(256)
+	largeBlob, largeHash := testutils.RandomDataAndHash(2048)
+
+	testCache, err := New(testutils.NewSilentLogger(), cacheDir, 1024,
+		proxy, WithPassthroughThreshold(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted blob should not reach the backend.
+	err = testCache.Put(context.Background(), cache.CAS, hashStr("foo"), int64(len(largeBlob)),
+		bytes.NewReader(largeBlob))
+	if err == nil {
+		t.Fatal("Expected hash mismatch error")
+	}
+	if backend.numItems() != 0 {
+		t.Fatal("Expected the corrupted blob not to be proxied")
+	}
+
+	err = testCache.Put(context.Background(), cache.CAS, largeHash, int64(len(largeBlob)),
+		bytes.NewReader(largeBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upload is synchronous, and bypasses the local cache.
+	if backend.numItems() != 1 {
+		t.Fatal("Expected the large blob to be uploaded before Put returned")
+	}
+	err = checkItems(testCache, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testCache.Put(context.Background(), cache.CAS, smallHash, int64(len(smallBlob)),
+		bytes.NewReader(smallBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkItems(testCache, int64(len(smallBlob)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Downloads of the large blob are streamed from the backend,
+	// without being stored locally.
+	for i := 0; i < 2; i++ {
+		r, size, err := testCache.Get(context.Background(), cache.CAS, largeHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = expectContentEquals(r, size, largeBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+
+		err = checkItems(testCache, int64(len(smallBlob)), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindMissingCasBlobs(t *testing.T) {
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := cachehttp.New(url, &http.Client{}, testutils.NewSilentLogger(),
+		testutils.NewSilentLogger())
+
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCache, err := New(testutils.NewSilentLogger(), cacheDir, 10*1024,
+		proxy, WithWriteThrough(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localBlob, localHash := testutils.RandomDataAndHash(100)
+	err = testCache.Put(context.Background(), cache.CAS, localHash,
+		int64(len(localBlob)), bytes.NewReader(localBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyBlob, proxyHash := testutils.RandomDataAndHash(100)
+	backend.mu.Lock()
+	backend.cas[proxyHash] = proxyBlob
+	backend.mu.Unlock()
+
+	_, missingHash := testutils.RandomDataAndHash(100)
+
+	missing := testCache.FindMissingCasBlobs(context.Background(),
+		[]string{localHash, proxyHash, missingHash})
+	if len(missing) != 1 || missing[0] != missingHash {
+		t.Fatalf("Expected only %s to be missing, got %v", missingHash, missing)
+	}
+
+	// Without a proxy, only the local blob should be found.
+	testCache = newTestCache(t, cacheDir, 10*1024, nil)
+	missing = testCache.FindMissingCasBlobs(context.Background(),
+		[]string{localHash, proxyHash, missingHash})
+	if len(missing) != 2 || missing[0] != proxyHash || missing[1] != missingHash {
+		t.Fatalf("Expected %s and %s to be missing, got %v",
+			proxyHash, missingHash, missing)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := cachehttp.New(url, &http.Client{}, testutils.NewSilentLogger(),
+		testutils.NewSilentLogger())
+
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCache, err := New(testutils.NewSilentLogger(), cacheDir, 10*1024,
+		proxy, WithWriteThrough(true), WithNegativeCache(time.Hour, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	blob, hash := testutils.RandomDataAndHash(100)
+
+	r, _, err := testCache.Get(ctx, cache.CAS, hash)
+	if err != nil || r != nil {
+		t.Fatalf("Expected a cache miss, got %v %v", r, err)
+	}
+	if backend.numRequests() != 1 {
+		t.Fatalf("Expected 1 proxy request, got %d", backend.numRequests())
+	}
+
+	// Further lookups of the same blob are answered locally.
+	r, _, err = testCache.Get(ctx, cache.CAS, hash)
+	if err != nil || r != nil {
+		t.Fatalf("Expected a cache miss, got %v %v", r, err)
+	}
+	found, _ := testCache.Contains(ctx, cache.CAS, hash)
+	if found {
+		t.Fatal("Expected a cache miss")
+	}
+	missing := testCache.FindMissingCasBlobs(ctx, []string{hash})
+	if len(missing) != 1 || missing[0] != hash {
+		t.Fatalf("Expected %s to be missing, got %v", hash, missing)
+	}
+	if backend.numRequests() != 1 {
+		t.Fatalf("Expected 1 proxy request, got %d", backend.numRequests())
+	}
+
+	// The other keyspaces are not affected.
+	testCache.Contains(ctx, cache.AC, hash)
+	if backend.numRequests() != 2 {
+		t.Fatalf("Expected 2 proxy requests, got %d", backend.numRequests())
+	}
+
+	// Uploading the blob invalidates the miss, even if it is not
+	// stored locally.
+	testCache.passthroughThreshold = 10
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(blob)),
+		bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _ = testCache.Contains(ctx, cache.CAS, hash)
+	if !found {
+		t.Fatal("Expected the uploaded blob to be found")
+	}
+
+	// Proxy errors are not remembered as misses.
+	_, hash = testutils.RandomDataAndHash(100)
+	backend.srv.Close()
+	testCache.Contains(ctx, cache.CAS, hash)
+	if testCache.negative.contains(cacheKey(cache.CAS, hash)) {
+		t.Fatal("Expected a proxy error not to be remembered as a miss")
+	}
+}
+
+func TestNegativeCacheBypassedProxy(t *testing.T) {
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := resilience.New(cachehttp.New(url, &http.Client{},
+		testutils.NewSilentLogger(), testutils.NewSilentLogger()),
+		"TestNegativeCacheBypassedProxy", config.ProxyResilienceConfig{
+			FailureThreshold: 1,
+			OpenDuration:     time.Hour,
+		}, testutils.NewSilentLogger())
+
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCache, err := New(testutils.NewSilentLogger(), cacheDir, 10*1024,
+		proxy, WithNegativeCache(time.Hour, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open the circuit breaker.
+	ctx := context.Background()
+	_, hash := testutils.RandomDataAndHash(100)
+	backend.srv.Close()
+	testCache.Contains(ctx, cache.CAS, hash)
+
+	// Lookups which bypass the proxy report misses, which are not
+	// remembered.
+	r, _, err := testCache.Get(ctx, cache.CAS, hash)
+	if err != nil || r != nil {
+		t.Fatalf("Expected a cache miss, got %v %v", r, err)
+	}
+	found, _ := testCache.Contains(ctx, cache.AC, hash)
+	if found {
+		t.Fatal("Expected a cache miss")
+	}
+	missing := testCache.FindMissingCasBlobs(ctx, []string{hash})
+	if len(missing) != 1 || missing[0] != hash {
+		t.Fatalf("Expected %s to be missing, got %v", hash, missing)
+	}
+	if testCache.negative.len() != 0 {
+		t.Fatalf("Expected no remembered misses, found %d",
+			testCache.negative.len())
+	}
+}
+
+func TestInvalidProxyItems(t *testing.T) {
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := verify.New(cachehttp.New(url, &http.Client{},
+		testutils.NewSilentLogger(), testutils.NewSilentLogger()),
+		"test", nil, testutils.NewSilentLogger())
+
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCache := newTestCache(t, cacheDir, 10*1024, proxy)
+
+	// A CAS blob with the wrong contents is reported as missing, and
+	// not stored locally.
+	_, hash := testutils.RandomDataAndHash(100)
+	other, _ := testutils.RandomDataAndHash(100)
+	backend.mu.Lock()
+	backend.cas[hash] = other
+	backend.ac[hash] = []byte{0xff, 0xff}
+	backend.mu.Unlock()
+
+	for _, kind := range []cache.EntryKind{cache.CAS, cache.AC} {
+		r, _, err := testCache.Get(context.Background(), kind, hash)
+		if err != nil || r != nil {
+			t.Fatalf("Expected a cache miss for %s, got %v %v", kind, r, err)
+		}
+	}
+
+	err = checkItems(testCache, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func ensureDirExists(path string) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		err = os.MkdirAll(path, os.ModePerm)
@@ -20,6 +20,7 @@ type SizedLRU interface {
 	Add(key Key, value SizedItem) (ok bool)
 	Get(key Key) (value SizedItem, ok bool)
 	Remove(key Key)
+	Keys() []Key
 	Len() int
 	CurrentSize() int64
 	MaxSize() int64
@@ -101,6 +102,16 @@ func (c *sizedLRU) Remove(key Key) {
 	}
 }
 
+// Keys returns the keys of all the items in the cache, in no
+// particular order.
+func (c *sizedLRU) Keys() []Key {
+	keys := make([]Key, 0, len(c.cache))
+	for key := range c.cache {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // Len returns the number of items in the cache
 func (c *sizedLRU) Len() int {
 	return len(c.cache)
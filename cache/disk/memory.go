@@ -0,0 +1,127 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/buchgr/bazel-remote/cache"
+)
+
+var errEvictedBeforeCommit = errors.New("item was evicted before it could be committed")
+
+// NewMemory returns a new instance of a cache which holds all blobs in
+// memory, with a maximum size of `maxSizeBytes` bytes and an optional
+// backend `proxy`. It behaves like a DiskCache that is created in an
+// empty directory, but nothing is written to the filesystem, and all
+// items are lost when the process exits.
+func NewMemory(logger cache.Logger, maxSizeBytes int64, proxy cache.CacheProxy, opts ...Option) (*DiskCache, error) {
+	store := &memStore{
+		blobs:   make(map[string][]byte),
+		pending: make(map[string]*memWriter),
+	}
+
+	return newDiskCache(logger, "", store, maxSizeBytes, proxy, opts), nil
+}
+
+// memStore is a blobStore which keeps all blobs in memory.
+type memStore struct {
+	mu      sync.Mutex
+	blobs   map[string][]byte
+	pending map[string]*memWriter
+}
+
+type memWriter struct {
+	store *memStore
+	key   string
+	buf   bytes.Buffer
+}
+
+// memReader adds a no-op Close method to bytes.Reader, so the data
+// can be returned as a seekable io.ReadCloser.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (r memReader) Close() error {
+	return nil
+}
+
+func notFound(op string, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
+
+func (s *memStore) create(key string) (blobWriter, error) {
+	w := &memWriter{store: s, key: key}
+
+	s.mu.Lock()
+	s.pending[key] = w
+	s.mu.Unlock()
+
+	return w, nil
+}
+
+func (s *memStore) open(key string) (io.ReadCloser, int64, error) {
+	s.mu.Lock()
+	data, found := s.blobs[key]
+	s.mu.Unlock()
+
+	if !found {
+		return nil, -1, notFound("open", key)
+	}
+
+	return memReader{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+func (s *memStore) remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.blobs[key]; !found {
+		return notFound("remove", key)
+	}
+	delete(s.blobs, key)
+
+	return nil
+}
+
+func (s *memStore) removeTemp(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.pending[key]; !found {
+		return notFound("remove", key)
+	}
+	delete(s.pending, key)
+
+	return nil
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) commit() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+
+	// The pending entry is removed if the item was evicted while
+	// it was being written.
+	if w.store.pending[w.key] != w {
+		return errEvictedBeforeCommit
+	}
+	delete(w.store.pending, w.key)
+	w.store.blobs[w.key] = w.buf.Bytes()
+
+	return nil
+}
+
+func (w *memWriter) abort() {
+	w.store.mu.Lock()
+	if w.store.pending[w.key] == w {
+		delete(w.store.pending, w.key)
+	}
+	w.store.mu.Unlock()
+}
@@ -0,0 +1,138 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	cachehttp "github.com/buchgr/bazel-remote/cache/http"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+func newTestMemoryCache(t *testing.T, maxSize int64, proxy cache.CacheProxy) *DiskCache {
+	c, err := NewMemory(testutils.NewSilentLogger(), maxSize, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMemoryCacheBasics(t *testing.T) {
+	testCache := newTestMemoryCache(t, 100, nil)
+
+	rdr, _, err := testCache.Get(context.Background(), cache.CAS, CONTENTS_HASH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rdr != nil {
+		t.Fatal("expected the item not to exist")
+	}
+
+	err = putGetCompare(cache.CAS, CONTENTS_HASH, CONTENTS, testCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, size := testCache.Contains(context.Background(), cache.CAS, CONTENTS_HASH)
+	if !found || size != int64(len(CONTENTS)) {
+		t.Fatalf("expected to find %d bytes, found: %v size: %d",
+			len(CONTENTS), found, size)
+	}
+
+	err = testCache.Put(context.Background(), cache.CAS, hashStr("foo"), int64(len(CONTENTS)),
+		strings.NewReader(CONTENTS))
+	if err == nil {
+		t.Fatal("expected hash mismatch error")
+	}
+
+	err = testCache.Put(context.Background(), cache.AC, hashStr("foo"), 10000,
+		strings.NewReader(CONTENTS))
+	if cerr, ok := err.(*cache.Error); !ok || cerr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected a %d error, got: %v",
+			http.StatusInsufficientStorage, err)
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	testCache := newTestMemoryCache(t, 10, nil)
+
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("%0*d", sha256HashStrSize, i)
+		err := testCache.Put(context.Background(), cache.AC, key, int64(i),
+			strings.NewReader(strings.Repeat("a", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the last item fits in the cache.
+	currentSize, numItems := testCache.Stats()
+	if currentSize != 7 || numItems != 1 {
+		t.Fatalf("expected a single 7 byte item, found %d items of total size %d",
+			numItems, currentSize)
+	}
+
+	store := testCache.store.(*memStore)
+	if len(store.blobs) != 1 || len(store.pending) != 0 {
+		t.Fatalf("expected the evicted items to be freed, found %d blobs and %d pending",
+			len(store.blobs), len(store.pending))
+	}
+}
+
+func TestMemoryCacheProxy(t *testing.T) {
+	backend := newTestServer(t)
+	url, err := url.Parse(backend.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := cachehttp.New(url, &http.Client{},
+		testutils.NewSilentLogger(), testutils.NewSilentLogger())
+
+	blob, casHash := testutils.RandomDataAndHash(1024)
+
+	testCache := newTestMemoryCache(t, 10*1024, proxy)
+	err = testCache.Put(context.Background(), cache.CAS, casHash, int64(len(blob)), bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second) // Proxying to the backend is async.
+
+	if backend.numItems() != 1 {
+		t.Fatal("Expected Put to be proxied to the backend",
+			backend.numItems())
+	}
+
+	// A new, empty cache should fetch the blob from the proxy.
+	testCache = newTestMemoryCache(t, 10*1024, proxy)
+	r, size, err := testCache.Get(context.Background(), cache.CAS, casHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil {
+		t.Fatal("Expected the Get to succeed")
+	}
+	if size != int64(len(blob)) {
+		t.Fatalf("Expected a blob of size %d, got %d", len(blob), size)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Fatal("Received the wrong data")
+	}
+
+	_, numItems := testCache.Stats()
+	if numItems != 1 {
+		t.Fatalf("Expected the proxied blob to be cached, found %d items", numItems)
+	}
+}
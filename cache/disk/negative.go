@@ -0,0 +1,163 @@
+package disk
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var negativeHits = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "bazel_remote_disk_cache_proxy_negative_hits",
+	Help: "The total number of proxy lookups skipped due to a recent proxy miss",
+})
+
+// The maximum number of entries in the negative cache, if not specified.
+const defaultNegativeCacheEntries = 100000
+
+// negativeCache remembers recent proxy misses for a short time, so
+// repeated lookups of missing items don't all reach the proxy backend.
+// Entries expire `ttl` after the lookup that found the miss started,
+// so items uploaded to the proxy by other clients are found again
+// after at most `ttl`. The oldest entries are evicted once there are
+// `maxEntries` of them.
+//
+// A nil *negativeCache is valid and never reports a miss.
+type negativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Oldest entries at the front.
+
+	// Incremented by each invalidation. Lookups which started before
+	// an invalidation might have missed the invalidated item, so their
+	// results are not cached.
+	generation uint64
+}
+
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+// A negativeLookup records when a proxy lookup started, see begin.
+type negativeLookup struct {
+	generation uint64
+	start      time.Time
+}
+
+func newNegativeCache(ttl time.Duration, maxEntries int) *negativeCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultNegativeCacheEntries
+	}
+
+	return &negativeCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// contains returns true if `key` was recently missing from the proxy.
+func (n *negativeCache) contains(key string) bool {
+	if n == nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	elem, found := n.entries[key]
+	if !found {
+		return false
+	}
+
+	if time.Now().After(elem.Value.(*negativeEntry).expires) {
+		n.order.Remove(elem)
+		delete(n.entries, key)
+		return false
+	}
+
+	negativeHits.Inc()
+	return true
+}
+
+// begin must be called before a proxy lookup whose misses will be
+// passed to add.
+func (n *negativeCache) begin() negativeLookup {
+	if n == nil {
+		return negativeLookup{}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return negativeLookup{generation: n.generation, start: time.Now()}
+}
+
+// add records that the lookup `l` did not find `keys` in the proxy.
+func (n *negativeCache) add(l negativeLookup, keys ...string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if l.generation != n.generation {
+		return
+	}
+
+	expires := l.start.Add(n.ttl)
+
+	for _, key := range keys {
+		elem, found := n.entries[key]
+		if found {
+			elem.Value.(*negativeEntry).expires = expires
+			n.order.MoveToBack(elem)
+			continue
+		}
+
+		if n.order.Len() >= n.maxEntries {
+			oldest := n.order.Front()
+			n.order.Remove(oldest)
+			delete(n.entries, oldest.Value.(*negativeEntry).key)
+		}
+
+		n.entries[key] = n.order.PushBack(&negativeEntry{
+			key:     key,
+			expires: expires,
+		})
+	}
+}
+
+// remove forgets any miss recorded for `key`, and prevents the results
+// of lookups which are already in progress from being recorded.
+func (n *negativeCache) remove(key string) {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.generation++
+
+	elem, found := n.entries[key]
+	if found {
+		n.order.Remove(elem)
+		delete(n.entries, key)
+	}
+}
+
+func (n *negativeCache) len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.order.Len()
+}
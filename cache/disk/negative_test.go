@@ -0,0 +1,68 @@
+package disk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegativeCacheExpiry(t *testing.T) {
+	n := newNegativeCache(10*time.Millisecond, 0)
+
+	n.add(n.begin(), "a")
+	if !n.contains("a") {
+		t.Fatal("Expected a to be found")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if n.contains("a") {
+		t.Fatal("Expected a to have expired")
+	}
+	if n.len() != 0 {
+		t.Fatalf("Expected the expired entry to be removed, got %d entries", n.len())
+	}
+}
+
+func TestNegativeCacheEviction(t *testing.T) {
+	n := newNegativeCache(time.Hour, 2)
+
+	n.add(n.begin(), "a", "b")
+	// Refreshing a moves it to the back of the eviction order.
+	n.add(n.begin(), "a")
+	n.add(n.begin(), "c")
+
+	if n.len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", n.len())
+	}
+	if n.contains("b") {
+		t.Fatal("Expected b to have been evicted")
+	}
+	if !n.contains("a") || !n.contains("c") {
+		t.Fatal("Expected a and c to be found")
+	}
+}
+
+func TestNegativeCacheInvalidation(t *testing.T) {
+	n := newNegativeCache(time.Hour, 0)
+
+	n.add(n.begin(), "a")
+	n.remove("a")
+	if n.contains("a") {
+		t.Fatal("Expected a to have been removed")
+	}
+
+	// Lookups which overlap with an invalidation are not remembered.
+	lookup := n.begin()
+	n.remove("b")
+	n.add(lookup, "b")
+	if n.contains("b") {
+		t.Fatal("Expected b not to be added")
+	}
+
+	// A nil negativeCache never reports misses.
+	var disabled *negativeCache
+	disabled.add(disabled.begin(), "a")
+	if disabled.contains("a") {
+		t.Fatal("Expected a nil negativeCache to be empty")
+	}
+}
@@ -0,0 +1,118 @@
+package disk
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// blobStore is the storage layer underneath the DiskCache LRU index.
+// Keys are relative paths of the form "kind/ab/abcdef...", as returned
+// by cacheKey. Implementations must be safe for concurrent use.
+type blobStore interface {
+	// create starts writing a new blob under `key`. The data is not
+	// visible to open until the returned blobWriter is committed.
+	create(key string) (blobWriter, error)
+
+	// open returns a reader for the committed blob stored under `key`,
+	// and its size in bytes.
+	open(key string) (io.ReadCloser, int64, error)
+
+	// remove deletes the committed blob stored under `key`.
+	remove(key string) error
+
+	// removeTemp deletes the uncommitted blob being written under
+	// `key`, if any. A subsequent commit of that blob must fail.
+	removeTemp(key string) error
+}
+
+// blobWriter receives the contents of a single blob.
+type blobWriter interface {
+	io.Writer
+
+	// commit makes the blob visible under its key, replacing any
+	// existing blob with the same key.
+	commit() error
+
+	// abort discards the blob if it has not been committed. It is
+	// safe to call abort after commit, in which case it does nothing.
+	abort()
+}
+
+// fileStore keeps each blob in a separate file below dir. Blobs are
+// written to a temporary file and then renamed into place.
+type fileStore struct {
+	dir string
+}
+
+type fileWriter struct {
+	f         *os.File
+	path      string
+	committed bool
+}
+
+func (s *fileStore) create(key string) (blobWriter, error) {
+	path := filepath.Join(s.dir, key)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileWriter{f: f, path: path}, nil
+}
+
+func (s *fileStore) open(key string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if err != nil {
+		return nil, -1, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, -1, err
+	}
+
+	return f, info.Size(), nil
+}
+
+func (s *fileStore) remove(key string) error {
+	return os.Remove(filepath.Join(s.dir, key))
+}
+
+func (s *fileStore) removeTemp(key string) error {
+	return os.Remove(filepath.Join(s.dir, key) + ".tmp")
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *fileWriter) commit() error {
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	// Rename to the final path. This fails if the temp file was
+	// removed due to the item being evicted while uploading.
+	err := os.Rename(w.f.Name(), w.path)
+	if err == nil {
+		w.committed = true
+	}
+
+	return err
+}
+
+func (w *fileWriter) abort() {
+	// Just in case we didn't already close it. No need to check errors.
+	w.f.Close()
+
+	if !w.committed {
+		// Only delete the temp file if moving it didn't succeed.
+		os.Remove(w.f.Name())
+	}
+}
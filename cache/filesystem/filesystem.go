@@ -0,0 +1,295 @@
+// Package filesystem provides a CacheProxy which stores blobs in a
+// directory, typically on a shared network filesystem such as NFS or
+// CephFS, so that several bazel-remote instances can share it.
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The maximum number of concurrent stat calls made by ContainsMany.
+const maxConcurrentContains = 32
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_filesystem_cache_hits",
+		Help: "The total number of filesystem backend cache hits",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_filesystem_cache_misses",
+		Help: "The total number of filesystem backend cache misses",
+	})
+)
+
+var errNotFound = errors.New("NOT FOUND")
+
+type filesystemCache struct {
+	dir          string
+	accessLogger cache.Logger
+	errorLogger  cache.Logger
+}
+
+// New returns a CacheProxy which stores blobs under `dir`, with the
+// same ac/cas/raw layout as the local disk cache. Blobs are written to
+// temporary files and renamed into place, so concurrent readers and
+// writers, including other bazel-remote instances, never see partial
+// blobs. Blobs are only removed from `dir` by Delete.
+func New(dir string, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	errorLogger.Printf("Using filesystem backend %s", dir)
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filesystemCache{
+		dir:          dir,
+		accessLogger: accessLogger,
+		errorLogger:  errorLogger,
+	}, nil
+}
+
+func (c *filesystemCache) blobPath(kind cache.EntryKind, hash string) (string, error) {
+	// Hashes are validated by the HTTP and gRPC servers, this only
+	// guards against escaping from c.dir.
+	if len(hash) < 2 || filepath.Base(hash) != hash {
+		return "", fmt.Errorf("Invalid hash: %q", hash)
+	}
+
+	return filepath.Join(c.dir, kind.String(), hash[:2], hash), nil
+}
+
+func (c *filesystemCache) logResponse(method string, path string, err error) {
+	status := "OK"
+	if err != nil {
+		status = err.Error()
+	}
+
+	c.accessLogger.Printf("FILESYSTEM %s %s %s", method, path, status)
+}
+
+func (c *filesystemCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	path, err := c.blobPath(kind, hash)
+	if err != nil {
+		return err
+	}
+
+	if kind == cache.CAS {
+		if _, err := os.Stat(path); err == nil {
+			// CAS blobs are immutable, no need to write it again.
+			c.logResponse("UPLOAD", path, nil)
+			return nil
+		}
+	}
+
+	err = c.writeFile(ctx, path, size, rdr)
+	c.logResponse("UPLOAD", path, err)
+
+	return err
+}
+
+// Write `size` bytes from `rdr` to a temporary file in the same
+// directory as `path`, and then rename it to `path`.
+func (c *filesystemCache) writeFile(ctx context.Context, path string, size int64, rdr io.Reader) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-"+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	removeTempFile := func() {
+		f.Close()
+		os.Remove(tmpName)
+	}
+
+	n, err := io.Copy(f, &ctxReader{ctx: ctx, r: rdr})
+	if err != nil {
+		removeTempFile()
+		return err
+	}
+	if n != size {
+		removeTempFile()
+		return fmt.Errorf("expected %d bytes, found %d", size, n)
+	}
+
+	// Make sure that other hosts never see a renamed but incomplete file.
+	err = f.Sync()
+	if err != nil {
+		removeTempFile()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	err = os.Chmod(tmpName, 0644)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	err = os.Rename(tmpName, path)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+// ctxReader stops reading once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (c *filesystemCache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	path, err := c.blobPath(kind, hash)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", path, errNotFound)
+		return nil, -1, nil
+	}
+	if err != nil {
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", path, err)
+		return nil, -1, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", path, err)
+		return nil, -1, err
+	}
+
+	cacheHits.Inc()
+	c.logResponse("DOWNLOAD", path, nil)
+
+	return f, info.Size(), nil
+}
+
+func (c *filesystemCache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	path, err := c.blobPath(kind, hash)
+	if err != nil {
+		return false, -1, err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		c.logResponse("CONTAINS", path, errNotFound)
+		return false, -1, nil
+	}
+	if err != nil {
+		c.logResponse("CONTAINS", path, err)
+		return false, -1, err
+	}
+
+	c.logResponse("CONTAINS", path, nil)
+
+	return true, info.Size(), nil
+}
+
+// Delete removes a blob, if it exists.
+func (c *filesystemCache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	path, err := c.blobPath(kind, hash)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	c.logResponse("DELETE", path, err)
+
+	return err
+}
+
+// List walks the blobs of the given kind in ascending order of hash,
+// which matches the order of the directory entries. Temporary files
+// are skipped.
+func (c *filesystemCache) List(ctx context.Context, kind cache.EntryKind, after string,
+	fn func(hash string, size int64) error) error {
+
+	kindDir := filepath.Join(c.dir, kind.String())
+	subDirs, err := ioutil.ReadDir(kindDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, subDir := range subDirs {
+		if !subDir.IsDir() {
+			continue
+		}
+		// Each subdirectory is named after the first two characters
+		// of the hashes of its blobs.
+		if len(after) >= 2 && subDir.Name() < after[:2] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(kindDir, subDir.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			name := f.Name()
+			if !f.Mode().IsRegular() || strings.Contains(name, ".") || name <= after {
+				continue
+			}
+
+			err = fn(name, f.Size())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *filesystemCache) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, c, kind, hashes, maxConcurrentContains)
+}
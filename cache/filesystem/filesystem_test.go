@@ -0,0 +1,180 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/buchgr/bazel-remote/cache"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	logger := testutils.NewSilentLogger()
+	c, err := New(dir, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	found, _, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("Expected an empty cache")
+	}
+
+	rc, _, err := c.Get(ctx, cache.CAS, hash)
+	if rc != nil || err != nil {
+		t.Fatalf("Expected a miss, got %v %v", rc, err)
+	}
+
+	err = c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The layout matches the local disk cache.
+	_, err = os.Stat(filepath.Join(dir, "cas", hash[:2], hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, size, err := c.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("Expected to find the blob")
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Fatal("Got the wrong data")
+	}
+
+	found, size, err = c.Contains(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || size != int64(len(data)) {
+		t.Fatalf("Expected to find %d bytes, got %v %d", len(data), found, size)
+	}
+
+	// Other kinds are stored separately.
+	found, _, err = c.Contains(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("Expected the AC entry to be missing")
+	}
+
+	err = c.(cache.Deleter).Delete(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err = c.Contains(ctx, cache.CAS, hash)
+	if err != nil || found {
+		t.Fatalf("Expected the blob to be deleted, got %v %v", found, err)
+	}
+
+	// Deleting a missing blob is not an error.
+	err = c.(cache.Deleter).Delete(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailedPutLeavesNoFiles(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	logger := testutils.NewSilentLogger()
+	c, err := New(dir, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	// Claim more data than the reader provides.
+	err = c.Put(ctx, cache.CAS, hash, int64(len(data)+1), bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("Expected an error for a size mismatch")
+	}
+
+	// A cancelled upload.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = c.Put(cancelled, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err == nil {
+		t.Fatal("Expected an error for a cancelled upload")
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "cas", hash[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected no files, found %d", len(entries))
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	logger := testutils.NewSilentLogger()
+	c, err := New(dir, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var hashes []string
+	for i := 0; i < 20; i++ {
+		data, hash := testutils.RandomDataAndHash(int64(i + 1))
+		err = c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	// Temporary files are skipped.
+	err = ioutil.WriteFile(filepath.Join(dir, "cas", hashes[0][:2], ".tmp-"+hashes[0]), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []string
+	err = c.(cache.Lister).List(ctx, cache.CAS, hashes[4],
+		func(hash string, size int64) error {
+			listed = append(listed, hash)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(listed, hashes[5:]) {
+		t.Fatalf("Expected %v, got %v", hashes[5:], listed)
+	}
+}
@@ -3,10 +3,14 @@
 package gcs
 
 import (
+	"context"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/buchgr/bazel-remote/cache"
 	cachehttp "github.com/buchgr/bazel-remote/cache/http"
@@ -53,5 +57,105 @@ func New(bucket string, useDefaultCredentials bool, jsonCredentialsFile string,
 		Path:   bucket,
 	}
 
-	return cachehttp.New(&baseURL, remoteClient, accessLogger, errorLogger), nil
+	return newGCSCache(&baseURL, remoteClient, accessLogger, errorLogger), nil
+}
+
+// The number of objects requested per list call.
+const maxListKeys = 1000
+
+// gcsCache uses the HTTP backend with the GCS XML API for everything
+// except listing, which the HTTP backend doesn't support.
+type gcsCache struct {
+	cache.CacheProxy
+
+	client       *http.Client
+	baseURL      *url.URL
+	accessLogger cache.Logger
+}
+
+func newGCSCache(baseURL *url.URL, client *http.Client,
+	accessLogger cache.Logger, errorLogger cache.Logger) *gcsCache {
+
+	return &gcsCache{
+		CacheProxy:   cachehttp.New(baseURL, client, accessLogger, errorLogger),
+		client:       client,
+		baseURL:      baseURL,
+		accessLogger: accessLogger,
+	}
+}
+
+// Delete removes an object, if it exists.
+func (c *gcsCache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	return c.CacheProxy.(cache.Deleter).Delete(ctx, kind, hash)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+}
+
+// List pages through the objects of the given kind, which GCS returns
+// in ascending order of name.
+func (c *gcsCache) List(ctx context.Context, kind cache.EntryKind, after string,
+	fn func(hash string, size int64) error) error {
+
+	prefix := kind.String() + "/"
+	marker := ""
+	if after != "" {
+		marker = prefix + after
+	}
+
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("max-keys", strconv.Itoa(maxListKeys))
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		u := c.baseURL.String() + "?" + query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		rsp, err := c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		c.accessLogger.Printf("HTTP LIST %d %s", rsp.StatusCode, u)
+
+		if rsp.StatusCode != http.StatusOK {
+			rsp.Body.Close()
+			return &cache.Error{
+				Code: rsp.StatusCode,
+				Text: fmt.Sprintf("Listing %s failed with status: %s", u, rsp.Status),
+			}
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(rsp.Body).Decode(&result)
+		rsp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			err = fn(strings.TrimPrefix(object.Key, prefix), object.Size)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return nil
+		}
+		marker = result.NextMarker
+		if marker == "" {
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
 }
@@ -0,0 +1,92 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/buchgr/bazel-remote/cache"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+// A fake GCS XML API bucket listing, which returns at most max-keys
+// objects per page.
+func listHandler(keys []string) http.HandlerFunc {
+	sort.Strings(keys)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket" {
+			http.Error(w, "unexpected path", http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+
+		var page []string
+		truncated := false
+		for _, key := range keys {
+			if !strings.HasPrefix(key, query.Get("prefix")) || key <= query.Get("marker") {
+				continue
+			}
+			if len(page) == maxKeys {
+				truncated = true
+				break
+			}
+			page = append(page, key)
+		}
+
+		fmt.Fprintf(w, "<ListBucketResult>")
+		for _, key := range page {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(key))
+		}
+		if truncated {
+			fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextMarker>%s</NextMarker>",
+				page[len(page)-1])
+		}
+		fmt.Fprintf(w, "</ListBucketResult>")
+	}
+}
+
+func TestList(t *testing.T) {
+	var keys []string
+	for i := 0; i < 2*maxListKeys+10; i++ {
+		keys = append(keys, fmt.Sprintf("cas/%064x", i))
+	}
+	keys = append(keys, "ac/"+strings.Repeat("a", 64))
+
+	srv := httptest.NewServer(listHandler(keys))
+	defer srv.Close()
+
+	baseURL, err := url.Parse(srv.URL + "/bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := testutils.NewSilentLogger()
+	c := newGCSCache(baseURL, &http.Client{}, logger, logger)
+
+	var hashes []string
+	err = c.List(context.Background(), cache.CAS, fmt.Sprintf("%064x", 4),
+		func(hash string, size int64) error {
+			if size != int64(len("cas/"+hash)) {
+				t.Fatalf("Unexpected size %d for %s", size, hash)
+			}
+			hashes = append(hashes, hash)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hashes) != len(keys)-6 {
+		t.Fatalf("Expected %d hashes, got %d", len(keys)-6, len(hashes))
+	}
+	if hashes[0] != fmt.Sprintf("%064x", 5) || !sort.StringsAreSorted(hashes) {
+		t.Fatalf("Unexpected order: %v...", hashes[:3])
+	}
+}
@@ -0,0 +1,556 @@
+// Package grpcproxy provides a CacheProxy which uses a REAPI-compatible
+// remote cache, such as another bazel-remote instance, over gRPC.
+package grpcproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+const (
+	// Blobs up to this size are transferred with BatchReadBlobs and
+	// BatchUpdateBlobs, larger blobs with ByteStream. This leaves room
+	// for the rest of the message below gRPC's default 4M limit.
+	maxBatchBlobSize = 1024 * 1024
+
+	// The size of each ByteStream WriteRequest.
+	maxChunkSize = 2 * 1024 * 1024
+
+	// The maximum number of digests in each FindMissingBlobs request.
+	maxFindMissingDigests = 10000
+
+	// The maximum number of concurrent GetActionResult requests made by
+	// ContainsMany.
+	maxConcurrentContains = 32
+)
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_grpc_cache_hits",
+		Help: "The total number of gRPC backend cache hits",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_grpc_cache_misses",
+		Help: "The total number of gRPC backend cache misses",
+	})
+)
+
+type remoteGrpcProxyCache struct {
+	instanceName string
+	ac           pb.ActionCacheClient
+	cas          pb.ContentAddressableStorageClient
+	bs           bytestream.ByteStreamClient
+	accessLogger cache.Logger
+	errorLogger  cache.Logger
+}
+
+// New connects to the gRPC backend described by `cfg`, and returns a
+// CacheProxy which uses it. Uploads are performed synchronously, use
+// the uploader package to perform them in the background.
+//
+// REAPI requests identify blobs by hash and size, but CacheProxy
+// requests only have a hash. Sizes are taken from the request context
+// (see cache.WithDigestSizes), CAS lookups with unknown sizes are
+// reported as misses, and unknown ActionResult sizes are sent as -1.
+// RAW entries can't be stored in REAPI caches, and are skipped.
+func New(cfg *config.GRPCBackendConfig, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	errorLogger.Printf("Using gRPC backend %s", cfg.BaseURL)
+
+	var opts []grpc.DialOption
+	var target string
+	if strings.HasPrefix(cfg.BaseURL, "grpcs://") {
+		target = strings.TrimPrefix(cfg.BaseURL, "grpcs://")
+
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		target = strings.TrimPrefix(cfg.BaseURL, "grpc://")
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, grpc.WithPerRPCCredentials(&headerCredentials{
+			headers: cfg.Headers,
+			secure:  strings.HasPrefix(cfg.BaseURL, "grpcs://"),
+		}))
+	}
+
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFromConn(conn, cfg.InstanceName, accessLogger, errorLogger), nil
+}
+
+// NewFromConn returns a CacheProxy which uses the REAPI instance named
+// `instanceName` on `conn`.
+func NewFromConn(conn *grpc.ClientConn, instanceName string,
+	accessLogger cache.Logger, errorLogger cache.Logger) cache.CacheProxy {
+
+	return &remoteGrpcProxyCache{
+		instanceName: instanceName,
+		ac:           pb.NewActionCacheClient(conn),
+		cas:          pb.NewContentAddressableStorageClient(conn),
+		bs:           bytestream.NewByteStreamClient(conn),
+		accessLogger: accessLogger,
+		errorLogger:  errorLogger,
+	}
+}
+
+func newTLSConfig(cfg *config.GRPCBackendConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.TLSCAFile != "" {
+		caCert, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("Failed to load CA certificates from %s", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// headerCredentials adds fixed metadata, such as authorization headers,
+// to each request.
+type headerCredentials struct {
+	headers map[string]string
+	secure  bool
+}
+
+func (c *headerCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return c.headers, nil
+}
+
+func (c *headerCredentials) RequireTransportSecurity() bool {
+	return c.secure
+}
+
+func (r *remoteGrpcProxyCache) digest(ctx context.Context, hash string) *pb.Digest {
+	return &pb.Digest{Hash: hash, SizeBytes: cache.DigestSize(ctx, hash)}
+}
+
+func (r *remoteGrpcProxyCache) logResponse(method string, kind cache.EntryKind, hash string, err error) {
+	code := status.Code(err)
+	r.accessLogger.Printf("GRPC PROXY %s %s/%s %s", method, kind, hash, code)
+}
+
+// Report cancelled requests with the context errors, like the other
+// backends do.
+func convertError(err error) error {
+	switch status.Code(err) {
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+func (r *remoteGrpcProxyCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	switch kind {
+	case cache.AC:
+		return r.putActionResult(ctx, hash, rdr)
+	case cache.CAS:
+		if size <= maxBatchBlobSize {
+			return r.putBatch(ctx, hash, size, rdr)
+		}
+		return r.putByteStream(ctx, hash, size, rdr)
+	}
+
+	// RAW entries aren't valid ActionResults.
+	return nil
+}
+
+func (r *remoteGrpcProxyCache) putActionResult(ctx context.Context, hash string, rdr io.Reader) error {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+
+	result := &pb.ActionResult{}
+	err = proto.Unmarshal(data, result)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.ac.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		InstanceName: r.instanceName,
+		ActionDigest: r.digest(ctx, hash),
+		ActionResult: result,
+	})
+	r.logResponse("PUT", cache.AC, hash, err)
+	if err != nil {
+		return convertError(err)
+	}
+
+	return nil
+}
+
+func (r *remoteGrpcProxyCache) putBatch(ctx context.Context, hash string, size int64, rdr io.Reader) error {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("expected %d bytes, found %d", size, len(data))
+	}
+
+	resp, err := r.cas.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		InstanceName: r.instanceName,
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{{
+			Digest: &pb.Digest{Hash: hash, SizeBytes: size},
+			Data:   data,
+		}},
+	})
+	if err == nil && len(resp.Responses) != 1 {
+		err = status.Errorf(codes.Internal,
+			"expected 1 BatchUpdateBlobs response, found %d", len(resp.Responses))
+	}
+	if err == nil {
+		err = status.ErrorProto(resp.Responses[0].Status)
+	}
+	r.logResponse("PUT", cache.CAS, hash, err)
+	if err != nil {
+		return convertError(err)
+	}
+
+	return nil
+}
+
+func (r *remoteGrpcProxyCache) resourcePrefix() string {
+	if r.instanceName == "" {
+		return ""
+	}
+	return r.instanceName + "/"
+}
+
+func (r *remoteGrpcProxyCache) putByteStream(ctx context.Context, hash string, size int64, rdr io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := r.bs.Write(ctx)
+	if err != nil {
+		r.logResponse("PUT", cache.CAS, hash, err)
+		return convertError(err)
+	}
+
+	resourceName := fmt.Sprintf("%suploads/%s/blobs/%s/%d",
+		r.resourcePrefix(), uuid.New().String(), hash, size)
+
+	buf := make([]byte, maxChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(rdr, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		req := &bytestream.WriteRequest{
+			WriteOffset: offset,
+			Data:        buf[:n],
+			FinishWrite: offset+int64(n) >= size,
+		}
+		if offset == 0 {
+			req.ResourceName = resourceName
+		}
+		offset += int64(n)
+
+		err = stream.Send(req)
+		if err == io.EOF {
+			// The server ended the stream early, either because it
+			// already has the blob or because of an error. Both are
+			// reported by CloseAndRecv.
+			break
+		}
+		if err != nil {
+			r.logResponse("PUT", cache.CAS, hash, err)
+			return convertError(err)
+		}
+
+		if req.FinishWrite {
+			break
+		}
+		if n == 0 {
+			return fmt.Errorf("expected %d bytes, found %d", size, offset)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	r.logResponse("PUT", cache.CAS, hash, err)
+	if err != nil {
+		return convertError(err)
+	}
+
+	// CommittedSize may be -1 if the blob was already present.
+	if resp.CommittedSize != size && resp.CommittedSize != -1 {
+		return fmt.Errorf("expected %d bytes to be committed, found %d",
+			size, resp.CommittedSize)
+	}
+
+	return nil
+}
+
+func (r *remoteGrpcProxyCache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	switch kind {
+	case cache.AC:
+		data, err := r.getActionResult(ctx, hash)
+		if data == nil || err != nil {
+			return nil, -1, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+
+	case cache.CAS:
+		size := cache.DigestSize(ctx, hash)
+		if size < 0 {
+			// We can't address the blob without its size.
+			cacheMisses.Inc()
+			return nil, -1, nil
+		}
+		if size <= maxBatchBlobSize {
+			return r.getBatch(ctx, hash, size)
+		}
+		return r.getByteStream(ctx, hash, size)
+	}
+
+	return nil, -1, nil
+}
+
+// Returns the serialized ActionResult, or nil if it wasn't found.
+func (r *remoteGrpcProxyCache) getActionResult(ctx context.Context, hash string) ([]byte, error) {
+	result, err := r.ac.GetActionResult(ctx, &pb.GetActionResultRequest{
+		InstanceName: r.instanceName,
+		ActionDigest: r.digest(ctx, hash),
+	})
+	r.logResponse("GET", cache.AC, hash, err)
+	if status.Code(err) == codes.NotFound {
+		cacheMisses.Inc()
+		return nil, nil
+	}
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	data, err := proto.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheHits.Inc()
+	return data, nil
+}
+
+func (r *remoteGrpcProxyCache) getBatch(ctx context.Context, hash string, size int64) (io.ReadCloser, int64, error) {
+	resp, err := r.cas.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{
+		InstanceName: r.instanceName,
+		Digests:      []*pb.Digest{{Hash: hash, SizeBytes: size}},
+	})
+	if err == nil && len(resp.Responses) != 1 {
+		err = status.Errorf(codes.Internal,
+			"expected 1 BatchReadBlobs response, found %d", len(resp.Responses))
+	}
+	if err == nil {
+		err = status.ErrorProto(resp.Responses[0].Status)
+	}
+	r.logResponse("GET", cache.CAS, hash, err)
+	if status.Code(err) == codes.NotFound {
+		cacheMisses.Inc()
+		return nil, -1, nil
+	}
+	if err != nil {
+		return nil, -1, convertError(err)
+	}
+
+	data := resp.Responses[0].Data
+	if int64(len(data)) != size {
+		return nil, -1, fmt.Errorf("expected %d bytes, found %d", size, len(data))
+	}
+
+	cacheHits.Inc()
+	return ioutil.NopCloser(bytes.NewReader(data)), size, nil
+}
+
+func (r *remoteGrpcProxyCache) getByteStream(ctx context.Context, hash string, size int64) (io.ReadCloser, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := r.bs.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: fmt.Sprintf("%sblobs/%s/%d", r.resourcePrefix(), hash, size),
+	})
+	if err != nil {
+		cancel()
+		r.logResponse("GET", cache.CAS, hash, err)
+		return nil, -1, convertError(err)
+	}
+
+	// Wait for the first response, so that missing blobs are reported
+	// as misses rather than read errors.
+	first, err := stream.Recv()
+	if err == io.EOF && size == 0 {
+		err = nil
+		first = &bytestream.ReadResponse{}
+	}
+	r.logResponse("GET", cache.CAS, hash, err)
+	if status.Code(err) == codes.NotFound {
+		cancel()
+		cacheMisses.Inc()
+		return nil, -1, nil
+	}
+	if err != nil {
+		cancel()
+		return nil, -1, convertError(err)
+	}
+
+	cacheHits.Inc()
+	return &streamReader{stream: stream, buf: first.Data, cancel: cancel}, size, nil
+}
+
+// streamReader is an io.ReadCloser for a ByteStream Read response.
+type streamReader struct {
+	stream bytestream.ByteStream_ReadClient
+	buf    []byte
+	cancel context.CancelFunc
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		resp, err := s.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, convertError(err)
+		}
+		s.buf = resp.Data
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *streamReader) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (r *remoteGrpcProxyCache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	switch kind {
+	case cache.AC:
+		data, err := r.getActionResult(ctx, hash)
+		if data == nil || err != nil {
+			return false, -1, err
+		}
+		return true, int64(len(data)), nil
+
+	case cache.CAS:
+		size := cache.DigestSize(ctx, hash)
+		found, err := r.ContainsMany(ctx, kind, []string{hash})
+		if err != nil || !found[0] {
+			return false, -1, err
+		}
+		return true, size, nil
+	}
+
+	return false, -1, nil
+}
+
+// ContainsMany checks CAS blobs with FindMissingBlobs. Blobs with
+// unknown sizes are reported as missing.
+func (r *remoteGrpcProxyCache) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	switch kind {
+	case cache.AC:
+		return cache.ContainsParallel(ctx, r, kind, hashes, maxConcurrentContains)
+	case cache.RAW:
+		return make([]bool, len(hashes)), nil
+	}
+
+	found := make([]bool, len(hashes))
+
+	var digests []*pb.Digest
+	indexes := make(map[string][]int)
+	for i, hash := range hashes {
+		size := cache.DigestSize(ctx, hash)
+		if size < 0 {
+			continue
+		}
+		if _, seen := indexes[hash]; !seen {
+			digests = append(digests, &pb.Digest{Hash: hash, SizeBytes: size})
+		}
+		indexes[hash] = append(indexes[hash], i)
+	}
+
+	for start := 0; start < len(digests); start += maxFindMissingDigests {
+		end := start + maxFindMissingDigests
+		if end > len(digests) {
+			end = len(digests)
+		}
+
+		resp, err := r.cas.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{
+			InstanceName: r.instanceName,
+			BlobDigests:  digests[start:end],
+		})
+		r.accessLogger.Printf("GRPC PROXY FINDMISSINGBLOBS %d digests %s",
+			end-start, status.Code(err))
+		if err != nil {
+			return found, convertError(err)
+		}
+
+		missing := make(map[string]struct{}, len(resp.MissingBlobDigests))
+		for _, d := range resp.MissingBlobDigests {
+			missing[d.Hash] = struct{}{}
+		}
+
+		for _, d := range digests[start:end] {
+			if _, ok := missing[d.Hash]; ok {
+				continue
+			}
+			for _, i := range indexes[d.Hash] {
+				found[i] = true
+			}
+		}
+	}
+
+	return found, nil
+}
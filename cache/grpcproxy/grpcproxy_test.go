@@ -0,0 +1,220 @@
+package grpcproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/disk"
+	"github.com/buchgr/bazel-remote/server"
+	testutils "github.com/buchgr/bazel-remote/utils"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// Start a bazel-remote gRPC server backed by a disk cache, and return a
+// proxy which uses it.
+func newTestProxy(t *testing.T) (cache.CacheProxy, *disk.DiskCache, func()) {
+	dir := testutils.TempDir(t)
+	logger := testutils.NewSilentLogger()
+
+	upstream, err := disk.New(logger, dir, 100*1024*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := bufconn.Listen(1024 * 1024)
+	go server.ServeGRPC(listener, []grpc.ServerOption{}, upstream, logger, logger, false)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup := func() {
+		conn.Close()
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+
+	return NewFromConn(conn, "", logger, logger), upstream, cleanup
+}
+
+func withSize(hash string, size int) context.Context {
+	return cache.WithDigestSizes(context.Background(), map[string]int64{hash: int64(size)})
+}
+
+func TestCASRoundTrip(t *testing.T) {
+	proxy, upstream, cleanup := newTestProxy(t)
+	defer cleanup()
+
+	// Small blobs use the batch APIs, large ones ByteStream.
+	for _, size := range []int{1024, 3*maxChunkSize + 17} {
+		data, hash := testutils.RandomDataAndHash(int64(size))
+		ctx := withSize(hash, size)
+
+		err := proxy.Put(ctx, cache.CAS, hash, int64(size), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, _ := upstream.Contains(context.Background(), cache.CAS, hash)
+		if !found {
+			t.Fatalf("Expected the upstream cache to contain the %d byte blob", size)
+		}
+
+		rc, gotSize, err := proxy.Get(ctx, cache.CAS, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc == nil {
+			t.Fatalf("Expected to find the %d byte blob", size)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotSize != int64(size) || !bytes.Equal(got, data) {
+			t.Fatalf("Got the wrong data for the %d byte blob", size)
+		}
+
+		found, _, err = proxy.Contains(ctx, cache.CAS, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatalf("Expected Contains to find the %d byte blob", size)
+		}
+
+		// Without a size, the blob can't be addressed.
+		rc, _, err = proxy.Get(context.Background(), cache.CAS, hash)
+		if rc != nil || err != nil {
+			t.Fatalf("Expected a miss for an unknown size, got %v %v", rc, err)
+		}
+	}
+}
+
+func TestCASMisses(t *testing.T) {
+	proxy, _, cleanup := newTestProxy(t)
+	defer cleanup()
+
+	for _, size := range []int{1024, 3 * maxChunkSize} {
+		_, hash := testutils.RandomDataAndHash(int64(size))
+		rc, _, err := proxy.Get(withSize(hash, size), cache.CAS, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc != nil {
+			t.Fatalf("Expected a miss for the %d byte blob", size)
+		}
+	}
+}
+
+func TestContainsMany(t *testing.T) {
+	proxy, _, cleanup := newTestProxy(t)
+	defer cleanup()
+
+	sizes := make(map[string]int64)
+	var hashes []string
+	for i := 0; i < 4; i++ {
+		data, hash := testutils.RandomDataAndHash(100)
+		sizes[hash] = 100
+		hashes = append(hashes, hash)
+
+		if i%2 == 0 {
+			err := proxy.Put(withSize(hash, 100), cache.CAS, hash, 100, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A stored blob with an unknown size.
+	data, hash := testutils.RandomDataAndHash(100)
+	err := proxy.Put(context.Background(), cache.CAS, hash, 100, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes = append(hashes, hash)
+
+	ctx := cache.WithDigestSizes(context.Background(), sizes)
+	found, err := proxy.ContainsMany(ctx, cache.CAS, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []bool{true, false, true, false, false}
+	for i := range expected {
+		if found[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, found)
+		}
+	}
+}
+
+func TestACRoundTrip(t *testing.T) {
+	proxy, _, cleanup := newTestProxy(t)
+	defer cleanup()
+
+	result := &pb.ActionResult{ExitCode: 42}
+	data, err := proto.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("an action"))
+	hash := hex.EncodeToString(sum[:])
+	ctx := withSize(hash, 9)
+
+	rc, _, err := proxy.Get(ctx, cache.AC, hash)
+	if rc != nil || err != nil {
+		t.Fatalf("Expected a miss, got %v %v", rc, err)
+	}
+
+	err = proxy.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err = proxy.Get(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("Expected to find the ActionResult")
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotResult := &pb.ActionResult{}
+	err = proto.Unmarshal(got, gotResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotResult.ExitCode != 42 {
+		t.Fatalf("Expected exit code 42, got %d", gotResult.ExitCode)
+	}
+
+	found, _, err := proxy.Contains(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("Expected Contains to find the ActionResult")
+	}
+}
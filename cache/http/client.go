@@ -0,0 +1,224 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+)
+
+// NewFromConfig returns a CacheProxy for the HTTP remote cache described
+// by `cfg`, with its authentication, TLS and connection pool settings.
+func NewFromConfig(cfg *config.HTTPBackendConfig, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	baseURL, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(baseURL, client, accessLogger, errorLogger), nil
+}
+
+// NewClient returns an http.Client with the authentication, TLS and
+// connection pool settings of `cfg`. cfg.BaseURL is not used.
+func NewClient(cfg *config.HTTPBackendConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < cfg.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = cfg.MaxIdleConnsPerHost
+		}
+	}
+	if cfg.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+
+	if cfg.TLSCAFile != "" || cfg.TLSCertFile != "" {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	headers := make(http.Header)
+	for k, v := range cfg.Headers {
+		headers.Set(k, v)
+	}
+
+	auth := &authTransport{
+		base:     transport,
+		headers:  headers,
+		username: cfg.Username,
+		password: cfg.Password,
+	}
+
+	if cfg.BearerToken != "" {
+		auth.headers.Set("Authorization", "Bearer "+cfg.BearerToken)
+	}
+
+	if cfg.BearerTokenFile != "" {
+		auth.token = &tokenFile{path: cfg.BearerTokenFile}
+		// Fail early if the file can't be read.
+		_, err := auth.token.get()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &http.Client{Transport: auth}, nil
+}
+
+func newTLSConfig(cfg *config.HTTPBackendConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.TLSCAFile != "" {
+		caCert, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("Failed to load CA certificates from %s", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// authTransport adds credentials and fixed headers to each request,
+// except for redirects to other hosts.
+type authTransport struct {
+	base     http.RoundTripper
+	headers  http.Header
+	username string
+	password string
+	token    *tokenFile
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// http.Client removes sensitive headers from redirects to other
+	// hosts, eg presigned object store URLs, but it doesn't know about
+	// the ones added here.
+	if RedirectedToOtherHost(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request.
+	req = req.Clone(req.Context())
+
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+
+	if t.token != nil {
+		token, err := t.token.get()
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// RedirectedToOtherHost returns true if `req` was created by http.Client
+// for a redirect, and has a different host than the original request.
+func RedirectedToOtherHost(req *http.Request) bool {
+	orig := req
+	for orig.Response != nil && orig.Response.Request != nil {
+		orig = orig.Response.Request
+	}
+
+	return orig.URL.Host != req.URL.Host
+}
+
+// The minimum time between checks for changes to a token file.
+var tokenCheckInterval = 10 * time.Second
+
+// tokenFile provides the contents of a file, which is re-read when its
+// modification time or size changes, eg when a sidecar refreshes it.
+type tokenFile struct {
+	path string
+
+	mu        sync.Mutex
+	token     string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+func (f *tokenFile) get() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.token != "" && now.Sub(f.lastCheck) < tokenCheckInterval {
+		return f.token, nil
+	}
+
+	fi, err := os.Stat(f.path)
+	if err != nil && f.token != "" {
+		// Keep using the previous token, the file might be in the
+		// middle of being replaced.
+		return f.token, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	f.lastCheck = now
+
+	if f.token != "" && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.token, nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("The bearer token file %s is empty", f.path)
+	}
+
+	f.token = token
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+
+	return f.token, nil
+}
@@ -0,0 +1,247 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+// A handler which records the headers of the last request, and reports
+// every blob as missing.
+type headerRecorder struct {
+	mu     sync.Mutex
+	header http.Header
+}
+
+func (h *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.header = r.Header.Clone()
+	h.mu.Unlock()
+
+	http.Error(w, "Not found", http.StatusNotFound)
+}
+
+func (h *headerRecorder) get(key string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.header.Get(key)
+}
+
+func newTestProxy(t *testing.T, cfg config.HTTPBackendConfig) cache.CacheProxy {
+	logger := testutils.NewSilentLogger()
+	p, err := NewFromConfig(&cfg, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestBasicAuthAndHeaders(t *testing.T) {
+	h := &headerRecorder{}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	p := newTestProxy(t, config.HTTPBackendConfig{
+		BaseURL:  srv.URL,
+		Username: "user",
+		Password: "pass",
+		Headers:  map[string]string{"X-Tenant": "team-a"},
+	})
+
+	_, hash := testutils.RandomDataAndHash(16)
+	_, _, err := p.Contains(context.Background(), cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.get("Authorization") != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("Unexpected Authorization header: %q", h.get("Authorization"))
+	}
+	if h.get("X-Tenant") != "team-a" {
+		t.Fatalf("Unexpected X-Tenant header: %q", h.get("X-Tenant"))
+	}
+}
+
+func TestCrossHostRedirect(t *testing.T) {
+	other := &headerRecorder{}
+	otherSrv := httptest.NewServer(other)
+	defer otherSrv.Close()
+
+	h := &headerRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		http.Redirect(w, r, otherSrv.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	p := newTestProxy(t, config.HTTPBackendConfig{
+		BaseURL:     srv.URL,
+		BearerToken: "EXAMPLE_TOKEN",
+		Headers:     map[string]string{"X-Tenant": "team-a"},
+	})
+
+	_, hash := testutils.RandomDataAndHash(16)
+	_, _, err := p.Get(context.Background(), cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.get("Authorization") != "Bearer EXAMPLE_TOKEN" || h.get("X-Tenant") != "team-a" {
+		t.Fatalf("Expected credentials for the original host, got %v", h.header)
+	}
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	if other.header == nil {
+		t.Fatal("Expected the redirect to be followed")
+	}
+	if other.header.Get("Authorization") != "" || other.header.Get("X-Tenant") != "" {
+		t.Fatalf("Unexpected credentials after a cross-host redirect: %v", other.header)
+	}
+}
+
+func TestBearerTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenPath := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenPath, []byte("token1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origInterval := tokenCheckInterval
+	tokenCheckInterval = 0
+	defer func() { tokenCheckInterval = origInterval }()
+
+	h := &headerRecorder{}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	p := newTestProxy(t, config.HTTPBackendConfig{
+		BaseURL:         srv.URL,
+		BearerTokenFile: tokenPath,
+	})
+
+	ctx := context.Background()
+	_, hash := testutils.RandomDataAndHash(16)
+	_, _, err = p.Get(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.get("Authorization") != "Bearer token1" {
+		t.Fatalf("Unexpected Authorization header: %q", h.get("Authorization"))
+	}
+
+	// A refreshed token is picked up.
+	err = ioutil.WriteFile(tokenPath, []byte("token-two\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = p.Get(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.get("Authorization") != "Bearer token-two" {
+		t.Fatalf("Unexpected Authorization header: %q", h.get("Authorization"))
+	}
+
+	// A missing token file is an error at startup.
+	cfg := config.HTTPBackendConfig{
+		BaseURL:         srv.URL,
+		BearerTokenFile: filepath.Join(dir, "nonexistent"),
+	}
+	logger := testutils.NewSilentLogger()
+	_, err = NewFromConfig(&cfg, logger, logger)
+	if err == nil {
+		t.Fatal("Expected an error for a missing token file")
+	}
+}
+
+func TestTLSCAFile(t *testing.T) {
+	s := newTestServer()
+	s.srv.Close()
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(s.handler))
+	defer s.srv.Close()
+
+	dir, err := ioutil.TempDir("", "httptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caPath := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.srv.Certificate().Raw,
+	})
+	err = ioutil.WriteFile(caPath, caPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server's certificate is not trusted by default.
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+	p := newTestProxy(t, config.HTTPBackendConfig{BaseURL: s.srv.URL})
+	_, _, err = p.Contains(ctx, cache.CAS, hash)
+	if err == nil {
+		t.Fatal("Expected a certificate error")
+	}
+
+	p = newTestProxy(t, config.HTTPBackendConfig{
+		BaseURL:             s.srv.URL,
+		TLSCAFile:           caPath,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+	})
+	err = p.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err := p.Contains(ctx, cache.CAS, hash)
+	if err != nil || !found {
+		t.Fatalf("Expected to find the blob, got %v %v", found, err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newTestServer()
+	defer s.srv.Close()
+
+	p := newTestProxy(t, config.HTTPBackendConfig{BaseURL: s.srv.URL})
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+	err := p.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting a missing blob is not an error.
+	for i := 0; i < 2; i++ {
+		err = p.(cache.Deleter).Delete(ctx, cache.CAS, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, _, err := p.Contains(ctx, cache.CAS, hash)
+	if err != nil || found {
+		t.Fatalf("Expected the blob to be deleted, got %v %v", found, err)
+	}
+}
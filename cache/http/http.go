@@ -3,6 +3,7 @@
 package http
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -17,20 +18,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const numUploaders = 100
-const maxQueuedUploads = 1000000
-
-type uploadReq struct {
-	hash string
-	size int64
-	kind cache.EntryKind
-	rdr  io.Reader
-}
+// The maximum number of concurrent HEAD requests made by ContainsMany.
+const maxConcurrentContains = 32
 
 type remoteHTTPProxyCache struct {
 	remote       *http.Client
 	baseURL      *url.URL
-	uploadQueue  chan<- uploadReq
 	accessLogger cache.Logger
 	errorLogger  cache.Logger
 }
@@ -46,85 +39,79 @@ var (
 	})
 )
 
-func uploadFile(remote *http.Client, baseURL *url.URL, accessLogger cache.Logger,
-	errorLogger cache.Logger, item uploadReq) {
+// New creates a cache that proxies requests to a HTTP remote cache.
+// Uploads are performed synchronously, use the uploader package to
+// perform them in the background.
+func New(baseURL *url.URL, remote *http.Client, accessLogger cache.Logger,
+	errorLogger cache.Logger) cache.CacheProxy {
+
+	return &remoteHTTPProxyCache{
+		remote:       remote,
+		baseURL:      baseURL,
+		accessLogger: accessLogger,
+		errorLogger:  errorLogger,
+	}
+}
+
+// Helper function for logging responses
+func logResponse(logger cache.Logger, method string, code int, url string) {
+	logger.Printf("HTTP %s %d %s", method, code, url)
+}
 
-	if item.size == 0 {
+func (r *remoteHTTPProxyCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	if size == 0 {
 		// See https://github.com/golang/go/issues/20257#issuecomment-299509391
-		item.rdr = http.NoBody
+		rdr = http.NoBody
 	}
 
-	url := requestURL(baseURL, item.hash, item.kind)
+	url := requestURL(r.baseURL, hash, kind)
 
-	rsp, err := remote.Head(url)
-	if err == nil && rsp.StatusCode == http.StatusOK {
-		accessLogger.Printf("SKIP UPLOAD %s", item.hash)
-		return
+	found, _, err := r.head(ctx, url)
+	if err == nil && found {
+		r.accessLogger.Printf("SKIP UPLOAD %s", hash)
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
-	req, err := http.NewRequest(http.MethodPut, url, item.rdr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, rdr)
 	if err != nil {
-		return
+		return err
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
-	req.ContentLength = item.size
+	req.ContentLength = size
 
-	rsp, err = remote.Do(req)
+	rsp, err := r.remote.Do(req)
 	if err != nil {
-		return
+		return err
 	}
 	io.Copy(ioutil.Discard, rsp.Body)
 	rsp.Body.Close()
 
-	logResponse(accessLogger, "UPLOAD", rsp.StatusCode, url)
-	return
-}
+	logResponse(r.accessLogger, "UPLOAD", rsp.StatusCode, url)
 
-// New creates a cache that proxies requests to a HTTP remote cache.
-func New(baseURL *url.URL, remote *http.Client, accessLogger cache.Logger,
-	errorLogger cache.Logger) cache.CacheProxy {
-
-	uploadQueue := make(chan uploadReq, maxQueuedUploads)
-
-	for i := 0; i < numUploaders; i++ {
-		go func(remote *http.Client, baseURL *url.URL, accessLogger cache.Logger,
-			errorLogger cache.Logger) {
-			for item := range uploadQueue {
-				uploadFile(remote, baseURL, accessLogger, errorLogger, item)
-			}
-		}(remote, baseURL, accessLogger, errorLogger)
+	if rsp.StatusCode != http.StatusOK {
+		return &cache.Error{
+			Code: rsp.StatusCode,
+			Text: fmt.Sprintf("Upload to %s failed with status: %s",
+				url, rsp.Status),
+		}
 	}
 
-	return &remoteHTTPProxyCache{
-		remote:       remote,
-		baseURL:      baseURL,
-		uploadQueue:  uploadQueue,
-		accessLogger: accessLogger,
-		errorLogger:  errorLogger,
-	}
+	return nil
 }
 
-// Helper function for logging responses
-func logResponse(logger cache.Logger, method string, code int, url string) {
-	logger.Printf("HTTP %s %d %s", method, code, url)
-}
-
-func (r *remoteHTTPProxyCache) Put(kind cache.EntryKind, hash string, size int64, rdr io.Reader) {
-	select {
-	case r.uploadQueue <- uploadReq{
-		hash: hash,
-		size: size,
-		kind: kind,
-		rdr:  rdr,
-	}:
-	default:
-		r.errorLogger.Printf("too many uploads queued")
-	}
-}
-
-func (r *remoteHTTPProxyCache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+func (r *remoteHTTPProxyCache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
 	url := requestURL(r.baseURL, hash, kind)
-	rsp, err := r.remote.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	// The size of the blob is taken from the Content-Length header,
+	// which compressed responses don't have.
+	req.Header.Set("Accept-Encoding", "identity")
+	rsp, err := r.remote.Do(req)
 	if err != nil {
 		cacheMisses.Inc()
 		return nil, -1, err
@@ -133,11 +120,14 @@ func (r *remoteHTTPProxyCache) Get(kind cache.EntryKind, hash string) (io.ReadCl
 	logResponse(r.accessLogger, "DOWNLOAD", rsp.StatusCode, url)
 
 	if rsp.StatusCode == http.StatusNotFound {
+		rsp.Body.Close()
 		cacheMisses.Inc()
 		return nil, -1, nil
 	}
 
 	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+
 		// If the failed http response contains some data then
 		// forward up to 1 KiB.
 		var errorBytes []byte
@@ -156,6 +146,7 @@ func (r *remoteHTTPProxyCache) Get(kind cache.EntryKind, hash string) (io.ReadCl
 
 	sizeBytesStr := rsp.Header.Get("Content-Length")
 	if sizeBytesStr == "" {
+		rsp.Body.Close()
 		err = errors.New("Missing Content-Length header")
 		cacheMisses.Inc()
 		return nil, -1, err
@@ -163,6 +154,7 @@ func (r *remoteHTTPProxyCache) Get(kind cache.EntryKind, hash string) (io.ReadCl
 
 	sizeBytesInt, err := strconv.Atoi(sizeBytesStr)
 	if err != nil {
+		rsp.Body.Close()
 		cacheMisses.Inc()
 		return nil, -1, err
 	}
@@ -173,16 +165,68 @@ func (r *remoteHTTPProxyCache) Get(kind cache.EntryKind, hash string) (io.ReadCl
 	return rsp.Body, sizeBytes, err
 }
 
-func (r *remoteHTTPProxyCache) Contains(kind cache.EntryKind, hash string) (bool, int64) {
+func (r *remoteHTTPProxyCache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	return r.head(ctx, requestURL(r.baseURL, hash, kind))
+}
+
+func (r *remoteHTTPProxyCache) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, r, kind, hashes, maxConcurrentContains)
+}
 
+// Delete removes an item from the remote cache. A 404 response is not
+// treated as an error.
+func (r *remoteHTTPProxyCache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
 	url := requestURL(r.baseURL, hash, kind)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
 
-	rsp, err := r.remote.Head(url)
-	if err == nil && rsp.StatusCode == http.StatusOK {
-		return true, rsp.ContentLength
+	rsp, err := r.remote.Do(req)
+	if err != nil {
+		return err
 	}
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+
+	logResponse(r.accessLogger, "DELETE", rsp.StatusCode, url)
 
-	return false, int64(-1)
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+
+	return &cache.Error{
+		Code: rsp.StatusCode,
+		Text: fmt.Sprintf("DELETE %s failed with status: %s", url, rsp.Status),
+	}
+}
+
+// Send a HEAD request for `url`, and return whether the item exists,
+// and its size if it does.
+func (r *remoteHTTPProxyCache) head(ctx context.Context, url string) (bool, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false, -1, err
+	}
+
+	rsp, err := r.remote.Do(req)
+	if err != nil {
+		return false, -1, err
+	}
+	rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return true, rsp.ContentLength, nil
+	case http.StatusNotFound:
+		return false, -1, nil
+	}
+
+	return false, -1, &cache.Error{
+		Code: rsp.StatusCode,
+		Text: fmt.Sprintf("HEAD %s failed with status: %s", url, rsp.Status),
+	}
 }
 
 func requestURL(baseURL *url.URL, hash string, kind cache.EntryKind) string {
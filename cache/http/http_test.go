@@ -57,6 +57,14 @@ func (s *testServer) handler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
 		}
+
+	case http.MethodDelete:
+		_, ok := kindMap[hash]
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		delete(kindMap, hash)
 	}
 }
 
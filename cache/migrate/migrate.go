@@ -0,0 +1,321 @@
+// Package migrate copies the items of one CacheProxy backend to another,
+// for the sync command.
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/verify"
+)
+
+// The number of listed items which are checked in the destination with
+// each ContainsMany call.
+const batchSize = 1000
+
+// Options controls which items Run copies, and how.
+type Options struct {
+	// The kinds of items to copy.
+	Kinds []cache.EntryKind
+
+	// The maximum number of items copied at the same time.
+	Concurrency int
+
+	// If true, only report the items which would be copied.
+	DryRun bool
+
+	// If not empty, the progress is recorded in this file, and a later
+	// run with the same file continues where this one stopped.
+	StateFile string
+}
+
+// Stats counts the items processed by Run.
+type Stats struct {
+	// The items found in the source.
+	Listed int64
+	// The items which were already in the destination.
+	Present int64
+	// The items which were copied, or would be in dry-run mode.
+	Copied      int64
+	CopiedBytes int64
+	// The items which could not be copied.
+	Failed int64
+}
+
+// The state file records the last hash of each kind up to which all
+// the items have been processed. The entry of a kind is removed once
+// all of its items have been processed, so the next run starts over and
+// finds the items which were added in the meantime.
+type state map[string]string
+
+type syncer struct {
+	src    cache.CacheProxy
+	lister cache.Lister
+	dst    cache.CacheProxy
+	opts   Options
+	logger cache.Logger
+
+	state state
+	stats Stats
+}
+
+// Run copies the items of `src` which are missing from `dst`. `src` must
+// implement cache.Lister. Items are verified while they are copied (see
+// the verify package), and their size in `dst` is checked afterwards.
+// Items which fail are logged and counted, and don't stop the run. An
+// error is returned if listing fails, or if `ctx` is cancelled.
+func Run(ctx context.Context, src cache.CacheProxy, dst cache.CacheProxy,
+	opts Options, logger cache.Logger) (Stats, error) {
+
+	lister, ok := src.(cache.Lister)
+	if !ok {
+		return Stats{}, errors.New("The source backend does not support listing its items")
+	}
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+
+	s := &syncer{
+		src:    verify.New(src, "source", nil, logger),
+		lister: lister,
+		dst:    dst,
+		opts:   opts,
+		logger: logger,
+		state:  make(state),
+	}
+
+	if opts.StateFile != "" {
+		err := s.loadState()
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	for _, kind := range opts.Kinds {
+		err := s.syncKind(ctx, kind)
+		if err != nil {
+			return s.stats, err
+		}
+	}
+
+	return s.stats, nil
+}
+
+func (s *syncer) loadState() error {
+	data, err := ioutil.ReadFile(s.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &s.state)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the state file %s: %v", s.opts.StateFile, err)
+	}
+	return nil
+}
+
+// Write the state file atomically, so an interrupted run never leaves
+// it corrupt.
+func (s *syncer) saveState() error {
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.opts.StateFile),
+		filepath.Base(s.opts.StateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.opts.StateFile)
+}
+
+type item struct {
+	hash string
+	size int64
+}
+
+func (s *syncer) syncKind(ctx context.Context, kind cache.EntryKind) error {
+	after := s.state[kind.String()]
+	if after != "" {
+		s.logger.Printf("Resuming %s after %s", kind, after)
+	}
+
+	// The state is only advanced while every item succeeds, so that
+	// failed items are retried by the next run.
+	advanceState := s.opts.StateFile != "" && !s.opts.DryRun
+
+	var batch []item
+	flush := func() error {
+		ok := s.syncBatch(ctx, kind, batch)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !ok {
+			advanceState = false
+		}
+		if advanceState {
+			s.state[kind.String()] = batch[len(batch)-1].hash
+			err := s.saveState()
+			if err != nil {
+				return err
+			}
+		}
+		s.logger.Printf("Processed %d items: %d present, %d copied, %d failed",
+			atomic.LoadInt64(&s.stats.Listed), atomic.LoadInt64(&s.stats.Present),
+			atomic.LoadInt64(&s.stats.Copied), atomic.LoadInt64(&s.stats.Failed))
+		batch = batch[:0]
+		return nil
+	}
+
+	err := s.lister.List(ctx, kind, after, func(hash string, size int64) error {
+		atomic.AddInt64(&s.stats.Listed, 1)
+		batch = append(batch, item{hash: hash, size: size})
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		err = flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if advanceState {
+		delete(s.state, kind.String())
+		return s.saveState()
+	}
+	return nil
+}
+
+// Copy the items of `batch` which are missing from the destination,
+// and return true if there were no failures.
+func (s *syncer) syncBatch(ctx context.Context, kind cache.EntryKind, batch []item) bool {
+	hashes := make([]string, len(batch))
+	for i := range batch {
+		hashes[i] = batch[i].hash
+	}
+
+	// Some backends can only address CAS blobs by their size, eg
+	// grpc_proxy. The listed sizes of other kinds are not digest sizes.
+	if kind == cache.CAS {
+		sizes := make(map[string]int64, len(batch))
+		for _, it := range batch {
+			sizes[it.hash] = it.size
+		}
+		ctx = cache.WithDigestSizes(ctx, sizes)
+	}
+
+	// Errors are not fatal, the items which couldn't be checked are
+	// reported as missing and copied again.
+	found, err := s.dst.ContainsMany(ctx, kind, hashes)
+	if err != nil {
+		s.logger.Printf("Failed to check the destination for %d items: %v",
+			len(hashes), err)
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+	sem := make(chan struct{}, s.opts.Concurrency)
+
+	for i, it := range batch {
+		if found[i] {
+			atomic.AddInt64(&s.stats.Present, 1)
+			continue
+		}
+
+		if s.opts.DryRun {
+			s.logger.Printf("Would copy %s/%s (%d bytes)", kind, it.hash, it.size)
+			atomic.AddInt64(&s.stats.Copied, 1)
+			atomic.AddInt64(&s.stats.CopiedBytes, it.size)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(it item) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			size, err := s.copyItem(ctx, kind, it.hash)
+			if err != nil {
+				s.logger.Printf("Failed to copy %s/%s: %v", kind, it.hash, err)
+				atomic.AddInt64(&s.stats.Failed, 1)
+				atomic.StoreInt32(&failed, 1)
+				return
+			}
+			atomic.AddInt64(&s.stats.Copied, 1)
+			atomic.AddInt64(&s.stats.CopiedBytes, size)
+		}(it)
+	}
+
+	wg.Wait()
+
+	return atomic.LoadInt32(&failed) == 0
+}
+
+// Copy an item, and return its size.
+func (s *syncer) copyItem(ctx context.Context, kind cache.EntryKind, hash string) (int64, error) {
+	rc, size, err := s.src.Get(ctx, kind, hash)
+	if err != nil {
+		return -1, err
+	}
+	if rc == nil {
+		// Corrupt items are reported as missing, see the verify package.
+		return -1, errors.New("The item is missing or invalid in the source")
+	}
+
+	err = s.dst.Put(ctx, kind, hash, size, rc)
+	rc.Close()
+	if err != nil {
+		return -1, err
+	}
+
+	found, dstSize, err := s.dst.Contains(ctx, kind, hash)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to check the copy: %v", err)
+	}
+	if !found {
+		return -1, errors.New("The copy is missing from the destination")
+	}
+	if dstSize >= 0 && dstSize != size {
+		return -1, fmt.Errorf("The copy has %d bytes, expected %d", dstSize, size)
+	}
+
+	return size, nil
+}
@@ -0,0 +1,260 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/filesystem"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+func newFilesystemCache(t *testing.T, dir string) cache.CacheProxy {
+	logger := testutils.NewSilentLogger()
+	c, err := filesystem.New(dir, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func put(t *testing.T, c cache.CacheProxy, kind cache.EntryKind, hash string, data []byte) {
+	err := c.Put(context.Background(), kind, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contains(t *testing.T, c cache.CacheProxy, kind cache.EntryKind, hash string) bool {
+	found, _, err := c.Contains(context.Background(), kind, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestRun(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := newFilesystemCache(t, filepath.Join(dir, "src"))
+	dst := newFilesystemCache(t, filepath.Join(dir, "dst"))
+
+	var hashes []string
+	for i := 0; i < 10; i++ {
+		data, hash := testutils.RandomDataAndHash(100)
+		put(t, src, cache.CAS, hash, data)
+		hashes = append(hashes, hash)
+	}
+	// One of the blobs is already present.
+	present, presentHash := testutils.RandomDataAndHash(100)
+	put(t, src, cache.CAS, presentHash, present)
+	put(t, dst, cache.CAS, presentHash, present)
+
+	acData, acHash := testutils.RandomDataAndHash(16)
+	put(t, src, cache.RAW, acHash, acData)
+
+	ctx := context.Background()
+	logger := testutils.NewSilentLogger()
+
+	// A dry run copies nothing.
+	stats, err := Run(ctx, src, dst, Options{
+		Kinds:       []cache.EntryKind{cache.CAS},
+		Concurrency: 4,
+		DryRun:      true,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Listed != 11 || stats.Present != 1 || stats.Copied != 10 ||
+		stats.CopiedBytes != 1000 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if contains(t, dst, cache.CAS, hashes[0]) {
+		t.Fatal("Expected the dry run not to copy anything")
+	}
+
+	// Only the requested kinds are copied.
+	stats, err = Run(ctx, src, dst, Options{
+		Kinds:       []cache.EntryKind{cache.CAS},
+		Concurrency: 4,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 10 || stats.Failed != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	for _, hash := range hashes {
+		if !contains(t, dst, cache.CAS, hash) {
+			t.Fatalf("Expected %s to be copied", hash)
+		}
+	}
+	if contains(t, dst, cache.RAW, acHash) {
+		t.Fatal("Expected the RAW item not to be copied")
+	}
+}
+
+// sizedProxy reports CAS blobs as missing unless their sizes are known,
+// like grpc_proxy.
+type sizedProxy struct {
+	cache.CacheProxy
+}
+
+func (p sizedProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) error {
+	if kind == cache.CAS && cache.DigestSize(ctx, hash) != size {
+		return fmt.Errorf("Unexpected digest size %d for %s, expected %d",
+			cache.DigestSize(ctx, hash), hash, size)
+	}
+	return p.CacheProxy.Put(ctx, kind, hash, size, r)
+}
+
+func (p sizedProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	if kind == cache.CAS && cache.DigestSize(ctx, hash) < 0 {
+		return false, -1, nil
+	}
+	return p.CacheProxy.Contains(ctx, kind, hash)
+}
+
+func (p sizedProxy) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, p, kind, hashes, 1)
+}
+
+func TestRunSizedDestination(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	src := newFilesystemCache(t, filepath.Join(dir, "src"))
+	fsDst := newFilesystemCache(t, filepath.Join(dir, "dst"))
+	dst := sizedProxy{fsDst}
+
+	data, hash := testutils.RandomDataAndHash(100)
+	put(t, src, cache.CAS, hash, data)
+	present, presentHash := testutils.RandomDataAndHash(100)
+	put(t, src, cache.CAS, presentHash, present)
+	put(t, fsDst, cache.CAS, presentHash, present)
+
+	stats, err := Run(context.Background(), src, dst, Options{
+		Kinds:       []cache.EntryKind{cache.CAS},
+		Concurrency: 2,
+	}, testutils.NewSilentLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Present != 1 || stats.Copied != 1 || stats.Failed != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	src := newFilesystemCache(t, srcDir)
+	dst := newFilesystemCache(t, filepath.Join(dir, "dst"))
+	stateFile := filepath.Join(dir, "state.json")
+
+	data, hash := testutils.RandomDataAndHash(100)
+	put(t, src, cache.CAS, hash, data)
+
+	// A corrupt blob fails, and is not recorded in the state.
+	bad, badHash := testutils.RandomDataAndHash(100)
+	bad[0]++
+	put(t, src, cache.CAS, badHash, bad)
+
+	ctx := context.Background()
+	logger := testutils.NewSilentLogger()
+	opts := Options{
+		Kinds:       []cache.EntryKind{cache.CAS},
+		Concurrency: 2,
+		StateFile:   stateFile,
+	}
+
+	stats, err := Run(ctx, src, dst, opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 1 || stats.Failed != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if contains(t, dst, cache.CAS, badHash) {
+		t.Fatal("Expected the corrupt blob not to be copied")
+	}
+	_, err = os.Stat(stateFile)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected no state file after a failure, got %v", err)
+	}
+
+	// Once everything succeeds, the state of the kind is reset, so the
+	// next run finds new items.
+	err = os.Remove(filepath.Join(srcDir, "cas", badHash[:2], badHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = Run(ctx, src, dst, opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Listed != 1 || stats.Present != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	expectState(t, stateFile, state{})
+
+	newData, newHash := testutils.RandomDataAndHash(100)
+	put(t, src, cache.CAS, newHash, newData)
+	stats, err = Run(ctx, src, dst, opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Listed != 2 || stats.Present != 1 || stats.Copied != 1 {
+		t.Fatalf("Expected the new item to be copied, got %+v", stats)
+	}
+	if !contains(t, dst, cache.CAS, newHash) {
+		t.Fatal("Expected the new item to be copied")
+	}
+	expectState(t, stateFile, state{})
+
+	// An interrupted run resumes after the last recorded hash.
+	first, last := hash, newHash
+	if first > last {
+		first, last = last, first
+	}
+	err = ioutil.WriteFile(stateFile, []byte(`{"cas": "`+first+`"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = Run(ctx, src, dst, opts, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Listed != 1 || stats.Present != 1 {
+		t.Fatalf("Expected the run to resume after %s, got %+v", first, stats)
+	}
+	expectState(t, stateFile, state{})
+}
+
+func expectState(t *testing.T, stateFile string, expected state) {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s state
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected the state %v, got %v", expected, s)
+	}
+}
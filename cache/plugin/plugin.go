@@ -0,0 +1,475 @@
+// Package plugin provides a CacheProxy which stores blobs using an
+// external helper program, to support storage services which are not
+// built into bazel-remote.
+//
+// The helper is started with the configured command, and is sent one
+// request at a time on its stdin. It should keep running and handle
+// further requests until stdin is closed. Each request is a single line
+// of space-separated fields, where <kind> is one of "ac", "cas" or
+// "raw", and <hash> is a lowercase hex SHA256 hash:
+//
+//	get <kind> <hash>
+//	contains <kind> <hash>
+//	put <kind> <hash> <size>
+//
+// A put request is followed by exactly <size> bytes of data, which the
+// helper must read even if it fails to store them. The helper must
+// reply to each request with a single line on its stdout:
+//
+//	ok <size>       to get, followed by exactly <size> bytes of data
+//	ok <size>       to contains, if the item exists
+//	ok              to put, once the item has been stored
+//	missing         to get or contains, if the item does not exist
+//	error <message> to any request which failed
+//
+// Anything the helper writes to stderr is logged. Several helper
+// processes are started to handle concurrent requests, up to a
+// configurable limit. A helper which exits, or which does not follow
+// the protocol, is replaced by a new process for later requests.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The default for config.PluginProxyConfig.MaxConcurrency.
+const defaultMaxConcurrency = 4
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_plugin_cache_hits",
+		Help: "The total number of plugin backend cache hits",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_plugin_cache_misses",
+		Help: "The total number of plugin backend cache misses",
+	})
+	helperStarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_plugin_helper_starts",
+		Help: "The total number of plugin helper processes started",
+	})
+)
+
+type pluginCache struct {
+	command        []string
+	maxConcurrency int
+
+	// Holds a token for each request in progress.
+	sem chan struct{}
+
+	mu   sync.Mutex
+	idle []*helper
+
+	accessLogger cache.Logger
+	errorLogger  cache.Logger
+}
+
+// New returns a CacheProxy which uses the helper program described by
+// `cfg`. Uploads are performed synchronously, use the uploader package
+// to perform them in the background.
+func New(cfg *config.PluginProxyConfig, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	if len(cfg.Command) == 0 {
+		return nil, errors.New("The plugin backend requires a command")
+	}
+
+	errorLogger.Printf("Using plugin backend %s", strings.Join(cfg.Command, " "))
+
+	maxConcurrency := cfg.MaxConcurrency
+	if maxConcurrency == 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+
+	c := &pluginCache{
+		command:        cfg.Command,
+		maxConcurrency: maxConcurrency,
+		sem:            make(chan struct{}, maxConcurrency),
+		accessLogger:   accessLogger,
+		errorLogger:    errorLogger,
+	}
+
+	return c, nil
+}
+
+// pluginError is an error reported by the helper, which does not affect
+// later requests.
+type pluginError string
+
+func (e pluginError) Error() string {
+	return string(e)
+}
+
+// helper is a running helper process.
+type helper struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	bw     *bufio.Writer
+	br     *bufio.Reader
+	reused bool
+
+	// Set if the process must not be used for further requests, eg
+	// because it exited or a request was interrupted.
+	broken bool
+
+	// Set by watch if the process was killed, only read after the
+	// function returned by watch has been called.
+	killed bool
+}
+
+// logWriter logs the stderr output of helper processes.
+type logWriter struct {
+	logger cache.Logger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.Printf("plugin helper: %s", line)
+	}
+	return len(p), nil
+}
+
+func (c *pluginCache) start() (*helper, error) {
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stderr = &logWriter{logger: c.errorLogger}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start the plugin helper: %v", err)
+	}
+	helperStarts.Inc()
+
+	return &helper{
+		cmd:   cmd,
+		stdin: stdin,
+		bw:    bufio.NewWriter(stdin),
+		br:    bufio.NewReader(stdout),
+	}, nil
+}
+
+// Stop a helper process, and release its resources in the background.
+func (h *helper) stop() {
+	h.stdin.Close()
+	h.cmd.Process.Kill()
+	go h.cmd.Wait()
+}
+
+// acquire waits until the concurrency limit allows another request,
+// and returns an idle helper or starts a new one.
+func (c *pluginCache) acquire(ctx context.Context) (*helper, error) {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		h := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		h.reused = true
+		return h, nil
+	}
+	c.mu.Unlock()
+
+	h, err := c.start()
+	if err != nil {
+		<-c.sem
+		return nil, err
+	}
+	return h, nil
+}
+
+func (c *pluginCache) release(h *helper) {
+	if h.broken {
+		h.stop()
+	} else {
+		c.mu.Lock()
+		c.idle = append(c.idle, h)
+		c.mu.Unlock()
+	}
+
+	<-c.sem
+}
+
+// watch kills the helper if `ctx` is cancelled before the returned
+// function is called, since requests cannot be interrupted otherwise.
+func (h *helper) watch(ctx context.Context) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			h.killed = true
+			h.cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if h.killed {
+			h.broken = true
+		}
+	}
+}
+
+// Send a request with an optional body of `size` bytes, and return the
+// status and argument of the response line. Errors reported by the
+// helper are returned as a pluginError, other errors mark the helper as
+// broken.
+func (h *helper) roundTrip(request string, body io.Reader, size int64) (string, string, error) {
+	_, err := h.bw.WriteString(request + "\n")
+	if err == nil && body != nil {
+		var n int64
+		n, err = io.CopyN(h.bw, body, size)
+		if err != nil && n < size {
+			err = fmt.Errorf("expected %d bytes, found %d: %v", size, n, err)
+		}
+	}
+	if err == nil {
+		err = h.bw.Flush()
+	}
+	if err != nil {
+		h.broken = true
+		return "", "", err
+	}
+
+	line, err := h.br.ReadString('\n')
+	if err != nil {
+		h.broken = true
+		return "", "", fmt.Errorf("Failed to read the plugin helper response: %v", err)
+	}
+
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+	status, arg := fields[0], ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+
+	switch status {
+	case "ok", "missing":
+		return status, arg, nil
+	case "error":
+		return status, arg, pluginError(arg)
+	}
+
+	h.broken = true
+	return "", "", fmt.Errorf("Invalid plugin helper response: %q", line)
+}
+
+// parseSize returns the size in an "ok <size>" response line, or marks
+// the helper as broken if it is invalid.
+func (h *helper) parseSize(arg string) (int64, error) {
+	size, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || size < 0 {
+		h.broken = true
+		return -1, fmt.Errorf("Invalid size in plugin helper response: %q", arg)
+	}
+	return size, nil
+}
+
+// Return true if a request which failed with `err` should be retried
+// with a new helper. This is the case if an idle helper had exited.
+func shouldRetry(ctx context.Context, h *helper, err error) bool {
+	return err != nil && h.broken && h.reused && ctx.Err() == nil
+}
+
+func (c *pluginCache) logResponse(method string, kind cache.EntryKind, hash string, status string) {
+	c.accessLogger.Printf("PLUGIN %s %s/%s %s", method, kind, hash, status)
+}
+
+func (c *pluginCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	h, err := c.acquire(ctx)
+	if err != nil {
+		c.logResponse("UPLOAD", kind, hash, err.Error())
+		return err
+	}
+	defer c.release(h)
+
+	stop := h.watch(ctx)
+	request := fmt.Sprintf("put %s %s %d", kind, hash, size)
+	status, _, err := h.roundTrip(request, rdr, size)
+	stop()
+
+	if err == nil && status != "ok" {
+		h.broken = true
+		err = fmt.Errorf("Invalid plugin helper response to put: %q", status)
+	}
+	if err != nil {
+		c.logResponse("UPLOAD", kind, hash, err.Error())
+		return err
+	}
+
+	c.logResponse("UPLOAD", kind, hash, "OK")
+	return nil
+}
+
+func (c *pluginCache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	request := fmt.Sprintf("get %s %s", kind, hash)
+
+	for {
+		h, err := c.acquire(ctx)
+		if err != nil {
+			cacheMisses.Inc()
+			c.logResponse("DOWNLOAD", kind, hash, err.Error())
+			return nil, -1, err
+		}
+
+		// The helper is watched until the body has been read.
+		stop := h.watch(ctx)
+		status, arg, err := h.roundTrip(request, nil, 0)
+
+		var size int64
+		if err == nil && status == "ok" {
+			size, err = h.parseSize(arg)
+		}
+		if err != nil || status != "ok" {
+			stop()
+			c.release(h)
+
+			if shouldRetry(ctx, h, err) {
+				continue
+			}
+
+			cacheMisses.Inc()
+			if err != nil {
+				c.logResponse("DOWNLOAD", kind, hash, err.Error())
+				return nil, -1, err
+			}
+			c.logResponse("DOWNLOAD", kind, hash, "NOT FOUND")
+			return nil, -1, nil
+		}
+
+		cacheHits.Inc()
+		c.logResponse("DOWNLOAD", kind, hash, "OK")
+
+		return &bodyReader{
+			c:         c,
+			h:         h,
+			stop:      stop,
+			remaining: size,
+		}, size, nil
+	}
+}
+
+// bodyReader returns the data following a response to a get request,
+// and releases the helper when it is closed.
+type bodyReader struct {
+	c         *pluginCache
+	h         *helper
+	stop      func()
+	remaining int64
+	closed    bool
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.h.br.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.h.broken = true
+		return n, err
+	}
+	if r.remaining == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *bodyReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	// The rest of the data must be consumed before the helper can be
+	// used for another request.
+	if r.remaining > 0 && !r.h.broken {
+		_, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			r.h.broken = true
+		}
+	}
+
+	r.stop()
+	r.c.release(r.h)
+	return nil
+}
+
+func (c *pluginCache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	request := fmt.Sprintf("contains %s %s", kind, hash)
+
+	for {
+		h, err := c.acquire(ctx)
+		if err != nil {
+			return false, -1, err
+		}
+
+		stop := h.watch(ctx)
+		status, arg, err := h.roundTrip(request, nil, 0)
+		stop()
+
+		size := int64(-1)
+		if err == nil && status == "ok" {
+			size, err = h.parseSize(arg)
+		}
+		c.release(h)
+
+		if shouldRetry(ctx, h, err) {
+			continue
+		}
+		if err != nil {
+			c.logResponse("CONTAINS", kind, hash, err.Error())
+			return false, -1, err
+		}
+
+		if status == "missing" {
+			c.logResponse("CONTAINS", kind, hash, "NOT FOUND")
+			return false, -1, nil
+		}
+
+		c.logResponse("CONTAINS", kind, hash, "OK")
+		return true, size, nil
+	}
+}
+
+func (c *pluginCache) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, c, kind, hashes, c.maxConcurrency)
+}
@@ -0,0 +1,402 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+// The helper stores items in this directory when the test binary is run
+// as a plugin helper.
+const testDirEnv = "BAZEL_REMOTE_PLUGIN_TEST_DIR"
+
+// Hashes with special behaviour in the test helper.
+var (
+	crashHash = strings.Repeat("c", 64) // Exit without replying.
+	errorHash = strings.Repeat("e", 64) // Reply with an error.
+	slowHash  = strings.Repeat("5", 64) // Never reply.
+)
+
+// TestHelperProcess is not a real test, it implements the plugin
+// protocol when the test binary is started by the plugin backend.
+func TestHelperProcess(t *testing.T) {
+	dir := os.Getenv(testDirEnv)
+	if dir == "" {
+		return
+	}
+
+	err := runTestHelper(dir, os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runTestHelper(dir string, stdin io.Reader, stdout io.Writer) error {
+	br := bufio.NewReader(stdin)
+	bw := bufio.NewWriter(stdout)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return fmt.Errorf("invalid request: %q", line)
+		}
+		path := filepath.Join(dir, fields[1]+"-"+fields[2])
+
+		switch fields[2] {
+		case crashHash:
+			return fmt.Errorf("crashing")
+		case slowHash:
+			time.Sleep(time.Hour)
+		case errorHash:
+			if fields[0] == "put" {
+				size, _ := strconv.ParseInt(fields[3], 10, 64)
+				io.CopyN(ioutil.Discard, br, size)
+			}
+			fmt.Fprintf(bw, "error something went wrong\n")
+			bw.Flush()
+			continue
+		}
+
+		switch fields[0] {
+		case "get":
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(bw, "missing\n")
+			} else {
+				fmt.Fprintf(bw, "ok %d\n", len(data))
+				bw.Write(data)
+			}
+		case "contains":
+			fi, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintf(bw, "missing\n")
+			} else {
+				fmt.Fprintf(bw, "ok %d\n", fi.Size())
+			}
+		case "put":
+			size, _ := strconv.ParseInt(fields[3], 10, 64)
+			data := make([]byte, size)
+			_, err = io.ReadFull(br, data)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(path, data, 0644)
+			if err != nil {
+				fmt.Fprintf(bw, "error %v\n", err)
+			} else {
+				fmt.Fprintf(bw, "ok\n")
+			}
+		default:
+			return fmt.Errorf("invalid request: %q", line)
+		}
+		bw.Flush()
+
+		// Simulate a helper which exits while it is idle.
+		if _, err := os.Stat(filepath.Join(dir, "exit")); err == nil {
+			return nil
+		}
+	}
+}
+
+func newTestCache(t *testing.T, maxConcurrency int) (*pluginCache, string) {
+	dir := testutils.TempDir(t)
+	os.Setenv(testDirEnv, dir)
+
+	c, err := New(&config.PluginProxyConfig{
+		Command:        []string{os.Args[0], "-test.run=^TestHelperProcess$"},
+		MaxConcurrency: maxConcurrency,
+	}, testutils.NewSilentLogger(), testutils.NewSilentLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.(*pluginCache), dir
+}
+
+func numIdle(c *pluginCache) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.idle)
+}
+
+func get(c *pluginCache, kind cache.EntryKind, hash string) ([]byte, error) {
+	rc, size, err := c.Get(context.Background(), kind, hash)
+	if err != nil || rc == nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("expected %d bytes, found %d", size, len(data))
+	}
+	return data, nil
+}
+
+func TestPutGetContains(t *testing.T) {
+	c, dir := newTestCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	found, _, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil || found {
+		t.Fatalf("Expected a miss, got %v %v", found, err)
+	}
+	rc, _, err := c.Get(ctx, cache.CAS, hash)
+	if err != nil || rc != nil {
+		t.Fatalf("Expected a miss, got %v %v", rc, err)
+	}
+
+	err = c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, size, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil || !found || size != int64(len(data)) {
+		t.Fatalf("Expected a hit of size %d, got %v %d %v", len(data), found, size, err)
+	}
+	received, err := get(c, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("Received different data")
+	}
+
+	// The other keyspaces are separate.
+	found, _, err = c.Contains(ctx, cache.AC, hash)
+	if err != nil || found {
+		t.Fatalf("Expected a miss, got %v %v", found, err)
+	}
+
+	// The requests so far were sent to the same helper.
+	if numIdle(c) != 1 {
+		t.Fatalf("Expected 1 idle helper, found %d", numIdle(c))
+	}
+
+	_, missingHash := testutils.RandomDataAndHash(10)
+	results, err := c.ContainsMany(ctx, cache.CAS, []string{hash, missingHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !results[0] || results[1] {
+		t.Fatalf("Unexpected ContainsMany results: %v", results)
+	}
+
+	// Empty blobs have no data after the response line.
+	err = c.Put(ctx, cache.AC, missingHash, 0, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err = get(c, cache.AC, missingHash)
+	if err != nil || received == nil || len(received) != 0 {
+		t.Fatalf("Expected an empty blob, got %v %v", received, err)
+	}
+}
+
+func TestHelperErrors(t *testing.T) {
+	c, dir := newTestCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+
+	err := c.Put(ctx, cache.CAS, errorHash, 3, bytes.NewReader([]byte("abc")))
+	if err == nil || !strings.Contains(err.Error(), "something went wrong") {
+		t.Fatalf("Expected the helper's error, got %v", err)
+	}
+	_, _, err = c.Get(ctx, cache.CAS, errorHash)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	_, _, err = c.Contains(ctx, cache.CAS, errorHash)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	// Errors reported by the helper don't require a new process.
+	if numIdle(c) != 1 {
+		t.Fatalf("Expected 1 idle helper, found %d", numIdle(c))
+	}
+
+	// Uploads with too little data can't be completed, and the helper
+	// has to be replaced.
+	_, hash := testutils.RandomDataAndHash(10)
+	err = c.Put(ctx, cache.CAS, hash, 10, bytes.NewReader([]byte("abc")))
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if numIdle(c) != 0 {
+		t.Fatalf("Expected no idle helpers, found %d", numIdle(c))
+	}
+}
+
+func TestHelperRestart(t *testing.T) {
+	c, dir := newTestCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(100)
+
+	err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A helper which crashes fails the request, and is replaced.
+	_, _, err = c.Get(ctx, cache.CAS, crashHash)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if numIdle(c) != 0 {
+		t.Fatalf("Expected no idle helpers, found %d", numIdle(c))
+	}
+
+	received, err := get(c, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("Received different data")
+	}
+
+	// Requests to a helper which exited while it was idle are retried
+	// with a new helper.
+	err = ioutil.WriteFile(filepath.Join(dir, "exit"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		found, _, err := c.Contains(ctx, cache.CAS, hash)
+		if err != nil || !found {
+			t.Fatalf("Expected a hit, got %v %v", found, err)
+		}
+	}
+}
+
+func TestPartialRead(t *testing.T) {
+	c, dir := newTestCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(100000)
+
+	err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err := c.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(rc, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	// The rest of the data was skipped, so the helper can be reused.
+	found, _, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil || !found {
+		t.Fatalf("Expected a hit, got %v %v", found, err)
+	}
+	if numIdle(c) != 1 {
+		t.Fatalf("Expected 1 idle helper, found %d", numIdle(c))
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	c, dir := newTestCache(t, 2)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(100)
+
+	err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unread bodies keep their helpers busy.
+	var readers []io.ReadCloser
+	for i := 0; i < 2; i++ {
+		rc, _, err := c.Get(ctx, cache.CAS, hash)
+		if err != nil || rc == nil {
+			t.Fatalf("Expected a hit, got %v %v", rc, err)
+		}
+		readers = append(readers, rc)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, _, err = c.Contains(tctx, cache.CAS, hash)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the request to wait for a helper, got %v", err)
+	}
+
+	for _, rc := range readers {
+		rc.Close()
+	}
+
+	found, _, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil || !found {
+		t.Fatalf("Expected a hit, got %v %v", found, err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	c, dir := newTestCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := c.Get(ctx, cache.CAS, slowHash)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Expected the request to be interrupted")
+	}
+
+	// The helper was killed, and is replaced for later requests.
+	if numIdle(c) != 0 {
+		t.Fatalf("Expected no idle helpers, found %d", numIdle(c))
+	}
+	_, hash := testutils.RandomDataAndHash(10)
+	found, _, err := c.Contains(context.Background(), cache.CAS, hash)
+	if err != nil || found {
+		t.Fatalf("Expected a miss, got %v %v", found, err)
+	}
+}
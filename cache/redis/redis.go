@@ -0,0 +1,259 @@
+// Package redis provides a CacheProxy which stores small blobs in a
+// Redis-compatible key-value store, such as Redis, KeyDB or Dragonfly.
+package redis
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// The default for config.RedisProxyConfig.MaxObjectSize.
+	defaultMaxObjectSize = 1024 * 1024
+
+	// The maximum number of idle connections to keep open.
+	maxIdleConns = 32
+
+	// The maximum number of commands sent in one pipelined request by
+	// ContainsMany.
+	maxPipelineLength = 1000
+)
+
+var (
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_redis_cache_hits",
+		Help: "The total number of redis backend cache hits",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_redis_cache_misses",
+		Help: "The total number of redis backend cache misses",
+	})
+	skippedPuts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_redis_skipped_uploads",
+		Help: "The total number of uploads to the redis backend which were skipped because they exceeded max_object_size",
+	})
+)
+
+type redisCache struct {
+	pool          *pool
+	prefix        string
+	maxObjectSize int64
+	ttlMillis     int64
+	accessLogger  cache.Logger
+	errorLogger   cache.Logger
+}
+
+// New returns a CacheProxy which uses the Redis-compatible server
+// described by `cfg`. Blobs larger than cfg.MaxObjectSize are not
+// uploaded, so this backend is best suited for small items such as
+// ActionResults. Uploads are performed synchronously, use the uploader
+// package to perform them in the background.
+func New(cfg *config.RedisProxyConfig, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	errorLogger.Printf("Using redis backend %s", cfg.Address)
+
+	maxObjectSize := cfg.MaxObjectSize
+	if maxObjectSize == 0 {
+		maxObjectSize = defaultMaxObjectSize
+	}
+
+	c := &redisCache{
+		pool: &pool{
+			address:  cfg.Address,
+			password: cfg.Password,
+			db:       cfg.DB,
+			useTLS:   cfg.TLS,
+			max:      maxIdleConns,
+		},
+		prefix:        cfg.KeyPrefix,
+		maxObjectSize: maxObjectSize,
+		ttlMillis:     cfg.TTL.Milliseconds(),
+		accessLogger:  accessLogger,
+		errorLogger:   errorLogger,
+	}
+
+	return c, nil
+}
+
+func (c *redisCache) key(kind cache.EntryKind, hash string) []byte {
+	if c.prefix == "" {
+		return []byte(fmt.Sprintf("%s/%s", kind, hash))
+	}
+	return []byte(fmt.Sprintf("%s/%s/%s", c.prefix, kind, hash))
+}
+
+func (c *redisCache) logResponse(method string, key []byte, status string) {
+	c.accessLogger.Printf("REDIS %s %s %s", method, key, status)
+}
+
+func statusString(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+func (c *redisCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	key := c.key(kind, hash)
+
+	if size > c.maxObjectSize {
+		skippedPuts.Inc()
+		c.logResponse("UPLOAD", key, "SKIPPED (too large)")
+		return nil
+	}
+
+	// Contains can't tell empty values from missing keys, which both
+	// have length 0. The server answers requests for empty blobs itself.
+	if size == 0 {
+		c.logResponse("UPLOAD", key, "SKIPPED (empty)")
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(rdr, size+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("expected %d bytes, found %d", size, len(data))
+	}
+
+	cmd := [][]byte{[]byte("SET"), key, data}
+	if c.ttlMillis > 0 {
+		cmd = append(cmd, []byte("PX"), []byte(strconv.FormatInt(c.ttlMillis, 10)))
+	}
+
+	_, err = c.pool.do(ctx, cmd)
+	c.logResponse("UPLOAD", key, statusString(err))
+
+	return err
+}
+
+func (c *redisCache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	key := c.key(kind, hash)
+
+	replies, err := c.pool.do(ctx, [][]byte{[]byte("GET"), key})
+	if err != nil {
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", key, err.Error())
+		return nil, -1, err
+	}
+
+	if replies[0] == nil {
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", key, "NOT FOUND")
+		return nil, -1, nil
+	}
+
+	data, ok := replies[0].([]byte)
+	if !ok {
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", key, errProtocol.Error())
+		return nil, -1, errProtocol
+	}
+
+	// Consistent with Contains, in case another client stored it.
+	if len(data) == 0 {
+		cacheMisses.Inc()
+		c.logResponse("DOWNLOAD", key, "NOT FOUND (empty)")
+		return nil, -1, nil
+	}
+
+	cacheHits.Inc()
+	c.logResponse("DOWNLOAD", key, "OK")
+
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// Return the sizes of the given keys with one pipelined request. Missing
+// keys have size 0.
+func (c *redisCache) sizes(ctx context.Context, keys [][]byte) ([]int64, error) {
+	cmds := make([][][]byte, len(keys))
+	for i, key := range keys {
+		cmds[i] = [][]byte{[]byte("STRLEN"), key}
+	}
+
+	replies, err := c.pool.do(ctx, cmds...)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make([]int64, len(keys))
+	for i, reply := range replies {
+		size, ok := reply.(int64)
+		if !ok {
+			return nil, errProtocol
+		}
+		sizes[i] = size
+	}
+
+	return sizes, nil
+}
+
+func (c *redisCache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	key := c.key(kind, hash)
+
+	sizes, err := c.sizes(ctx, [][]byte{key})
+	if err != nil {
+		c.logResponse("CONTAINS", key, err.Error())
+		return false, -1, err
+	}
+
+	// Empty blobs are never uploaded.
+	if sizes[0] == 0 {
+		c.logResponse("CONTAINS", key, "NOT FOUND")
+		return false, -1, nil
+	}
+
+	c.logResponse("CONTAINS", key, "OK")
+	return true, sizes[0], nil
+}
+
+// Delete removes a key, if it exists.
+func (c *redisCache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	key := c.key(kind, hash)
+
+	_, err := c.pool.do(ctx, [][]byte{[]byte("DEL"), key})
+	c.logResponse("DELETE", key, statusString(err))
+
+	return err
+}
+
+// ContainsMany checks the keys with pipelined requests, rather than one
+// round trip per key.
+func (c *redisCache) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	found := make([]bool, len(hashes))
+
+	for start := 0; start < len(hashes); start += maxPipelineLength {
+		end := start + maxPipelineLength
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		keys := make([][]byte, 0, end-start)
+		for _, hash := range hashes[start:end] {
+			keys = append(keys, c.key(kind, hash))
+		}
+
+		sizes, err := c.sizes(ctx, keys)
+		c.accessLogger.Printf("REDIS CONTAINSMANY %d keys %s", len(keys), statusString(err))
+		if err != nil {
+			return found, err
+		}
+
+		for i, size := range sizes {
+			found[start+i] = size > 0
+		}
+	}
+
+	return found, nil
+}
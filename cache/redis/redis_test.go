@@ -0,0 +1,433 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+// fakeServer is an in-process stand-in for a Redis server, which supports
+// the commands used by the backend.
+type fakeServer struct {
+	listener net.Listener
+	password string
+
+	mu        sync.Mutex
+	values    map[string][]byte
+	ttls      map[string]int64 // In milliseconds.
+	flushes   int              // The number of reads which returned commands.
+	lastBatch int              // The number of commands in the last read.
+
+	// If non-nil, called before the replies to each read are sent.
+	beforeReply func()
+}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{
+		listener: l,
+		password: password,
+		values:   make(map[string][]byte),
+		ttls:     make(map[string]int64),
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeServer) readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReaderSize(c, 64*1024)
+	w := bufio.NewWriter(c)
+	authenticated := s.password == ""
+
+	batch := 0
+	for {
+		args, err := s.readCommand(r)
+		if err != nil {
+			return
+		}
+		batch++
+
+		if !authenticated && strings.ToUpper(args[0]) != "AUTH" {
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		} else {
+			s.handle(w, args, &authenticated)
+		}
+
+		// Reply once all the pipelined commands have been read.
+		if r.Buffered() == 0 {
+			s.mu.Lock()
+			s.flushes++
+			s.lastBatch = batch
+			s.mu.Unlock()
+			batch = 0
+
+			if s.beforeReply != nil {
+				s.beforeReply()
+			}
+			w.Flush()
+		}
+	}
+}
+
+func (s *fakeServer) handle(w *bufio.Writer, args []string, authenticated *bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		if args[1] != s.password {
+			w.WriteString("-WRONGPASS invalid password\r\n")
+			return
+		}
+		*authenticated = true
+		w.WriteString("+OK\r\n")
+	case "SELECT":
+		w.WriteString("+OK\r\n")
+	case "SET":
+		s.values[args[1]] = []byte(args[2])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ttl, _ := strconv.ParseInt(args[4], 10, 64)
+			s.ttls[args[1]] = ttl
+		}
+		w.WriteString("+OK\r\n")
+	case "GET":
+		v, ok := s.values[args[1]]
+		if !ok {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		w.Write(v)
+		w.WriteString("\r\n")
+	case "DEL":
+		_, ok := s.values[args[1]]
+		delete(s.values, args[1])
+		if ok {
+			w.WriteString(":1\r\n")
+		} else {
+			w.WriteString(":0\r\n")
+		}
+	case "STRLEN":
+		w.WriteString(":" + strconv.Itoa(len(s.values[args[1]])) + "\r\n")
+	default:
+		w.WriteString("-ERR unknown command\r\n")
+	}
+}
+
+func newTestCache(t *testing.T, s *fakeServer, cfg config.RedisProxyConfig) cache.CacheProxy {
+	cfg.Address = s.listener.Addr().String()
+	logger := testutils.NewSilentLogger()
+	c, err := New(&cfg, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := newFakeServer(t, "secret")
+	defer s.listener.Close()
+
+	c := newTestCache(t, s, config.RedisProxyConfig{
+		Password:  "secret",
+		DB:        2,
+		KeyPrefix: "test",
+		TTL:       time.Hour,
+	})
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	rc, _, err := c.Get(ctx, cache.AC, hash)
+	if rc != nil || err != nil {
+		t.Fatalf("Expected a miss, got %v %v", rc, err)
+	}
+
+	err = c.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "test/ac/" + hash
+	s.mu.Lock()
+	ttl := s.ttls[key]
+	s.mu.Unlock()
+	if ttl != time.Hour.Milliseconds() {
+		t.Fatalf("Expected a TTL of %d ms, got %d", time.Hour.Milliseconds(), ttl)
+	}
+
+	rc, size, err := c.Get(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("Expected to find the blob")
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if size != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Fatal("Got the wrong data")
+	}
+
+	found, size, err := c.Contains(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || size != int64(len(data)) {
+		t.Fatalf("Expected to find %d bytes, got %v %d", len(data), found, size)
+	}
+
+	found, _, err = c.Contains(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("Expected the CAS blob to be missing")
+	}
+
+	err = c.(cache.Deleter).Delete(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err = c.Contains(ctx, cache.AC, hash)
+	if err != nil || found {
+		t.Fatalf("Expected the blob to be deleted, got %v %v", found, err)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	s := newFakeServer(t, "secret")
+	defer s.listener.Close()
+
+	c := newTestCache(t, s, config.RedisProxyConfig{Password: "wrong"})
+
+	_, hash := testutils.RandomDataAndHash(16)
+	_, _, err := c.Get(context.Background(), cache.AC, hash)
+	if err == nil {
+		t.Fatal("Expected an authentication error")
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	s := newFakeServer(t, "")
+	defer s.listener.Close()
+
+	c := newTestCache(t, s, config.RedisProxyConfig{MaxObjectSize: 100})
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(101)
+	err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	numValues := len(s.values)
+	s.mu.Unlock()
+	if numValues != 0 {
+		t.Fatal("Expected the large blob to be skipped")
+	}
+}
+
+func TestEmptyBlobs(t *testing.T) {
+	s := newFakeServer(t, "")
+	defer s.listener.Close()
+
+	c := newTestCache(t, s, config.RedisProxyConfig{})
+
+	ctx := context.Background()
+	_, hash := testutils.RandomDataAndHash(16)
+	err := c.Put(ctx, cache.CAS, hash, 0, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	numValues := len(s.values)
+	s.mu.Unlock()
+	if numValues != 0 {
+		t.Fatal("Expected the empty blob to be skipped")
+	}
+
+	// Empty values stored by other clients are reported as missing by
+	// both Get and Contains.
+	s.mu.Lock()
+	s.values["cas/"+hash] = []byte{}
+	s.mu.Unlock()
+
+	rc, _, err := c.Get(ctx, cache.CAS, hash)
+	if rc != nil || err != nil {
+		t.Fatalf("Expected a miss, got %v %v", rc, err)
+	}
+	found, _, err := c.Contains(ctx, cache.CAS, hash)
+	if found || err != nil {
+		t.Fatalf("Expected a miss, got %v %v", found, err)
+	}
+}
+
+func TestContainsManyPipelined(t *testing.T) {
+	s := newFakeServer(t, "")
+	defer s.listener.Close()
+
+	c := newTestCache(t, s, config.RedisProxyConfig{})
+	ctx := context.Background()
+
+	var hashes []string
+	var expected []bool
+	// Few enough that the commands are sent in a single write.
+	for i := 0; i < 20; i++ {
+		data, hash := testutils.RandomDataAndHash(64)
+		hashes = append(hashes, hash)
+		expected = append(expected, i%3 == 0)
+		if i%3 == 0 {
+			err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	flushesBefore := s.flushes
+	s.mu.Unlock()
+
+	found, err := c.ContainsMany(ctx, cache.CAS, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range expected {
+		if found[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, found)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flushes-flushesBefore != 1 || s.lastBatch != len(hashes) {
+		t.Fatalf("Expected one round trip with %d commands, got %d round trips, the last with %d commands",
+			len(hashes), s.flushes-flushesBefore, s.lastBatch)
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	// A server which never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	logger := testutils.NewSilentLogger()
+	c, err := New(&config.RedisProxyConfig{Address: l.Addr().String()}, logger, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, hash := testutils.RandomDataAndHash(16)
+	_, _, err = c.Get(ctx, cache.AC, hash)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCancelledAfterReply(t *testing.T) {
+	s := newFakeServer(t, "")
+	defer s.listener.Close()
+	c := newTestCache(t, s, config.RedisProxyConfig{})
+	p := c.(*redisCache).pool
+
+	// The context is cancelled while the reply is on its way, so the
+	// connection might get a deadline in the past once the reply has been
+	// read.
+	ctx, cancel := context.WithCancel(context.Background())
+	s.beforeReply = cancel
+	_, hash := testutils.RandomDataAndHash(16)
+	_, _, err := c.Get(ctx, cache.AC, hash)
+	if err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+
+	p.mu.Lock()
+	idle := len(p.idle)
+	p.mu.Unlock()
+	if idle != 0 {
+		t.Fatalf("Expected the connection to be discarded, found %d idle connections", idle)
+	}
+
+	s.beforeReply = nil
+	_, _, err = c.Get(context.Background(), cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
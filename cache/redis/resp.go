@@ -0,0 +1,307 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A minimal client for the Redis serialization protocol (RESP), which is
+// also spoken by KeyDB, Dragonfly and other Redis-compatible servers.
+// Only the commands used by the cache backend are supported.
+
+const dialTimeout = 10 * time.Second
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+var errProtocol = errors.New("redis: protocol error")
+
+type conn struct {
+	nc net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// Write a command as an array of bulk strings. The command is buffered
+// until flush is called.
+func (c *conn) writeCommand(args ...[]byte) error {
+	_, err := fmt.Fprintf(c.bw, "*%d\r\n", len(args))
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		_, err = fmt.Fprintf(c.bw, "$%d\r\n", len(arg))
+		if err != nil {
+			return err
+		}
+		_, err = c.bw.Write(arg)
+		if err != nil {
+			return err
+		}
+		_, err = c.bw.WriteString("\r\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.br.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// Read one reply. Simple strings and bulk strings are returned as
+// []byte, integers as int64, arrays as []interface{}, and null replies
+// as nil. Error replies are returned as a redisError. Other errors mean
+// that the connection is unusable.
+func (c *conn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return append([]byte{}, line[1:]...), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.br, buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = c.readReply()
+			if _, isRedisErr := err.(redisError); err != nil && !isRedisErr {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, errProtocol
+}
+
+// pool manages a set of idle connections to one server.
+type pool struct {
+	address  string
+	password string
+	db       int
+	useTLS   bool
+
+	mu   sync.Mutex
+	idle []*conn
+	max  int
+}
+
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var nc net.Conn
+	var err error
+	if p.useTLS {
+		host, _, _ := net.SplitHostPort(p.address)
+		nc, err = tls.DialWithDialer(dialer, "tcp", p.address,
+			&tls.Config{ServerName: host})
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", p.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conn{
+		nc: nc,
+		br: bufio.NewReader(nc),
+		bw: bufio.NewWriter(nc),
+	}
+
+	var setup [][][]byte
+	if p.password != "" {
+		setup = append(setup, [][]byte{[]byte("AUTH"), []byte(p.password)})
+	}
+	if p.db != 0 {
+		setup = append(setup, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(p.db))})
+	}
+	if len(setup) > 0 {
+		_, err = c.pipeline(ctx, setup)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	return p.dial(ctx)
+}
+
+func (p *pool) put(c *conn) {
+	p.mu.Lock()
+	if len(p.idle) < p.max {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mu.Unlock()
+
+	if c != nil {
+		c.nc.Close()
+	}
+}
+
+// Send `cmds` in a single round trip, and return their replies. The
+// result is only nil if a connection-level error occurred, individual
+// commands can still have failed with a redisError.
+func (c *conn) pipeline(ctx context.Context, cmds [][][]byte) ([]interface{}, error) {
+	// Abort blocking reads and writes when the context is done.
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+	err := c.nc.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.nc.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	replies, err := c.roundTrip(ctx, cmds)
+
+	close(done)
+	<-exited
+	if ctx.Err() != nil {
+		// The watcher may have set a deadline in the past after the
+		// replies were read, so the connection can't be reused.
+		return nil, ctx.Err()
+	}
+
+	return replies, err
+}
+
+func (c *conn) roundTrip(ctx context.Context, cmds [][][]byte) ([]interface{}, error) {
+	for _, cmd := range cmds {
+		err := c.writeCommand(cmd...)
+		if err != nil {
+			return nil, c.contextError(ctx, err)
+		}
+	}
+	err := c.bw.Flush()
+	if err != nil {
+		return nil, c.contextError(ctx, err)
+	}
+
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		var reply interface{}
+		reply, err = c.readReply()
+		if rerr, ok := err.(redisError); ok {
+			replies[i] = rerr
+			if firstErr == nil {
+				firstErr = rerr
+			}
+			continue
+		}
+		if err != nil {
+			return nil, c.contextError(ctx, err)
+		}
+		replies[i] = reply
+	}
+
+	return replies, firstErr
+}
+
+// Prefer the context's error to the resulting I/O timeout. The socket
+// deadline is the context's deadline, so the I/O can time out before
+// the context reports that its deadline has passed.
+func (c *conn) contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		deadline, ok := ctx.Deadline()
+		if ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// do runs `cmds` on a pooled connection. Connections which failed with
+// anything other than a redisError are closed rather than reused.
+func (p *pool) do(ctx context.Context, cmds ...[][]byte) ([]interface{}, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := c.pipeline(ctx, cmds)
+	if replies == nil {
+		c.nc.Close()
+		return nil, err
+	}
+
+	p.put(c)
+	return replies, err
+}
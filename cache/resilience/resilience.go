@@ -0,0 +1,350 @@
+// Package resilience provides a CacheProxy wrapper which retries failed
+// requests to the wrapped backend, and temporarily bypasses the backend
+// with a circuit breaker when it keeps failing.
+package resilience
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	backendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bazel_remote_proxy_backend_healthy",
+		Help: "Whether the circuit breaker of the proxy backend is closed (1) or open/half-open (0)",
+	}, []string{"backend"})
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_proxy_retries",
+		Help: "The total number of retried proxy backend requests",
+	}, []string{"backend"})
+	bypassed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_proxy_bypassed_requests",
+		Help: "The total number of proxy backend requests skipped because the circuit breaker was open",
+	}, []string{"backend"})
+	circuitOpened = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_proxy_circuit_opened",
+		Help: "The total number of times the circuit breaker of the proxy backend was opened",
+	}, []string{"backend"})
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+// The circuit breaker states.
+const (
+	// Requests are sent to the backend.
+	Closed State = iota
+	// Requests bypass the backend.
+	Open
+	// A single probe request is sent to the backend, to check if it
+	// has recovered.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Status describes the health of a wrapped backend.
+type Status struct {
+	Name                string
+	State               string
+	ConsecutiveFailures int
+}
+
+// The wrappers returned by New, for Statuses.
+var (
+	registryMu sync.Mutex
+	registry   []*resilientProxy
+)
+
+// Statuses returns the health of the backends wrapped by New, in the
+// order they were created.
+func Statuses() []Status {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	var statuses []Status
+	for _, p := range registry {
+		statuses = append(statuses, p.status())
+	}
+	return statuses
+}
+
+type resilientProxy struct {
+	backend     cache.CacheProxy
+	name        string
+	cfg         config.ProxyResilienceConfig
+	errorLogger cache.Logger
+
+	mu        sync.Mutex
+	state     State
+	failures  int // The number of consecutive failures.
+	openUntil time.Time
+	probing   bool // Whether the half-open probe is in flight.
+}
+
+// New returns a CacheProxy which retries failed Get, Contains and
+// ContainsMany calls to `backend` up to cfg.MaxRetries times, with
+// jittered exponential backoff. Put calls are only retried if their
+// reader implements io.Seeker, so that it can be rewound.
+//
+// After cfg.FailureThreshold consecutive failed requests, the backend is
+// bypassed for cfg.OpenDuration: Get, Contains and ContainsMany calls
+// fail with cache.ErrBypassed and Put calls fail with a cache.Error with
+// code http.StatusServiceUnavailable, without contacting the backend.
+// Then a single probe request is let through, which closes the circuit
+// again if it succeeds.
+//
+// Requests which fail because the caller's context is done, or with a
+// 4xx cache.Error (other than 408 and 429), are not retried and do not
+// count as failures. `name` identifies the backend in log messages,
+// metrics and Statuses.
+func New(backend cache.CacheProxy, name string, cfg config.ProxyResilienceConfig,
+	errorLogger cache.Logger) cache.CacheProxy {
+
+	p := &resilientProxy{
+		backend:     backend,
+		name:        name,
+		cfg:         cfg,
+		errorLogger: errorLogger,
+	}
+	backendHealthy.WithLabelValues(name).Set(1)
+
+	registryMu.Lock()
+	registry = append(registry, p)
+	registryMu.Unlock()
+
+	return p
+}
+
+func (p *resilientProxy) status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return Status{
+		Name:                p.name,
+		State:               p.state.String(),
+		ConsecutiveFailures: p.failures,
+	}
+}
+
+// Return true if a request may be sent to the backend.
+func (p *resilientProxy) allow() bool {
+	if p.cfg.FailureThreshold <= 0 {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state == Open && !time.Now().Before(p.openUntil) {
+		p.state = HalfOpen
+	}
+
+	switch p.state {
+	case Open:
+		return false
+	case HalfOpen:
+		if p.probing {
+			return false
+		}
+		p.probing = true
+	}
+
+	return true
+}
+
+func (p *resilientProxy) isOpen() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.state == Open
+}
+
+// Update the circuit breaker with the result of a request.
+func (p *resilientProxy) record(ctx context.Context, err error) {
+	if p.cfg.FailureThreshold <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wasProbe := p.probing && p.state == HalfOpen
+	if wasProbe {
+		p.probing = false
+	}
+
+	if ctx.Err() != nil {
+		// The result says nothing about the backend's health.
+		return
+	}
+
+	if !cache.IsBackendFailure(err) {
+		p.failures = 0
+		if p.state != Closed {
+			p.errorLogger.Printf("Proxy backend %s has recovered", p.name)
+			p.state = Closed
+			backendHealthy.WithLabelValues(p.name).Set(1)
+		}
+		return
+	}
+
+	p.failures++
+	if p.state == Open {
+		return
+	}
+	if wasProbe || p.failures >= p.cfg.FailureThreshold {
+		p.errorLogger.Printf("Bypassing proxy backend %s for %v after %d consecutive failures: %v",
+			p.name, p.cfg.OpenDuration, p.failures, err)
+		p.state = Open
+		p.openUntil = time.Now().Add(p.cfg.OpenDuration)
+		backendHealthy.WithLabelValues(p.name).Set(0)
+		circuitOpened.WithLabelValues(p.name).Inc()
+	}
+}
+
+// Return the delay before the given retry, counting from 1.
+func (p *resilientProxy) backoff(retry int) time.Duration {
+	delay := p.cfg.MaxBackoff
+	if retry < 30 {
+		d := p.cfg.InitialBackoff << uint(retry-1)
+		if p.cfg.MaxBackoff == 0 || d < p.cfg.MaxBackoff {
+			delay = d
+		}
+	}
+
+	// Add up to 50% jitter, so that retries from concurrent requests
+	// are spread out.
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Call `op`, retrying it up to cfg.MaxRetries times if `retry` is true,
+// and record the result in the circuit breaker. The caller must have
+// checked allow() first.
+func (p *resilientProxy) call(ctx context.Context, retry bool, op func() error) error {
+	err := op()
+	for attempt := 1; retry && attempt <= p.cfg.MaxRetries; attempt++ {
+		if !cache.IsBackendFailure(err) || ctx.Err() != nil || p.isOpen() {
+			break
+		}
+
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			p.record(ctx, err)
+			return err
+		}
+
+		retries.WithLabelValues(p.name).Inc()
+		err = op()
+	}
+
+	p.record(ctx, err)
+	return err
+}
+
+func (p *resilientProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	if !p.allow() {
+		bypassed.WithLabelValues(p.name).Inc()
+		return &cache.Error{
+			Code: http.StatusServiceUnavailable,
+			Text: fmt.Sprintf("Proxy backend %s is unavailable", p.name),
+		}
+	}
+
+	seeker, canRetry := rdr.(io.Seeker)
+	var offset int64
+	if canRetry {
+		var err error
+		offset, err = seeker.Seek(0, io.SeekCurrent)
+		canRetry = err == nil
+	}
+
+	first := true
+	return p.call(ctx, canRetry, func() error {
+		if !first {
+			_, err := seeker.Seek(offset, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+		first = false
+		return p.backend.Put(ctx, kind, hash, size, rdr)
+	})
+}
+
+func (p *resilientProxy) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	if !p.allow() {
+		bypassed.WithLabelValues(p.name).Inc()
+		return nil, -1, cache.ErrBypassed
+	}
+
+	var rc io.ReadCloser
+	var size int64
+	err := p.call(ctx, true, func() error {
+		var err error
+		rc, size, err = p.backend.Get(ctx, kind, hash)
+		if err != nil && rc != nil {
+			rc.Close()
+			rc = nil
+		}
+		return err
+	})
+
+	return rc, size, err
+}
+
+func (p *resilientProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	if !p.allow() {
+		bypassed.WithLabelValues(p.name).Inc()
+		return false, -1, cache.ErrBypassed
+	}
+
+	var found bool
+	var size int64
+	err := p.call(ctx, true, func() error {
+		var err error
+		found, size, err = p.backend.Contains(ctx, kind, hash)
+		return err
+	})
+
+	return found, size, err
+}
+
+func (p *resilientProxy) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	if !p.allow() {
+		bypassed.WithLabelValues(p.name).Inc()
+		return make([]bool, len(hashes)), cache.ErrBypassed
+	}
+
+	var found []bool
+	err := p.call(ctx, true, func() error {
+		var err error
+		found, err = p.backend.ContainsMany(ctx, kind, hashes)
+		return err
+	})
+
+	return found, err
+}
@@ -0,0 +1,264 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+var errUnavailable = errors.New("backend unavailable")
+
+// A backend which fails the first `failures` requests with `err`, and
+// counts the requests it receives.
+type flakyBackend struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	calls    int
+	puts     []string
+}
+
+func (b *flakyBackend) fail() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.calls++
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return nil
+}
+
+func (b *flakyBackend) numCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.calls
+}
+
+func (b *flakyBackend) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	data, _ := ioutil.ReadAll(rdr)
+	err := b.fail()
+	if err == nil {
+		b.mu.Lock()
+		b.puts = append(b.puts, string(data))
+		b.mu.Unlock()
+	}
+	return err
+}
+
+func (b *flakyBackend) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	err := b.fail()
+	if err != nil {
+		return nil, -1, err
+	}
+	return ioutil.NopCloser(strings.NewReader("foo")), 3, nil
+}
+
+func (b *flakyBackend) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	err := b.fail()
+	if err != nil {
+		return false, -1, err
+	}
+	return true, 3, nil
+}
+
+func (b *flakyBackend) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	found := make([]bool, len(hashes))
+	err := b.fail()
+	if err != nil {
+		return found, err
+	}
+	for i := range found {
+		found[i] = true
+	}
+	return found, nil
+}
+
+func TestRetries(t *testing.T) {
+	backend := &flakyBackend{failures: 2, err: errUnavailable}
+	p := New(backend, "TestRetries", config.ProxyResilienceConfig{
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+	}, testutils.NewSilentLogger())
+
+	rc, size, err := p.Get(context.Background(), cache.CAS, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if size != 3 || backend.numCalls() != 3 {
+		t.Fatalf("Expected a hit after 3 attempts, got size %d after %d attempts",
+			size, backend.numCalls())
+	}
+
+	// Out of retries.
+	backend.failures = 3
+	_, _, err = p.Contains(context.Background(), cache.CAS, "foo")
+	if err != errUnavailable {
+		t.Fatalf("Expected %v, got %v", errUnavailable, err)
+	}
+}
+
+func TestNoRetryForClientErrors(t *testing.T) {
+	backend := &flakyBackend{
+		failures: 1,
+		err:      &cache.Error{Code: http.StatusForbidden, Text: "forbidden"},
+	}
+	p := New(backend, "TestNoRetryForClientErrors", config.ProxyResilienceConfig{
+		MaxRetries:       2,
+		InitialBackoff:   time.Millisecond,
+		FailureThreshold: 1,
+		OpenDuration:     time.Hour,
+	}, testutils.NewSilentLogger())
+
+	_, err := p.ContainsMany(context.Background(), cache.CAS, []string{"foo"})
+	if err == nil || backend.numCalls() != 1 {
+		t.Fatalf("Expected one failed attempt, got %d attempts and error %v",
+			backend.numCalls(), err)
+	}
+
+	// The backend responded, so it is healthy.
+	if s := p.(*resilientProxy).status(); s.State != "closed" {
+		t.Fatalf("Expected the circuit to be closed, got %s", s.State)
+	}
+}
+
+func TestPutRetries(t *testing.T) {
+	backend := &flakyBackend{failures: 1, err: errUnavailable}
+	p := New(backend, "TestPutRetries", config.ProxyResilienceConfig{
+		MaxRetries:     1,
+		InitialBackoff: time.Millisecond,
+	}, testutils.NewSilentLogger())
+
+	// Seekable readers are rewound and retried.
+	err := p.Put(context.Background(), cache.CAS, "foo", 3, strings.NewReader("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.puts) != 1 || backend.puts[0] != "foo" {
+		t.Fatalf("Expected the retry to upload \"foo\", got %q", backend.puts)
+	}
+
+	// Other readers can't be replayed.
+	backend.failures = 1
+	err = p.Put(context.Background(), cache.CAS, "foo", 3,
+		ioutil.NopCloser(strings.NewReader("foo")))
+	if err != errUnavailable {
+		t.Fatalf("Expected %v, got %v", errUnavailable, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	backend := &flakyBackend{failures: 3, err: errUnavailable}
+	p := New(backend, "TestCircuitBreaker", config.ProxyResilienceConfig{
+		FailureThreshold: 3,
+		OpenDuration:     50 * time.Millisecond,
+	}, testutils.NewSilentLogger())
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, _, err := p.Contains(ctx, cache.AC, "foo")
+		if err != errUnavailable {
+			t.Fatalf("Expected %v, got %v", errUnavailable, err)
+		}
+	}
+
+	// The backend is bypassed while the circuit is open.
+	found, _, err := p.Contains(ctx, cache.AC, "foo")
+	if found || err != cache.ErrBypassed {
+		t.Fatalf("Expected a bypassed miss, got %v %v", found, err)
+	}
+	rc, _, err := p.Get(ctx, cache.AC, "foo")
+	if rc != nil || err != cache.ErrBypassed {
+		t.Fatalf("Expected a bypassed miss, got %v %v", rc, err)
+	}
+	err = p.Put(ctx, cache.AC, "foo", 3, strings.NewReader("foo"))
+	cerr, ok := err.(*cache.Error)
+	if !ok || cerr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a 503 error, got %v", err)
+	}
+	if backend.numCalls() != 3 {
+		t.Fatalf("Expected the backend to be bypassed, got %d calls", backend.numCalls())
+	}
+
+	found = false
+	for _, s := range Statuses() {
+		if s.Name == "TestCircuitBreaker" {
+			found = true
+			if s.State != "open" || s.ConsecutiveFailures != 3 {
+				t.Fatalf("Unexpected status: %+v", s)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Expected to find the backend in Statuses()")
+	}
+
+	// After OpenDuration, a probe request closes the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	found, _, err = p.Contains(ctx, cache.AC, "foo")
+	if !found || err != nil {
+		t.Fatalf("Expected a hit, got %v %v", found, err)
+	}
+	if s := p.(*resilientProxy).status(); s.State != "closed" || s.ConsecutiveFailures != 0 {
+		t.Fatalf("Unexpected status: %+v", s)
+	}
+}
+
+func TestFailedProbeReopens(t *testing.T) {
+	backend := &flakyBackend{failures: 2, err: errUnavailable}
+	p := New(backend, "TestFailedProbeReopens", config.ProxyResilienceConfig{
+		FailureThreshold: 1,
+		OpenDuration:     10 * time.Millisecond,
+	}, testutils.NewSilentLogger()).(*resilientProxy)
+	ctx := context.Background()
+
+	p.Contains(ctx, cache.CAS, "foo")
+	time.Sleep(20 * time.Millisecond)
+
+	if !p.allow() {
+		t.Fatal("Expected a probe request to be allowed")
+	}
+	if p.allow() {
+		t.Fatal("Expected only one probe request to be allowed")
+	}
+	p.record(ctx, errUnavailable)
+
+	if s := p.status(); s.State != "open" {
+		t.Fatalf("Expected the circuit to be open again, got %s", s.State)
+	}
+}
+
+func TestCancelledNotAFailure(t *testing.T) {
+	backend := &flakyBackend{failures: 1, err: context.Canceled}
+	p := New(backend, "TestCancelledNotAFailure", config.ProxyResilienceConfig{
+		MaxRetries:       3,
+		InitialBackoff:   time.Millisecond,
+		FailureThreshold: 1,
+		OpenDuration:     time.Hour,
+	}, testutils.NewSilentLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := p.Get(ctx, cache.CAS, "foo")
+	if err != context.Canceled || backend.numCalls() != 1 {
+		t.Fatalf("Expected one cancelled attempt, got %d attempts and error %v",
+			backend.numCalls(), err)
+	}
+	if s := p.(*resilientProxy).status(); s.State != "closed" {
+		t.Fatalf("Expected the circuit to be closed, got %s", s.State)
+	}
+}
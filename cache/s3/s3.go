@@ -1,34 +1,42 @@
 package s3
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/buchgr/bazel-remote/cache"
 	"github.com/buchgr/bazel-remote/config"
 	"github.com/minio/minio-go/v6"
 	"github.com/minio/minio-go/v6/pkg/credentials"
+	"github.com/minio/minio-go/v6/pkg/encrypt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const numUploaders = 100
-const maxQueuedUploads = 1000000
+// The maximum number of concurrent StatObject requests made by ContainsMany.
+const maxConcurrentContains = 32
 
-type uploadReq struct {
-	hash string
-	size int64
-	kind cache.EntryKind
-	rdr  io.Reader
-}
+// The default for config.S3CloudStorageConfig.MultipartPartSize.
+const defaultPartSize = 64 * 1024 * 1024
+
+// The number of objects requested per ListObjectsV2 call.
+const maxListKeys = 1000
 
 type s3Cache struct {
 	logger       cache.Logger
 	mcore        *minio.Core
 	prefix       string
 	bucket       string
-	uploadQueue  chan<- uploadReq
+	sse          encrypt.ServerSide
+	readSSE      encrypt.ServerSide // Only set for SSE-C.
+	storageClass string
+	partSize     int64
 	accessLogger cache.Logger
 	errorLogger  cache.Logger
 }
@@ -47,67 +55,120 @@ var (
 // Used in place of minio's verbose "NoSuchKey" error.
 var errNotFound = errors.New("NOT FOUND")
 
-// New returns a new instance of the S3-API based cache
+// New returns a new instance of the S3-API based cache. Uploads are
+// performed synchronously, use the uploader package to perform them
+// in the background.
 func New(s3Config *config.S3CloudStorageConfig, accessLogger cache.Logger,
 	errorLogger cache.Logger) (cache.CacheProxy, error) {
 
 	errorLogger.Printf("Using S3 backend.")
 
-	var minioCore *minio.Core
-	var err error
-
-	if s3Config.IAMRoleEndpoint != "" {
-		// Initialize minio client object with IAM credentials
-		creds := credentials.NewIAM(s3Config.IAMRoleEndpoint)
-		minioClient, err := minio.NewWithCredentials(
-			s3Config.Endpoint,
-			creds,
-			!s3Config.DisableSSL,
-			s3Config.Region,
-		)
-
-		if err != nil {
-			return nil, err
-		}
+	sse, err := newSSE(s3Config)
+	if err != nil {
+		return nil, err
+	}
 
-		minioCore = &minio.Core{
-			Client: minioClient,
-		}
-	} else {
-		// Initialize minio client object.
-		minioCore, err = minio.NewCore(
-			s3Config.Endpoint,
-			s3Config.AccessKeyID,
-			s3Config.SecretAccessKey,
-			!s3Config.DisableSSL,
-		)
+	minioClient, err := minio.NewWithOptions(s3Config.Endpoint, &minio.Options{
+		Creds:  newCredentials(s3Config),
+		Secure: !s3Config.DisableSSL,
+		Region: s3Config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	partSize := s3Config.MultipartPartSize
+	if partSize == 0 {
+		partSize = defaultPartSize
 	}
 
-	uploadQueue := make(chan uploadReq, maxQueuedUploads)
 	c := &s3Cache{
-		mcore:        minioCore,
+		mcore:        &minio.Core{Client: minioClient},
 		prefix:       s3Config.Prefix,
 		bucket:       s3Config.Bucket,
-		uploadQueue:  uploadQueue,
+		sse:          sse,
+		storageClass: s3Config.StorageClass,
+		partSize:     partSize,
 		accessLogger: accessLogger,
 		errorLogger:  errorLogger,
 	}
 
-	for uploader := 0; uploader < numUploaders; uploader++ {
-		go func() {
-			for item := range uploadQueue {
-				c.uploadFile(item)
-			}
-		}()
+	// SSE-C keys must also be sent when reading objects.
+	if sse != nil && sse.Type() == encrypt.SSEC {
+		c.readSSE = sse
 	}
 
 	return c, nil
 }
 
+// Return the credentials specified by `s3Config`. If neither static keys
+// nor an IAM role endpoint are specified, use the standard AWS credential
+// chain: environment variables, then the shared credentials file, then a
+// web identity token file. Requests are anonymous if none of these
+// provide credentials.
+func newCredentials(s3Config *config.S3CloudStorageConfig) *credentials.Credentials {
+	if s3Config.AccessKeyID != "" {
+		return credentials.NewStaticV4(s3Config.AccessKeyID,
+			s3Config.SecretAccessKey, "")
+	}
+
+	if s3Config.IAMRoleEndpoint != "" {
+		return credentials.NewIAM(s3Config.IAMRoleEndpoint)
+	}
+
+	providers := []credentials.Provider{
+		&credentials.EnvAWS{},
+		credentialsProvider{credentials.NewFileAWSCredentials(
+			s3Config.SharedCredentialsFile, s3Config.Profile)},
+	}
+
+	tokenFile := s3Config.WebIdentityTokenFile
+	roleARN := s3Config.RoleARN
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if tokenFile != "" && roleARN != "" {
+		providers = append(providers, newWebIdentity(s3Config.STSEndpoint,
+			roleARN, tokenFile))
+	}
+
+	return credentials.NewChainCredentials(providers)
+}
+
+// credentialsProvider adapts a *credentials.Credentials, so that it can
+// be used in a credentials.Chain.
+type credentialsProvider struct {
+	*credentials.Credentials
+}
+
+func (p credentialsProvider) Retrieve() (credentials.Value, error) {
+	return p.Get()
+}
+
+// Return the server-side encryption specified by `s3Config`, or nil.
+func newSSE(s3Config *config.S3CloudStorageConfig) (encrypt.ServerSide, error) {
+	switch s3Config.SSE {
+	case config.S3SSES3:
+		return encrypt.NewSSE(), nil
+	case config.S3SSEKMS:
+		return encrypt.NewSSEKMS(s3Config.SSEKMSKeyID, nil)
+	case config.S3SSEC:
+		data, err := ioutil.ReadFile(s3Config.SSECKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode SSE-C key file %s: %v",
+				s3Config.SSECKeyFile, err)
+		}
+		return encrypt.NewSSEC(key)
+	}
+
+	return nil, nil
+}
+
 func (c *s3Cache) objectKey(hash string, kind cache.EntryKind) string {
 	return fmt.Sprintf("%s/%s/%s", c.prefix, kind, hash)
 }
@@ -122,47 +183,67 @@ func (c *s3Cache) logResponse(log cache.Logger, method, bucket, key string, err
 	c.accessLogger.Printf("S3 %s %s %s %s", method, bucket, key, status)
 }
 
-func (c *s3Cache) uploadFile(item uploadReq) {
-	uploadDigest := ""
-	if item.kind == cache.CAS {
-		uploadDigest = item.hash
-	}
+func (c *s3Cache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	var err error
+	if size >= c.partSize {
+		// Let minio split the upload into parts.
+		_, err = c.mcore.Client.PutObjectWithContext(
+			ctx,
+			c.bucket,                // bucketName
+			c.objectKey(hash, kind), // objectName
+			rdr,                     // reader
+			size,                    // objectSize
+			minio.PutObjectOptions{
+				ContentType:          "application/octet-stream",
+				ServerSideEncryption: c.sse,
+				StorageClass:         c.storageClass,
+				PartSize:             uint64(c.partSize),
+				// minio-go v6.0.44 shares an error variable between
+				// its part upload goroutines, so a failed part could
+				// be reported as a successful upload.
+				NumThreads: 1,
+			}, // opts
+		)
+	} else {
+		uploadDigest := ""
+		if kind == cache.CAS {
+			uploadDigest = hash
+		}
 
-	_, err := c.mcore.PutObject(
-		c.bucket,                          // bucketName
-		c.objectKey(item.hash, item.kind), // objectName
-		item.rdr,                          // reader
-		item.size,                         // objectSize
-		"",                                // md5base64
-		uploadDigest,                      // sha256
-		map[string]string{
+		metadata := map[string]string{
 			"Content-Type": "application/octet-stream",
-		}, // metadata
-		nil, // sse
-	)
-
-	c.logResponse(c.accessLogger, "UPLOAD", c.bucket, c.objectKey(item.hash, item.kind), err)
-}
+		}
+		if c.storageClass != "" {
+			metadata["X-Amz-Storage-Class"] = c.storageClass
+		}
 
-func (c *s3Cache) Put(kind cache.EntryKind, hash string, size int64, rdr io.Reader) {
-	select {
-	case c.uploadQueue <- uploadReq{
-		hash: hash,
-		size: size,
-		kind: kind,
-		rdr:  rdr,
-	}:
-	default:
-		c.errorLogger.Printf("too many uploads queued\n")
+		_, err = c.mcore.PutObjectWithContext(
+			ctx,
+			c.bucket,                // bucketName
+			c.objectKey(hash, kind), // objectName
+			rdr,                     // reader
+			size,                    // objectSize
+			"",                      // md5base64
+			uploadDigest,            // sha256
+			metadata,                // metadata
+			c.sse,                   // sse
+		)
 	}
+
+	c.logResponse(c.accessLogger, "UPLOAD", c.bucket, c.objectKey(hash, kind), err)
+
+	return err
 }
 
-func (c *s3Cache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+func (c *s3Cache) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
 
-	object, info, _, err := c.mcore.GetObject(
-		c.bucket,                 // bucketName
-		c.objectKey(hash, kind),  // objectName
-		minio.GetObjectOptions{}, // opts
+	object, info, _, err := c.mcore.GetObjectWithContext(
+		ctx,
+		c.bucket,                // bucketName
+		c.objectKey(hash, kind), // objectName
+		minio.GetObjectOptions{
+			ServerSideEncryption: c.readSSE,
+		}, // opts
 	)
 	if err != nil {
 		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
@@ -181,23 +262,82 @@ func (c *s3Cache) Get(kind cache.EntryKind, hash string) (io.ReadCloser, int64,
 	return object, info.Size, nil
 }
 
-func (c *s3Cache) Contains(kind cache.EntryKind, hash string) (bool, int64) {
-	size := int64(-1)
-
-	s, err := c.mcore.StatObject(
-		c.bucket,                  // bucketName
-		c.objectKey(hash, kind),   // objectName
-		minio.StatObjectOptions{}, // opts
+func (c *s3Cache) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+
+	s, err := c.mcore.StatObjectWithContext(
+		ctx,
+		c.bucket,                // bucketName
+		c.objectKey(hash, kind), // objectName
+		minio.StatObjectOptions{
+			GetObjectOptions: minio.GetObjectOptions{
+				ServerSideEncryption: c.readSSE,
+			},
+		}, // opts
 	)
-
-	exists := (err == nil)
 	if err != nil {
-		err = errNotFound
-	} else {
-		size = s.Size
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			c.logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), errNotFound)
+			return false, -1, nil
+		}
+		c.logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), err)
+		return false, -1, err
 	}
 
-	c.logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), err)
+	c.logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), nil)
+
+	return true, s.Size, nil
+}
+
+// Delete removes an object. S3 does not report an error for objects
+// which don't exist.
+func (c *s3Cache) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	// minio-go v6 has no context-aware variant of RemoveObject.
+	err := c.mcore.RemoveObject(c.bucket, c.objectKey(hash, kind))
+
+	c.logResponse(c.accessLogger, "DELETE", c.bucket, c.objectKey(hash, kind), err)
+
+	return err
+}
+
+// List pages through the objects of the given kind. S3 lists keys in
+// ascending order, and all the keys share the same prefix.
+func (c *s3Cache) List(ctx context.Context, kind cache.EntryKind, after string,
+	fn func(hash string, size int64) error) error {
+
+	prefix := c.objectKey("", kind)
+	startAfter := ""
+	if after != "" {
+		startAfter = prefix + after
+	}
+
+	token := ""
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// minio-go v6 has no context-aware variant of ListObjectsV2.
+		result, err := c.mcore.ListObjectsV2(c.bucket, prefix, token, false,
+			"", maxListKeys, startAfter)
+		c.logResponse(c.accessLogger, "LIST", c.bucket, prefix, err)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Contents {
+			err = fn(strings.TrimPrefix(object.Key, prefix), object.Size)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
 
-	return exists, size
+func (c *s3Cache) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, c, kind, hashes, maxConcurrentContains)
 }
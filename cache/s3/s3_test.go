@@ -0,0 +1,398 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/config"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+// fakeS3 is an httptest stand-in for an S3 server, which records the
+// headers of each request.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string][]byte
+	headers []http.Header // The headers of each object or part upload.
+}
+
+// Return the payload of a request, which minio sends with aws-chunked
+// encoding when it has not hashed it in advance.
+func readBody(r *http.Request) []byte {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		data, _ := ioutil.ReadAll(r.Body)
+		return data
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		// <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return data
+		}
+		size, err := strconv.ParseInt(strings.SplitN(line, ";", 2)[0], 16, 64)
+		if err != nil || size == 0 {
+			return data
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(br, chunk)
+		if err != nil {
+			return data
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := r.URL.Query()
+	name := r.URL.Path
+
+	switch {
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.headers = append(s.headers, r.Header.Clone())
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>upload1</UploadId></InitiateMultipartUploadResult>`)
+
+	case r.Method == http.MethodPut && query.Get("partNumber") != "":
+		s.headers = append(s.headers, r.Header.Clone())
+		s.parts[query.Get("partNumber")] = readBody(r)
+		w.Header().Set("ETag", `"etag`+query.Get("partNumber")+`"`)
+
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		var blob []byte
+		for i := 1; i <= len(s.parts); i++ {
+			blob = append(blob, s.parts[fmt.Sprint(i)]...)
+		}
+		s.objects[name] = blob
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><ETag>"etag"</ETag></CompleteMultipartUploadResult>`)
+
+	case r.Method == http.MethodPut:
+		s.headers = append(s.headers, r.Header.Clone())
+		s.objects[name] = readBody(r)
+		w.Header().Set("ETag", `"etag"`)
+
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		// Return one object per page, to exercise the continuation
+		// tokens.
+		after := query.Get("start-after")
+		if query.Get("continuation-token") != "" {
+			after = query.Get("continuation-token")
+		}
+		var keys []string
+		for objectName := range s.objects {
+			key := strings.TrimPrefix(objectName, "/bucket/")
+			if strings.HasPrefix(key, query.Get("prefix")) && key > after {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "<ListBucketResult><Name>bucket</Name>")
+		if len(keys) > 0 {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>",
+				keys[0], len(s.objects["/bucket/"+keys[0]]))
+		}
+		if len(keys) > 1 {
+			fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[0])
+		}
+		fmt.Fprintf(w, "</ListBucketResult>")
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.headers = append(s.headers, r.Header.Clone())
+		data, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			}
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+	}
+}
+
+func newTestCache(t *testing.T, s *fakeS3, cfg config.S3CloudStorageConfig) (cache.CacheProxy, func()) {
+	srv := httptest.NewServer(s)
+
+	cfg.Endpoint = strings.TrimPrefix(srv.URL, "http://")
+	cfg.Bucket = "bucket"
+	cfg.Prefix = "prefix"
+	cfg.AccessKeyID = "EXAMPLE_ACCESS_KEY"
+	cfg.SecretAccessKey = "EXAMPLE_SECRET_KEY"
+	cfg.DisableSSL = true
+	cfg.Region = "us-east-1"
+
+	logger := testutils.NewSilentLogger()
+	c, err := New(&cfg, logger, logger)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return c, srv.Close
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		parts:   make(map[string][]byte),
+	}
+}
+
+func TestSSEKMSAndStorageClass(t *testing.T) {
+	s := newFakeS3()
+	c, cleanup := newTestCache(t, s, config.S3CloudStorageConfig{
+		SSE:          config.S3SSEKMS,
+		SSEKMSKeyID:  "my-key",
+		StorageClass: "STANDARD_IA",
+	})
+	defer cleanup()
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+	err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := s.headers[0]
+	if h.Get("X-Amz-Server-Side-Encryption") != "aws:kms" ||
+		h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "my-key" {
+		t.Fatalf("Expected SSE-KMS headers, got %v", h)
+	}
+	if h.Get("X-Amz-Storage-Class") != "STANDARD_IA" {
+		t.Fatalf("Expected a storage class header, got %v", h)
+	}
+
+	// SSE-KMS keys must not be sent on reads.
+	found, _, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil || !found {
+		t.Fatalf("Expected to find the blob, got %v %v", found, err)
+	}
+	h = s.headers[1]
+	if h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != "" {
+		t.Fatalf("Unexpected SSE-KMS header on read: %v", h)
+	}
+}
+
+func TestSSEC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	keyFile := filepath.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile,
+		[]byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newFakeS3()
+	c, cleanup := newTestCache(t, s, config.S3CloudStorageConfig{
+		SSE:         config.S3SSEC,
+		SSECKeyFile: keyFile,
+	})
+	defer cleanup()
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+	err = c.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err := c.Get(ctx, cache.AC, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatal("Got the wrong data")
+	}
+
+	// The key must be sent on both writes and reads.
+	expected := base64.StdEncoding.EncodeToString(key)
+	for _, h := range s.headers {
+		if h.Get("X-Amz-Server-Side-Encryption-Customer-Key") != expected {
+			t.Fatalf("Expected the SSE-C key to be sent, got %v", h)
+		}
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	s := newFakeS3()
+	c, cleanup := newTestCache(t, s, config.S3CloudStorageConfig{
+		MultipartPartSize: config.S3MinPartSize,
+		SSE:               config.S3SSES3,
+	})
+	defer cleanup()
+
+	data, hash := testutils.RandomDataAndHash(2*config.S3MinPartSize + 100)
+	err := c.Put(context.Background(), cache.CAS, hash, int64(len(data)),
+		bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(s.parts))
+	}
+	if !bytes.Equal(s.objects["/bucket/prefix/cas/"+hash], data) {
+		t.Fatal("Got the wrong data")
+	}
+	// The encryption is requested when the upload is initiated.
+	if s.headers[0].Get("X-Amz-Server-Side-Encryption") != "AES256" {
+		t.Fatalf("Expected SSE-S3 headers, got %v", s.headers[0])
+	}
+}
+
+func TestWebIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenFile, []byte("the-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiration := time.Now().Add(time.Hour).UTC()
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" ||
+			r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/cache" ||
+			r.Form.Get("WebIdentityToken") != "the-token" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, expiration.Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	// Make sure the earlier providers in the chain find nothing.
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"} {
+		orig, ok := os.LookupEnv(env)
+		os.Unsetenv(env)
+		if ok {
+			defer os.Setenv(env, orig)
+		}
+	}
+
+	creds := newCredentials(&config.S3CloudStorageConfig{
+		SharedCredentialsFile: filepath.Join(dir, "nonexistent"),
+		WebIdentityTokenFile:  tokenFile,
+		RoleARN:               "arn:aws:iam::123456789012:role/cache",
+		STSEndpoint:           sts.URL,
+	})
+
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "ASIAEXAMPLE" || v.SecretAccessKey != "secret" ||
+		v.SessionToken != "session" {
+		t.Fatalf("Unexpected credentials: %+v", v)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newFakeS3()
+	c, cleanup := newTestCache(t, s, config.S3CloudStorageConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(1024)
+	err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.(cache.Deleter).Delete(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err := c.Contains(ctx, cache.CAS, hash)
+	if err != nil || found {
+		t.Fatalf("Expected the blob to be deleted, got %v %v", found, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	s := newFakeS3()
+	c, cleanup := newTestCache(t, s, config.S3CloudStorageConfig{})
+	defer cleanup()
+
+	ctx := context.Background()
+	var hashes []string
+	for i := 0; i < 4; i++ {
+		data, hash := testutils.RandomDataAndHash(int64(i + 1))
+		err := c.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	var listed []string
+	err := c.(cache.Lister).List(ctx, cache.CAS, hashes[0],
+		func(hash string, size int64) error {
+			listed = append(listed, hash)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(listed, hashes[1:]) {
+		t.Fatalf("Expected %v, got %v", hashes[1:], listed)
+	}
+}
@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v6/pkg/credentials"
+)
+
+const defaultSTSEndpoint = "https://sts.amazonaws.com"
+
+// webIdentity is a credentials.Provider which exchanges the token in a
+// file for temporary credentials, with the STS AssumeRoleWithWebIdentity
+// API. This is how the AWS SDKs support eg EKS service accounts.
+//
+// The token file is read on each refresh, since it is rotated.
+type webIdentity struct {
+	credentials.Expiry
+
+	client      *http.Client
+	stsEndpoint string
+	roleARN     string
+	sessionName string
+	tokenFile   string
+}
+
+func newWebIdentity(stsEndpoint string, roleARN string, tokenFile string) *webIdentity {
+	if stsEndpoint == "" {
+		stsEndpoint = defaultSTSEndpoint
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("bazel-remote-%d", time.Now().UnixNano())
+	}
+
+	return &webIdentity{
+		client:      &http.Client{Timeout: time.Minute},
+		stsEndpoint: stsEndpoint,
+		roleARN:     roleARN,
+		sessionName: sessionName,
+		tokenFile:   tokenFile,
+	}
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// Retrieve implements credentials.Provider.
+func (w *webIdentity) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(w.tokenFile)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", w.roleARN)
+	form.Set("RoleSessionName", w.sessionName)
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	resp, err := w.client.PostForm(w.stsEndpoint, form)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return credentials.Value{}, fmt.Errorf("AssumeRoleWithWebIdentity failed: %s: %s",
+			resp.Status, body)
+	}
+
+	var result assumeRoleWithWebIdentityResponse
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	w.SetExpiration(result.Credentials.Expiration, credentials.DefaultExpiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
@@ -0,0 +1,140 @@
+// Package timeout provides a CacheProxy wrapper which limits the time
+// spent on each request to the wrapped backend.
+package timeout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+)
+
+type timeoutProxy struct {
+	backend  cache.CacheProxy
+	get      time.Duration
+	put      time.Duration
+	contains time.Duration
+}
+
+// New returns a CacheProxy which cancels Get, Put and Contains calls
+// to `backend` that take longer than the respective timeout. A timeout
+// of zero disables the limit for that operation. The Get timeout also
+// covers reading the returned io.ReadCloser, and the Contains timeout
+// applies to each ContainsMany call as a whole.
+//
+// Requests which time out fail with a cache.Error with code
+// http.StatusGatewayTimeout.
+func New(backend cache.CacheProxy, get time.Duration, put time.Duration,
+	contains time.Duration) cache.CacheProxy {
+
+	return &timeoutProxy{
+		backend:  backend,
+		get:      get,
+		put:      put,
+		contains: contains,
+	}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Replace errors caused by our own deadline with a cache.Error, so
+// they can be told apart from the caller's context expiring.
+func timeoutError(parent context.Context, ctx context.Context, err error,
+	op string, kind cache.EntryKind, hash string, timeout time.Duration) error {
+
+	if err == nil || parent.Err() != nil ||
+		ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+
+	return &cache.Error{
+		Code: http.StatusGatewayTimeout,
+		Text: fmt.Sprintf("Proxy %s of %s/%s timed out after %v",
+			op, kind, hash, timeout),
+	}
+}
+
+func (p *timeoutProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	tctx, cancel := withTimeout(ctx, p.put)
+	defer cancel()
+
+	err := p.backend.Put(tctx, kind, hash, size, rdr)
+	return timeoutError(ctx, tctx, err, "upload", kind, hash, p.put)
+}
+
+func (p *timeoutProxy) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	tctx, cancel := withTimeout(ctx, p.get)
+
+	rc, size, err := p.backend.Get(tctx, kind, hash)
+	if err != nil || rc == nil {
+		if rc != nil {
+			rc.Close()
+		}
+		err = timeoutError(ctx, tctx, err, "download", kind, hash, p.get)
+		cancel()
+		return nil, size, err
+	}
+
+	return &cancelReadCloser{
+		ReadCloser: rc,
+		parent:     ctx,
+		ctx:        tctx,
+		cancel:     cancel,
+		kind:       kind,
+		hash:       hash,
+		timeout:    p.get,
+	}, size, nil
+}
+
+func (p *timeoutProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	tctx, cancel := withTimeout(ctx, p.contains)
+	defer cancel()
+
+	found, size, err := p.backend.Contains(tctx, kind, hash)
+	return found, size, timeoutError(ctx, tctx, err, "contains check", kind, hash, p.contains)
+}
+
+// ContainsMany applies the Contains timeout to the whole batch.
+func (p *timeoutProxy) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	tctx, cancel := withTimeout(ctx, p.contains)
+	defer cancel()
+
+	found, err := p.backend.ContainsMany(tctx, kind, hashes)
+	return found, timeoutError(ctx, tctx, err, "batch contains check", kind,
+		fmt.Sprintf("[%d blobs]", len(hashes)), p.contains)
+}
+
+// cancelReadCloser releases the context of a Get request when the
+// returned reader is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+
+	parent  context.Context
+	ctx     context.Context
+	cancel  context.CancelFunc
+	kind    cache.EntryKind
+	hash    string
+	timeout time.Duration
+}
+
+func (r *cancelReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = timeoutError(r.parent, r.ctx, err, "download", r.kind, r.hash, r.timeout)
+	}
+	return n, err
+}
+
+func (r *cancelReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,115 @@
+package timeout
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+)
+
+// A backend whose Put and Contains calls block until their context is
+// done, and whose Get readers block until the context is done.
+type hangingBackend struct {
+	getCtx context.Context
+}
+
+func (b *hangingBackend) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (b *hangingBackend) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	b.getCtx = ctx
+	return ioutil.NopCloser(&hangingReader{ctx: ctx}), 10, nil
+}
+
+func (b *hangingBackend) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	<-ctx.Done()
+	return false, -1, ctx.Err()
+}
+
+func (b *hangingBackend) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	<-ctx.Done()
+	return make([]bool, len(hashes)), ctx.Err()
+}
+
+type hangingReader struct {
+	ctx context.Context
+}
+
+func (r *hangingReader) Read(p []byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func checkTimeoutError(t *testing.T, err error) {
+	t.Helper()
+
+	cerr, ok := err.(*cache.Error)
+	if !ok {
+		t.Fatalf("Expected a cache.Error, got: %v", err)
+	}
+	if cerr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected code %d, got %d", http.StatusGatewayTimeout, cerr.Code)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	backend := &hangingBackend{}
+	p := New(backend, 10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+	ctx := context.Background()
+
+	err := p.Put(ctx, cache.CAS, "foo", 3, strings.NewReader("foo"))
+	checkTimeoutError(t, err)
+
+	_, _, err = p.Contains(ctx, cache.CAS, "foo")
+	checkTimeoutError(t, err)
+
+	rc, _, err := p.Get(ctx, cache.CAS, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(rc)
+	checkTimeoutError(t, err)
+	rc.Close()
+}
+
+func TestCallerCancellation(t *testing.T) {
+	backend := &hangingBackend{}
+	p := New(backend, time.Hour, time.Hour, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	// The caller's own cancellation should be passed through as-is.
+	err := p.Put(ctx, cache.CAS, "foo", 3, strings.NewReader("foo"))
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestGetCancelledOnClose(t *testing.T) {
+	backend := &hangingBackend{}
+	p := New(backend, 0, 0, 0)
+
+	rc, _, err := p.Get(context.Background(), cache.CAS, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.getCtx.Err() != nil {
+		t.Fatal("Expected the backend context to be live until Close")
+	}
+
+	rc.Close()
+	if backend.getCtx.Err() != context.Canceled {
+		t.Fatal("Expected the backend context to be cancelled by Close")
+	}
+}
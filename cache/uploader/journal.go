@@ -0,0 +1,482 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 10 * time.Minute
+
+	// Give up on an upload after this many failed attempts. With the
+	// delays above, this corresponds to a couple of hours of retrying.
+	maxAttempts = 20
+
+	// The maximum number of entries listed by BacklogHandler.
+	maxListedEntries = 1000
+
+	gaugeUpdateInterval = 15 * time.Second
+)
+
+var (
+	queueItems = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bazel_remote_upload_queue_items",
+		Help: "The number of uploads in the proxy upload journal",
+	})
+	queueBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bazel_remote_upload_queue_bytes",
+		Help: "The total size of the uploads in the proxy upload journal",
+	})
+	queueOldestAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bazel_remote_upload_queue_oldest_item_age_seconds",
+		Help: "The age of the oldest upload in the proxy upload journal",
+	})
+	uploadRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_upload_queue_retries",
+		Help: "The total number of failed proxy upload attempts that were retried",
+	})
+	uploadsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_upload_queue_dropped",
+		Help: "The total number of proxy uploads that were given up on",
+	})
+)
+
+type journalEntry struct {
+	kind   cache.EntryKind
+	hash   string
+	size   int64
+	queued time.Time
+
+	// Incremented when the journal file is replaced with newer data.
+	generation int
+
+	attempts    int
+	lastErr     error
+	nextAttempt time.Time
+}
+
+// Journal is a CacheProxy which queues uploads to the wrapped backend
+// in a directory, so that pending uploads survive restarts. Each
+// pending upload is stored as a separate file, which is removed once
+// the backend has accepted the upload. Failed uploads are retried with
+// exponential backoff.
+//
+// Journal is safe for concurrent use.
+type Journal struct {
+	backend     cache.CacheProxy
+	dir         string
+	errorLogger cache.Logger
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	entries map[string]*journalEntry // Keyed by file name.
+	ready   []string                 // Entries waiting for an uploader.
+	size    int64                    // The sum of the entry sizes.
+}
+
+// NewJournal returns a Journal which stores pending uploads to `backend`
+// in `dir`, which is created if it doesn't exist. Uploads which were
+// pending when the previous Journal using `dir` stopped are queued
+// again.
+func NewJournal(backend cache.CacheProxy, dir string, errorLogger cache.Logger) (*Journal, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		backend:     backend,
+		dir:         dir,
+		errorLogger: errorLogger,
+		entries:     make(map[string]*journalEntry),
+	}
+	j.cond = sync.NewCond(&j.mu)
+
+	err = j.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < numUploaders; i++ {
+		go func() {
+			for {
+				j.upload(j.next())
+			}
+		}()
+	}
+
+	go func() {
+		for range time.Tick(gaugeUpdateInterval) {
+			j.mu.Lock()
+			j.updateGauges()
+			j.mu.Unlock()
+		}
+	}()
+
+	return j, nil
+}
+
+// Matches the hash part of journal file names, but not temp files.
+var journalHashRegex = regexp.MustCompile("^[a-f0-9]{64}$")
+
+func journalName(kind cache.EntryKind, hash string) string {
+	return kind.String() + "-" + hash
+}
+
+func parseJournalName(name string) (cache.EntryKind, string, bool) {
+	fields := strings.SplitN(name, "-", 2)
+	if len(fields) != 2 || !journalHashRegex.MatchString(fields[1]) {
+		return 0, "", false
+	}
+
+	for _, kind := range []cache.EntryKind{cache.AC, cache.CAS, cache.RAW} {
+		if fields[0] == kind.String() {
+			return kind, fields[1], true
+		}
+	}
+
+	return 0, "", false
+}
+
+// Queue the uploads found in the journal directory.
+func (j *Journal) replay() error {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+
+	// Replay the oldest uploads first.
+	sort.Slice(files, func(a int, b int) bool {
+		return files[a].ModTime().Before(files[b].ModTime())
+	})
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, f := range files {
+		name := f.Name()
+		path := filepath.Join(j.dir, name)
+
+		kind, hash, ok := parseJournalName(name)
+		if !ok || f.IsDir() {
+			// Most likely an incomplete temp file.
+			j.errorLogger.Printf("Removing unexpected upload journal file: %s", path)
+			os.RemoveAll(path)
+			continue
+		}
+
+		j.entries[name] = &journalEntry{
+			kind:   kind,
+			hash:   hash,
+			size:   f.Size(),
+			queued: f.ModTime(),
+		}
+		j.size += f.Size()
+		j.ready = append(j.ready, name)
+	}
+
+	if len(j.ready) > 0 {
+		j.errorLogger.Printf("Replaying %d pending uploads from %s",
+			len(j.ready), j.dir)
+	}
+	j.updateGauges()
+
+	return nil
+}
+
+// Update the gauges which are cheap to compute. Must be called with
+// j.mu held.
+func (j *Journal) updateSizeGauges() {
+	queueItems.Set(float64(len(j.entries)))
+	queueBytes.Set(float64(j.size))
+}
+
+// Update all gauges. This walks every entry, so it is only called
+// periodically. Must be called with j.mu held.
+func (j *Journal) updateGauges() {
+	j.updateSizeGauges()
+
+	oldest := time.Now()
+	for _, e := range j.entries {
+		if e.queued.Before(oldest) {
+			oldest = e.queued
+		}
+	}
+	queueOldestAge.Set(time.Since(oldest).Seconds())
+}
+
+// Put stores the upload in the journal, and returns once it has been
+// persisted. If `rdr` is an *os.File, the journal file is created as a
+// hard link to it if possible, which avoids copying the data.
+//
+// Uploads of CAS items which are already queued are ignored. For other
+// kinds of item, the queued data is replaced.
+func (j *Journal) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	defer closeReader(rdr)
+
+	name := journalName(kind, hash)
+
+	j.mu.Lock()
+	_, pending := j.entries[name]
+	j.mu.Unlock()
+	if pending && kind == cache.CAS {
+		return nil
+	}
+
+	err := j.writeFile(name, rdr)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e, pending := j.entries[name]
+	if pending {
+		// Either an uploader or a retry timer holds this entry,
+		// and will pick up the new data.
+		j.size += size - e.size
+		e.size = size
+		e.generation++
+		e.attempts = 0
+	} else {
+		j.entries[name] = &journalEntry{
+			kind:   kind,
+			hash:   hash,
+			size:   size,
+			queued: time.Now(),
+		}
+		j.size += size
+		j.ready = append(j.ready, name)
+		j.cond.Signal()
+	}
+	j.updateSizeGauges()
+
+	return nil
+}
+
+// Atomically replace the journal file `name` with the data from `rdr`.
+func (j *Journal) writeFile(name string, rdr io.Reader) error {
+	path := filepath.Join(j.dir, name)
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, rand.Int63())
+
+	if f, ok := rdr.(*os.File); ok {
+		if os.Link(f.Name(), tmpPath) == nil {
+			return os.Rename(tmpPath, path)
+		}
+		// Fall back to copying, eg if the journal is on a different
+		// filesystem.
+	}
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, rdr)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+
+	return err
+}
+
+// Wait until an entry is ready to be uploaded, and return its name.
+func (j *Journal) next() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for len(j.ready) == 0 {
+		j.cond.Wait()
+	}
+
+	name := j.ready[0]
+	j.ready = j.ready[1:]
+
+	return name
+}
+
+func (j *Journal) upload(name string) {
+	j.mu.Lock()
+	e := j.entries[name]
+	kind, hash, size, generation := e.kind, e.hash, e.size, e.generation
+	j.mu.Unlock()
+
+	path := filepath.Join(j.dir, name)
+	f, err := os.Open(path)
+	if err == nil {
+		err = j.backend.Put(context.Background(), kind, hash, size, f)
+		f.Close()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if e.generation != generation {
+		// The data was replaced during the upload, try again.
+		j.ready = append(j.ready, name)
+		j.cond.Signal()
+		return
+	}
+
+	if err == nil {
+		j.remove(name)
+		return
+	}
+
+	e.attempts++
+	e.lastErr = err
+
+	if e.attempts >= maxAttempts {
+		j.errorLogger.Printf("Giving up on upload of %s/%s after %d attempts: %v",
+			kind, hash, e.attempts, err)
+		uploadsDropped.Inc()
+		j.remove(name)
+		return
+	}
+
+	delay := retryDelay(e.attempts)
+	e.nextAttempt = time.Now().Add(delay)
+	j.errorLogger.Printf("Failed to upload %s/%s (attempt %d), retrying in %v: %v",
+		kind, hash, e.attempts, delay, err)
+	uploadRetries.Inc()
+
+	time.AfterFunc(delay, func() {
+		j.mu.Lock()
+		j.ready = append(j.ready, name)
+		j.cond.Signal()
+		j.mu.Unlock()
+	})
+}
+
+// Return a jittered, exponentially increasing delay for the given
+// number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := maxRetryDelay
+	if attempts < 20 {
+		delay = minRetryDelay << uint(attempts-1)
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+
+	// Add up to 50% jitter, so that failed uploads don't all retry
+	// at the same time.
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// Remove a finished entry. Must be called with j.mu held.
+func (j *Journal) remove(name string) {
+	err := os.Remove(filepath.Join(j.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		j.errorLogger.Printf("Failed to remove upload journal file: %v", err)
+	}
+
+	j.size -= j.entries[name].size
+	delete(j.entries, name)
+	j.updateSizeGauges()
+}
+
+// Get forwards the request to the backend.
+func (j *Journal) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	return j.backend.Get(ctx, kind, hash)
+}
+
+// Contains forwards the request to the backend.
+func (j *Journal) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	return j.backend.Contains(ctx, kind, hash)
+}
+
+// ContainsMany forwards the request to the backend.
+func (j *Journal) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return j.backend.ContainsMany(ctx, kind, hashes)
+}
+
+type backlogEntry struct {
+	Kind        string
+	Hash        string
+	SizeBytes   int64
+	Queued      time.Time
+	Attempts    int
+	LastError   string     `json:",omitempty"`
+	NextAttempt *time.Time `json:",omitempty"`
+}
+
+type backlogPageData struct {
+	NumItems         int
+	TotalBytes       int64
+	OldestAgeSeconds float64
+	Items            []backlogEntry
+}
+
+// BacklogHandler serves a JSON summary of the pending uploads, including
+// up to 1000 of the oldest entries.
+func (j *Journal) BacklogHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	now := time.Now()
+	data := backlogPageData{Items: []backlogEntry{}}
+
+	j.mu.Lock()
+	data.NumItems = len(j.entries)
+	data.TotalBytes = j.size
+	for _, e := range j.entries {
+		be := backlogEntry{
+			Kind:      e.kind.String(),
+			Hash:      e.hash,
+			SizeBytes: e.size,
+			Queued:    e.queued,
+			Attempts:  e.attempts,
+		}
+		if e.lastErr != nil {
+			be.LastError = e.lastErr.Error()
+		}
+		if e.nextAttempt.After(now) {
+			nextAttempt := e.nextAttempt
+			be.NextAttempt = &nextAttempt
+		}
+		data.Items = append(data.Items, be)
+	}
+	j.mu.Unlock()
+
+	sort.Slice(data.Items, func(a int, b int) bool {
+		return data.Items[a].Queued.Before(data.Items[b].Queued)
+	})
+	if len(data.Items) > 0 {
+		data.OldestAgeSeconds = now.Sub(data.Items[0].Queued).Seconds()
+	}
+	if len(data.Items) > maxListedEntries {
+		data.Items = data.Items[:maxListedEntries]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.Encode(data)
+}
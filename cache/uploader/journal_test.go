@@ -0,0 +1,178 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+// A backend which fails the first `failures` uploads.
+type flakyBackend struct {
+	testBackend
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (b *flakyBackend) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	b.mu.Lock()
+	fail := b.failures > 0
+	if fail {
+		b.failures--
+	}
+	b.mu.Unlock()
+
+	if fail {
+		return errors.New("upload failed")
+	}
+
+	return b.testBackend.Put(ctx, kind, hash, size, rdr)
+}
+
+func waitForUpload(t *testing.T, b cache.CacheProxy, hash string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if found, _, _ := b.Contains(context.Background(), cache.CAS, hash); found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to be uploaded within %v", hash, timeout)
+}
+
+func waitForEmptyDir(t *testing.T, dir string) {
+	for i := 0; i < 100; i++ {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected the journal directory %s to be emptied", dir)
+}
+
+func TestJournalUpload(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	backend := &testBackend{blobs: make(map[string][]byte)}
+	j, err := NewJournal(backend, dir, testutils.NewSilentLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	rdr := &closeRecorder{Reader: bytes.NewReader(data)}
+
+	err = j.Put(context.Background(), cache.CAS, hash, int64(len(data)), rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rdr.isClosed() {
+		t.Fatal("Expected the reader to be closed once the upload was journaled")
+	}
+
+	waitForUpload(t, backend, hash, time.Second)
+	waitForEmptyDir(t, dir)
+
+	if !bytes.Equal(backend.blobs[hash], data) {
+		t.Fatal("Uploaded data does not match")
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Simulate the state left behind by a previous process.
+	data, hash := testutils.RandomDataAndHash(1024)
+	err := ioutil.WriteFile(filepath.Join(dir, journalName(cache.CAS, hash)), data, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, journalName(cache.CAS, hash)+".123.tmp"), data[:10], os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &testBackend{blobs: make(map[string][]byte)}
+	_, err = NewJournal(backend, dir, testutils.NewSilentLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForUpload(t, backend, hash, time.Second)
+	waitForEmptyDir(t, dir)
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if len(backend.blobs) != 1 {
+		t.Fatalf("Expected exactly one upload, got %d", len(backend.blobs))
+	}
+	if !bytes.Equal(backend.blobs[hash], data) {
+		t.Fatal("Replayed data does not match")
+	}
+}
+
+func TestJournalRetry(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	backend := &flakyBackend{
+		testBackend: testBackend{blobs: make(map[string][]byte)},
+		failures:    1,
+	}
+	j, err := NewJournal(backend, dir, testutils.NewSilentLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	err = j.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the first attempt to fail, then check the backlog.
+	var backlog backlogPageData
+	for i := 0; i < 100; i++ {
+		rr := httptest.NewRecorder()
+		j.BacklogHandler(rr, httptest.NewRequest("GET", "/admin/uploads", nil))
+		err = json.Unmarshal(rr.Body.Bytes(), &backlog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backlog.Items) == 1 && backlog.Items[0].Attempts == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if backlog.NumItems != 1 || backlog.TotalBytes != int64(len(data)) {
+		t.Fatalf("Unexpected backlog: %+v", backlog)
+	}
+	item := backlog.Items[0]
+	if item.Hash != hash || item.Attempts != 1 || item.LastError == "" ||
+		item.NextAttempt == nil {
+		t.Fatalf("Unexpected backlog entry: %+v", item)
+	}
+
+	// The retry happens after 1-1.5 seconds.
+	waitForUpload(t, backend, hash, 3*time.Second)
+	waitForEmptyDir(t, dir)
+}
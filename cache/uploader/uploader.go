@@ -0,0 +1,101 @@
+// Package uploader provides a CacheProxy wrapper which performs uploads
+// to the wrapped backend asynchronously, from a bounded queue.
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/buchgr/bazel-remote/cache"
+)
+
+const numUploaders = 100
+const maxQueuedUploads = 1000000
+
+// ErrQueueFull is returned by Put when the upload could not be queued.
+var ErrQueueFull = errors.New("too many uploads queued")
+
+type uploadReq struct {
+	hash string
+	size int64
+	kind cache.EntryKind
+	rdr  io.Reader
+}
+
+type asyncProxy struct {
+	backend     cache.CacheProxy
+	uploadQueue chan<- uploadReq
+	errorLogger cache.Logger
+}
+
+// New returns a CacheProxy which forwards Get and Contains calls to
+// `backend`, and queues Put calls to be performed in the background.
+// Put returns ErrQueueFull if the queue is full, and otherwise returns
+// nil without waiting for the upload. Failed uploads are logged to
+// `errorLogger`.
+//
+// Readers passed to Put which implement io.Closer are closed once the
+// upload has finished.
+func New(backend cache.CacheProxy, errorLogger cache.Logger) cache.CacheProxy {
+	uploadQueue := make(chan uploadReq, maxQueuedUploads)
+
+	p := &asyncProxy{
+		backend:     backend,
+		uploadQueue: uploadQueue,
+		errorLogger: errorLogger,
+	}
+
+	for i := 0; i < numUploaders; i++ {
+		go func() {
+			for item := range uploadQueue {
+				p.upload(item)
+			}
+		}()
+	}
+
+	return p
+}
+
+func (p *asyncProxy) upload(item uploadReq) {
+	err := p.backend.Put(context.Background(), item.kind, item.hash, item.size, item.rdr)
+	if err != nil {
+		p.errorLogger.Printf("Failed to upload %s/%s: %v",
+			item.kind, item.hash, err)
+	}
+
+	closeReader(item.rdr)
+}
+
+func closeReader(rdr io.Reader) {
+	if rc, ok := rdr.(io.Closer); ok {
+		rc.Close()
+	}
+}
+
+func (p *asyncProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	select {
+	case p.uploadQueue <- uploadReq{
+		hash: hash,
+		size: size,
+		kind: kind,
+		rdr:  rdr,
+	}:
+		return nil
+	default:
+		closeReader(rdr)
+		return ErrQueueFull
+	}
+}
+
+func (p *asyncProxy) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	return p.backend.Get(ctx, kind, hash)
+}
+
+func (p *asyncProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	return p.backend.Contains(ctx, kind, hash)
+}
+
+func (p *asyncProxy) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return p.backend.ContainsMany(ctx, kind, hashes)
+}
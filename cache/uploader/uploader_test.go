@@ -0,0 +1,114 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	testutils "github.com/buchgr/bazel-remote/utils"
+)
+
+type testBackend struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (b *testBackend) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.blobs[hash] = data
+	b.mu.Unlock()
+
+	return nil
+}
+
+func (b *testBackend) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	b.mu.Lock()
+	data, found := b.blobs[hash]
+	b.mu.Unlock()
+
+	if !found {
+		return nil, -1, nil
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (b *testBackend) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	b.mu.Lock()
+	data, found := b.blobs[hash]
+	b.mu.Unlock()
+
+	return found, int64(len(data)), nil
+}
+
+func (b *testBackend) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, b, kind, hashes, 4)
+}
+
+type closeRecorder struct {
+	io.Reader
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *closeRecorder) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func TestAsyncUpload(t *testing.T) {
+	backend := &testBackend{blobs: make(map[string][]byte)}
+	p := New(backend, testutils.NewSilentLogger())
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	rdr := &closeRecorder{Reader: bytes.NewReader(data)}
+
+	err := p.Put(context.Background(), cache.CAS, hash, int64(len(data)), rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for i := 0; i < 100 && !found; i++ {
+		found, _, _ = p.Contains(context.Background(), cache.CAS, hash)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !found {
+		t.Fatal("Expected the upload to reach the backend")
+	}
+
+	for i := 0; i < 100 && !rdr.isClosed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !rdr.isClosed() {
+		t.Fatal("Expected the reader to be closed after the upload")
+	}
+
+	r, size, err := p.Get(context.Background(), cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || size != int64(len(data)) {
+		t.Fatalf("Expected to get %d bytes, got %d", len(data), size)
+	}
+	r.Close()
+}
@@ -0,0 +1,304 @@
+// Package verify provides a CacheProxy wrapper which checks the items
+// downloaded from the wrapped backend, so that corrupt items are not
+// copied into the local cache.
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	invalidItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_proxy_invalid_items",
+		Help: "The total number of corrupt items downloaded from the proxy backend",
+	}, []string{"backend", "kind"})
+	deletedItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_proxy_deleted_invalid_items",
+		Help: "The total number of corrupt items deleted from the proxy backend",
+	}, []string{"backend"})
+	quarantinedItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bazel_remote_proxy_quarantined_invalid_items",
+		Help: "The total number of corrupt items copied from the proxy backend to the quarantine directory",
+	}, []string{"backend"})
+)
+
+// The time allowed for quarantining and deleting a corrupt item.
+const deleteTimeout = time.Minute
+
+// The maximum number of corrupt items which are being deleted at the
+// same time. Further items are only reported, they are deleted when
+// they are found again.
+const maxConcurrentDeletes = 16
+
+type verifyingProxy struct {
+	cache.CacheProxy
+
+	name          string
+	deleter       cache.Deleter
+	quarantineDir string
+	errorLogger   cache.Logger
+
+	deletes chan struct{}  // Limits the number of concurrent deletions.
+	pending sync.WaitGroup // The deletions in progress.
+}
+
+// Option is used to configure optional verification behaviour.
+type Option func(*verifyingProxy)
+
+// WithQuarantineDir makes the proxy copy corrupt items from the backend
+// to `dir`, as <dir>/<kind>/<hash>, before deleting them. Items which
+// can't be copied are not deleted. This has no effect without a deleter.
+func WithQuarantineDir(dir string) Option {
+	return func(p *verifyingProxy) {
+		p.quarantineDir = dir
+	}
+}
+
+// New returns a CacheProxy which checks the items returned by Get calls
+// to `backend`. AC items must be valid, non-empty ActionResult messages,
+// and are reported as missing if they are not. CAS items must match
+// their hash, which is checked while they are read: the reader returns a
+// cache.InvalidItemError at the end of a corrupt item. RAW items are not
+// checked.
+//
+// Corrupt items are logged and counted, with `name` identifying the
+// backend. If `deleter` is not nil, they are also deleted with it in the
+// background, which should remove the item from `backend`.
+func New(backend cache.CacheProxy, name string, deleter cache.Deleter,
+	errorLogger cache.Logger, opts ...Option) cache.CacheProxy {
+
+	p := &verifyingProxy{
+		CacheProxy:  backend,
+		name:        name,
+		deleter:     deleter,
+		errorLogger: errorLogger,
+		deletes:     make(chan struct{}, maxConcurrentDeletes),
+	}
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	return p
+}
+
+func (p *verifyingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	rc, size, err := p.CacheProxy.Get(ctx, kind, hash)
+	if err != nil || rc == nil {
+		return rc, size, err
+	}
+
+	switch kind {
+	case cache.AC:
+		return p.getActionResult(kind, hash, rc, size)
+	case cache.CAS:
+		return &verifyingReader{
+			ReadCloser: rc,
+			proxy:      p,
+			hasher:     sha256.New(),
+			hash:       hash,
+			size:       size,
+		}, size, nil
+	}
+
+	return rc, size, nil
+}
+
+// Read and check an ActionResult, and return it unless it is corrupt.
+func (p *verifyingProxy) getActionResult(kind cache.EntryKind, hash string,
+	rc io.ReadCloser, size int64) (io.ReadCloser, int64, error) {
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if len(data) == 0 {
+		// Valid, but never uploaded by Bazel or bazel-remote.
+		p.invalid(kind, hash, "empty ActionResult")
+		return nil, -1, nil
+	}
+
+	if size >= 0 && int64(len(data)) != size {
+		p.invalid(kind, hash, fmt.Sprintf("expected %d bytes, found %d",
+			size, len(data)))
+		return nil, -1, nil
+	}
+
+	err = proto.Unmarshal(data, &pb.ActionResult{})
+	if err != nil {
+		p.invalid(kind, hash, fmt.Sprintf("not an ActionResult: %v", err))
+		return nil, -1, nil
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// Log and count a corrupt item, and delete it if configured to.
+func (p *verifyingProxy) invalid(kind cache.EntryKind, hash string, reason string) {
+	invalidItems.WithLabelValues(p.name, kind.String()).Inc()
+	p.errorLogger.Printf("Invalid item %s/%s from proxy backend %s: %s",
+		kind, hash, p.name, reason)
+
+	if p.deleter == nil {
+		return
+	}
+
+	select {
+	case p.deletes <- struct{}{}:
+	default:
+		p.errorLogger.Printf("Too many pending deletions, not deleting invalid item %s/%s from proxy backend %s",
+			kind, hash, p.name)
+		return
+	}
+
+	p.pending.Add(1)
+	go func() {
+		defer func() {
+			<-p.deletes
+			p.pending.Done()
+		}()
+		p.delete(kind, hash)
+	}()
+}
+
+// Quarantine a corrupt item if configured to, then delete it.
+func (p *verifyingProxy) delete(kind cache.EntryKind, hash string) {
+	// Not tied to the caller's context, the item should be deleted
+	// even if the request that found it was cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+	defer cancel()
+
+	if p.quarantineDir != "" {
+		err := p.quarantine(ctx, kind, hash)
+		if err != nil {
+			p.errorLogger.Printf("Failed to quarantine invalid item %s/%s from proxy backend %s, not deleting it: %v",
+				kind, hash, p.name, err)
+			return
+		}
+		quarantinedItems.WithLabelValues(p.name).Inc()
+	}
+
+	err := p.deleter.Delete(ctx, kind, hash)
+	if err != nil {
+		p.errorLogger.Printf("Failed to delete invalid item %s/%s from proxy backend %s: %v",
+			kind, hash, p.name, err)
+		return
+	}
+
+	deletedItems.WithLabelValues(p.name).Inc()
+}
+
+// Copy an item from the backend to the quarantine directory, without
+// checking it.
+func (p *verifyingProxy) quarantine(ctx context.Context, kind cache.EntryKind, hash string) error {
+	rc, _, err := p.CacheProxy.Get(ctx, kind, hash)
+	if err != nil {
+		return err
+	}
+	if rc == nil {
+		return errors.New("The item is missing from the backend")
+	}
+	defer rc.Close()
+
+	dir := filepath.Join(p.quarantineDir, kind.String())
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so the quarantine directory
+	// never contains partial items.
+	f, err := ioutil.TempFile(dir, hash+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(dir, hash))
+}
+
+// verifyingReader checks the hash and size of a CAS blob once it has
+// been read completely.
+type verifyingReader struct {
+	io.ReadCloser
+
+	proxy  *verifyingProxy
+	hasher hash.Hash
+	hash   string
+	size   int64
+
+	read int64
+	err  error
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if r.hasher != nil {
+		r.hasher.Write(p[:n])
+	}
+	r.read += int64(n)
+
+	if r.size >= 0 && (r.read > r.size || (err == io.EOF && r.read != r.size)) {
+		r.fail(fmt.Sprintf("expected %d bytes, found %d", r.size, r.read))
+		return 0, r.err
+	}
+
+	// Some readers stop as soon as they have the expected number of
+	// bytes, so check the hash then if the size is known.
+	if r.hasher != nil && (r.read == r.size || err == io.EOF) {
+		actualHash := hex.EncodeToString(r.hasher.Sum(nil))
+		r.hasher = nil
+		if actualHash != r.hash {
+			r.fail(fmt.Sprintf("contents have hash %s", actualHash))
+			return 0, r.err
+		}
+	}
+
+	return n, err
+}
+
+// On failure, the last chunk of data is held back, so the receiver
+// sees an incomplete item even if it ignores the error.
+func (r *verifyingReader) fail(reason string) {
+	r.proxy.invalid(cache.CAS, r.hash, reason)
+	r.err = &cache.InvalidItemError{
+		Kind:   cache.CAS,
+		Hash:   r.hash,
+		Reason: reason,
+	}
+}
@@ -0,0 +1,241 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buchgr/bazel-remote/cache"
+	testutils "github.com/buchgr/bazel-remote/utils"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/proto"
+)
+
+// An in-memory backend, which returns whatever was stored, and records
+// deletions.
+type memoryBackend struct {
+	mu      sync.Mutex
+	items   map[string][]byte
+	deleted []string
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{items: make(map[string][]byte)}
+}
+
+func (b *memoryBackend) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, rdr io.Reader) error {
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.items[kind.String()+"/"+hash] = data
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBackend) Get(ctx context.Context, kind cache.EntryKind, hash string) (io.ReadCloser, int64, error) {
+	b.mu.Lock()
+	data, ok := b.items[kind.String()+"/"+hash]
+	b.mu.Unlock()
+	if !ok {
+		return nil, -1, nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (b *memoryBackend) Contains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64, error) {
+	b.mu.Lock()
+	data, ok := b.items[kind.String()+"/"+hash]
+	b.mu.Unlock()
+	return ok, int64(len(data)), nil
+}
+
+func (b *memoryBackend) ContainsMany(ctx context.Context, kind cache.EntryKind, hashes []string) ([]bool, error) {
+	return cache.ContainsParallel(ctx, b, kind, hashes, 1)
+}
+
+func (b *memoryBackend) Delete(ctx context.Context, kind cache.EntryKind, hash string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.items, kind.String()+"/"+hash)
+	b.deleted = append(b.deleted, kind.String()+"/"+hash)
+	return nil
+}
+
+func (b *memoryBackend) numDeleted() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.deleted)
+}
+
+func TestActionResults(t *testing.T) {
+	backend := newMemoryBackend()
+	p := New(backend, "test", backend, testutils.NewSilentLogger())
+	ctx := context.Background()
+
+	ar := &pb.ActionResult{ExitCode: 1, StdoutRaw: []byte("hello")}
+	data, err := proto.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hash := testutils.RandomDataAndHash(16)
+	backend.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+
+	rc, size, err := p.Get(ctx, cache.AC, hash)
+	if err != nil || rc == nil {
+		t.Fatalf("Expected to find the ActionResult, got %v %v", rc, err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if size != int64(len(data)) || !bytes.Equal(got, data) {
+		t.Fatal("Got the wrong data")
+	}
+
+	// A corrupt ActionResult is reported as missing, and deleted.
+	bad := []byte{0xff, 0xff, 0xff}
+	_, badHash := testutils.RandomDataAndHash(16)
+	backend.Put(ctx, cache.AC, badHash, int64(len(bad)), bytes.NewReader(bad))
+
+	rc, _, err = p.Get(ctx, cache.AC, badHash)
+	if err != nil || rc != nil {
+		t.Fatalf("Expected a cache miss, got %v %v", rc, err)
+	}
+	p.(*verifyingProxy).pending.Wait()
+	if backend.numDeleted() != 1 {
+		t.Fatalf("Expected the item to be deleted, got %v", backend.deleted)
+	}
+	found, _, _ := backend.Contains(ctx, cache.AC, badHash)
+	if found {
+		t.Fatal("Expected the item to be deleted")
+	}
+
+	// So is an empty one.
+	_, emptyHash := testutils.RandomDataAndHash(16)
+	backend.Put(ctx, cache.AC, emptyHash, 0, bytes.NewReader(nil))
+	rc, _, err = p.Get(ctx, cache.AC, emptyHash)
+	if err != nil || rc != nil {
+		t.Fatalf("Expected a cache miss, got %v %v", rc, err)
+	}
+	p.(*verifyingProxy).pending.Wait()
+	if backend.numDeleted() != 2 {
+		t.Fatalf("Expected the item to be deleted, got %v", backend.deleted)
+	}
+
+	// RAW items are not checked.
+	backend.Put(ctx, cache.RAW, badHash, int64(len(bad)), bytes.NewReader(bad))
+	rc, _, err = p.Get(ctx, cache.RAW, badHash)
+	if err != nil || rc == nil {
+		t.Fatalf("Expected to find the RAW item, got %v %v", rc, err)
+	}
+	rc.Close()
+}
+
+func TestCASBlobs(t *testing.T) {
+	backend := newMemoryBackend()
+	// Without a deleter, corrupt items are only reported.
+	p := New(backend, "test", nil, testutils.NewSilentLogger())
+	ctx := context.Background()
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	backend.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+
+	rc, _, err := p.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Expected to read the blob, got %v", err)
+	}
+
+	other, _ := testutils.RandomDataAndHash(1024)
+	backend.Put(ctx, cache.CAS, hash, int64(len(other)), bytes.NewReader(other))
+
+	rc, _, err = p.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if _, ok := err.(*cache.InvalidItemError); !ok {
+		t.Fatalf("Expected an InvalidItemError, got %v", err)
+	}
+	if backend.numDeleted() != 0 {
+		t.Fatal("Expected nothing to be deleted")
+	}
+
+	// A truncated blob is detected too.
+	backend.Put(ctx, cache.CAS, hash, 10, bytes.NewReader(data[:10]))
+	rc, _, err = p.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if _, ok := err.(*cache.InvalidItemError); !ok {
+		t.Fatalf("Expected an InvalidItemError, got %v", err)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	backend := newMemoryBackend()
+	p := New(backend, "test", backend, testutils.NewSilentLogger(),
+		WithQuarantineDir(dir))
+	ctx := context.Background()
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	data[0]++
+	backend.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+
+	rc, _, err := p.Get(ctx, cache.CAS, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if _, ok := err.(*cache.InvalidItemError); !ok {
+		t.Fatalf("Expected an InvalidItemError, got %v", err)
+	}
+	p.(*verifyingProxy).pending.Wait()
+
+	// The corrupt blob is copied to the quarantine directory, then
+	// deleted from the backend.
+	quarantined, err := ioutil.ReadFile(filepath.Join(dir, "cas", hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(quarantined, data) {
+		t.Fatal("Expected the quarantined blob to have the original contents")
+	}
+	if backend.numDeleted() != 1 {
+		t.Fatalf("Expected the blob to be deleted, got %v", backend.deleted)
+	}
+
+	// Items which can't be quarantined are not deleted.
+	err = ioutil.WriteFile(filepath.Join(dir, "ac"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []byte{0xff, 0xff}
+	_, badHash := testutils.RandomDataAndHash(16)
+	backend.Put(ctx, cache.AC, badHash, int64(len(bad)), bytes.NewReader(bad))
+	rc, _, err = p.Get(ctx, cache.AC, badHash)
+	if err != nil || rc != nil {
+		t.Fatalf("Expected a cache miss, got %v %v", rc, err)
+	}
+	p.(*verifyingProxy).pending.Wait()
+	if backend.numDeleted() != 1 {
+		t.Fatalf("Expected the item not to be deleted, got %v", backend.deleted)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
@@ -19,8 +20,39 @@ type S3CloudStorageConfig struct {
 	DisableSSL      bool   `yaml:"disable_ssl"`
 	IAMRoleEndpoint string `yaml:"iam_role_endpoint"`
 	Region          string `yaml:"region"`
+
+	// Used by the default credential chain, if neither AccessKeyID nor
+	// IAMRoleEndpoint are set.
+	SharedCredentialsFile string `yaml:"shared_credentials_file"`
+	Profile               string `yaml:"profile"`
+	WebIdentityTokenFile  string `yaml:"web_identity_token_file"`
+	RoleARN               string `yaml:"role_arn"`
+	STSEndpoint           string `yaml:"sts_endpoint"`
+
+	// One of "" (no server-side encryption), "sse-s3", "sse-kms" or "sse-c".
+	SSE         string `yaml:"sse"`
+	SSEKMSKeyID string `yaml:"sse_kms_key_id"`
+	SSECKeyFile string `yaml:"sse_c_key_file"`
+
+	StorageClass string `yaml:"storage_class"`
+	// Blobs of at least this many bytes are uploaded in parts of this
+	// size. Defaults to 64 MiB.
+	MultipartPartSize int64 `yaml:"multipart_part_size"`
 }
 
+// The supported values of the s3_proxy 'sse' key.
+const (
+	S3SSES3  = "sse-s3"
+	S3SSEKMS = "sse-kms"
+	S3SSEC   = "sse-c"
+)
+
+// The range of valid s3_proxy 'multipart_part_size' values.
+const (
+	S3MinPartSize = 5 * 1024 * 1024
+	S3MaxPartSize = 5 * 1024 * 1024 * 1024
+)
+
 type GoogleCloudStorageConfig struct {
 	Bucket                string `yaml:"bucket"`
 	UseDefaultCredentials bool   `yaml:"use_default_credentials"`
@@ -29,48 +61,270 @@ type GoogleCloudStorageConfig struct {
 
 type HTTPBackendConfig struct {
 	BaseURL string `yaml:"url"`
+
+	// At most one of basic auth, BearerToken and BearerTokenFile can be
+	// used. Basic auth credentials can also be specified in BaseURL.
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearer_token"`
+	// A file containing a bearer token, which is re-read when it changes.
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+	Headers         map[string]string `yaml:"headers"`
+
+	TLSCAFile   string `yaml:"tls_ca_file"`
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+
+	// Connection pool settings, zero values use the net/http defaults.
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+}
+
+// GRPCBackendConfig describes a REAPI-compatible remote cache, which is
+// accessed over gRPC.
+type GRPCBackendConfig struct {
+	// grpc://host:port, or grpcs://host:port for TLS.
+	BaseURL      string            `yaml:"url"`
+	InstanceName string            `yaml:"instance_name"`
+	TLSCAFile    string            `yaml:"tls_ca_file"`
+	TLSCertFile  string            `yaml:"tls_cert_file"`
+	TLSKeyFile   string            `yaml:"tls_key_file"`
+	Headers      map[string]string `yaml:"headers"`
+}
+
+// FilesystemProxyConfig describes a directory, typically on a shared
+// network filesystem, which is used as a proxy backend.
+type FilesystemProxyConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+// RedisProxyConfig describes a Redis-compatible key-value store which is
+// used as a proxy backend.
+type RedisProxyConfig struct {
+	Address   string `yaml:"address"`
+	Password  string `yaml:"password"`
+	DB        int    `yaml:"db"`
+	TLS       bool   `yaml:"tls"`
+	KeyPrefix string `yaml:"key_prefix"`
+	// Larger blobs are not uploaded. Zero means 1 MiB.
+	MaxObjectSize int64 `yaml:"max_object_size"`
+	// Zero means that keys don't expire.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// PluginProxyConfig describes an external helper program which is used
+// as a proxy backend, see the cache/plugin package for its protocol.
+type PluginProxyConfig struct {
+	// The program and its arguments.
+	Command []string `yaml:"command"`
+	// The maximum number of concurrent requests, each handled by a
+	// separate helper process. Zero means 4.
+	MaxConcurrency int `yaml:"max_concurrency"`
+}
+
+// AzBlobStorageConfig describes an Azure Blob Storage container which is
+// used as a proxy backend.
+type AzBlobStorageConfig struct {
+	StorageAccount string `yaml:"storage_account"`
+	ContainerName  string `yaml:"container_name"`
+	Prefix         string `yaml:"prefix"`
+	// Defaults to https://<storage_account>.blob.core.windows.net
+	Endpoint                string `yaml:"endpoint"`
+	AuthMethod              string `yaml:"auth_method"`
+	SharedKey               string `yaml:"shared_key"`
+	SASToken                string `yaml:"sas_token"`
+	ManagedIdentityClientID string `yaml:"managed_identity_client_id"`
+}
+
+// The supported values of the azblob_proxy 'auth_method' key.
+const (
+	AzBlobAuthSharedKey       = "shared_key"
+	AzBlobAuthSAS             = "sas"
+	AzBlobAuthManagedIdentity = "managed_identity"
+)
+
+// ProxyChainBackendConfig describes one element of a proxy chain. Exactly
+// one of the backend fields must be set.
+type ProxyChainBackendConfig struct {
+	GoogleCloudStorage *GoogleCloudStorageConfig `yaml:"gcs_proxy"`
+	HTTPBackend        *HTTPBackendConfig        `yaml:"http_proxy"`
+	S3CloudStorage     *S3CloudStorageConfig     `yaml:"s3_proxy"`
+	GRPCBackend        *GRPCBackendConfig        `yaml:"grpc_proxy"`
+	FilesystemProxy    *FilesystemProxyConfig    `yaml:"filesystem_proxy"`
+	RedisProxy         *RedisProxyConfig         `yaml:"redis_proxy"`
+	AzBlobStorage      *AzBlobStorageConfig      `yaml:"azblob_proxy"`
+	PluginProxy        *PluginProxyConfig        `yaml:"plugin_proxy"`
+	Mode               string                    `yaml:"mode"`
+}
+
+// ProxyChainConfig describes an ordered list of proxy backends, which
+// are used together.
+type ProxyChainConfig struct {
+	ReadMode string                    `yaml:"read_mode"`
+	Backfill bool                      `yaml:"backfill"`
+	Backends []ProxyChainBackendConfig `yaml:"backends"`
+}
+
+// The supported values of the proxy chain 'mode' key. An empty value
+// means ProxyModeReadWrite.
+const (
+	ProxyModeReadWrite = "read_write"
+	ProxyModeReadOnly  = "read_only"
+	ProxyModeWriteOnly = "write_only"
+)
+
+// The supported values of the proxy chain 'read_mode' key. An empty
+// value means ProxyChainFirstHit.
+const (
+	ProxyChainFirstHit = "first_hit"
+	ProxyChainRace     = "race"
+)
+
+// ClusterConfig describes the other bazel-remote nodes which this node
+// shares its cache items with.
+type ClusterConfig struct {
+	Self              string   `yaml:"self"`
+	Peers             []string `yaml:"peers"`
+	MembershipFile    string   `yaml:"membership_file"`
+	ReplicationFactor int      `yaml:"replication_factor"`
+
+	// Shared by all nodes, and sent with requests forwarded between
+	// them. Forwarding markers from requests without it are ignored.
+	Secret string `yaml:"secret"`
+
+	// Authentication, TLS and connection pool settings for requests to
+	// the other nodes, with the same keys as 'http_proxy' (except for
+	// 'url').
+	Client HTTPBackendConfig `yaml:",inline"`
 }
 
 // Config provides the configuration
 type Config struct {
-	Host                    string                    `yaml:"host"`
-	Port                    int                       `yaml:"port"`
-	GRPCPort                int                       `yaml:"grpc_port"`
-	ProfileHost             string                    `yaml:"profile_host"`
-	ProfilePort             int                       `yaml:"profile_port"`
-	Dir                     string                    `yaml:"dir"`
-	MaxSize                 int                       `yaml:"max_size"`
-	HtpasswdFile            string                    `yaml:"htpasswd_file"`
-	TLSCertFile             string                    `yaml:"tls_cert_file"`
-	TLSKeyFile              string                    `yaml:"tls_key_file"`
-	S3CloudStorage          *S3CloudStorageConfig     `yaml:"s3_proxy"`
-	GoogleCloudStorage      *GoogleCloudStorageConfig `yaml:"gcs_proxy"`
-	HTTPBackend             *HTTPBackendConfig        `yaml:"http_proxy"`
-	IdleTimeout             time.Duration             `yaml:"idle_timeout"`
-	DisableHTTPACValidation bool                      `yaml:"disable_http_ac_validation"`
+	Host                      string                    `yaml:"host"`
+	Port                      int                       `yaml:"port"`
+	GRPCPort                  int                       `yaml:"grpc_port"`
+	ProfileHost               string                    `yaml:"profile_host"`
+	ProfilePort               int                       `yaml:"profile_port"`
+	Dir                       string                    `yaml:"dir"`
+	StorageMode               string                    `yaml:"storage_mode"`
+	MaxSize                   int                       `yaml:"max_size"`
+	HtpasswdFile              string                    `yaml:"htpasswd_file"`
+	TLSCertFile               string                    `yaml:"tls_cert_file"`
+	TLSKeyFile                string                    `yaml:"tls_key_file"`
+	S3CloudStorage            *S3CloudStorageConfig     `yaml:"s3_proxy"`
+	GoogleCloudStorage        *GoogleCloudStorageConfig `yaml:"gcs_proxy"`
+	HTTPBackend               *HTTPBackendConfig        `yaml:"http_proxy"`
+	GRPCBackend               *GRPCBackendConfig        `yaml:"grpc_proxy"`
+	FilesystemProxy           *FilesystemProxyConfig    `yaml:"filesystem_proxy"`
+	RedisProxy                *RedisProxyConfig         `yaml:"redis_proxy"`
+	AzBlobStorage             *AzBlobStorageConfig      `yaml:"azblob_proxy"`
+	PluginProxy               *PluginProxyConfig        `yaml:"plugin_proxy"`
+	ProxyChain                *ProxyChainConfig         `yaml:"proxy_chain"`
+	ProxyWriteThrough         bool                      `yaml:"proxy_write_through"`
+	ProxyPassthroughThreshold int64                     `yaml:"proxy_passthrough_threshold"`
+	ProxyUploadQueueDir       string                    `yaml:"proxy_upload_queue_dir"`
+	ProxyTimeouts             ProxyTimeoutsConfig       `yaml:"proxy_timeouts"`
+	ProxyResilience           ProxyResilienceConfig     `yaml:"proxy_resilience"`
+	ProxyNegativeCache        ProxyNegativeCacheConfig  `yaml:"proxy_negative_cache"`
+	ProxyDeleteInvalidItems   bool                      `yaml:"proxy_delete_invalid_items"`
+	ProxyQuarantineDir        string                    `yaml:"proxy_quarantine_dir"`
+	ProxyBackfill             ProxyBackfillConfig       `yaml:"proxy_backfill"`
+	Cluster                   *ClusterConfig            `yaml:"cluster"`
+	IdleTimeout               time.Duration             `yaml:"idle_timeout"`
+	DisableHTTPACValidation   bool                      `yaml:"disable_http_ac_validation"`
+	ReadOnly                  bool                      `yaml:"read_only"`
+	HTTPCompression           bool                      `yaml:"http_compression"`
+	MaxChunkedUploadSize      int64                     `yaml:"max_chunked_upload_size"`
+}
+
+// ProxyTimeoutsConfig stores the per-operation timeouts for requests
+// to the proxy backend. Zero values disable the timeout.
+type ProxyTimeoutsConfig struct {
+	Get      time.Duration `yaml:"get"`
+	Put      time.Duration `yaml:"put"`
+	Contains time.Duration `yaml:"contains"`
 }
 
+// ProxyResilienceConfig controls retries and the circuit breaker for
+// requests to the proxy backend. Zero values disable the respective
+// feature.
+type ProxyResilienceConfig struct {
+	// The number of times to retry failed idempotent requests.
+	MaxRetries int `yaml:"max_retries"`
+	// The delay before the first retry, doubled for each further
+	// retry up to MaxBackoff.
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	// The number of consecutive failures after which the backend is
+	// bypassed for OpenDuration.
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+}
+
+// Enabled returns true if retries or the circuit breaker are enabled.
+func (r ProxyResilienceConfig) Enabled() bool {
+	return r.MaxRetries > 0 || r.FailureThreshold > 0
+}
+
+// ProxyNegativeCacheConfig controls how long proxy misses are
+// remembered, to avoid asking the proxy backend about the same missing
+// items repeatedly. A zero TTL disables this.
+type ProxyNegativeCacheConfig struct {
+	TTL time.Duration `yaml:"ttl"`
+	// The maximum number of misses to remember, or 0 for the default.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// ProxyBackfillConfig controls the background upload of items which
+// were stored locally before the proxy backend was configured. The
+// backfill is disabled if StateFile is empty.
+type ProxyBackfillConfig struct {
+	// Records the progress, so the backfill can resume after a restart.
+	StateFile string `yaml:"state_file"`
+	// The upload rate limit, or 0 for no limit.
+	MaxBytesPerSecond int64 `yaml:"max_bytes_per_second"`
+}
+
+// The supported values of the 'storage_mode' flag/key.
+const (
+	StorageModeDisk   = "disk"
+	StorageModeMemory = "memory"
+)
+
 // New ...
-func New(dir string, maxSize int, host string, port int, grpc_port int,
+func New(dir string, storageMode string, maxSize int, host string, port int, grpc_port int,
 	profile_host string, profile_port int, htpasswdFile string,
 	tlsCertFile string, tlsKeyFile string, idleTimeout time.Duration,
-	s3 *S3CloudStorageConfig, disable_http_ac_validation bool) (*Config, error) {
+	s3 *S3CloudStorageConfig, proxyWriteThrough bool,
+	proxyPassthroughThreshold int64, proxyUploadQueueDir string,
+	proxyTimeouts ProxyTimeoutsConfig, disable_http_ac_validation bool,
+	readOnly bool, httpCompression bool,
+	maxChunkedUploadSize int64) (*Config, error) {
 	c := Config{
-		Host:                    host,
-		Port:                    port,
-		GRPCPort:                grpc_port,
-		ProfileHost:             profile_host,
-		ProfilePort:             profile_port,
-		Dir:                     dir,
-		MaxSize:                 maxSize,
-		HtpasswdFile:            htpasswdFile,
-		TLSCertFile:             tlsCertFile,
-		TLSKeyFile:              tlsKeyFile,
-		S3CloudStorage:          s3,
-		GoogleCloudStorage:      nil,
-		HTTPBackend:             nil,
-		IdleTimeout:             idleTimeout,
-		DisableHTTPACValidation: disable_http_ac_validation,
+		Host:                      host,
+		Port:                      port,
+		GRPCPort:                  grpc_port,
+		ProfileHost:               profile_host,
+		ProfilePort:               profile_port,
+		Dir:                       dir,
+		StorageMode:               storageMode,
+		MaxSize:                   maxSize,
+		HtpasswdFile:              htpasswdFile,
+		TLSCertFile:               tlsCertFile,
+		TLSKeyFile:                tlsKeyFile,
+		S3CloudStorage:            s3,
+		GoogleCloudStorage:        nil,
+		HTTPBackend:               nil,
+		ProxyWriteThrough:         proxyWriteThrough,
+		ProxyPassthroughThreshold: proxyPassthroughThreshold,
+		ProxyUploadQueueDir:       proxyUploadQueueDir,
+		ProxyTimeouts:             proxyTimeouts,
+		IdleTimeout:               idleTimeout,
+		DisableHTTPACValidation:   disable_http_ac_validation,
+		ReadOnly:                  readOnly,
+		HTTPCompression:           httpCompression,
+		MaxChunkedUploadSize:      maxChunkedUploadSize,
 	}
 
 	err := validateConfig(&c)
@@ -111,8 +365,18 @@ func newFromYaml(data []byte) (*Config, error) {
 }
 
 func validateConfig(c *Config) error {
-	if c.Dir == "" {
-		return errors.New("The 'dir' flag/key is required")
+	switch c.StorageMode {
+	case "", StorageModeDisk:
+		if c.Dir == "" {
+			return errors.New("The 'dir' flag/key is required")
+		}
+	case StorageModeMemory:
+		if c.Dir != "" {
+			return errors.New("The 'dir' flag/key must not be set when 'storage_mode' is 'memory'")
+		}
+	default:
+		return fmt.Errorf("The 'storage_mode' flag/key must be either '%s' or '%s', found '%s'",
+			StorageModeDisk, StorageModeMemory, c.StorageMode)
 	}
 
 	if c.MaxSize <= 0 {
@@ -132,25 +396,368 @@ func validateConfig(c *Config) error {
 			"'tls_key_file' and 'tls_cert_file'")
 	}
 
-	if c.GoogleCloudStorage != nil && c.HTTPBackend != nil && c.S3CloudStorage != nil {
+	numProxies := 0
+	for _, set := range []bool{c.GoogleCloudStorage != nil, c.HTTPBackend != nil,
+		c.S3CloudStorage != nil, c.GRPCBackend != nil, c.FilesystemProxy != nil,
+		c.RedisProxy != nil, c.AzBlobStorage != nil, c.PluginProxy != nil} {
+		if set {
+			numProxies++
+		}
+	}
+	if numProxies > 1 {
 		return errors.New("One can specify at most one proxying backend")
 	}
 
-	if c.GoogleCloudStorage != nil {
-		if c.GoogleCloudStorage.Bucket == "" {
+	err := validateProxyBackend(c.GoogleCloudStorage, c.HTTPBackend,
+		c.S3CloudStorage, c.GRPCBackend, c.FilesystemProxy, c.RedisProxy,
+		c.AzBlobStorage, c.PluginProxy)
+	if err != nil {
+		return err
+	}
+
+	if c.ProxyChain != nil {
+		err = validateProxyChain(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ProxyPassthroughThreshold < 0 {
+		return errors.New("The 'proxy_passthrough_threshold' flag/key must be 0 (disabled) or a positive integer")
+	}
+
+	if c.ProxyPassthroughThreshold > 0 && !c.hasProxy() {
+		return errors.New("The 'proxy_passthrough_threshold' flag/key requires a proxy backend")
+	}
+
+	if c.MaxChunkedUploadSize < 0 {
+		return errors.New("The 'max_chunked_upload_size' flag/key must be 0 (the default of 1 GiB) or a positive integer")
+	}
+
+	if c.ProxyTimeouts.Get < 0 || c.ProxyTimeouts.Put < 0 || c.ProxyTimeouts.Contains < 0 {
+		return errors.New("The 'proxy_timeouts' flags/keys must not be negative")
+	}
+
+	err = validateProxyResilience(c)
+	if err != nil {
+		return err
+	}
+
+	if c.ProxyNegativeCache.TTL < 0 || c.ProxyNegativeCache.MaxEntries < 0 {
+		return errors.New("The 'proxy_negative_cache' keys must not be negative")
+	}
+
+	if c.ProxyNegativeCache.TTL > 0 && !c.hasProxy() {
+		return errors.New("The 'proxy_negative_cache' key requires a proxy backend")
+	}
+
+	if c.ProxyNegativeCache.MaxEntries > 0 && c.ProxyNegativeCache.TTL == 0 {
+		return errors.New("The 'proxy_negative_cache.ttl' key is required when 'max_entries' is set")
+	}
+
+	if c.ProxyDeleteInvalidItems && !c.hasProxy() {
+		return errors.New("The 'proxy_delete_invalid_items' key requires a proxy backend")
+	}
+
+	if c.ProxyQuarantineDir != "" && !c.ProxyDeleteInvalidItems {
+		return errors.New("The 'proxy_quarantine_dir' key requires 'proxy_delete_invalid_items'")
+	}
+
+	if c.ProxyBackfill.MaxBytesPerSecond < 0 {
+		return errors.New("The 'proxy_backfill.max_bytes_per_second' key must not be negative")
+	}
+
+	if c.ProxyBackfill.StateFile != "" {
+		if !c.hasProxy() {
+			return errors.New("The 'proxy_backfill' key requires a proxy backend")
+		}
+		if c.StorageMode == StorageModeMemory {
+			return errors.New("The 'proxy_backfill' key requires the 'disk' storage mode")
+		}
+	} else if c.ProxyBackfill.MaxBytesPerSecond > 0 {
+		return errors.New("The 'proxy_backfill.state_file' key is required when 'max_bytes_per_second' is set")
+	}
+
+	if c.ProxyUploadQueueDir != "" {
+		if !c.hasProxy() {
+			return errors.New("The 'proxy_upload_queue_dir' flag/key requires a proxy backend")
+		}
+		if c.ProxyWriteThrough {
+			return errors.New("The 'proxy_upload_queue_dir' and 'proxy_write_through' flags/keys are mutually exclusive")
+		}
+	}
+
+	if c.Cluster != nil {
+		if c.Cluster.Self == "" {
+			return errors.New("The 'cluster.self' key is required")
+		}
+		if len(c.Cluster.Peers) == 0 && c.Cluster.MembershipFile == "" {
+			return errors.New("The 'cluster' key requires 'peers' and/or 'membership_file'")
+		}
+		if c.Cluster.ReplicationFactor < 0 {
+			return errors.New("The 'cluster.replication_factor' key must be 0 (the default of 1) or a positive integer")
+		}
+		if c.Cluster.Secret == "" {
+			return errors.New("The 'cluster.secret' key is required")
+		}
+		if c.Cluster.Client.BaseURL != "" {
+			return errors.New("The 'cluster' key does not support 'url', use 'self', 'peers' and/or 'membership_file'")
+		}
+		err := validateHTTPClient("cluster", &c.Cluster.Client)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) hasProxy() bool {
+	return c.GoogleCloudStorage != nil || c.HTTPBackend != nil ||
+		c.S3CloudStorage != nil || c.GRPCBackend != nil ||
+		c.FilesystemProxy != nil || c.RedisProxy != nil ||
+		c.AzBlobStorage != nil || c.PluginProxy != nil || c.ProxyChain != nil
+}
+
+func validateProxyResilience(c *Config) error {
+	r := c.ProxyResilience
+	if r.MaxRetries < 0 || r.InitialBackoff < 0 || r.MaxBackoff < 0 ||
+		r.FailureThreshold < 0 || r.OpenDuration < 0 {
+		return errors.New("The 'proxy_resilience' keys must not be negative")
+	}
+
+	if r.Enabled() && !c.hasProxy() {
+		return errors.New("The 'proxy_resilience' key requires a proxy backend")
+	}
+
+	if r.MaxRetries > 0 && r.InitialBackoff == 0 {
+		return errors.New("The 'proxy_resilience.initial_backoff' key is required when 'max_retries' is set")
+	}
+
+	if r.MaxBackoff != 0 && r.MaxBackoff < r.InitialBackoff {
+		return errors.New("The 'proxy_resilience.max_backoff' key must not be less than 'initial_backoff'")
+	}
+
+	if r.FailureThreshold > 0 && r.OpenDuration == 0 {
+		return errors.New("The 'proxy_resilience.open_duration' key is required when 'failure_threshold' is set")
+	}
+
+	return nil
+}
+
+func validateProxyBackend(gcs *GoogleCloudStorageConfig, h *HTTPBackendConfig,
+	s3 *S3CloudStorageConfig, g *GRPCBackendConfig, fs *FilesystemProxyConfig,
+	redis *RedisProxyConfig, az *AzBlobStorageConfig, plugin *PluginProxyConfig) error {
+
+	if gcs != nil {
+		if gcs.Bucket == "" {
 			return errors.New("The 'bucket' field is required for 'gcs_proxy'")
 		}
 	}
 
-	if c.HTTPBackend != nil {
-		if c.HTTPBackend.BaseURL == "" {
-			return errors.New("The 'url' field is required for 'http_proxy'")
+	if h != nil {
+		err := validateHTTPBackend(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	if g != nil {
+		if !strings.HasPrefix(g.BaseURL, "grpc://") && !strings.HasPrefix(g.BaseURL, "grpcs://") {
+			return errors.New("The 'url' field of 'grpc_proxy' must start with 'grpc://' or 'grpcs://'")
+		}
+		if (g.TLSCertFile != "") != (g.TLSKeyFile != "") {
+			return errors.New("The 'tls_cert_file' and 'tls_key_file' fields of 'grpc_proxy' must be specified together")
+		}
+		if (g.TLSCAFile != "" || g.TLSCertFile != "") && !strings.HasPrefix(g.BaseURL, "grpcs://") {
+			return errors.New("The TLS fields of 'grpc_proxy' require a 'grpcs://' url")
+		}
+	}
+
+	if fs != nil {
+		if fs.Dir == "" {
+			return errors.New("The 'dir' field is required for 'filesystem_proxy'")
+		}
+	}
+
+	if redis != nil {
+		if redis.Address == "" {
+			return errors.New("The 'address' field is required for 'redis_proxy'")
+		}
+		if redis.MaxObjectSize < 0 {
+			return errors.New("The 'max_object_size' field of 'redis_proxy' must not be negative")
+		}
+		if redis.TTL < 0 {
+			return errors.New("The 'ttl' field of 'redis_proxy' must not be negative")
+		}
+	}
+
+	if plugin != nil {
+		if len(plugin.Command) == 0 {
+			return errors.New("The 'command' field is required for 'plugin_proxy'")
+		}
+		if plugin.MaxConcurrency < 0 {
+			return errors.New("The 'max_concurrency' field of 'plugin_proxy' must not be negative")
+		}
+	}
+
+	if az != nil {
+		if az.StorageAccount == "" || az.ContainerName == "" {
+			return errors.New("The 'storage_account' and 'container_name' fields are required for 'azblob_proxy'")
+		}
+		switch az.AuthMethod {
+		case AzBlobAuthSharedKey:
+			if az.SharedKey == "" {
+				return errors.New("The 'shared_key' field of 'azblob_proxy' is required for the 'shared_key' auth_method")
+			}
+		case AzBlobAuthSAS:
+			if az.SASToken == "" {
+				return errors.New("The 'sas_token' field of 'azblob_proxy' is required for the 'sas' auth_method")
+			}
+		case AzBlobAuthManagedIdentity:
+		default:
+			return fmt.Errorf("The 'auth_method' field of 'azblob_proxy' must be one of '%s', '%s' or '%s', found '%s'",
+				AzBlobAuthSharedKey, AzBlobAuthSAS, AzBlobAuthManagedIdentity, az.AuthMethod)
+		}
+	}
+
+	if s3 != nil {
+		err := validateS3(s3)
+		if err != nil {
+			return err
 		}
 	}
 
-	if c.S3CloudStorage != nil {
-		if c.S3CloudStorage.AccessKeyID != "" && c.S3CloudStorage.IAMRoleEndpoint != "" {
-			return errors.New("Expected either 's3.access_key_id' or 's3.iam_role_endpoint', found both")
+	return nil
+}
+
+func validateHTTPBackend(h *HTTPBackendConfig) error {
+	if h.BaseURL == "" {
+		return errors.New("The 'url' field is required for 'http_proxy'")
+	}
+
+	err := validateHTTPClient("http_proxy", h)
+	if err != nil {
+		return err
+	}
+
+	if (h.TLSCAFile != "" || h.TLSCertFile != "") && !strings.HasPrefix(h.BaseURL, "https://") {
+		return errors.New("The TLS fields of 'http_proxy' require an 'https://' url")
+	}
+
+	return nil
+}
+
+// Validate the client settings of an HTTP backend config, which is
+// used by the key `name`.
+func validateHTTPClient(name string, h *HTTPBackendConfig) error {
+	numAuth := 0
+	for _, set := range []bool{h.Username != "" || h.Password != "",
+		h.BearerToken != "", h.BearerTokenFile != ""} {
+		if set {
+			numAuth++
+		}
+	}
+	if numAuth > 1 {
+		return fmt.Errorf("At most one of basic auth, 'bearer_token' and 'bearer_token_file' can be specified for '%s'", name)
+	}
+	if h.Password != "" && h.Username == "" {
+		return fmt.Errorf("The 'password' field of '%s' requires a 'username'", name)
+	}
+
+	if (h.TLSCertFile != "") != (h.TLSKeyFile != "") {
+		return fmt.Errorf("The 'tls_cert_file' and 'tls_key_file' fields of '%s' must be specified together", name)
+	}
+
+	if h.MaxIdleConnsPerHost < 0 || h.MaxConnsPerHost < 0 || h.IdleConnTimeout < 0 {
+		return fmt.Errorf("The connection pool fields of '%s' must not be negative", name)
+	}
+
+	return nil
+}
+
+func validateS3(s3 *S3CloudStorageConfig) error {
+	if s3.AccessKeyID != "" && s3.IAMRoleEndpoint != "" {
+		return errors.New("Expected either 's3.access_key_id' or 's3.iam_role_endpoint', found both")
+	}
+
+	if (s3.WebIdentityTokenFile == "") != (s3.RoleARN == "") {
+		return errors.New("The 's3.web_identity_token_file' and 's3.role_arn' keys must be specified together")
+	}
+
+	switch s3.SSE {
+	case "", S3SSES3, S3SSEKMS:
+	case S3SSEC:
+		if s3.SSECKeyFile == "" {
+			return errors.New("The 's3.sse_c_key_file' key is required when 's3.sse' is 'sse-c'")
+		}
+		if s3.DisableSSL {
+			return errors.New("The 's3.sse' key must not be 'sse-c' when 's3.disable_ssl' is set")
+		}
+	default:
+		return fmt.Errorf("The 's3.sse' key must be one of '%s', '%s' or '%s', found '%s'",
+			S3SSES3, S3SSEKMS, S3SSEC, s3.SSE)
+	}
+
+	if s3.SSEKMSKeyID != "" && s3.SSE != S3SSEKMS {
+		return errors.New("The 's3.sse_kms_key_id' key requires 's3.sse' to be 'sse-kms'")
+	}
+	if s3.SSECKeyFile != "" && s3.SSE != S3SSEC {
+		return errors.New("The 's3.sse_c_key_file' key requires 's3.sse' to be 'sse-c'")
+	}
+
+	if s3.MultipartPartSize != 0 &&
+		(s3.MultipartPartSize < S3MinPartSize || s3.MultipartPartSize > S3MaxPartSize) {
+		return fmt.Errorf("The 's3.multipart_part_size' key must be between %d and %d bytes",
+			S3MinPartSize, S3MaxPartSize)
+	}
+
+	return nil
+}
+
+func validateProxyChain(c *Config) error {
+	if c.GoogleCloudStorage != nil || c.HTTPBackend != nil || c.S3CloudStorage != nil ||
+		c.GRPCBackend != nil || c.FilesystemProxy != nil || c.RedisProxy != nil ||
+		c.AzBlobStorage != nil || c.PluginProxy != nil {
+		return errors.New("The 'proxy_chain' key cannot be combined with another proxy backend")
+	}
+
+	switch c.ProxyChain.ReadMode {
+	case "", ProxyChainFirstHit, ProxyChainRace:
+	default:
+		return fmt.Errorf("The 'proxy_chain.read_mode' key must be either '%s' or '%s', found '%s'",
+			ProxyChainFirstHit, ProxyChainRace, c.ProxyChain.ReadMode)
+	}
+
+	if len(c.ProxyChain.Backends) == 0 {
+		return errors.New("The 'proxy_chain.backends' key must list at least one backend")
+	}
+
+	for i, b := range c.ProxyChain.Backends {
+		numBackends := 0
+		for _, set := range []bool{b.GoogleCloudStorage != nil, b.HTTPBackend != nil,
+			b.S3CloudStorage != nil, b.GRPCBackend != nil, b.FilesystemProxy != nil,
+			b.RedisProxy != nil, b.AzBlobStorage != nil, b.PluginProxy != nil} {
+			if set {
+				numBackends++
+			}
+		}
+		if numBackends != 1 {
+			return fmt.Errorf("Entry %d of 'proxy_chain.backends' must specify exactly one proxy backend", i)
+		}
+
+		err := validateProxyBackend(b.GoogleCloudStorage, b.HTTPBackend,
+			b.S3CloudStorage, b.GRPCBackend, b.FilesystemProxy, b.RedisProxy,
+			b.AzBlobStorage, b.PluginProxy)
+		if err != nil {
+			return fmt.Errorf("Entry %d of 'proxy_chain.backends': %v", i, err)
+		}
+
+		switch b.Mode {
+		case "", ProxyModeReadWrite, ProxyModeReadOnly, ProxyModeWriteOnly:
+		default:
+			return fmt.Errorf("Entry %d of 'proxy_chain.backends' has an invalid 'mode': '%s', expected one of '%s', '%s' or '%s'",
+				i, b.Mode, ProxyModeReadWrite, ProxyModeReadOnly, ProxyModeWriteOnly)
 		}
 	}
 
@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -213,3 +214,833 @@ profile_host: 192.168.1.1`
 		t.Fatalf("Expected '%+v' but got '%+v'", expectedConfig, config)
 	}
 }
+
+func TestMemoryStorageMode(t *testing.T) {
+	yaml := `port: 8080
+storage_mode: memory
+max_size: 10
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedConfig := &Config{
+		Port:        8080,
+		StorageMode: "memory",
+		MaxSize:     10,
+	}
+
+	if !cmp.Equal(config, expectedConfig) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expectedConfig, config)
+	}
+
+	_, err = newFromYaml([]byte(yaml + "dir: /opt/cache-dir\n"))
+	if err == nil {
+		t.Fatal("Expected an error when combining 'dir' with memory storage_mode")
+	}
+
+	_, err = newFromYaml([]byte(`port: 8080
+storage_mode: tape
+dir: /opt/cache-dir
+max_size: 10
+`))
+	if err == nil {
+		t.Fatal("Expected an error for an unknown storage_mode")
+	}
+}
+
+func TestProxyUploadQueueDir(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+proxy_upload_queue_dir: /opt/upload-queue
+`
+	_, err := newFromYaml([]byte(yaml))
+	if err == nil {
+		t.Fatal("Expected an error when using 'proxy_upload_queue_dir' without a proxy backend")
+	}
+
+	yaml += `http_proxy:
+  url: https://remote-cache.com:8080/cache
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ProxyUploadQueueDir != "/opt/upload-queue" {
+		t.Fatalf("Unexpected proxy_upload_queue_dir: %q", config.ProxyUploadQueueDir)
+	}
+
+	_, err = newFromYaml([]byte(yaml + "proxy_write_through: true\n"))
+	if err == nil {
+		t.Fatal("Expected an error when combining 'proxy_upload_queue_dir' with 'proxy_write_through'")
+	}
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_timeouts:
+  get: 5m
+  contains: 10s
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ProxyTimeoutsConfig{
+		Get:      5 * time.Minute,
+		Contains: 10 * time.Second,
+	}
+	if config.ProxyTimeouts != expected {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.ProxyTimeouts)
+	}
+
+	_, err = newFromYaml([]byte(yaml + "  put: -1s\n"))
+	if err == nil {
+		t.Fatal("Expected an error for a negative timeout")
+	}
+}
+
+func TestProxyChain(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+proxy_chain:
+  read_mode: race
+  backfill: true
+  backends:
+    - s3_proxy:
+        endpoint: minio.example.com:9000
+        bucket: test-bucket
+    - http_proxy:
+        url: https://remote-cache.com:8080/cache
+      mode: read_only
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedChain := &ProxyChainConfig{
+		ReadMode: ProxyChainRace,
+		Backfill: true,
+		Backends: []ProxyChainBackendConfig{
+			{
+				S3CloudStorage: &S3CloudStorageConfig{
+					Endpoint: "minio.example.com:9000",
+					Bucket:   "test-bucket",
+				},
+			},
+			{
+				HTTPBackend: &HTTPBackendConfig{
+					BaseURL: "https://remote-cache.com:8080/cache",
+				},
+				Mode: ProxyModeReadOnly,
+			},
+		},
+	}
+	if !cmp.Equal(config.ProxyChain, expectedChain) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expectedChain, config.ProxyChain)
+	}
+
+	invalid := []string{
+		// Combined with a top-level proxy.
+		yaml + `http_proxy:
+  url: https://remote-cache.com:8080/cache
+`,
+		// An entry with two backends.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+proxy_chain:
+  backends:
+    - http_proxy:
+        url: https://remote-cache.com:8080/cache
+      gcs_proxy:
+        bucket: gcs-bucket
+`,
+		// An unknown mode.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+proxy_chain:
+  backends:
+    - http_proxy:
+        url: https://remote-cache.com:8080/cache
+      mode: sometimes
+`,
+	}
+	for _, y := range invalid {
+		_, err = newFromYaml([]byte(y))
+		if err == nil {
+			t.Errorf("Expected an error for config:\n%s", y)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+cluster:
+  self: http://node-a:8080
+  peers:
+    - http://node-b:8080
+    - http://node-c:8080
+  replication_factor: 2
+  secret: EXAMPLE_SECRET
+  tls_ca_file: /opt/ca.pem
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedCluster := &ClusterConfig{
+		Self:              "http://node-a:8080",
+		Peers:             []string{"http://node-b:8080", "http://node-c:8080"},
+		ReplicationFactor: 2,
+		Secret:            "EXAMPLE_SECRET",
+		Client:            HTTPBackendConfig{TLSCAFile: "/opt/ca.pem"},
+	}
+	if !cmp.Equal(config.Cluster, expectedCluster) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expectedCluster, config.Cluster)
+	}
+
+	invalid := []string{
+		// No self.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+cluster:
+  peers:
+    - http://node-b:8080
+  secret: EXAMPLE_SECRET
+`,
+		// No peers.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+cluster:
+  self: http://node-a:8080
+  secret: EXAMPLE_SECRET
+`,
+		// No secret.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+cluster:
+  self: http://node-a:8080
+  peers:
+    - http://node-b:8080
+`,
+		// Client settings are validated.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+cluster:
+  self: http://node-a:8080
+  peers:
+    - http://node-b:8080
+  secret: EXAMPLE_SECRET
+  tls_cert_file: /opt/cert.pem
+`,
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+cluster:
+  self: http://node-a:8080
+  peers:
+    - http://node-b:8080
+  secret: EXAMPLE_SECRET
+  url: http://node-b:8080
+`,
+	}
+	for _, y := range invalid {
+		_, err = newFromYaml([]byte(y))
+		if err == nil {
+			t.Errorf("Expected an error for config:\n%s", y)
+		}
+	}
+}
+
+func TestGRPCProxy(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+grpc_proxy:
+  url: grpcs://remote-cache.example.com:9092
+  instance_name: main
+  tls_ca_file: /etc/ca.pem
+  headers:
+    authorization: Bearer secret
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedGRPC := &GRPCBackendConfig{
+		BaseURL:      "grpcs://remote-cache.example.com:9092",
+		InstanceName: "main",
+		TLSCAFile:    "/etc/ca.pem",
+		Headers:      map[string]string{"authorization": "Bearer secret"},
+	}
+	if !cmp.Equal(config.GRPCBackend, expectedGRPC) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expectedGRPC, config.GRPCBackend)
+	}
+
+	invalid := []string{
+		// Not a gRPC url.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+grpc_proxy:
+  url: https://remote-cache.example.com:9092
+`,
+		// TLS settings without TLS.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+grpc_proxy:
+  url: grpc://remote-cache.example.com:9092
+  tls_ca_file: /etc/ca.pem
+`,
+		// Combined with another proxy.
+		yaml + `http_proxy:
+  url: https://remote-cache.com:8080/cache
+`,
+	}
+	for _, y := range invalid {
+		_, err = newFromYaml([]byte(y))
+		if err == nil {
+			t.Errorf("Expected an error for config:\n%s", y)
+		}
+	}
+}
+
+func TestFilesystemProxy(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+filesystem_proxy:
+  dir: /mnt/shared/bazel-cache
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &FilesystemProxyConfig{Dir: "/mnt/shared/bazel-cache"}
+	if !cmp.Equal(config.FilesystemProxy, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.FilesystemProxy)
+	}
+
+	_, err = newFromYaml([]byte(`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+filesystem_proxy:
+  dir: ""
+`))
+	if err == nil {
+		t.Fatal("Expected an error for an empty 'dir'")
+	}
+}
+
+func TestRedisProxy(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+redis_proxy:
+  address: redis.example.com:6379
+  password: secret
+  key_prefix: bazel
+  max_object_size: 65536
+  ttl: 168h
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &RedisProxyConfig{
+		Address:       "redis.example.com:6379",
+		Password:      "secret",
+		KeyPrefix:     "bazel",
+		MaxObjectSize: 65536,
+		TTL:           168 * time.Hour,
+	}
+	if !cmp.Equal(config.RedisProxy, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.RedisProxy)
+	}
+
+	_, err = newFromYaml([]byte(`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+redis_proxy:
+  password: secret
+`))
+	if err == nil {
+		t.Fatal("Expected an error for a missing 'address'")
+	}
+}
+
+func TestPluginProxy(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+plugin_proxy:
+  command: ["/usr/local/bin/helper", "--bucket", "bazel"]
+  max_concurrency: 8
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &PluginProxyConfig{
+		Command:        []string{"/usr/local/bin/helper", "--bucket", "bazel"},
+		MaxConcurrency: 8,
+	}
+	if !cmp.Equal(config.PluginProxy, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.PluginProxy)
+	}
+
+	_, err = newFromYaml([]byte(`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+plugin_proxy:
+  max_concurrency: 8
+`))
+	if err == nil {
+		t.Fatal("Expected an error for a missing 'command'")
+	}
+}
+
+func TestAzBlobProxy(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+azblob_proxy:
+  storage_account: myaccount
+  container_name: bazel
+  prefix: cache
+  auth_method: managed_identity
+  managed_identity_client_id: my-identity
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &AzBlobStorageConfig{
+		StorageAccount:          "myaccount",
+		ContainerName:           "bazel",
+		Prefix:                  "cache",
+		AuthMethod:              AzBlobAuthManagedIdentity,
+		ManagedIdentityClientID: "my-identity",
+	}
+	if !cmp.Equal(config.AzBlobStorage, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.AzBlobStorage)
+	}
+
+	invalid := []string{
+		// Missing container_name.
+		`azblob_proxy:
+  storage_account: myaccount
+  auth_method: managed_identity
+`,
+		// Missing shared_key.
+		`azblob_proxy:
+  storage_account: myaccount
+  container_name: bazel
+  auth_method: shared_key
+`,
+		// Unknown auth_method.
+		`azblob_proxy:
+  storage_account: myaccount
+  container_name: bazel
+  auth_method: password
+`,
+	}
+	for _, proxy := range invalid {
+		_, err = newFromYaml([]byte("port: 8080\ndir: /opt/cache-dir\nmax_size: 10\n" + proxy))
+		if err == nil {
+			t.Fatalf("Expected an error for:\n%s", proxy)
+		}
+	}
+}
+
+func TestProxyResilience(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_resilience:
+  max_retries: 3
+  initial_backoff: 100ms
+  max_backoff: 5s
+  failure_threshold: 5
+  open_duration: 30s
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ProxyResilienceConfig{
+		MaxRetries:       3,
+		InitialBackoff:   100 * time.Millisecond,
+		MaxBackoff:       5 * time.Second,
+		FailureThreshold: 5,
+		OpenDuration:     30 * time.Second,
+	}
+	if !cmp.Equal(config.ProxyResilience, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.ProxyResilience)
+	}
+
+	invalid := []string{
+		// No proxy backend.
+		`proxy_resilience:
+  max_retries: 3
+  initial_backoff: 100ms
+`,
+		// Missing initial_backoff.
+		`http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_resilience:
+  max_retries: 3
+`,
+		// Missing open_duration.
+		`http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_resilience:
+  failure_threshold: 3
+`,
+	}
+	for _, c := range invalid {
+		_, err = newFromYaml([]byte("port: 8080\ndir: /opt/cache-dir\nmax_size: 10\n" + c))
+		if err == nil {
+			t.Fatalf("Expected an error for:\n%s", c)
+		}
+	}
+}
+
+func TestS3Features(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+s3_proxy:
+  endpoint: s3.us-east-1.amazonaws.com
+  bucket: test-bucket
+  prefix: test-prefix
+  web_identity_token_file: /var/run/secrets/token
+  role_arn: arn:aws:iam::123456789012:role/cache
+  sse: sse-kms
+  sse_kms_key_id: my-key
+  storage_class: STANDARD_IA
+  multipart_part_size: 16777216
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &S3CloudStorageConfig{
+		Endpoint:             "s3.us-east-1.amazonaws.com",
+		Bucket:               "test-bucket",
+		Prefix:               "test-prefix",
+		WebIdentityTokenFile: "/var/run/secrets/token",
+		RoleARN:              "arn:aws:iam::123456789012:role/cache",
+		SSE:                  S3SSEKMS,
+		SSEKMSKeyID:          "my-key",
+		StorageClass:         "STANDARD_IA",
+		MultipartPartSize:    16 * 1024 * 1024,
+	}
+	if !cmp.Equal(config.S3CloudStorage, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.S3CloudStorage)
+	}
+
+	invalid := []string{
+		// Unknown sse.
+		"  sse: aes\n",
+		// Missing sse_c_key_file.
+		"  sse: sse-c\n",
+		// sse-c without TLS.
+		"  sse: sse-c\n  sse_c_key_file: key\n  disable_ssl: true\n",
+		// sse_kms_key_id without sse-kms.
+		"  sse: sse-s3\n  sse_kms_key_id: my-key\n",
+		// Missing role_arn.
+		"  web_identity_token_file: /var/run/secrets/token\n",
+		// Part size too small.
+		"  multipart_part_size: 1024\n",
+	}
+	for _, s3 := range invalid {
+		_, err = newFromYaml([]byte(`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+s3_proxy:
+  endpoint: s3.us-east-1.amazonaws.com
+  bucket: test-bucket
+` + s3))
+		if err == nil {
+			t.Fatalf("Expected an error for:\n%s", s3)
+		}
+	}
+}
+
+func TestHTTPBackendOptions(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+  bearer_token_file: /var/run/secrets/token
+  headers:
+    x-tenant: my-team
+  tls_ca_file: ca.pem
+  tls_cert_file: client.pem
+  tls_key_file: client.key
+  max_idle_conns_per_host: 100
+  idle_conn_timeout: 90s
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &HTTPBackendConfig{
+		BaseURL:             "https://remote-cache.com:8080/cache",
+		BearerTokenFile:     "/var/run/secrets/token",
+		Headers:             map[string]string{"x-tenant": "my-team"},
+		TLSCAFile:           "ca.pem",
+		TLSCertFile:         "client.pem",
+		TLSKeyFile:          "client.key",
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if !cmp.Equal(config.HTTPBackend, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.HTTPBackend)
+	}
+
+	invalid := []string{
+		// Two kinds of credentials.
+		"  url: https://remote-cache.com/cache\n  username: user\n  bearer_token: token\n",
+		// Password without a username.
+		"  url: https://remote-cache.com/cache\n  password: pass\n",
+		// Client certificate without a key.
+		"  url: https://remote-cache.com/cache\n  tls_cert_file: client.pem\n",
+		// TLS options without https.
+		"  url: http://remote-cache.com/cache\n  tls_ca_file: ca.pem\n",
+		// Negative pool settings.
+		"  url: https://remote-cache.com/cache\n  max_conns_per_host: -1\n",
+	}
+	for _, h := range invalid {
+		_, err = newFromYaml([]byte("port: 8080\ndir: /opt/cache-dir\nmax_size: 10\nhttp_proxy:\n" + h))
+		if err == nil {
+			t.Fatalf("Expected an error for:\n%s", h)
+		}
+	}
+}
+
+func TestProxyNegativeCache(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_negative_cache:
+  ttl: 10s
+  max_entries: 1000
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ProxyNegativeCacheConfig{
+		TTL:        10 * time.Second,
+		MaxEntries: 1000,
+	}
+	if !cmp.Equal(config.ProxyNegativeCache, expected) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.ProxyNegativeCache)
+	}
+
+	invalid := []string{
+		// No proxy backend.
+		`proxy_negative_cache:
+  ttl: 10s
+`,
+		// Missing ttl.
+		`http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_negative_cache:
+  max_entries: 1000
+`,
+		`http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_negative_cache:
+  ttl: -1s
+`,
+	}
+	for _, c := range invalid {
+		_, err = newFromYaml([]byte("port: 8080\ndir: /opt/cache-dir\nmax_size: 10\n" + c))
+		if err == nil {
+			t.Fatalf("Expected an error for:\n%s", c)
+		}
+	}
+}
+
+func TestProxyDeleteInvalidItems(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_delete_invalid_items: true
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.ProxyDeleteInvalidItems {
+		t.Fatal("Expected proxy_delete_invalid_items to be set")
+	}
+
+	yaml = `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+proxy_delete_invalid_items: true
+`
+	_, err = newFromYaml([]byte(yaml))
+	if err == nil {
+		t.Fatal("Expected an error without a proxy backend")
+	}
+
+	yaml = `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_delete_invalid_items: true
+proxy_quarantine_dir: /opt/quarantine
+`
+	config, err = newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ProxyQuarantineDir != "/opt/quarantine" {
+		t.Fatalf("Unexpected proxy_quarantine_dir: %q", config.ProxyQuarantineDir)
+	}
+
+	yaml = `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_quarantine_dir: /opt/quarantine
+`
+	_, err = newFromYaml([]byte(yaml))
+	if err == nil {
+		t.Fatal("Expected an error without proxy_delete_invalid_items")
+	}
+}
+
+func TestProxyBackfill(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_backfill:
+  state_file: /opt/backfill.json
+  max_bytes_per_second: 1048576
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ProxyBackfillConfig{
+		StateFile:         "/opt/backfill.json",
+		MaxBytesPerSecond: 1048576,
+	}
+	if config.ProxyBackfill != expected {
+		t.Fatalf("Expected '%+v' but got '%+v'", expected, config.ProxyBackfill)
+	}
+
+	invalid := []string{
+		// No proxy backend.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+proxy_backfill:
+  state_file: /opt/backfill.json
+`,
+		// Nothing to backfill in memory.
+		`port: 8080
+storage_mode: memory
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_backfill:
+  state_file: /opt/backfill.json
+`,
+		// No state file.
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_backfill:
+  max_bytes_per_second: 1048576
+`,
+		`port: 8080
+dir: /opt/cache-dir
+max_size: 10
+http_proxy:
+  url: https://remote-cache.com:8080/cache
+proxy_backfill:
+  state_file: /opt/backfill.json
+  max_bytes_per_second: -1
+`,
+	}
+	for _, yaml := range invalid {
+		_, err = newFromYaml([]byte(yaml))
+		if err == nil {
+			t.Errorf("Expected an error for:\n%s", yaml)
+		}
+	}
+}
+
+func TestMaxChunkedUploadSize(t *testing.T) {
+	yaml := `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+max_chunked_upload_size: 1048576
+`
+	config, err := newFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxChunkedUploadSize != 1048576 {
+		t.Fatalf("Expected max_chunked_upload_size 1048576, got %d",
+			config.MaxChunkedUploadSize)
+	}
+
+	yaml = `port: 8080
+dir: /opt/cache-dir
+max_size: 10
+max_chunked_upload_size: -1
+`
+	_, err = newFromYaml([]byte(yaml))
+	if err == nil {
+		t.Fatal("Expected an error for a negative max_chunked_upload_size")
+	}
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SyncBackendConfig describes the source or destination of the sync
+// command, with the same keys as the proxy backends. Exactly one field
+// must be set.
+type SyncBackendConfig struct {
+	// A bazel-remote cache directory, which must not be in use by a
+	// running bazel-remote instance.
+	Dir string `yaml:"dir"`
+
+	GoogleCloudStorage *GoogleCloudStorageConfig `yaml:"gcs_proxy"`
+	HTTPBackend        *HTTPBackendConfig        `yaml:"http_proxy"`
+	S3CloudStorage     *S3CloudStorageConfig     `yaml:"s3_proxy"`
+	GRPCBackend        *GRPCBackendConfig        `yaml:"grpc_proxy"`
+	FilesystemProxy    *FilesystemProxyConfig    `yaml:"filesystem_proxy"`
+	RedisProxy         *RedisProxyConfig         `yaml:"redis_proxy"`
+	AzBlobStorage      *AzBlobStorageConfig      `yaml:"azblob_proxy"`
+	PluginProxy        *PluginProxyConfig        `yaml:"plugin_proxy"`
+}
+
+// SyncConfig is the configuration file of the sync command.
+type SyncConfig struct {
+	Source      SyncBackendConfig `yaml:"source"`
+	Destination SyncBackendConfig `yaml:"destination"`
+}
+
+// NewSyncFromYamlFile reads and validates the configuration file of the
+// sync command.
+func NewSyncFromYamlFile(path string) (*SyncConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file '%s': %v", path, err)
+	}
+
+	return newSyncFromYaml(data)
+}
+
+func newSyncFromYaml(data []byte) (*SyncConfig, error) {
+	c := SyncConfig{}
+	err := yaml.Unmarshal(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse YAML config: %v", err)
+	}
+
+	err = validateSyncBackend("source", &c.Source)
+	if err != nil {
+		return nil, err
+	}
+	err = validateSyncBackend("destination", &c.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Source.Dir != "" && c.Source.Dir == c.Destination.Dir {
+		return nil, errors.New("The 'source' and 'destination' keys must not refer to the same directory")
+	}
+
+	return &c, nil
+}
+
+func validateSyncBackend(name string, b *SyncBackendConfig) error {
+	numBackends := 0
+	for _, set := range []bool{b.Dir != "", b.GoogleCloudStorage != nil,
+		b.HTTPBackend != nil, b.S3CloudStorage != nil, b.GRPCBackend != nil,
+		b.FilesystemProxy != nil, b.RedisProxy != nil, b.AzBlobStorage != nil,
+		b.PluginProxy != nil} {
+		if set {
+			numBackends++
+		}
+	}
+	if numBackends != 1 {
+		return fmt.Errorf("The '%s' key must specify exactly one backend", name)
+	}
+
+	err := validateProxyBackend(b.GoogleCloudStorage, b.HTTPBackend,
+		b.S3CloudStorage, b.GRPCBackend, b.FilesystemProxy, b.RedisProxy,
+		b.AzBlobStorage, b.PluginProxy)
+	if err != nil {
+		return fmt.Errorf("The '%s' key: %v", name, err)
+	}
+
+	return nil
+}
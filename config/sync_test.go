@@ -0,0 +1,63 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestSyncConfig(t *testing.T) {
+	yaml := `source:
+  gcs_proxy:
+    bucket: old-cache
+    use_default_credentials: true
+destination:
+  s3_proxy:
+    endpoint: s3.us-east-1.amazonaws.com
+    bucket: new-cache
+    prefix: bazel
+    iam_role_endpoint: http://169.254.169.254
+`
+	c, err := newSyncFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Source.GoogleCloudStorage == nil || c.Source.GoogleCloudStorage.Bucket != "old-cache" {
+		t.Fatalf("Unexpected source: %+v", c.Source)
+	}
+	if c.Destination.S3CloudStorage == nil || c.Destination.S3CloudStorage.Prefix != "bazel" {
+		t.Fatalf("Unexpected destination: %+v", c.Destination)
+	}
+
+	invalid := []string{
+		// No destination.
+		`source:
+  dir: /opt/cache-dir
+`,
+		// Two sources.
+		`source:
+  dir: /opt/cache-dir
+  filesystem_proxy:
+    dir: /mnt/cache
+destination:
+  dir: /opt/other-dir
+`,
+		// Invalid backend config.
+		`source:
+  dir: /opt/cache-dir
+destination:
+  gcs_proxy:
+    use_default_credentials: true
+`,
+		// The same directory.
+		`source:
+  dir: /opt/cache-dir
+destination:
+  dir: /opt/cache-dir
+`,
+	}
+	for _, c := range invalid {
+		_, err = newSyncFromYaml([]byte(c))
+		if err == nil {
+			t.Fatalf("Expected an error for:\n%s", c)
+		}
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/golang/protobuf v1.3.2
 	github.com/google/go-cmp v0.3.1
 	github.com/google/uuid v1.1.1
+	github.com/klauspost/compress v1.10.3
 	github.com/minio/minio-go/v6 v6.0.44
 	github.com/prometheus/client_golang v1.3.0
 	github.com/smartystreets/goconvey v1.6.4 // indirect
@@ -6,8 +6,8 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof" // Register pprof handlers with DefaultServeMux.
-	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync"
@@ -15,9 +15,20 @@ import (
 
 	auth "github.com/abbot/go-http-auth"
 	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/azblob"
+	"github.com/buchgr/bazel-remote/cache/chain"
+	"github.com/buchgr/bazel-remote/cache/cluster"
 	"github.com/buchgr/bazel-remote/cache/disk"
+	"github.com/buchgr/bazel-remote/cache/filesystem"
 	"github.com/buchgr/bazel-remote/cache/gcs"
+	"github.com/buchgr/bazel-remote/cache/grpcproxy"
+	"github.com/buchgr/bazel-remote/cache/plugin"
+	"github.com/buchgr/bazel-remote/cache/redis"
+	"github.com/buchgr/bazel-remote/cache/resilience"
 	"github.com/buchgr/bazel-remote/cache/s3"
+	"github.com/buchgr/bazel-remote/cache/timeout"
+	"github.com/buchgr/bazel-remote/cache/uploader"
+	"github.com/buchgr/bazel-remote/cache/verify"
 
 	cachehttp "github.com/buchgr/bazel-remote/cache/http"
 
@@ -65,9 +76,15 @@ func main() {
 		&cli.StringFlag{
 			Name:    "dir",
 			Value:   "",
-			Usage:   "Directory path where to store the cache contents. This flag is required.",
+			Usage:   "Directory path where to store the cache contents. This flag is required, unless storage_mode is \"memory\".",
 			EnvVars: []string{"BAZEL_REMOTE_DIR"},
 		},
+		&cli.StringFlag{
+			Name:    "storage_mode",
+			Value:   "disk",
+			Usage:   "Where to store the cache contents, either \"disk\" (in the directory specified by dir) or \"memory\" (lost when the server exits).",
+			EnvVars: []string{"BAZEL_REMOTE_STORAGE_MODE"},
+		},
 		&cli.Int64Flag{
 			Name:    "max_size",
 			Value:   -1,
@@ -180,13 +197,126 @@ func main() {
 			Usage:   "The AWS region. Required when using s3.iam_role_endpoint",
 			EnvVars: []string{"BAZEL_REMOTE_S3_REGION"},
 		},
+		&cli.StringFlag{
+			Name:    "s3.shared_credentials_file",
+			Value:   "",
+			Usage:   "Path to an AWS shared credentials file. Defaults to $AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials. Only used if neither s3.access_key_id nor s3.iam_role_endpoint are set.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_SHARED_CREDENTIALS_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.profile",
+			Value:   "",
+			Usage:   "The profile to use from the AWS shared credentials file. Defaults to $AWS_PROFILE or \"default\".",
+			EnvVars: []string{"BAZEL_REMOTE_S3_PROFILE"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.web_identity_token_file",
+			Value:   "",
+			Usage:   "Path to a web identity token file, which is exchanged for credentials for s3.role_arn. Defaults to $AWS_WEB_IDENTITY_TOKEN_FILE.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_WEB_IDENTITY_TOKEN_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.role_arn",
+			Value:   "",
+			Usage:   "The ARN of the role to assume with s3.web_identity_token_file. Defaults to $AWS_ROLE_ARN.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_ROLE_ARN"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.sts_endpoint",
+			Value:   "",
+			Usage:   "The STS endpoint to use with s3.web_identity_token_file. (default: \"https://sts.amazonaws.com\")",
+			EnvVars: []string{"BAZEL_REMOTE_S3_STS_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.sse",
+			Value:   "",
+			Usage:   "The server-side encryption to request for uploads, either \"sse-s3\", \"sse-kms\" or \"sse-c\". Disabled by default.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_SSE"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.sse_kms_key_id",
+			Value:   "",
+			Usage:   "The KMS key to use when s3.sse is \"sse-kms\". Defaults to the AWS managed key.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_SSE_KMS_KEY_ID"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.sse_c_key_file",
+			Value:   "",
+			Usage:   "Path to a file containing the base64 encoded 256 bit key to use when s3.sse is \"sse-c\".",
+			EnvVars: []string{"BAZEL_REMOTE_S3_SSE_C_KEY_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "s3.storage_class",
+			Value:   "",
+			Usage:   "The storage class of uploaded objects, eg STANDARD_IA. Defaults to the bucket's default.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_STORAGE_CLASS"},
+		},
+		&cli.Int64Flag{
+			Name:    "s3.multipart_part_size",
+			Value:   0,
+			Usage:   "Blobs of at least this many bytes are uploaded in parts of this size, which must be between 5 MiB and 5 GiB. Defaults to 64 MiB.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_MULTIPART_PART_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:    "proxy_write_through",
+			Usage:   "Whether to wait for the proxy backend to store each upload, and fail the client request if the proxy fails. Default is false (upload to the proxy in the background).",
+			EnvVars: []string{"BAZEL_REMOTE_PROXY_WRITE_THROUGH"},
+		},
+		&cli.Int64Flag{
+			Name:    "proxy_passthrough_threshold",
+			Value:   0,
+			Usage:   "If a positive integer, blobs larger than this many bytes are not stored locally, but streamed directly to and from the proxy backend. Disabled by default.",
+			EnvVars: []string{"BAZEL_REMOTE_PROXY_PASSTHROUGH_THRESHOLD"},
+		},
+		&cli.StringFlag{
+			Name:    "proxy_upload_queue_dir",
+			Value:   "",
+			Usage:   "Directory path where pending proxy uploads are stored, so that they survive restarts and are retried on failure. Pending uploads are only kept in memory by default.",
+			EnvVars: []string{"BAZEL_REMOTE_PROXY_UPLOAD_QUEUE_DIR"},
+		},
+		&cli.DurationFlag{
+			Name:    "proxy_timeouts.get",
+			Value:   0,
+			Usage:   "The maximum time to spend on each download from the proxy backend, including streaming the blob. Disabled by default.",
+			EnvVars: []string{"BAZEL_REMOTE_PROXY_TIMEOUTS_GET"},
+		},
+		&cli.DurationFlag{
+			Name:    "proxy_timeouts.put",
+			Value:   0,
+			Usage:   "The maximum time to spend on each upload to the proxy backend. Disabled by default.",
+			EnvVars: []string{"BAZEL_REMOTE_PROXY_TIMEOUTS_PUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "proxy_timeouts.contains",
+			Value:   0,
+			Usage:   "The maximum time to spend on each existence check against the proxy backend. Disabled by default.",
+			EnvVars: []string{"BAZEL_REMOTE_PROXY_TIMEOUTS_CONTAINS"},
+		},
 		&cli.BoolFlag{
 			Name:    "disable_http_ac_validation",
 			Usage:   "Whether to disable ActionResult validation for HTTP requests.  Default is false (enable validation).",
 			EnvVars: []string{"BAZEL_REMOTE_DISABLE_HTTP_AC_VALIDATION"},
 		},
+		&cli.BoolFlag{
+			Name:    "read_only",
+			Usage:   "Whether to reject all uploads from clients. Items fetched from a proxy backend are still stored locally. Default is false (accept uploads).",
+			EnvVars: []string{"BAZEL_REMOTE_READ_ONLY"},
+		},
+		&cli.BoolFlag{
+			Name:    "http_compression",
+			Usage:   "Whether to compress HTTP responses with gzip or zstd for clients which send a suitable Accept-Encoding header. Default is false (do not compress responses).",
+			EnvVars: []string{"BAZEL_REMOTE_HTTP_COMPRESSION"},
+		},
+		&cli.Int64Flag{
+			Name:    "max_chunked_upload_size",
+			Value:   0,
+			Usage:   "The maximum size in bytes of HTTP PUT requests which are written to a temporary file before they are added to the cache: those without a Content-Length header, and the decompressed size of those with a Content-Encoding header. They are also limited by the cache size. Defaults to 1 GiB.",
+			EnvVars: []string{"BAZEL_REMOTE_MAX_CHUNKED_UPLOAD_SIZE"},
+		},
 	}
 
+	app.Commands = []*cli.Command{syncCommand()}
+
 	app.Action = func(ctx *cli.Context) error {
 		configFile := ctx.String("config_file")
 		var c *config.Config
@@ -205,10 +335,22 @@ func main() {
 					DisableSSL:      ctx.Bool("s3.disable_ssl"),
 					IAMRoleEndpoint: ctx.String("s3.iam_role_endpoint"),
 					Region:          ctx.String("s3.region"),
+
+					SharedCredentialsFile: ctx.String("s3.shared_credentials_file"),
+					Profile:               ctx.String("s3.profile"),
+					WebIdentityTokenFile:  ctx.String("s3.web_identity_token_file"),
+					RoleARN:               ctx.String("s3.role_arn"),
+					STSEndpoint:           ctx.String("s3.sts_endpoint"),
+					SSE:                   ctx.String("s3.sse"),
+					SSEKMSKeyID:           ctx.String("s3.sse_kms_key_id"),
+					SSECKeyFile:           ctx.String("s3.sse_c_key_file"),
+					StorageClass:          ctx.String("s3.storage_class"),
+					MultipartPartSize:     ctx.Int64("s3.multipart_part_size"),
 				}
 			}
 			c, err = config.New(
 				ctx.String("dir"),
+				ctx.String("storage_mode"),
 				ctx.Int("max_size"),
 				ctx.String("host"),
 				ctx.Int("port"),
@@ -220,7 +362,18 @@ func main() {
 				ctx.String("tls_key_file"),
 				ctx.Duration("idle_timeout"),
 				s3,
+				ctx.Bool("proxy_write_through"),
+				ctx.Int64("proxy_passthrough_threshold"),
+				ctx.String("proxy_upload_queue_dir"),
+				config.ProxyTimeoutsConfig{
+					Get:      ctx.Duration("proxy_timeouts.get"),
+					Put:      ctx.Duration("proxy_timeouts.put"),
+					Contains: ctx.Duration("proxy_timeouts.contains"),
+				},
 				ctx.Bool("disable_http_ac_validation"),
+				ctx.Bool("read_only"),
+				ctx.Bool("http_compression"),
+				ctx.Int64("max_chunked_upload_size"),
 			)
 		}
 
@@ -236,45 +389,107 @@ func main() {
 		adjustRlimit(errorLogger)
 
 		var proxyCache cache.CacheProxy
-		if c.GoogleCloudStorage != nil {
-			proxyCache, err = gcs.New(c.GoogleCloudStorage.Bucket,
-				c.GoogleCloudStorage.UseDefaultCredentials, c.GoogleCloudStorage.JSONCredentialsFile,
-				accessLogger, errorLogger)
-			if err != nil {
-				log.Fatal(err)
+		if c.ProxyChain != nil {
+			proxyCache, err = newProxyChain(c, accessLogger, errorLogger)
+		} else {
+			proxyCache, err = newProxy(c.GoogleCloudStorage, c.HTTPBackend,
+				c.S3CloudStorage, c.GRPCBackend, c.FilesystemProxy, c.RedisProxy,
+				c.AzBlobStorage, c.PluginProxy, accessLogger, errorLogger)
+			if proxyCache != nil {
+				proxyCache = wrapProxy(c, proxyCache, "proxy", errorLogger)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Uploads which are written to a temporary file before they are
+		// added to the cache are kept in the cache directory rather than
+		// in a possibly small /tmp. Leftovers from a previous run are
+		// removed before the disk cache loads its files.
+		var spoolDir string
+		if c.StorageMode != config.StorageModeMemory {
+			spoolDir = filepath.Join(c.Dir, "spool")
+			err = os.RemoveAll(spoolDir)
+			if err == nil {
+				err = os.MkdirAll(spoolDir, os.ModePerm)
 			}
-		} else if c.HTTPBackend != nil {
-			httpClient := &http.Client{}
-			var baseURL *url.URL
-			baseURL, err = url.Parse(c.HTTPBackend.BaseURL)
 			if err != nil {
 				log.Fatal(err)
 			}
-			proxyCache = cachehttp.New(baseURL,
-				httpClient, accessLogger, errorLogger)
-		} else if c.S3CloudStorage != nil {
-			proxyCache, err = s3.New(c.S3CloudStorage, accessLogger, errorLogger)
+		}
+
+		var diskCache *disk.DiskCache
+		maxSizeBytes := int64(c.MaxSize) * 1024 * 1024 * 1024
+		diskOpts := []disk.Option{
+			disk.WithWriteThrough(c.ProxyWriteThrough),
+			disk.WithPassthroughThreshold(c.ProxyPassthroughThreshold),
+			disk.WithNegativeCache(c.ProxyNegativeCache.TTL,
+				c.ProxyNegativeCache.MaxEntries),
+			disk.WithBackfill(c.ProxyBackfill.StateFile,
+				c.ProxyBackfill.MaxBytesPerSecond),
+		}
+		var uploadJournal *uploader.Journal
+		if c.ProxyUploadQueueDir != "" {
+			uploadJournal, err = uploader.NewJournal(proxyCache,
+				c.ProxyUploadQueueDir, errorLogger)
 			if err != nil {
 				log.Fatal(err)
 			}
+			diskOpts = append(diskOpts, disk.WithUploader(uploadJournal))
+		}
+		if c.StorageMode == config.StorageModeMemory {
+			diskCache, err = disk.NewMemory(errorLogger, maxSizeBytes, proxyCache, diskOpts...)
+		} else {
+			diskCache, err = disk.New(errorLogger, c.Dir, maxSizeBytes, proxyCache, diskOpts...)
 		}
-
-		diskCache, err := disk.New(errorLogger, c.Dir, int64(c.MaxSize)*1024*1024*1024, proxyCache)
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		var cacheImpl disk.Cache = diskCache
+		var clusterImpl *cluster.Cluster
+		if c.Cluster != nil {
+			clusterImpl, err = cluster.New(diskCache, c.Cluster.Self,
+				c.Cluster.Peers, c.Cluster.MembershipFile,
+				c.Cluster.ReplicationFactor, c.Cluster.Secret,
+				&c.Cluster.Client, accessLogger, errorLogger)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cacheImpl = clusterImpl
+		}
+
 		mux := http.NewServeMux()
 		httpServer := &http.Server{
 			Addr:    c.Host + ":" + strconv.Itoa(c.Port),
 			Handler: mux,
 		}
 		validateAC := !c.DisableHTTPACValidation
-		h := server.NewHTTPCache(diskCache, accessLogger, errorLogger, validateAC, gitCommit)
+		h := server.NewHTTPCache(cacheImpl, accessLogger, errorLogger, validateAC,
+			c.ReadOnly, gitCommit, server.WithCompression(c.HTTPCompression),
+			server.WithMaxChunkedUploadSize(c.MaxChunkedUploadSize),
+			server.WithSpoolDir(spoolDir))
 		mux.Handle("/metrics", promhttp.Handler())
 		mux.HandleFunc("/status", h.StatusPageHandler)
+		if uploadJournal != nil {
+			// The backlog lists the hashes of recently uploaded items.
+			backlogHandler := uploadJournal.BacklogHandler
+			if c.HtpasswdFile != "" {
+				backlogHandler = wrapAuthHandler(backlogHandler, c.HtpasswdFile, c.Host)
+			}
+			mux.HandleFunc("/admin/uploads", backlogHandler)
+		}
+
+		cacheMux := http.NewServeMux()
+		cacheMux.HandleFunc("/batch/contains", h.BatchContainsHandler)
+		cacheMux.HandleFunc("/batch/get", h.BatchGetHandler)
+		cacheMux.HandleFunc("/", h.CacheHandler)
 
-		cacheHandler := h.CacheHandler
+		cacheHandler := cacheMux.ServeHTTP
+		if clusterImpl != nil {
+			cacheHandler = clusterImpl.WrapHandler(cacheHandler)
+		}
 		if c.HtpasswdFile != "" {
 			cacheHandler = wrapAuthHandler(cacheHandler, c.HtpasswdFile, c.Host)
 		}
@@ -306,7 +521,7 @@ func main() {
 				log.Printf("Starting gRPC server on address %s", addr)
 
 				err3 := server.ListenAndServeGRPC(addr, opts,
-					diskCache, accessLogger, errorLogger)
+					cacheImpl, accessLogger, errorLogger, c.ReadOnly)
 				if err3 != nil {
 					log.Fatal(err3)
 				}
@@ -339,6 +554,114 @@ func main() {
 	}
 }
 
+// Return a proxy backend for whichever of the configs is non-nil, or
+// nil if they are all nil.
+func newProxy(gcsConfig *config.GoogleCloudStorageConfig,
+	httpConfig *config.HTTPBackendConfig, s3Config *config.S3CloudStorageConfig,
+	grpcConfig *config.GRPCBackendConfig, fsConfig *config.FilesystemProxyConfig,
+	redisConfig *config.RedisProxyConfig, azConfig *config.AzBlobStorageConfig,
+	pluginConfig *config.PluginProxyConfig,
+	accessLogger cache.Logger, errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	if gcsConfig != nil {
+		return gcs.New(gcsConfig.Bucket, gcsConfig.UseDefaultCredentials,
+			gcsConfig.JSONCredentialsFile, accessLogger, errorLogger)
+	}
+
+	if httpConfig != nil {
+		return cachehttp.NewFromConfig(httpConfig, accessLogger, errorLogger)
+	}
+
+	if s3Config != nil {
+		return s3.New(s3Config, accessLogger, errorLogger)
+	}
+
+	if grpcConfig != nil {
+		return grpcproxy.New(grpcConfig, accessLogger, errorLogger)
+	}
+
+	if fsConfig != nil {
+		return filesystem.New(fsConfig.Dir, accessLogger, errorLogger)
+	}
+
+	if redisConfig != nil {
+		return redis.New(redisConfig, accessLogger, errorLogger)
+	}
+
+	if azConfig != nil {
+		return azblob.New(azConfig, accessLogger, errorLogger)
+	}
+
+	if pluginConfig != nil {
+		return plugin.New(pluginConfig, accessLogger, errorLogger)
+	}
+
+	return nil, nil
+}
+
+// Apply the proxy timeouts, retries, circuit breaker and validation of
+// downloaded items to a proxy backend.
+func wrapProxy(c *config.Config, proxy cache.CacheProxy, name string,
+	errorLogger cache.Logger) cache.CacheProxy {
+
+	var deleter cache.Deleter
+	if c.ProxyDeleteInvalidItems {
+		var ok bool
+		deleter, ok = proxy.(cache.Deleter)
+		if !ok {
+			errorLogger.Printf("The %s backend does not support deleting invalid items", name)
+		}
+	}
+
+	proxy = timeout.New(proxy, c.ProxyTimeouts.Get,
+		c.ProxyTimeouts.Put, c.ProxyTimeouts.Contains)
+	if c.ProxyResilience.Enabled() {
+		proxy = resilience.New(proxy, name, c.ProxyResilience, errorLogger)
+	}
+
+	var opts []verify.Option
+	if c.ProxyQuarantineDir != "" {
+		opts = append(opts, verify.WithQuarantineDir(
+			filepath.Join(c.ProxyQuarantineDir, name)))
+	}
+
+	return verify.New(proxy, name, deleter, errorLogger, opts...)
+}
+
+// Return a proxy backend combining the backends in c.ProxyChain. The
+// proxy timeouts, retries, circuit breakers and validation are applied
+// to each backend separately.
+func newProxyChain(c *config.Config, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	var backends []chain.Backend
+	for i, bc := range c.ProxyChain.Backends {
+		proxy, err := newProxy(bc.GoogleCloudStorage, bc.HTTPBackend,
+			bc.S3CloudStorage, bc.GRPCBackend, bc.FilesystemProxy, bc.RedisProxy,
+			bc.AzBlobStorage, bc.PluginProxy, accessLogger, errorLogger)
+		if err != nil {
+			return nil, err
+		}
+
+		name := fmt.Sprintf("proxy_chain.backends[%d]", i)
+		proxy = wrapProxy(c, proxy, name, errorLogger)
+
+		backends = append(backends, chain.Backend{
+			Name:  name,
+			Proxy: proxy,
+			Read:  bc.Mode != config.ProxyModeWriteOnly,
+			Write: bc.Mode != config.ProxyModeReadOnly,
+		})
+	}
+
+	readMode := chain.FirstHit
+	if c.ProxyChain.ReadMode == config.ProxyChainRace {
+		readMode = chain.Race
+	}
+
+	return chain.New(backends, readMode, c.ProxyChain.Backfill, errorLogger), nil
+}
+
 func wrapIdleHandler(handler http.HandlerFunc, idleTimeout time.Duration, accessLogger cache.Logger, httpServer *http.Server) http.HandlerFunc {
 	lastRequest := time.Now()
 	ticker := time.NewTicker(time.Second)
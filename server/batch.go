@@ -0,0 +1,316 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/server/batchpb"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// The maximum number of items in a batch request.
+	maxBatchItems = 10000
+
+	// The maximum size of a batch request body.
+	maxBatchRequestSize = 4 * 1024 * 1024
+
+	// The number of items in a batch request which are looked up in
+	// parallel.
+	batchConcurrency = 16
+)
+
+// The supported content types of batch requests and responses.
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// BatchContainsHandler checks the existence of the items listed in a
+// batch request, and responds with their sizes in the same format as
+// the request.
+func (h *httpCache) BatchContainsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	req, kinds, contentType, err := h.parseBatchRequest(r)
+	if err != nil {
+		h.batchError(w, r, err)
+		return
+	}
+
+	rsp := &batchpb.BatchContainsResponse{
+		Results: make([]*batchpb.ContainsResult, len(req.Items)),
+	}
+	forEachParallel(len(req.Items), func(i int) {
+		item := req.Items[i]
+		found, size := h.batchContains(r.Context(), kinds[i], item.Hash)
+		if !found {
+			size = 0
+		}
+		rsp.Results[i] = &batchpb.ContainsResult{
+			Kind:  item.Kind,
+			Hash:  item.Hash,
+			Found: found,
+			Size:  size,
+		}
+	})
+
+	w.Header().Set("Content-Type", contentType)
+	if contentType == contentTypeJSON {
+		marshaler := jsonpb.Marshaler{EmitDefaults: true}
+		err = marshaler.Marshal(w, rsp)
+	} else {
+		var data []byte
+		data, err = proto.Marshal(rsp)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+	}
+	if err != nil {
+		h.errorLogger.Printf("POST %s: %s", r.URL.Path, err)
+		h.logResponse(http.StatusInternalServerError, r)
+		return
+	}
+
+	h.logResponse(http.StatusOK, r)
+}
+
+// BatchGetHandler responds with a tar stream of the items listed in a
+// batch request, in the requested order. Each item is stored as a file
+// named "<kind>/<hash>". Items which are not found are omitted.
+func (h *httpCache) BatchGetHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	req, kinds, _, err := h.parseBatchRequest(r)
+	if err != nil {
+		h.batchError(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Items are fetched in parallel but written in order, with at most
+	// batchConcurrency items fetched or open at a time.
+	results := make([]chan batchGetResult, len(req.Items))
+	for i := range results {
+		results[i] = make(chan batchGetResult, 1)
+	}
+	sem := make(chan struct{}, batchConcurrency)
+	go func() {
+		for i, item := range req.Items {
+			sem <- struct{}{}
+			go func(i int, item *batchpb.Item) {
+				results[i] <- h.batchGet(ctx, kinds[i], item.Hash)
+			}(i, item)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+
+	// Once writing the response fails, the remaining results are only
+	// closed.
+	for i, item := range req.Items {
+		res := <-results[i]
+
+		if err == nil && res.err != nil {
+			h.errorLogger.Printf("POST %s: %s: %s", r.URL.Path,
+				path(kinds[i], item.Hash), res.err)
+		}
+		if err == nil && res.rdr != nil {
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     item.Kind + "/" + item.Hash,
+				Mode:     0644,
+				Size:     res.size,
+			})
+			if err == nil {
+				_, err = io.Copy(tw, res.rdr)
+			}
+			if err != nil {
+				cancel()
+			}
+		}
+
+		if res.rdr != nil {
+			res.rdr.Close()
+		}
+		<-sem
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		h.errorLogger.Printf("POST %s: %s", r.URL.Path, err)
+		h.logResponse(http.StatusInternalServerError, r)
+		return
+	}
+
+	h.logResponse(http.StatusOK, r)
+}
+
+type batchGetResult struct {
+	rdr  io.ReadCloser // nil if the item was not found.
+	size int64
+	err  error
+}
+
+func (h *httpCache) batchGet(ctx context.Context, kind cache.EntryKind, hash string) batchGetResult {
+	if h.validateAC && kind == cache.AC {
+		_, data, err := h.cache.GetValidatedActionResult(ctx, hash)
+		if err != nil || data == nil {
+			return batchGetResult{err: err}
+		}
+		return batchGetResult{
+			rdr:  ioutil.NopCloser(bytes.NewReader(data)),
+			size: int64(len(data)),
+		}
+	}
+
+	rdr, size, err := h.cache.Get(ctx, kind, hash)
+	if err == nil && rdr != nil && size < 0 {
+		// Tar headers need the size up front.
+		rdr.Close()
+		return batchGetResult{err: fmt.Errorf("unknown size")}
+	}
+	return batchGetResult{rdr: rdr, size: size, err: err}
+}
+
+func (h *httpCache) batchContains(ctx context.Context, kind cache.EntryKind, hash string) (bool, int64) {
+	if h.validateAC && kind == cache.AC {
+		_, data, err := h.cache.GetValidatedActionResult(ctx, hash)
+		if err != nil || data == nil {
+			return false, -1
+		}
+		return true, int64(len(data))
+	}
+
+	return h.cache.Contains(ctx, kind, hash)
+}
+
+// parseBatchRequest reads and validates the body of a batch request,
+// and returns it along with the kind of each item and the content type
+// of the request.
+func (h *httpCache) parseBatchRequest(r *http.Request) (*batchpb.BatchRequest, []cache.EntryKind, string, error) {
+	if r.Method != http.MethodPost {
+		return nil, nil, "", &cache.Error{
+			Code: http.StatusMethodNotAllowed,
+			Text: fmt.Sprintf("Method '%s' not supported.", r.Method),
+		}
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (contentType != contentTypeJSON && contentType != contentTypeProtobuf) {
+		return nil, nil, "", &cache.Error{
+			Code: http.StatusUnsupportedMediaType,
+			Text: fmt.Sprintf("Content-Type must be %s or %s",
+				contentTypeJSON, contentTypeProtobuf),
+		}
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBatchRequestSize+1))
+	if err != nil {
+		return nil, nil, "", &cache.Error{
+			Code: http.StatusBadRequest,
+			Text: fmt.Sprintf("Failed to read the request body: %v", err),
+		}
+	}
+	if len(data) > maxBatchRequestSize {
+		return nil, nil, "", &cache.Error{
+			Code: http.StatusRequestEntityTooLarge,
+			Text: fmt.Sprintf("The request body must not exceed %d bytes",
+				maxBatchRequestSize),
+		}
+	}
+
+	req := &batchpb.BatchRequest{}
+	if contentType == contentTypeJSON {
+		err = jsonpb.Unmarshal(bytes.NewReader(data), req)
+	} else {
+		err = proto.Unmarshal(data, req)
+	}
+	if err != nil {
+		return nil, nil, "", &cache.Error{
+			Code: http.StatusBadRequest,
+			Text: fmt.Sprintf("Invalid batch request: %v", err),
+		}
+	}
+
+	if len(req.Items) > maxBatchItems {
+		return nil, nil, "", &cache.Error{
+			Code: http.StatusRequestEntityTooLarge,
+			Text: fmt.Sprintf("A batch request must not contain more than %d items",
+				maxBatchItems),
+		}
+	}
+
+	kinds := make([]cache.EntryKind, len(req.Items))
+	for i, item := range req.Items {
+		switch {
+		case item == nil:
+			err = fmt.Errorf("item %d is empty", i)
+		case item.Kind == "cas":
+			kinds[i] = cache.CAS
+		case item.Kind == "ac" && h.validateAC:
+			kinds[i] = cache.AC
+		case item.Kind == "ac":
+			kinds[i] = cache.RAW
+		default:
+			err = fmt.Errorf("item %d: kind must be 'ac' or 'cas', got '%s'",
+				i, item.Kind)
+		}
+		if err == nil && !hashKeyRegex.MatchString(item.Hash) {
+			err = fmt.Errorf("item %d: hash must be a SHA256 hash in hex, got '%s'",
+				i, item.Hash)
+		}
+		if err != nil {
+			return nil, nil, "", &cache.Error{
+				Code: http.StatusBadRequest,
+				Text: fmt.Sprintf("Invalid batch request: %v", err),
+			}
+		}
+	}
+
+	return req, kinds, contentType, nil
+}
+
+func (h *httpCache) batchError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	if cerr, ok := err.(*cache.Error); ok {
+		code = cerr.Code
+	}
+	http.Error(w, err.Error(), code)
+	h.logResponse(code, r)
+}
+
+// forEachParallel calls f for each index in [0, n), with at most
+// batchConcurrency calls running at a time.
+func forEachParallel(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency)
+
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/server/batchpb"
+	"github.com/buchgr/bazel-remote/utils"
+
+	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestBatchContains(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	c := newTestDiskCache(t, cacheDir, 100000, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		false, false, "")
+
+	var items []*batchpb.Item
+	var expected []*batchpb.ContainsResult
+	for i := 0; i < 50; i++ {
+		data, hash := testutils.RandomDataAndHash(int64(100 + i))
+		kind := cache.CAS
+		kindName := "cas"
+		if i%2 == 1 {
+			kind = cache.RAW
+			kindName = "ac"
+		}
+		found := i%3 != 0
+		if found {
+			err := c.Put(context.Background(), kind, hash, int64(len(data)),
+				bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		items = append(items, &batchpb.Item{Kind: kindName, Hash: hash})
+		result := &batchpb.ContainsResult{Kind: kindName, Hash: hash, Found: found}
+		if found {
+			result.Size = int64(len(data))
+		}
+		expected = append(expected, result)
+	}
+	req := &batchpb.BatchRequest{Items: items}
+
+	// Protobuf.
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := postBatch(h.BatchContainsHandler, contentTypeProtobuf, body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != contentTypeProtobuf {
+		t.Fatalf("Unexpected Content-Type: %q", ct)
+	}
+	rsp := &batchpb.BatchContainsResponse{}
+	err = proto.Unmarshal(rr.Body.Bytes(), rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContainsResults(t, rsp, expected)
+
+	// JSON.
+	body = []byte(`{"items": [`)
+	for i, item := range items {
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, fmt.Sprintf(`{"kind": %q, "hash": %q}`,
+			item.Kind, item.Hash)...)
+	}
+	body = append(body, "]}"...)
+	rr = postBatch(h.BatchContainsHandler, "application/json; charset=utf-8", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != contentTypeJSON {
+		t.Fatalf("Unexpected Content-Type: %q", ct)
+	}
+	if !strings.Contains(rr.Body.String(), `"found": false`) &&
+		!strings.Contains(rr.Body.String(), `"found":false`) {
+		t.Fatalf("Expected missing items in the JSON response: %s", rr.Body)
+	}
+	rsp = &batchpb.BatchContainsResponse{}
+	err = jsonpb.Unmarshal(rr.Body, rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContainsResults(t, rsp, expected)
+}
+
+func TestBatchContainsValidatedAC(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	c := newTestDiskCache(t, cacheDir, 100000, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		true, false, "")
+
+	ar := &pb.ActionResult{ExitCode: 1}
+	data, err := proto.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hash := testutils.RandomDataAndHash(10)
+	err = c.Put(context.Background(), cache.AC, hash, int64(len(data)),
+		bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, missingHash := testutils.RandomDataAndHash(10)
+
+	body, err := proto.Marshal(&batchpb.BatchRequest{Items: []*batchpb.Item{
+		{Kind: "ac", Hash: hash},
+		{Kind: "ac", Hash: missingHash},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := postBatch(h.BatchContainsHandler, contentTypeProtobuf, body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	rsp := &batchpb.BatchContainsResponse{}
+	err = proto.Unmarshal(rr.Body.Bytes(), rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContainsResults(t, rsp, []*batchpb.ContainsResult{
+		{Kind: "ac", Hash: hash, Found: true, Size: int64(len(data))},
+		{Kind: "ac", Hash: missingHash},
+	})
+}
+
+func TestBatchGet(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	c := newTestDiskCache(t, cacheDir, 100000, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		false, false, "")
+
+	type entry struct {
+		name string
+		data []byte
+	}
+	var items []*batchpb.Item
+	var expected []entry
+	for i := 0; i < 40; i++ {
+		data, hash := testutils.RandomDataAndHash(int64(1000 + i))
+		kind := cache.CAS
+		kindName := "cas"
+		if i%4 == 1 {
+			kind = cache.RAW
+			kindName = "ac"
+		}
+		items = append(items, &batchpb.Item{Kind: kindName, Hash: hash})
+		if i%5 == 0 {
+			continue // Missing.
+		}
+		err := c.Put(context.Background(), kind, hash, int64(len(data)),
+			bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, entry{kindName + "/" + hash, data})
+	}
+
+	body, err := proto.Marshal(&batchpb.BatchRequest{Items: items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := postBatch(h.BatchGetHandler, contentTypeProtobuf, body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-tar" {
+		t.Fatalf("Unexpected Content-Type: %q", ct)
+	}
+
+	tr := tar.NewReader(rr.Body)
+	for _, e := range expected {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != e.name || hdr.Size != int64(len(e.data)) {
+			t.Fatalf("Expected %s with size %d, got %s with size %d",
+				e.name, len(e.data), hdr.Name, hdr.Size)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, e.data) {
+			t.Fatalf("Received the wrong content for %s", e.name)
+		}
+	}
+	_, err = tr.Next()
+	if err != io.EOF {
+		t.Fatalf("Expected the end of the tar stream, got %v", err)
+	}
+}
+
+func TestBatchInvalidRequests(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	c := newTestDiskCache(t, cacheDir, 100000, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		true, false, "")
+
+	_, hash := testutils.RandomDataAndHash(10)
+
+	tooMany := &batchpb.BatchRequest{}
+	for i := 0; i <= maxBatchItems; i++ {
+		tooMany.Items = append(tooMany.Items, &batchpb.Item{Kind: "cas", Hash: hash})
+	}
+	tooManyData, err := proto.Marshal(tooMany)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		method      string
+		contentType string
+		body        string
+		code        int
+	}{
+		{http.MethodGet, contentTypeJSON, `{}`, http.StatusMethodNotAllowed},
+		{http.MethodPost, "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, contentTypeJSON, `{"items": 1}`, http.StatusBadRequest},
+		{http.MethodPost, contentTypeProtobuf, "\xff", http.StatusBadRequest},
+		{http.MethodPost, contentTypeJSON,
+			`{"items": [{"kind": "raw", "hash": "` + hash + `"}]}`, http.StatusBadRequest},
+		{http.MethodPost, contentTypeJSON,
+			`{"items": [{"kind": "cas", "hash": "` + strings.ToUpper(hash) + `"}]}`, http.StatusBadRequest},
+		{http.MethodPost, contentTypeJSON,
+			`{"items": [{"kind": "cas", "hash": "abc"}]}`, http.StatusBadRequest},
+		{http.MethodPost, contentTypeProtobuf, string(tooManyData), http.StatusRequestEntityTooLarge},
+		{http.MethodPost, contentTypeJSON,
+			strings.Repeat(" ", maxBatchRequestSize+1), http.StatusRequestEntityTooLarge},
+		{http.MethodPost, contentTypeJSON, `{}`, http.StatusOK},
+	}
+
+	for _, handler := range []http.HandlerFunc{h.BatchContainsHandler, h.BatchGetHandler} {
+		for _, tc := range testCases {
+			req, err := http.NewRequest(tc.method, "/batch", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tc.code {
+				t.Errorf("%s %s %.50q: expected status %d, got %d",
+					tc.method, tc.contentType, tc.body, tc.code, rr.Code)
+			}
+		}
+	}
+}
+
+func TestForEachParallel(t *testing.T) {
+	const n = 100
+	results := make([]int, n)
+
+	var mu sync.Mutex
+	running := 0
+	maxRunning := 0
+	forEachParallel(n, func(i int) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		results[i] = i * i
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	for i, r := range results {
+		if r != i*i {
+			t.Fatalf("f was not called for index %d", i)
+		}
+	}
+	if maxRunning > batchConcurrency {
+		t.Fatalf("Expected at most %d parallel calls, got %d",
+			batchConcurrency, maxRunning)
+	}
+}
+
+func postBatch(handler http.HandlerFunc, contentType string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodPost, "/batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func expectContainsResults(t *testing.T, rsp *batchpb.BatchContainsResponse, expected []*batchpb.ContainsResult) {
+	t.Helper()
+
+	if len(rsp.Results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d", len(expected), len(rsp.Results))
+	}
+	for i, r := range rsp.Results {
+		if !proto.Equal(r, expected[i]) {
+			t.Fatalf("Result %d: expected %v, got %v", i, expected[i], r)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: server/batchpb/batch.proto
+
+package batchpb
+
+import (
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// An item in the cache.
+type Item struct {
+	// "ac" or "cas".
+	Kind string `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	// The lowercase hex encoded SHA256 hash.
+	Hash                 string   `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Item) Reset()         { *m = Item{} }
+func (m *Item) String() string { return proto.CompactTextString(m) }
+func (*Item) ProtoMessage()    {}
+func (*Item) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8b67ec904cad6d8d, []int{0}
+}
+
+func (m *Item) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Item.Unmarshal(m, b)
+}
+func (m *Item) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Item.Marshal(b, m, deterministic)
+}
+func (m *Item) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Item.Merge(m, src)
+}
+func (m *Item) XXX_Size() int {
+	return xxx_messageInfo_Item.Size(m)
+}
+func (m *Item) XXX_DiscardUnknown() {
+	xxx_messageInfo_Item.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Item proto.InternalMessageInfo
+
+func (m *Item) GetKind() string {
+	if m != nil {
+		return m.Kind
+	}
+	return ""
+}
+
+func (m *Item) GetHash() string {
+	if m != nil {
+		return m.Hash
+	}
+	return ""
+}
+
+// The request body of both /batch/contains and /batch/get.
+type BatchRequest struct {
+	Items                []*Item  `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BatchRequest) Reset()         { *m = BatchRequest{} }
+func (m *BatchRequest) String() string { return proto.CompactTextString(m) }
+func (*BatchRequest) ProtoMessage()    {}
+func (*BatchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8b67ec904cad6d8d, []int{1}
+}
+
+func (m *BatchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchRequest.Unmarshal(m, b)
+}
+func (m *BatchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchRequest.Marshal(b, m, deterministic)
+}
+func (m *BatchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchRequest.Merge(m, src)
+}
+func (m *BatchRequest) XXX_Size() int {
+	return xxx_messageInfo_BatchRequest.Size(m)
+}
+func (m *BatchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchRequest proto.InternalMessageInfo
+
+func (m *BatchRequest) GetItems() []*Item {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+// The existence of a requested item.
+type ContainsResult struct {
+	Kind  string `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	Hash  string `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	Found bool   `protobuf:"varint,3,opt,name=found,proto3" json:"found,omitempty"`
+	// The size of the item in bytes, or -1 if it was found but the size
+	// is unknown.
+	Size                 int64    `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ContainsResult) Reset()         { *m = ContainsResult{} }
+func (m *ContainsResult) String() string { return proto.CompactTextString(m) }
+func (*ContainsResult) ProtoMessage()    {}
+func (*ContainsResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8b67ec904cad6d8d, []int{2}
+}
+
+func (m *ContainsResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ContainsResult.Unmarshal(m, b)
+}
+func (m *ContainsResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ContainsResult.Marshal(b, m, deterministic)
+}
+func (m *ContainsResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ContainsResult.Merge(m, src)
+}
+func (m *ContainsResult) XXX_Size() int {
+	return xxx_messageInfo_ContainsResult.Size(m)
+}
+func (m *ContainsResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_ContainsResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ContainsResult proto.InternalMessageInfo
+
+func (m *ContainsResult) GetKind() string {
+	if m != nil {
+		return m.Kind
+	}
+	return ""
+}
+
+func (m *ContainsResult) GetHash() string {
+	if m != nil {
+		return m.Hash
+	}
+	return ""
+}
+
+func (m *ContainsResult) GetFound() bool {
+	if m != nil {
+		return m.Found
+	}
+	return false
+}
+
+func (m *ContainsResult) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+// The response body of /batch/contains, with one result for each
+// requested item, in the same order.
+type BatchContainsResponse struct {
+	Results              []*ContainsResult `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *BatchContainsResponse) Reset()         { *m = BatchContainsResponse{} }
+func (m *BatchContainsResponse) String() string { return proto.CompactTextString(m) }
+func (*BatchContainsResponse) ProtoMessage()    {}
+func (*BatchContainsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8b67ec904cad6d8d, []int{3}
+}
+
+func (m *BatchContainsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchContainsResponse.Unmarshal(m, b)
+}
+func (m *BatchContainsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchContainsResponse.Marshal(b, m, deterministic)
+}
+func (m *BatchContainsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchContainsResponse.Merge(m, src)
+}
+func (m *BatchContainsResponse) XXX_Size() int {
+	return xxx_messageInfo_BatchContainsResponse.Size(m)
+}
+func (m *BatchContainsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchContainsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchContainsResponse proto.InternalMessageInfo
+
+func (m *BatchContainsResponse) GetResults() []*ContainsResult {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Item)(nil), "bazel_remote.batch.Item")
+	proto.RegisterType((*BatchRequest)(nil), "bazel_remote.batch.BatchRequest")
+	proto.RegisterType((*ContainsResult)(nil), "bazel_remote.batch.ContainsResult")
+	proto.RegisterType((*BatchContainsResponse)(nil), "bazel_remote.batch.BatchContainsResponse")
+}
+
+func init() { proto.RegisterFile("server/batchpb/batch.proto", fileDescriptor_8b67ec904cad6d8d) }
+
+var fileDescriptor_8b67ec904cad6d8d = []byte{
+	// 249 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x90, 0xbd, 0x4b, 0x04, 0x31,
+	0x10, 0xc5, 0x89, 0xbb, 0xe7, 0x47, 0x14, 0x8b, 0xa0, 0x10, 0xac, 0x96, 0x54, 0xdb, 0x5c, 0x16,
+	0xb4, 0x15, 0x8b, 0xb3, 0xb2, 0x0d, 0xd8, 0xd8, 0xc8, 0x66, 0x6f, 0xbc, 0x04, 0x77, 0x93, 0x35,
+	0x1f, 0x16, 0xfb, 0xd7, 0x4b, 0x12, 0x0e, 0x3c, 0xb4, 0xb8, 0x2a, 0x2f, 0x33, 0xf3, 0xf8, 0x3d,
+	0x1e, 0xbe, 0xf3, 0xe0, 0xbe, 0xc1, 0x75, 0xb2, 0x0f, 0x83, 0x9a, 0x65, 0x79, 0xf9, 0xec, 0x6c,
+	0xb0, 0x84, 0xc8, 0x7e, 0x81, 0xf1, 0xdd, 0xc1, 0x64, 0x03, 0xf0, 0xbc, 0x61, 0x1c, 0xd7, 0x2f,
+	0x01, 0x26, 0x42, 0x70, 0xfd, 0xa9, 0xcd, 0x96, 0xa2, 0x06, 0xb5, 0x17, 0x22, 0xeb, 0x34, 0x53,
+	0xbd, 0x57, 0xf4, 0xa4, 0xcc, 0x92, 0x66, 0x4f, 0xf8, 0x6a, 0x93, 0x8c, 0x02, 0xbe, 0x22, 0xf8,
+	0x40, 0x38, 0x5e, 0xe9, 0x00, 0x93, 0xa7, 0xa8, 0xa9, 0xda, 0xcb, 0x7b, 0xca, 0xff, 0x32, 0x78,
+	0x02, 0x88, 0x72, 0xc6, 0x24, 0xbe, 0x7e, 0xb6, 0x26, 0xf4, 0xda, 0x78, 0x01, 0x3e, 0x8e, 0xe1,
+	0x58, 0x32, 0xb9, 0xc1, 0xab, 0x0f, 0x1b, 0xcd, 0x96, 0x56, 0x0d, 0x6a, 0xcf, 0x45, 0xf9, 0xa4,
+	0x4b, 0xaf, 0x17, 0xa0, 0x75, 0x83, 0xda, 0x4a, 0x64, 0xcd, 0x5e, 0xf1, 0x6d, 0xce, 0xf8, 0x0b,
+	0x34, 0x5b, 0xe3, 0x81, 0x3c, 0xe2, 0x33, 0x97, 0xa1, 0xfb, 0xb8, 0xec, 0xbf, 0xb8, 0x87, 0xf9,
+	0xc4, 0xde, 0xb2, 0xe9, 0xde, 0xd6, 0x3b, 0x1d, 0x54, 0x94, 0x7c, 0xb0, 0x53, 0x27, 0xe3, 0xa0,
+	0x76, 0xa9, 0xe7, 0x05, 0xc6, 0x75, 0xf1, 0x77, 0x87, 0xdd, 0xcb, 0xd3, 0x5c, 0xfb, 0xc3, 0xcf,
+	0x00, 0x4a, 0x59, 0x14, 0xf2, 0x94, 0x01, 0x00, 0x00,
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The supported values of the Content-Encoding header, in order of
+// preference.
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+// Smaller responses are not compressed, since the savings would be
+// insignificant.
+const minCompressSize = 1024
+
+// The maximum amount of memory used to decode a zstd upload, which
+// limits the window size. This is the same limit as the zstd command
+// line tool uses by default.
+const maxZstdDecoderMemory = 1 << 27
+
+// negotiateEncoding returns the preferred supported encoding in an
+// Accept-Encoding header, or the empty string if the response should
+// not be compressed.
+func negotiateEncoding(acceptEncoding string) string {
+	best := ""
+	bestQ := 0.0
+
+	for _, spec := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(spec, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+
+		if coding == "*" {
+			coding = encodingZstd
+		}
+		if coding != encodingZstd && coding != encodingGzip {
+			continue
+		}
+
+		// Prefer zstd if both are equally acceptable.
+		if q > bestQ || (q == bestQ && q > 0 && coding == encodingZstd) {
+			best = coding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// newEncoder returns a writer which compresses data written to it
+// with `encoding` into `w`. The returned writer must be closed to
+// flush the compressed data.
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	case encodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1))
+	}
+
+	return nil, fmt.Errorf("Unsupported encoding: %s", encoding)
+}
+
+// newDecoder returns a reader which decompresses the data in `r`,
+// which is encoded as described by a Content-Encoding header.
+func newDecoder(r io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	case encodingGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, &cache.Error{
+				Code: http.StatusBadRequest,
+				Text: fmt.Sprintf("Invalid gzip data: %v", err),
+			}
+		}
+		return zr, nil
+	case encodingZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxZstdDecoderMemory))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+
+	return nil, &cache.Error{
+		Code: http.StatusUnsupportedMediaType,
+		Text: fmt.Sprintf("Unsupported Content-Encoding: %s",
+			contentEncoding),
+	}
+}
+
+// spooledBody is a request body which has been written to a temporary
+// file. The file is removed when it is closed.
+type spooledBody struct {
+	*os.File
+}
+
+func (s *spooledBody) Close() error {
+	err := s.File.Close()
+	os.Remove(s.File.Name())
+	return err
+}
+
+// readErrorRecorder records errors from the underlying reader, so they
+// can be told apart from write errors after io.Copy.
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// spoolBody copies `r` to a temporary file in `dir` (or the default
+// directory for temporary files if `dir` is empty), and returns it along
+// with its size, ready to be read from the start. Bodies larger than
+// `maxSize` bytes are rejected with the same error as items which are
+// too large for the cache.
+func spoolBody(r io.Reader, dir string, maxSize int64) (io.ReadCloser, int64, error) {
+	f, err := ioutil.TempFile(dir, "upload-")
+	if err != nil {
+		return nil, -1, err
+	}
+	body := &spooledBody{f}
+
+	rr := &readErrorRecorder{r: io.LimitReader(r, maxSize+1)}
+	size, err := io.Copy(f, rr)
+	if rr.err != nil {
+		// Eg invalid compressed data, or the client disconnected.
+		err = &cache.Error{
+			Code: http.StatusBadRequest,
+			Text: fmt.Sprintf("Failed to read the request body: %v", rr.err),
+		}
+	}
+	if err == nil && size > maxSize {
+		err = &cache.Error{
+			Code: http.StatusInsufficientStorage,
+			Text: "The item that has been tried to insert was too big.",
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return nil, -1, err
+	}
+
+	return body, size, nil
+}
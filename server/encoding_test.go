@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"br", ""},
+		{"gzip", encodingGzip},
+		{"gzip, deflate", encodingGzip},
+		{"zstd", encodingZstd},
+		{"gzip, zstd", encodingZstd},
+		{"ZSTD;q=0.5, GZIP", encodingGzip},
+		{"zstd;q=0, gzip;q=0.1", encodingGzip},
+		{"gzip;q=0", ""},
+		{"gzip;q=invalid", ""},
+		{"*", encodingZstd},
+		{"*;q=0.5, gzip", encodingGzip},
+	}
+
+	for _, tc := range testCases {
+		actual := negotiateEncoding(tc.acceptEncoding)
+		if actual != tc.expected {
+			t.Errorf("negotiateEncoding(%q): expected %q, got %q",
+				tc.acceptEncoding, tc.expected, actual)
+		}
+	}
+}
+
+func TestEncoderDecoderRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("bazel-remote "), 1000)
+
+	for _, encoding := range []string{encodingGzip, encodingZstd} {
+		var buf bytes.Buffer
+		enc, err := newEncoder(&buf, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = enc.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() >= len(data) {
+			t.Errorf("%s: expected compressed data, got %d bytes", encoding, buf.Len())
+		}
+
+		dec, err := newDecoder(&buf, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ioutil.ReadAll(dec)
+		dec.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%s: round trip returned the wrong data", encoding)
+		}
+	}
+}
+
+func TestNewDecoderErrors(t *testing.T) {
+	_, err := newDecoder(strings.NewReader("not gzip"), encodingGzip)
+	expectCacheError(t, err, http.StatusBadRequest)
+
+	_, err = newDecoder(strings.NewReader(""), "br")
+	expectCacheError(t, err, http.StatusUnsupportedMediaType)
+}
+
+func TestSpoolBody(t *testing.T) {
+	data := []byte("0123456789")
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	body, size, err := spoolBody(bytes.NewReader(data), dir, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := body.(*spooledBody).Name()
+	if filepath.Dir(name) != dir {
+		t.Fatalf("Expected the body to be spooled in %s, got %s", dir, name)
+	}
+	spooled, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || !bytes.Equal(spooled, data) {
+		t.Fatalf("Unexpected spooled body: %q (size %d)", spooled, size)
+	}
+	body.Close()
+	_, err = ioutil.ReadFile(name)
+	if err == nil {
+		t.Fatal("Expected the temporary file to be removed")
+	}
+
+	_, _, err = spoolBody(bytes.NewReader(data), dir, int64(len(data)-1))
+	expectCacheError(t, err, http.StatusInsufficientStorage)
+
+	// A truncated zstd stream is a read error.
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(bytes.Repeat(data, 1000))
+	enc.Close()
+	dec, err := newDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), encodingZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	_, _, err = spoolBody(dec, dir, 1000000)
+	expectCacheError(t, err, http.StatusBadRequest)
+
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write(bytes.Repeat(data, 1000))
+	gz.Close()
+	dec, err = newDecoder(bytes.NewReader(gzBuf.Bytes()[:gzBuf.Len()/2]), encodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	_, _, err = spoolBody(dec, dir, 1000000)
+	expectCacheError(t, err, http.StatusBadRequest)
+
+	// zstd frames which need too much memory to decode.
+	buf.Reset()
+	enc, err = zstd.NewWriter(&buf, zstd.WithWindowSize(maxZstdDecoderMemory*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(bytes.Repeat(data, 1000))
+	enc.Close()
+	dec, err = newDecoder(bytes.NewReader(buf.Bytes()), encodingZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	_, _, err = spoolBody(dec, dir, 1000000)
+	expectCacheError(t, err, http.StatusBadRequest)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected the temporary files to be removed, found %d", len(files))
+	}
+}
+
+func expectCacheError(t *testing.T, err error, code int) {
+	t.Helper()
+
+	cerr, ok := err.(*cache.Error)
+	if !ok {
+		t.Fatalf("Expected a cache.Error with code %d, got %v", code, err)
+	}
+	if cerr.Code != code {
+		t.Fatalf("Expected error code %d, got %d: %v", code, cerr.Code, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"regexp"
 
 	"google.golang.org/genproto/googleapis/bytestream"
@@ -29,28 +30,35 @@ var (
 	hashKeyRegex = regexp.MustCompile("^[a-f0-9]{64}$")
 )
 
+var errReadOnly = status.Error(codes.PermissionDenied, "This cache is read-only")
+
 type grpcServer struct {
-	cache        *disk.DiskCache
+	cache        disk.Cache
 	accessLogger cache.Logger
 	errorLogger  cache.Logger
+	readOnly     bool
 }
 
+// ListenAndServeGRPC creates a new gRPC server listening on the given
+// address. If readOnly is true, all requests that would modify the
+// cache are rejected with PERMISSION_DENIED.
 func ListenAndServeGRPC(addr string, opts []grpc.ServerOption,
-	c *disk.DiskCache, a cache.Logger, e cache.Logger) error {
+	c disk.Cache, a cache.Logger, e cache.Logger, readOnly bool) error {
 
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	return ServeGRPC(listener, opts, c, a, e)
+	return ServeGRPC(listener, opts, c, a, e, readOnly)
 }
 
 func ServeGRPC(l net.Listener, opts []grpc.ServerOption,
-	c *disk.DiskCache, a cache.Logger, e cache.Logger) error {
+	c disk.Cache, a cache.Logger, e cache.Logger, readOnly bool) error {
 
 	srv := grpc.NewServer(opts...)
-	s := &grpcServer{cache: c, accessLogger: a, errorLogger: e}
+	s := &grpcServer{cache: c, accessLogger: a, errorLogger: e,
+		readOnly: readOnly}
 	pb.RegisterActionCacheServer(srv, s)
 	pb.RegisterCapabilitiesServer(srv, s)
 	pb.RegisterContentAddressableStorageServer(srv, s)
@@ -69,7 +77,7 @@ func (s *grpcServer) GetCapabilities(ctx context.Context,
 		CacheCapabilities: &pb.CacheCapabilities{
 			DigestFunction: []pb.DigestFunction_Value{pb.DigestFunction_SHA256},
 			ActionCacheUpdateCapabilities: &pb.ActionCacheUpdateCapabilities{
-				UpdateEnabled: true,
+				UpdateEnabled: !s.readOnly,
 			},
 			CachePriorityCapabilities: &pb.PriorityCapabilities{
 				Priorities: []*pb.PriorityCapabilities_PriorityRange{
@@ -117,3 +125,27 @@ func (s *grpcServer) validateHash(hash string, size int64, logPrefix string) err
 
 	return nil
 }
+
+// Return the gRPC status code for an error returned by the cache.
+// Errors from the proxy backend are reported as Unavailable, proxy
+// timeouts and cancelled requests are reported as DeadlineExceeded and
+// Canceled, and other errors are reported as `fallback`.
+func errorCode(err error, fallback codes.Code) codes.Code {
+	if cerr, ok := err.(*cache.Error); ok {
+		switch cerr.Code {
+		case http.StatusServiceUnavailable:
+			return codes.Unavailable
+		case http.StatusGatewayTimeout:
+			return codes.DeadlineExceeded
+		}
+	}
+
+	switch err {
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case context.Canceled:
+		return codes.Canceled
+	}
+
+	return fallback
+}
@@ -43,10 +43,11 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 		return nil, err
 	}
 
-	result, _, err := s.cache.GetValidatedActionResult(req.ActionDigest.Hash)
+	ctx = cache.WithDigestSize(ctx, req.ActionDigest)
+	result, _, err := s.cache.GetValidatedActionResult(ctx, req.ActionDigest.Hash)
 	if err != nil {
 		s.accessLogger.Printf("%s %s %s", errorPrefix, req.ActionDigest.Hash, err)
-		return nil, status.Error(codes.Unknown, err.Error())
+		return nil, status.Error(errorCode(err, codes.Unknown), err.Error())
 	}
 
 	if result == nil {
@@ -59,14 +60,14 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 
 	var inlinedSoFar int64
 
-	err = s.maybeInline(req.InlineStdout,
+	err = s.maybeInline(ctx, req.InlineStdout,
 		&result.StdoutRaw, &result.StdoutDigest, &inlinedSoFar)
 	if err != nil {
 		s.accessLogger.Printf("%s %s %s", errorPrefix, req.ActionDigest.Hash, err)
 		return nil, status.Error(codes.Unknown, err.Error())
 	}
 
-	err = s.maybeInline(req.InlineStderr,
+	err = s.maybeInline(ctx, req.InlineStderr,
 		&result.StderrRaw, &result.StderrDigest, &inlinedSoFar)
 	if err != nil {
 		s.accessLogger.Printf("%s %s %s", errorPrefix, req.ActionDigest.Hash, err)
@@ -79,7 +80,7 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 	}
 	for _, of := range result.GetOutputFiles() {
 		_, ok := inlinableFiles[of.Path]
-		err = s.maybeInline(ok, &of.Contents, &of.Digest, &inlinedSoFar)
+		err = s.maybeInline(ctx, ok, &of.Contents, &of.Digest, &inlinedSoFar)
 		if err != nil {
 			s.accessLogger.Printf("%s %s %s", errorPrefix, req.ActionDigest.Hash, err)
 			return nil, status.Error(codes.Unknown, err.Error())
@@ -91,7 +92,7 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 	return result, nil
 }
 
-func (s *grpcServer) maybeInline(inline bool, slice *[]byte, digest **pb.Digest, inlinedSoFar *int64) error {
+func (s *grpcServer) maybeInline(ctx context.Context, inline bool, slice *[]byte, digest **pb.Digest, inlinedSoFar *int64) error {
 
 	if (*inlinedSoFar + int64(len(*slice))) > maxInlineSize {
 		inline = false
@@ -113,9 +114,9 @@ func (s *grpcServer) maybeInline(inline bool, slice *[]byte, digest **pb.Digest,
 			}
 		}
 
-		found, _ := s.cache.Contains(cache.CAS, (*digest).Hash)
+		found, _ := s.cache.Contains(cache.WithDigestSize(ctx, *digest), cache.CAS, (*digest).Hash)
 		if !found {
-			err := s.cache.Put(cache.CAS, (*digest).Hash, (*digest).SizeBytes,
+			err := s.cache.Put(ctx, cache.CAS, (*digest).Hash, (*digest).SizeBytes,
 				bytes.NewReader(*slice))
 			if err != nil {
 				return err
@@ -137,7 +138,7 @@ func (s *grpcServer) maybeInline(inline bool, slice *[]byte, digest **pb.Digest,
 
 	// Otherwise, attempt to inline.
 	if (*digest).SizeBytes > 0 {
-		data, err := s.getBlobData((*digest).Hash, (*digest).SizeBytes)
+		data, err := s.getBlobData(ctx, (*digest).Hash, (*digest).SizeBytes)
 		if err != nil {
 			return err
 		}
@@ -152,6 +153,12 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 	req *pb.UpdateActionResultRequest) (*pb.ActionResult, error) {
 
 	errorPrefix := "GRPC AC PUT"
+	if s.readOnly {
+		s.accessLogger.Printf("%s %s: %s", errorPrefix,
+			req.ActionDigest.GetHash(), "read-only")
+		return nil, errReadOnly
+	}
+
 	err := s.validateHash(req.ActionDigest.Hash, req.ActionDigest.SizeBytes, errorPrefix)
 	if err != nil {
 		return nil, err
@@ -172,11 +179,11 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 		return nil, errEmptyActionResult
 	}
 
-	err = s.cache.Put(cache.AC, req.ActionDigest.Hash,
+	err = s.cache.Put(cache.WithDigestSize(ctx, req.ActionDigest), cache.AC, req.ActionDigest.Hash,
 		int64(len(data)), bytes.NewReader(data))
 	if err != nil {
 		s.accessLogger.Printf("%s %s %s", errorPrefix, req.ActionDigest.Hash, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(errorCode(err, codes.Internal), err.Error())
 	}
 
 	// Also cache any inlined blobs, separately in the CAS.
@@ -186,12 +193,12 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 
 	for _, f := range req.ActionResult.OutputFiles {
 		if f != nil && len(f.Contents) > 0 {
-			err = s.cache.Put(cache.CAS, f.Digest.Hash,
+			err = s.cache.Put(ctx, cache.CAS, f.Digest.Hash,
 				f.Digest.SizeBytes, bytes.NewReader(f.Contents))
 			if err != nil {
 				s.accessLogger.Printf("%s %s %s", errorPrefix,
 					req.ActionDigest.Hash, err)
-				return nil, status.Error(codes.Internal, err.Error())
+				return nil, status.Error(errorCode(err, codes.Internal), err.Error())
 			}
 		}
 	}
@@ -208,12 +215,12 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 			sizeBytes = int64(len(req.ActionResult.StdoutRaw))
 		}
 
-		err = s.cache.Put(cache.CAS, hash, sizeBytes,
+		err = s.cache.Put(ctx, cache.CAS, hash, sizeBytes,
 			bytes.NewReader(req.ActionResult.StdoutRaw))
 		if err != nil {
 			s.accessLogger.Printf("%s %s %s", errorPrefix,
 				req.ActionDigest.Hash, err)
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, status.Error(errorCode(err, codes.Internal), err.Error())
 		}
 	}
 
@@ -229,12 +236,12 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 			sizeBytes = int64(len(req.ActionResult.StderrRaw))
 		}
 
-		err = s.cache.Put(cache.CAS, hash, sizeBytes,
+		err = s.cache.Put(ctx, cache.CAS, hash, sizeBytes,
 			bytes.NewReader(req.ActionResult.StderrRaw))
 		if err != nil {
 			s.accessLogger.Printf("%s %s %s", errorPrefix,
 				req.ActionDigest.Hash, err)
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, status.Error(errorCode(err, codes.Internal), err.Error())
 		}
 	}
 
@@ -94,11 +94,12 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 		return status.Error(codes.OutOfRange, msg)
 	}
 
-	rdr, sizeBytes, err := s.cache.Get(cache.CAS, hash)
+	ctx := cache.WithDigestSizes(resp.Context(), map[string]int64{hash: size})
+	rdr, sizeBytes, err := s.cache.Get(ctx, cache.CAS, hash)
 	if err != nil {
 		msg := fmt.Sprintf("GRPC BYTESTREAM READ FAILED: %v", err)
 		s.accessLogger.Printf(msg)
-		return status.Error(codes.Unknown, msg)
+		return status.Error(errorCode(err, codes.Unknown), msg)
 	}
 	if rdr == nil {
 		msg := fmt.Sprintf("GRPC BYTESTREAM READ BLOB NOT FOUND: %s", hash)
@@ -226,6 +227,11 @@ func (s *grpcServer) parseWriteResource(r string) (string, int64, error) {
 
 func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 
+	if s.readOnly {
+		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: read-only")
+		return errReadOnly
+	}
+
 	var resp bytestream.WriteResponse
 	pr, pw := io.Pipe()
 
@@ -283,7 +289,7 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 				}
 
 				go func() {
-					putResult <- s.cache.Put(cache.CAS, hash, size, pr)
+					putResult <- s.cache.Put(srv.Context(), cache.CAS, hash, size, pr)
 				}()
 
 				firstIteration = false
@@ -367,7 +373,7 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 	}
 	if err != nil {
 		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", err)
-		return status.Error(codes.Unknown, err.Error())
+		return status.Error(errorCode(err, codes.Unknown), err.Error())
 	}
 
 	err = srv.SendAndClose(&resp)
@@ -30,6 +30,8 @@ func (s *grpcServer) FindMissingBlobs(ctx context.Context,
 	resp := pb.FindMissingBlobsResponse{}
 
 	errorPrefix := "GRPC CAS GET"
+	digests := make(map[string]*pb.Digest, len(req.BlobDigests))
+	hashes := make([]string, 0, len(req.BlobDigests))
 	for _, digest := range req.BlobDigests {
 		hash := digest.GetHash()
 		err := s.validateHash(hash, digest.SizeBytes, errorPrefix)
@@ -43,11 +45,29 @@ func (s *grpcServer) FindMissingBlobs(ctx context.Context,
 			continue
 		}
 
-		found, _ := s.cache.Contains(cache.CAS, hash)
-		if !found {
-			s.accessLogger.Printf("GRPC CAS HEAD %s NOT FOUND", hash)
-			resp.MissingBlobDigests = append(resp.MissingBlobDigests, digest)
-		} else {
+		if _, seen := digests[hash]; !seen {
+			digests[hash] = digest
+			hashes = append(hashes, hash)
+		}
+	}
+
+	// Check all the blobs at once, so that local misses can be looked
+	// up concurrently in the proxy backend.
+	sizes := make(map[string]int64, len(digests))
+	for hash, digest := range digests {
+		sizes[hash] = digest.SizeBytes
+	}
+	ctx = cache.WithDigestSizes(ctx, sizes)
+	missing := s.cache.FindMissingCasBlobs(ctx, hashes)
+
+	missingSet := make(map[string]struct{}, len(missing))
+	for _, hash := range missing {
+		missingSet[hash] = struct{}{}
+		s.accessLogger.Printf("GRPC CAS HEAD %s NOT FOUND", hash)
+		resp.MissingBlobDigests = append(resp.MissingBlobDigests, digests[hash])
+	}
+	for _, hash := range hashes {
+		if _, ok := missingSet[hash]; !ok {
 			s.accessLogger.Printf("GRPC CAS HEAD %s OK", hash)
 		}
 	}
@@ -64,6 +84,11 @@ func (s *grpcServer) BatchUpdateBlobs(ctx context.Context,
 	}
 
 	errorPrefix := "GRPC CAS PUT"
+	if s.readOnly {
+		s.accessLogger.Printf("%s: %s", errorPrefix, "read-only")
+		return nil, errReadOnly
+	}
+
 	for _, req := range in.Requests {
 		// TODO: consider fanning-out goroutines here.
 		err := s.validateHash(req.Digest.Hash, req.Digest.SizeBytes, errorPrefix)
@@ -80,11 +105,11 @@ func (s *grpcServer) BatchUpdateBlobs(ctx context.Context,
 		}
 		resp.Responses = append(resp.Responses, &rr)
 
-		err = s.cache.Put(cache.CAS, req.Digest.Hash,
+		err = s.cache.Put(ctx, cache.CAS, req.Digest.Hash,
 			int64(len(req.Data)), bytes.NewReader(req.Data))
 		if err != nil {
 			s.errorLogger.Printf("%s %s %s", errorPrefix, req.Digest.Hash, err)
-			rr.Status.Code = int32(code.Code_UNKNOWN)
+			rr.Status.Code = int32(errorCode(err, codes.Unknown))
 			continue
 		}
 
@@ -97,7 +122,7 @@ func (s *grpcServer) BatchUpdateBlobs(ctx context.Context,
 // Return the data for a blob, or an error.  If the blob was not
 // found, the returned error is errBlobNotFound. Only use this
 // function when it's OK to buffer the entire blob in memory.
-func (s *grpcServer) getBlobData(hash string, size int64) ([]byte, error) {
+func (s *grpcServer) getBlobData(ctx context.Context, hash string, size int64) ([]byte, error) {
 	if size < 0 {
 		return []byte{}, errBadSize
 	}
@@ -106,9 +131,12 @@ func (s *grpcServer) getBlobData(hash string, size int64) ([]byte, error) {
 		return []byte{}, nil
 	}
 
-	rdr, sizeBytes, err := s.cache.Get(cache.CAS, hash)
+	ctx = cache.WithDigestSizes(ctx, map[string]int64{hash: size})
+	rdr, sizeBytes, err := s.cache.Get(ctx, cache.CAS, hash)
 	if err != nil {
-		rdr.Close()
+		if rdr != nil {
+			rdr.Close()
+		}
 		return []byte{}, err
 	}
 
@@ -130,10 +158,10 @@ func (s *grpcServer) getBlobData(hash string, size int64) ([]byte, error) {
 	return data, rdr.Close()
 }
 
-func (s *grpcServer) getBlobResponse(digest *pb.Digest) *pb.BatchReadBlobsResponse_Response {
+func (s *grpcServer) getBlobResponse(ctx context.Context, digest *pb.Digest) *pb.BatchReadBlobsResponse_Response {
 	r := pb.BatchReadBlobsResponse_Response{Digest: digest}
 
-	data, err := s.getBlobData(digest.Hash, digest.SizeBytes)
+	data, err := s.getBlobData(ctx, digest.Hash, digest.SizeBytes)
 	if err == errBlobNotFound {
 		s.accessLogger.Printf("GRPC CAS GET %s NOT FOUND", digest.Hash)
 		r.Status = &status.Status{Code: int32(code.Code_NOT_FOUND)}
@@ -169,7 +197,7 @@ func (s *grpcServer) BatchReadBlobs(ctx context.Context,
 		if err != nil {
 			return nil, err
 		}
-		resp.Responses = append(resp.Responses, s.getBlobResponse(digest))
+		resp.Responses = append(resp.Responses, s.getBlobResponse(ctx, digest))
 	}
 
 	return &resp, nil
@@ -187,7 +215,7 @@ func (s *grpcServer) GetTree(in *pb.GetTreeRequest,
 		return err
 	}
 
-	data, err := s.getBlobData(in.RootDigest.Hash, in.RootDigest.SizeBytes)
+	data, err := s.getBlobData(stream.Context(), in.RootDigest.Hash, in.RootDigest.SizeBytes)
 	if err == errBlobNotFound {
 		s.accessLogger.Printf("GRPC CAS GETTREEREQUEST %s NOT FOUND",
 			in.RootDigest.Hash)
@@ -205,7 +233,7 @@ func (s *grpcServer) GetTree(in *pb.GetTreeRequest,
 		return grpc_status.Error(codes.DataLoss, err.Error())
 	}
 
-	err = s.fillDirectories(&resp, &dir, errorPrefix)
+	err = s.fillDirectories(stream.Context(), &resp, &dir, errorPrefix)
 	if err != nil {
 		return err
 	}
@@ -220,7 +248,7 @@ func (s *grpcServer) GetTree(in *pb.GetTreeRequest,
 
 // Attempt to populate `resp`. Return errors for invalid requests, but
 // otherwise attempt to return as many blobs as possible.
-func (s *grpcServer) fillDirectories(resp *pb.GetTreeResponse, dir *pb.Directory, errorPrefix string) error {
+func (s *grpcServer) fillDirectories(ctx context.Context, resp *pb.GetTreeResponse, dir *pb.Directory, errorPrefix string) error {
 
 	// Add this dir.
 	resp.Directories = append(resp.Directories, dir)
@@ -233,7 +261,7 @@ func (s *grpcServer) fillDirectories(resp *pb.GetTreeResponse, dir *pb.Directory
 			return err
 		}
 
-		data, err := s.getBlobData(dirNode.Digest.Hash, dirNode.Digest.SizeBytes)
+		data, err := s.getBlobData(ctx, dirNode.Digest.Hash, dirNode.Digest.SizeBytes)
 		if err == errBlobNotFound {
 			s.accessLogger.Printf("GRPC GETTREEREQUEST BLOB %s NOT FOUND",
 				dirNode.Digest.Hash)
@@ -254,7 +282,7 @@ func (s *grpcServer) fillDirectories(resp *pb.GetTreeResponse, dir *pb.Directory
 		s.accessLogger.Printf("GRPC GETTREEREQUEST BLOB %s ADDED OK",
 			dirNode.Digest.Hash)
 
-		err = s.fillDirectories(resp, &dirMsg, errorPrefix)
+		err = s.fillDirectories(ctx, resp, &dirMsg, errorPrefix)
 		if err != nil {
 			return err
 		}
@@ -23,6 +23,7 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 
+	"github.com/buchgr/bazel-remote/cache"
 	"github.com/buchgr/bazel-remote/cache/disk"
 	"github.com/buchgr/bazel-remote/utils"
 )
@@ -65,7 +66,12 @@ func TestMain(m *testing.M) {
 	}
 	defer os.RemoveAll(dir)
 
-	diskCache := disk.New(dir, int64(10*maxChunkSize), nil)
+	diskCache, err := disk.New(testutils.NewSilentLogger(), dir,
+		int64(10*maxChunkSize), nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	accessLogger := testutils.NewSilentLogger()
 	errorLogger := testutils.NewSilentLogger()
@@ -76,7 +82,7 @@ func TestMain(m *testing.M) {
 		err2 := ServeGRPC(
 			listener,
 			[]grpc.ServerOption{},
-			diskCache, accessLogger, errorLogger)
+			diskCache, accessLogger, errorLogger, false)
 		if err2 != nil {
 			fmt.Println(err2)
 			os.Exit(1)
@@ -818,3 +824,80 @@ func TestGrpcCasTreeRequest(t *testing.T) {
 		t.Fatal("Neither directory matches")
 	}
 }
+
+func TestGrpcReadOnly(t *testing.T) {
+	dir := testutils.TempDir(t)
+	defer os.RemoveAll(dir)
+
+	diskCache, err := disk.New(testutils.NewSilentLogger(), dir, 1024*1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roListener := bufconn.Listen(bufSize)
+	go ServeGRPC(roListener, []grpc.ServerOption{}, diskCache,
+		testutils.NewSilentLogger(), testutils.NewSilentLogger(), true)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return roListener.Dial()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	caps, err := pb.NewCapabilitiesClient(conn).GetCapabilities(ctx,
+		&pb.GetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.CacheCapabilities.ActionCacheUpdateCapabilities.UpdateEnabled {
+		t.Fatal("Expected UpdateEnabled to be false")
+	}
+
+	data, hash := testutils.RandomDataAndHash(1024)
+	digest := pb.Digest{Hash: hash, SizeBytes: int64(len(data))}
+
+	_, err = pb.NewActionCacheClient(conn).UpdateActionResult(ctx,
+		&pb.UpdateActionResultRequest{
+			ActionDigest: &digest,
+			ActionResult: &pb.ActionResult{ExitCode: int32(42)},
+		})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied from UpdateActionResult, got: %v", err)
+	}
+
+	_, err = pb.NewContentAddressableStorageClient(conn).BatchUpdateBlobs(ctx,
+		&pb.BatchUpdateBlobsRequest{
+			Requests: []*pb.BatchUpdateBlobsRequest_Request{
+				{Digest: &digest, Data: data},
+			},
+		})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied from BatchUpdateBlobs, got: %v", err)
+	}
+
+	bswc, err := bytestream.NewByteStreamClient(conn).Write(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bswc.Send(&bytestream.WriteRequest{
+		ResourceName: fmt.Sprintf("uploads/%s/blobs/%s/%d",
+			uuid.New().String(), hash, len(data)),
+		Data:        data,
+		FinishWrite: true,
+	})
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	_, err = bswc.CloseAndRecv()
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied from ByteStream Write, got: %v", err)
+	}
+
+	found, _ := diskCache.Contains(context.Background(), cache.CAS, hash)
+	if found {
+		t.Fatal("Expected the read-only cache to remain empty")
+	}
+}
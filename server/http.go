@@ -16,6 +16,7 @@ import (
 	pb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buchgr/bazel-remote/cache"
 	"github.com/buchgr/bazel-remote/cache/disk"
+	"github.com/buchgr/bazel-remote/cache/resilience"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 )
@@ -25,15 +26,68 @@ var blobNameSHA256 = regexp.MustCompile("^/?(.*/)?(ac/|cas/)([a-f0-9]{64})$")
 // HTTPCache ...
 type HTTPCache interface {
 	CacheHandler(w http.ResponseWriter, r *http.Request)
+	BatchContainsHandler(w http.ResponseWriter, r *http.Request)
+	BatchGetHandler(w http.ResponseWriter, r *http.Request)
 	StatusPageHandler(w http.ResponseWriter, r *http.Request)
 }
 
 type httpCache struct {
-	cache        *disk.DiskCache
+	cache        disk.Cache
 	accessLogger cache.Logger
 	errorLogger  cache.Logger
 	validateAC   bool
+	readOnly     bool
 	gitCommit    string
+
+	// If true, responses are compressed if the client accepts it.
+	compression bool
+
+	// The maximum size of uploads which are written to a temporary file.
+	// They are also limited by the cache size.
+	maxChunkedUploadSize int64
+
+	// The directory for temporary upload files, or the empty string to
+	// use the default directory for temporary files.
+	spoolDir string
+}
+
+// HTTPOption is used to configure optional httpCache behaviour.
+type HTTPOption func(*httpCache)
+
+// WithCompression makes the cache compress GET responses with gzip or
+// zstd, if the client accepts it with an Accept-Encoding header. Range
+// requests and small responses are never compressed. Uploads with a
+// Content-Encoding header are decompressed regardless of this option.
+func WithCompression(enabled bool) HTTPOption {
+	return func(h *httpCache) {
+		h.compression = enabled
+	}
+}
+
+// The default limit of WithMaxChunkedUploadSize.
+const defaultMaxChunkedUploadSize = 1024 * 1024 * 1024
+
+// WithMaxChunkedUploadSize limits the size of PUT requests which are
+// written to a temporary file before they are added to the cache: those
+// without a Content-Length header, and the decompressed size of those
+// with a Content-Encoding header. If maxSize is 0 the default of 1 GiB
+// is used. The size of the cache is always a limit too.
+func WithMaxChunkedUploadSize(maxSize int64) HTTPOption {
+	return func(h *httpCache) {
+		if maxSize == 0 {
+			maxSize = defaultMaxChunkedUploadSize
+		}
+		h.maxChunkedUploadSize = maxSize
+	}
+}
+
+// WithSpoolDir sets the directory where uploads are written to before
+// they are added to the cache, see WithMaxChunkedUploadSize. The
+// directory must exist.
+func WithSpoolDir(dir string) HTTPOption {
+	return func(h *httpCache) {
+		h.spoolDir = dir
+	}
 }
 
 type statusPageData struct {
@@ -42,13 +96,17 @@ type statusPageData struct {
 	NumFiles   int
 	ServerTime int64
 	GitCommit  string
+
+	// The health of the proxy backends, if proxy_resilience is enabled.
+	ProxyBackends []resilience.Status `json:",omitempty"`
 }
 
 // NewHTTPCache returns a new instance of the cache.
 // accessLogger will print one line for each HTTP request to stdout.
 // errorLogger will print unexpected server errors. Inexistent files and malformed URLs will not
 // be reported.
-func NewHTTPCache(cache *disk.DiskCache, accessLogger cache.Logger, errorLogger cache.Logger, validateAC bool, commit string) HTTPCache {
+// If readOnly is true, all PUT requests are rejected with 403 Forbidden.
+func NewHTTPCache(cache disk.Cache, accessLogger cache.Logger, errorLogger cache.Logger, validateAC bool, readOnly bool, commit string, opts ...HTTPOption) HTTPCache {
 
 	_, numItems := cache.Stats()
 
@@ -59,12 +117,19 @@ func NewHTTPCache(cache *disk.DiskCache, accessLogger cache.Logger, errorLogger
 		accessLogger: accessLogger,
 		errorLogger:  errorLogger,
 		validateAC:   validateAC,
+		readOnly:     readOnly,
+
+		maxChunkedUploadSize: defaultMaxChunkedUploadSize,
 	}
 
 	if commit != "{STABLE_GIT_COMMIT}" {
 		hc.gitCommit = commit
 	}
 
+	for _, opt := range opts {
+		opt(hc)
+	}
+
 	return hc
 }
 
@@ -97,7 +162,7 @@ func parseRequestURL(url string, validateAC bool) (cache.EntryKind, string, erro
 	return cache.RAW, hash, nil
 }
 func (h *httpCache) handleContainsValidAC(w http.ResponseWriter, r *http.Request, hash string) {
-	_, data, err := h.cache.GetValidatedActionResult(hash)
+	_, data, err := h.cache.GetValidatedActionResult(r.Context(), hash)
 	if err != nil {
 		http.Error(w, "Not found", http.StatusNotFound)
 		h.logResponse(http.StatusNotFound, r)
@@ -116,7 +181,7 @@ func (h *httpCache) handleContainsValidAC(w http.ResponseWriter, r *http.Request
 }
 
 func (h *httpCache) handleGetValidAC(w http.ResponseWriter, r *http.Request, hash string) {
-	_, data, err := h.cache.GetValidatedActionResult(hash)
+	_, data, err := h.cache.GetValidatedActionResult(r.Context(), hash)
 	if err != nil {
 		http.Error(w, "Not found", http.StatusNotFound)
 		h.logResponse(http.StatusNotFound, r)
@@ -175,6 +240,18 @@ func (h *httpCache) logResponse(code int, r *http.Request) {
 	h.accessLogger.Printf("%4s %d %15s %s", r.Method, code, clientAddress, r.URL.Path)
 }
 
+// statusWriter records the status code of a response, for the access
+// log.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
 func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -193,7 +270,7 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		rdr, sizeBytes, err := h.cache.Get(kind, hash)
+		rdr, sizeBytes, err := h.cache.Get(r.Context(), kind, hash)
 		if err != nil {
 			if e, ok := err.(*cache.Error); ok {
 				http.Error(w, e.Error(), e.Code)
@@ -212,21 +289,70 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 		defer rdr.Close()
 
 		w.Header().Set("Content-Type", "application/octet-stream")
+
+		if h.compression {
+			w.Header().Set("Vary", "Accept-Encoding")
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding != "" && sizeBytes >= minCompressSize &&
+				r.Header.Get("Range") == "" {
+
+				h.writeCompressed(w, r, rdr, encoding)
+				return
+			}
+		}
+
+		// Items stored locally can be seeked, so Range requests can be
+		// served without reading the skipped parts. Other items, eg
+		// those streamed from the proxy backend, are always returned
+		// in full.
+		if rs, ok := rdr.(io.ReadSeeker); ok {
+			if kind == cache.CAS {
+				// CAS blobs never change, so the hash is a strong
+				// validator for If-Range (and If-None-Match) requests.
+				w.Header().Set("ETag", `"`+hash+`"`)
+			}
+			sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+			http.ServeContent(sw, r, "", time.Time{}, rs)
+			h.logResponse(sw.code, r)
+			return
+		}
+
 		w.Header().Set("Content-Length", strconv.FormatInt(sizeBytes, 10))
 		io.Copy(w, rdr)
 
 		h.logResponse(http.StatusOK, r)
 	case http.MethodPut:
-		if r.ContentLength == -1 {
-			// We need the content-length header to make sure we have enough disk space.
-			msg := fmt.Sprintf("PUT without Content-Length (key = %s)", path(kind, hash))
-			http.Error(w, msg, http.StatusBadRequest)
-			h.errorLogger.Printf("PUT %s: %s", path(kind, hash), msg)
+		if h.readOnly {
+			http.Error(w, "This cache is read-only", http.StatusForbidden)
+			h.logResponse(http.StatusForbidden, r)
 			return
 		}
+
 		contentLength := r.ContentLength
 
-		rc := r.Body
+		var rc io.ReadCloser = r.Body
+		encoding := r.Header.Get("Content-Encoding")
+		if contentLength == -1 || (encoding != "" && encoding != "identity") {
+			// The (decompressed) size is needed to reserve space in the
+			// cache, so write the body to a temporary file first.
+			maxSize := h.cache.MaxSize()
+			if h.maxChunkedUploadSize < maxSize {
+				maxSize = h.maxChunkedUploadSize
+			}
+			rc, contentLength, err = decodeBody(r.Body, encoding,
+				h.spoolDir, maxSize)
+			if err != nil {
+				if cerr, ok := err.(*cache.Error); ok {
+					http.Error(w, err.Error(), cerr.Code)
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				h.errorLogger.Printf("PUT %s: %s", path(kind, hash), err)
+				return
+			}
+			defer rc.Close()
+		}
 		if h.validateAC && kind == cache.AC {
 			// verify that this is a valid ActionResult
 
@@ -261,7 +387,7 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 			rc = ioutil.NopCloser(bytes.NewReader(data))
 		}
 
-		err := h.cache.Put(kind, hash, contentLength, rc)
+		err := h.cache.Put(r.Context(), kind, hash, contentLength, rc)
 		if err != nil {
 			if cerr, ok := err.(*cache.Error); ok {
 				http.Error(w, err.Error(), cerr.Code)
@@ -282,7 +408,7 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Unvalidated path:
 
-		ok, size := h.cache.Contains(kind, hash)
+		ok, size := h.cache.Contains(r.Context(), kind, hash)
 		if !ok {
 			http.Error(w, "Not found", http.StatusNotFound)
 			h.logResponse(http.StatusNotFound, r)
@@ -299,6 +425,40 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Stream an item to the client, compressed with `encoding`.
+func (h *httpCache) writeCompressed(w http.ResponseWriter, r *http.Request,
+	rdr io.Reader, encoding string) {
+
+	// The compressed size is unknown, so the response is chunked.
+	w.Header().Set("Content-Encoding", encoding)
+
+	enc, err := newEncoder(w, encoding)
+	if err == nil {
+		_, err = io.Copy(enc, rdr)
+		if err == nil {
+			err = enc.Close()
+		}
+	}
+	if err != nil {
+		h.errorLogger.Printf("GET %s: %s", r.URL.Path, err)
+	}
+
+	h.logResponse(http.StatusOK, r)
+}
+
+// Decompress an uploaded body (if `encoding` is not empty) to a temporary
+// file in `dir`, and return it along with its size, which must not exceed
+// `maxSize`.
+func decodeBody(body io.Reader, encoding string, dir string, maxSize int64) (io.ReadCloser, int64, error) {
+	dec, err := newDecoder(body, encoding)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer dec.Close()
+
+	return spoolBody(dec, dir, maxSize)
+}
+
 func addWorkerMetadataHTTP(addr string, ct string, orig []byte) (data []byte, code int, err error) {
 	ar := &pb.ActionResult{}
 	if ct == "application/json" {
@@ -349,6 +509,8 @@ func (h *httpCache) StatusPageHandler(w http.ResponseWriter, r *http.Request) {
 		NumFiles:   numItems,
 		ServerTime: time.Now().Unix(),
 		GitCommit:  h.gitCommit,
+
+		ProxyBackends: resilience.Statuses(),
 	})
 }
 
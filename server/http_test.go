@@ -2,12 +2,15 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -24,6 +27,14 @@ import (
 	"github.com/golang/protobuf/proto"
 )
 
+func newTestDiskCache(t *testing.T, dir string, maxSize int64, proxy cache.CacheProxy) *disk.DiskCache {
+	c, err := disk.New(testutils.NewSilentLogger(), dir, maxSize, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
 func TestDownloadFile(t *testing.T) {
 	cacheDir := testutils.CreateTmpCacheDirs(t)
 	defer os.RemoveAll(cacheDir)
@@ -35,8 +46,8 @@ func TestDownloadFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c := disk.New(cacheDir, blobSize, nil)
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, "")
+	c := newTestDiskCache(t, cacheDir, blobSize, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, "")
 
 	req, err := http.NewRequest("GET", "/cas/"+hash, bytes.NewReader([]byte{}))
 	if err != nil {
@@ -98,8 +109,8 @@ func TestUploadFilesConcurrently(t *testing.T) {
 		requests[i] = r
 	}
 
-	c := disk.New(cacheDir, 1000*1024, nil)
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, "")
+	c := newTestDiskCache(t, cacheDir, 1000*1024, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, "")
 	handler := http.HandlerFunc(h.CacheHandler)
 
 	var wg sync.WaitGroup
@@ -154,8 +165,8 @@ func TestUploadSameFileConcurrently(t *testing.T) {
 
 	data, hash := testutils.RandomDataAndHash(1024)
 
-	c := disk.New(cacheDir, 1024, nil)
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, "")
+	c := newTestDiskCache(t, cacheDir, 1024, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, "")
 	handler := http.HandlerFunc(h.CacheHandler)
 
 	var wg sync.WaitGroup
@@ -200,8 +211,8 @@ func TestUploadCorruptedFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c := disk.New(cacheDir, 2048, nil)
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, "")
+	c := newTestDiskCache(t, cacheDir, 2048, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, "")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.CacheHandler)
 	handler.ServeHTTP(rr, r)
@@ -240,9 +251,9 @@ func TestUploadEmptyActionResult(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c := disk.New(cacheDir, 2048, nil)
+	c := newTestDiskCache(t, cacheDir, 2048, nil)
 	validate := true
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), validate, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), validate, false, "")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.CacheHandler)
 	handler.ServeHTTP(rr, r)
@@ -281,6 +292,35 @@ func TestUploadEmptyActionResult(t *testing.T) {
 	}
 }
 
+func TestReadOnlyRejectsPut(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	c := newTestDiskCache(t, cacheDir, 2048, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, true, "")
+	handler := http.HandlerFunc(h.CacheHandler)
+
+	r, err := http.NewRequest("PUT", "/cas/"+hash, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Error("Handler returned wrong status code",
+			"expected", http.StatusForbidden,
+			"got", status)
+	}
+
+	found, _ := c.Contains(context.Background(), cache.CAS, hash)
+	if found {
+		t.Error("Expected the PUT to be rejected")
+	}
+}
+
 func TestStatusPage(t *testing.T) {
 	cacheDir := testutils.CreateTmpCacheDirs(t)
 	defer os.RemoveAll(cacheDir)
@@ -290,8 +330,8 @@ func TestStatusPage(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c := disk.New(cacheDir, 2048, nil)
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, "")
+	c := newTestDiskCache(t, cacheDir, 2048, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, "")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.StatusPageHandler)
 	handler.ServeHTTP(rr, r)
@@ -402,9 +442,9 @@ func TestRemoteReturnsNotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(cacheDir)
-	emptyCache := disk.New(cacheDir, 1024, nil)
+	emptyCache := newTestDiskCache(t, cacheDir, 1024, nil)
 
-	h := NewHTTPCache(emptyCache, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, "")
+	h := NewHTTPCache(emptyCache, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, "")
 	// create a fake http.Request
 	_, hash := testutils.RandomDataAndHash(1024)
 	url, _ := url.Parse(fmt.Sprintf("http://localhost:8080/ac/%s", hash))
@@ -427,3 +467,400 @@ func TestRemoteReturnsNotFound(t *testing.T) {
 		t.Errorf("Wrong status code, expected %d, got %d", http.StatusNotFound, statusCode)
 	}
 }
+
+func TestRangeRequests(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	data, hash := testutils.RandomDataAndHash(1000)
+
+	c := newTestDiskCache(t, cacheDir, 10000, nil)
+	err := c.Put(context.Background(), cache.CAS, hash, int64(len(data)),
+		bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Put(context.Background(), cache.RAW, hash, int64(len(data)),
+		bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(validateAC bool, path string, header map[string]string) *http.Response {
+		h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+			validateAC, false, "")
+		req, err := http.NewRequest("GET", path, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.CacheHandler).ServeHTTP(rr, req)
+		return rr.Result()
+	}
+
+	expectBody := func(rsp *http.Response, code int, expected []byte) {
+		t.Helper()
+		if rsp.StatusCode != code {
+			t.Fatalf("Expected status %d, got %d", code, rsp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, expected) {
+			t.Fatalf("Received the wrong content: %q", body)
+		}
+	}
+
+	rsp := get(true, "/cas/"+hash, nil)
+	expectBody(rsp, http.StatusOK, data)
+	if rsp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Expected 'Accept-Ranges: bytes', got %q", rsp.Header.Get("Accept-Ranges"))
+	}
+	etag := rsp.Header.Get("ETag")
+	if etag != `"`+hash+`"` {
+		t.Fatalf("Unexpected ETag: %q", etag)
+	}
+
+	rsp = get(true, "/cas/"+hash, map[string]string{"Range": "bytes=100-199"})
+	expectBody(rsp, http.StatusPartialContent, data[100:200])
+	if cr := rsp.Header.Get("Content-Range"); cr != "bytes 100-199/1000" {
+		t.Fatalf("Unexpected Content-Range: %q", cr)
+	}
+
+	rsp = get(true, "/cas/"+hash, map[string]string{"Range": "bytes=-10"})
+	expectBody(rsp, http.StatusPartialContent, data[990:])
+
+	// Resuming a download only succeeds if the blob is the same.
+	rsp = get(true, "/cas/"+hash, map[string]string{
+		"Range":    "bytes=500-",
+		"If-Range": etag,
+	})
+	expectBody(rsp, http.StatusPartialContent, data[500:])
+	rsp = get(true, "/cas/"+hash, map[string]string{
+		"Range":    "bytes=500-",
+		"If-Range": `"other"`,
+	})
+	expectBody(rsp, http.StatusOK, data)
+
+	rsp = get(true, "/cas/"+hash, map[string]string{"Range": "bytes=2000-"})
+	if rsp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Expected status %d, got %d",
+			http.StatusRequestedRangeNotSatisfiable, rsp.StatusCode)
+	}
+
+	// Several ranges are returned as a multipart response.
+	rsp = get(true, "/cas/"+hash, map[string]string{"Range": "bytes=0-9,20-29"})
+	if rsp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusPartialContent, rsp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Unexpected Content-Type: %q", rsp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(rsp.Body, params["boundary"])
+	for _, expected := range [][]byte{data[0:10], data[20:30]} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, expected) {
+			t.Fatalf("Received the wrong content: %q", body)
+		}
+	}
+
+	// Unvalidated AC entries support ranges too, but can be replaced.
+	rsp = get(false, "/ac/"+hash, map[string]string{"Range": "bytes=100-199"})
+	expectBody(rsp, http.StatusPartialContent, data[100:200])
+	if rsp.Header.Get("ETag") != "" {
+		t.Fatalf("Unexpected ETag for an AC entry: %q", rsp.Header.Get("ETag"))
+	}
+}
+
+func TestCompressedDownload(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	data, hash := testutils.RandomDataAndHash(4096)
+	smallData, smallHash := testutils.RandomDataAndHash(100)
+
+	c := newTestDiskCache(t, cacheDir, 10000, nil)
+	err := c.Put(context.Background(), cache.CAS, hash, int64(len(data)),
+		bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Put(context.Background(), cache.CAS, smallHash, int64(len(smallData)),
+		bytes.NewReader(smallData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(compression bool, hash string, header map[string]string) *http.Response {
+		h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+			true, false, "", WithCompression(compression))
+		req, err := http.NewRequest("GET", "/cas/"+hash, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.CacheHandler).ServeHTTP(rr, req)
+		rsp := rr.Result()
+		if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("Unexpected status %d", rsp.StatusCode)
+		}
+		return rsp
+	}
+
+	readAll := func(r io.Reader) []byte {
+		t.Helper()
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		rsp := get(true, hash, map[string]string{"Accept-Encoding": encoding})
+		if ce := rsp.Header.Get("Content-Encoding"); ce != encoding {
+			t.Fatalf("Expected 'Content-Encoding: %s', got %q", encoding, ce)
+		}
+		if rsp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("Expected 'Vary: Accept-Encoding', got %q", rsp.Header.Get("Vary"))
+		}
+		dec, err := newDecoder(rsp.Body, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readAll(dec)
+		dec.Close()
+		if !bytes.Equal(body, data) {
+			t.Fatalf("%s: received the wrong content", encoding)
+		}
+	}
+
+	// Responses are not compressed if the option is disabled, for
+	// small items, for Range requests and for clients which don't
+	// accept a supported encoding.
+	testCases := []struct {
+		compression bool
+		hash        string
+		header      map[string]string
+		expected    []byte
+	}{
+		{false, hash, map[string]string{"Accept-Encoding": "gzip"}, data},
+		{true, smallHash, map[string]string{"Accept-Encoding": "gzip"}, smallData},
+		{true, hash, map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-99"}, data[:100]},
+		{true, hash, map[string]string{"Accept-Encoding": "br"}, data},
+		{true, hash, nil, data},
+	}
+	for _, tc := range testCases {
+		rsp := get(tc.compression, tc.hash, tc.header)
+		if ce := rsp.Header.Get("Content-Encoding"); ce != "" {
+			t.Fatalf("Unexpected Content-Encoding %q for %v", ce, tc.header)
+		}
+		if !bytes.Equal(readAll(rsp.Body), tc.expected) {
+			t.Fatalf("Received the wrong content for %v", tc.header)
+		}
+	}
+}
+
+func TestCompressedUpload(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	spoolDir := filepath.Join(cacheDir, "spool")
+	err := os.Mkdir(spoolDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestDiskCache(t, cacheDir, 10000, nil)
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		true, false, "", WithSpoolDir(spoolDir))
+	handler := http.HandlerFunc(h.CacheHandler)
+
+	put := func(hash string, encoding string, body []byte) int {
+		req, err := http.NewRequest("PUT", "/cas/"+hash, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	compress := func(encoding string, data []byte) []byte {
+		var buf bytes.Buffer
+		enc, err := newEncoder(&buf, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc.Write(data)
+		enc.Close()
+		return buf.Bytes()
+	}
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		data, hash := testutils.RandomDataAndHash(2000)
+
+		code := put(hash, encoding, compress(encoding, data))
+		if code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", encoding, http.StatusOK, code)
+		}
+		rdr, size, err := c.Get(context.Background(), cache.CAS, hash)
+		if err != nil || rdr == nil {
+			t.Fatalf("%s: expected the item to be stored: %v", encoding, err)
+		}
+		stored, err := ioutil.ReadAll(rdr)
+		rdr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(data)) || !bytes.Equal(stored, data) {
+			t.Fatalf("%s: the decompressed item was not stored", encoding)
+		}
+
+		// The hash is checked against the decompressed data, with
+		// the same result as for uncompressed uploads.
+		_, otherHash := testutils.RandomDataAndHash(2000)
+		code = put(otherHash, encoding, compress(encoding, data))
+		if code != http.StatusInternalServerError {
+			t.Fatalf("%s: expected status %d for a hash mismatch, got %d",
+				encoding, http.StatusInternalServerError, code)
+		}
+		found, _ := c.Contains(context.Background(), cache.CAS, otherHash)
+		if found {
+			t.Fatalf("%s: an item with the wrong hash was stored", encoding)
+		}
+
+		// Invalid compressed data.
+		code = put(hash, encoding, []byte("not compressed"))
+		if code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d for invalid data, got %d",
+				encoding, http.StatusBadRequest, code)
+		}
+
+		// Items which are too large once decompressed.
+		large, largeHash := testutils.RandomDataAndHash(20000)
+		code = put(largeHash, encoding, compress(encoding, large))
+		if code != http.StatusInsufficientStorage {
+			t.Fatalf("%s: expected status %d for a large item, got %d",
+				encoding, http.StatusInsufficientStorage, code)
+		}
+	}
+
+	// The temporary files are removed.
+	files, err := ioutil.ReadDir(spoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected an empty spool directory, found %d files", len(files))
+	}
+
+	data, hash := testutils.RandomDataAndHash(100)
+	code := put(hash, "br", data)
+	if code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected status %d for an unsupported encoding, got %d",
+			http.StatusUnsupportedMediaType, code)
+	}
+	code = put(hash, "identity", data)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status %d for an identity encoded item, got %d",
+			http.StatusOK, code)
+	}
+
+	// The upload size limit applies to the decompressed size.
+	h = NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		true, false, "", WithMaxChunkedUploadSize(1000))
+	handler = http.HandlerFunc(h.CacheHandler)
+	data, hash = testutils.RandomDataAndHash(1001)
+	code = put(hash, "gzip", compress("gzip", data))
+	if code != http.StatusInsufficientStorage {
+		t.Fatalf("Expected status %d for an item over the limit, got %d",
+			http.StatusInsufficientStorage, code)
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	cacheDir := testutils.CreateTmpCacheDirs(t)
+	defer os.RemoveAll(cacheDir)
+
+	c := newTestDiskCache(t, cacheDir, 10000, nil)
+
+	put := func(h HTTPCache, hash string, body []byte) int {
+		req, err := http.NewRequest("PUT", "/cas/"+hash, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.CacheHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		true, false, "", WithMaxChunkedUploadSize(1000))
+
+	data, hash := testutils.RandomDataAndHash(1000)
+	code := put(h, hash, data)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	found, size := c.Contains(context.Background(), cache.CAS, hash)
+	if !found || size != int64(len(data)) {
+		t.Fatalf("Expected the item to be stored with size %d, got %v %d",
+			len(data), found, size)
+	}
+
+	// Same hash verification as uploads with a Content-Length header.
+	_, otherHash := testutils.RandomDataAndHash(1000)
+	code = put(h, otherHash, data)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("Expected status %d for a hash mismatch, got %d",
+			http.StatusInternalServerError, code)
+	}
+	found, _ = c.Contains(context.Background(), cache.CAS, otherHash)
+	if found {
+		t.Fatal("An item with the wrong hash was stored")
+	}
+
+	large, largeHash := testutils.RandomDataAndHash(1001)
+	code = put(h, largeHash, large)
+	if code != http.StatusInsufficientStorage {
+		t.Fatalf("Expected status %d for an item over the limit, got %d",
+			http.StatusInsufficientStorage, code)
+	}
+
+	// The default limit is larger than the cache, so the cache size
+	// applies.
+	h = NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(),
+		true, false, "", WithMaxChunkedUploadSize(0))
+	if h.(*httpCache).maxChunkedUploadSize != defaultMaxChunkedUploadSize {
+		t.Fatalf("Expected the default limit of %d bytes, got %d",
+			defaultMaxChunkedUploadSize, h.(*httpCache).maxChunkedUploadSize)
+	}
+	code = put(h, largeHash, large)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	tooLarge, tooLargeHash := testutils.RandomDataAndHash(10001)
+	code = put(h, tooLargeHash, tooLarge)
+	if code != http.StatusInsufficientStorage {
+		t.Fatalf("Expected status %d for an item larger than the cache, got %d",
+			http.StatusInsufficientStorage, code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/buchgr/bazel-remote/cache"
+	"github.com/buchgr/bazel-remote/cache/filesystem"
+	"github.com/buchgr/bazel-remote/cache/migrate"
+	"github.com/buchgr/bazel-remote/config"
+	"github.com/urfave/cli/v2"
+)
+
+func syncCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "sync",
+		Usage: "Copy the items of one cache backend which are missing from another",
+		Description: "The source and destination backends are read from a YAML file, " +
+			"with the same keys as the proxy backends, eg:\n\n" +
+			"   source:\n" +
+			"     gcs_proxy:\n" +
+			"       bucket: old-cache\n" +
+			"       use_default_credentials: true\n" +
+			"   destination:\n" +
+			"     dir: /opt/cache-dir",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "config_file",
+				Usage:    "Path to a YAML file describing the source and destination backends.",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "kinds",
+				Value: "ac,cas,raw",
+				Usage: "A comma-separated list of the kinds of items to copy.",
+			},
+			&cli.IntFlag{
+				Name:  "concurrency",
+				Value: 16,
+				Usage: "The maximum number of items to copy at the same time.",
+			},
+			&cli.BoolFlag{
+				Name:  "dry_run",
+				Usage: "Only log the items which would be copied.",
+			},
+			&cli.StringFlag{
+				Name: "state_file",
+				Usage: "If set, the progress is recorded in this file, and a later run " +
+					"with the same file resumes an interrupted sync.",
+			},
+		},
+		Action: runSync,
+	}
+}
+
+func runSync(ctx *cli.Context) error {
+	c, err := config.NewSyncFromYamlFile(ctx.String("config_file"))
+	if err != nil {
+		return err
+	}
+
+	var kinds []cache.EntryKind
+	for _, k := range strings.Split(ctx.String("kinds"), ",") {
+		switch strings.TrimSpace(k) {
+		case "ac":
+			kinds = append(kinds, cache.AC)
+		case "cas":
+			kinds = append(kinds, cache.CAS)
+		case "raw":
+			kinds = append(kinds, cache.RAW)
+		default:
+			return fmt.Errorf("Invalid kind %q in the 'kinds' flag, expected 'ac', 'cas' or 'raw'", k)
+		}
+	}
+
+	// Every request would be logged, only log errors and progress.
+	accessLogger := log.New(ioutil.Discard, "", logFlags)
+	errorLogger := log.New(os.Stderr, "", logFlags)
+
+	src, err := newSyncBackend(c.Source, accessLogger, errorLogger)
+	if err != nil {
+		return err
+	}
+	dst, err := newSyncBackend(c.Destination, accessLogger, errorLogger)
+	if err != nil {
+		return err
+	}
+
+	stats, err := migrate.Run(context.Background(), src, dst, migrate.Options{
+		Kinds:       kinds,
+		Concurrency: ctx.Int("concurrency"),
+		DryRun:      ctx.Bool("dry_run"),
+		StateFile:   ctx.String("state_file"),
+	}, errorLogger)
+
+	verb := "Copied"
+	if ctx.Bool("dry_run") {
+		verb = "Would copy"
+	}
+	errorLogger.Printf("Listed %d items, %d already present. %s %d items (%d bytes), %d failed.",
+		stats.Listed, stats.Present, verb, stats.Copied, stats.CopiedBytes, stats.Failed)
+
+	if err != nil {
+		return err
+	}
+	if stats.Failed > 0 {
+		return cli.Exit(fmt.Sprintf("Failed to copy %d items", stats.Failed), 1)
+	}
+	return nil
+}
+
+func newSyncBackend(b config.SyncBackendConfig, accessLogger cache.Logger,
+	errorLogger cache.Logger) (cache.CacheProxy, error) {
+
+	if b.Dir != "" {
+		// The local cache uses the same layout as the filesystem backend.
+		return filesystem.New(b.Dir, accessLogger, errorLogger)
+	}
+
+	return newProxy(b.GoogleCloudStorage, b.HTTPBackend, b.S3CloudStorage,
+		b.GRPCBackend, b.FilesystemProxy, b.RedisProxy, b.AzBlobStorage,
+		b.PluginProxy, accessLogger, errorLogger)
+}